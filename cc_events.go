@@ -120,6 +120,9 @@ type CCEventTry struct {
     cli, cld, caller_name string
     auth        *sippy_header.SipAuthorizationBody
     body        sippy_types.MsgBody
+    pai         []*sippy_header.SipPAssertedIdentity
+    privacy     *sippy_header.SipPrivacy
+    diversion   []*DiversionInfo
 }
 
 func NewCCEventTry(call_id *sippy_header.SipCallId, cisco_guid *sippy_header.SipCiscoGUID, cli string, cld string, body sippy_types.MsgBody, auth *sippy_header.SipAuthorizationBody, caller_name string, rtime *sippy_time.MonoTime, origin string, extra_headers ...sippy_header.SipHeader) *CCEventTry {
@@ -162,6 +165,34 @@ func (self *CCEventTry) GetCLI() string {
     return self.cli
 }
 
+// GetPAI returns the asserted identities of the caller. The UA only sets
+// them when the request came from its trust domain.
+func (self *CCEventTry) GetPAI() []*sippy_header.SipPAssertedIdentity {
+    return self.pai
+}
+
+func (self *CCEventTry) SetPAI(pai []*sippy_header.SipPAssertedIdentity) {
+    self.pai = pai
+}
+
+func (self *CCEventTry) GetPrivacy() *sippy_header.SipPrivacy {
+    return self.privacy
+}
+
+func (self *CCEventTry) SetPrivacy(privacy *sippy_header.SipPrivacy) {
+    self.privacy = privacy
+}
+
+// GetDiversion returns the redirection history of the call, the most
+// recent redirection first.
+func (self *CCEventTry) GetDiversion() []*DiversionInfo {
+    return self.diversion
+}
+
+func (self *CCEventTry) SetDiversion(diversion []*DiversionInfo) {
+    self.diversion = diversion
+}
+
 func (self *CCEventTry) String() string { return "CCEventTry" }
 
 type CCEventRing struct {
@@ -321,3 +352,57 @@ func NewCCEventPreConnect(scode int, scode_reason string, body sippy_types.MsgBo
 func (self *CCEventPreConnect) String() string { return "CCEventPreConnect" }
 func (self *CCEventPreConnect) GetScode() int { return self.scode }
 func (self *CCEventPreConnect) GetScodeReason() string { return self.scode_reason }
+
+// CCEventMessage carries a MESSAGE request (RFC 3428) between the call
+// legs. The leg that delivers the message reports the final response of
+// the far end through Respond() so that the delivery status reaches the
+// originator.
+type CCEventMessage struct {
+    CCEventGeneric
+    body            sippy_types.MsgBody
+    lock            sync.Mutex
+    response_cb     func(int, string)
+    forwarded       bool
+}
+
+func NewCCEventMessage(rtime *sippy_time.MonoTime, origin string, msg_body sippy_types.MsgBody, extra_headers ...sippy_header.SipHeader) *CCEventMessage {
+    return &CCEventMessage{
+        CCEventGeneric : newCCEventGeneric(rtime, origin, extra_headers...),
+        body           : msg_body,
+    }
+}
+
+func (self *CCEventMessage) String() string { return "CCEventMessage" }
+
+func (self *CCEventMessage) GetBody() sippy_types.MsgBody {
+    return self.body
+}
+
+func (self *CCEventMessage) SetResponseCb(response_cb func(int, string)) {
+    self.lock.Lock()
+    self.response_cb = response_cb
+    self.lock.Unlock()
+}
+
+func (self *CCEventMessage) markForwarded() {
+    self.lock.Lock()
+    self.forwarded = true
+    self.lock.Unlock()
+}
+
+func (self *CCEventMessage) isForwarded() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.forwarded
+}
+
+// Respond reports the delivery status. Only the first call has effect.
+func (self *CCEventMessage) Respond(scode int, scode_reason string) {
+    self.lock.Lock()
+    response_cb := self.response_cb
+    self.response_cb = nil
+    self.lock.Unlock()
+    if response_cb != nil {
+        response_cb(scode, scode_reason)
+    }
+}
@@ -368,9 +368,25 @@ func (self *clientTransaction) SetUAck(uack bool) {
 }
 
 func (self *clientTransaction) BeforeRequestSent(req sippy_types.SipRequest) {
+    if self.sip_tm == nil {
+        return
+    }
+    self.sip_tm.beforeRequestSent(req)
     if self.before_request_sent != nil {
         self.before_request_sent(req)
     }
+    // The callbacks could have changed the request
+    self.address = req.GetTarget()
+    if self.needack {
+        var err error
+        if self.ack, err = req.GenACK(nil); err != nil {
+            self.sip_tm.config.ErrorLogger().Error("clientTransaction::BeforeRequestSent: #1: " + err.Error())
+        }
+        if self.cancel, err = req.GenCANCEL(); err != nil {
+            self.sip_tm.config.ErrorLogger().Error("clientTransaction::BeforeRequestSent: #2: " + err.Error())
+        }
+    }
+    self.data = []byte(req.LocalStr(self.userv.GetLAddress(), false /* compact */))
 }
 
 func (self *clientTransaction) TransmitData() {
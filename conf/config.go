@@ -56,6 +56,8 @@ type Config interface {
 
     AutoConvertTelUrl() bool
     SetAutoConvertTelUrl(bool)
+    StrictParser() bool
+    SetStrictParser(bool)
     GetSipTransportFactory() sippy_net.SipTransportFactory
     SetSipTransportFactory(sippy_net.SipTransportFactory)
 }
@@ -72,6 +74,7 @@ type config struct {
     my_uaname       string
     allow_formats   []int
     autoconvert_tel_url bool
+    strict_parser   bool
     tfactory        sippy_net.SipTransportFactory
 }
 
@@ -168,6 +171,16 @@ func (self *config) SetAutoConvertTelUrl(v bool) {
     self.autoconvert_tel_url = v
 }
 
+// StrictParser tells whether the incoming requests violating the RFC 3261
+// grammar are to be rejected rather than handled on the best effort basis.
+func (self *config) StrictParser() bool {
+    return self.strict_parser
+}
+
+func (self *config) SetStrictParser(v bool) {
+    self.strict_parser = v
+}
+
 func (self *config) GetSipTransportFactory() sippy_net.SipTransportFactory {
     return self.tfactory
 }
@@ -0,0 +1,399 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "encoding/json"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+)
+
+type replicationMsg struct {
+    Op      string
+    State   *DialogState    `json:",omitempty"`
+    Key     string          `json:",omitempty"`
+}
+
+const (
+    replOpSave      = "save"
+    replOpDelete    = "delete"
+    replOpReset     = "reset"
+    replOpPing      = "ping"
+)
+
+// DialogReplicator is the DialogStore of the active instance. Every
+// change is written to the optional local store and mirrored to the
+// standby instance listening at the given "tcp" or "unix" address. The
+// full set of dialogs is resent each time the link is (re)established.
+type DialogReplicator struct {
+    config          sippy_conf.Config
+    network         string
+    address         string
+    store           DialogStore
+    states          map[string]*DialogState
+    lock            sync.Mutex
+    queue           chan *replicationMsg
+    overflow        bool
+    shutdown_chan   chan struct{}
+    ping_ival       time.Duration
+    retry_ival      time.Duration
+}
+
+func NewDialogReplicator(config sippy_conf.Config, network, address string, store DialogStore) *DialogReplicator {
+    return &DialogReplicator{
+        config          : config,
+        network         : network,
+        address         : address,
+        store           : store,
+        states          : make(map[string]*DialogState),
+        queue           : make(chan *replicationMsg, 1024),
+        shutdown_chan   : make(chan struct{}),
+        ping_ival       : time.Second,
+        retry_ival      : time.Second,
+    }
+}
+
+// SetPingInterval sets how often the heartbeat is sent on the idle link.
+// It must be well below the dead interval of the standby.
+func (self *DialogReplicator) SetPingInterval(ival time.Duration) {
+    self.ping_ival = ival
+}
+
+func (self *DialogReplicator) Start() {
+    go self.run()
+}
+
+func (self *DialogReplicator) Shutdown() {
+    close(self.shutdown_chan)
+}
+
+func (self *DialogReplicator) Save(state *DialogState) error {
+    self.lock.Lock()
+    self.states[state.Key()] = state
+    self.enqueue(&replicationMsg{ Op : replOpSave, State : state })
+    self.lock.Unlock()
+    if self.store != nil {
+        return self.store.Save(state)
+    }
+    return nil
+}
+
+func (self *DialogReplicator) Delete(key string) error {
+    self.lock.Lock()
+    delete(self.states, key)
+    self.enqueue(&replicationMsg{ Op : replOpDelete, Key : key })
+    self.lock.Unlock()
+    if self.store != nil {
+        return self.store.Delete(key)
+    }
+    return nil
+}
+
+func (self *DialogReplicator) Load() ([]*DialogState, error) {
+    if self.store != nil {
+        return self.store.Load()
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    rval := make([]*DialogState, 0, len(self.states))
+    for _, state := range self.states {
+        rval = append(rval, state)
+    }
+    return rval, nil
+}
+
+// must be called with the lock held
+func (self *DialogReplicator) enqueue(msg *replicationMsg) {
+    select {
+    case self.queue <- msg:
+    default:
+        // the standby will get the full state on the next connect
+        self.overflow = true
+    }
+}
+
+// connect establishes the link and sends the full set of dialogs. The
+// queued updates are already covered by the snapshot so they are dropped.
+func (self *DialogReplicator) connect() (net.Conn, *json.Encoder) {
+    conn, err := net.DialTimeout(self.network, self.address, self.retry_ival)
+    if err != nil {
+        self.config.ErrorLogger().Debug("DialogReplicator::connect: #1: " + err.Error())
+        return nil, nil
+    }
+    enc := json.NewEncoder(conn)
+    msgs := []*replicationMsg{ &replicationMsg{ Op : replOpReset } }
+    self.lock.Lock()
+    for len(self.queue) > 0 {
+        <-self.queue
+    }
+    self.overflow = false
+    for _, state := range self.states {
+        msgs = append(msgs, &replicationMsg{ Op : replOpSave, State : state })
+    }
+    self.lock.Unlock()
+    for _, msg := range msgs {
+        if err = self.write(conn, enc, msg); err != nil {
+            self.config.ErrorLogger().Error("DialogReplicator::connect: #2: " + err.Error())
+            conn.Close()
+            return nil, nil
+        }
+    }
+    return conn, enc
+}
+
+func (self *DialogReplicator) write(conn net.Conn, enc *json.Encoder, msg *replicationMsg) error {
+    conn.SetWriteDeadline(time.Now().Add(self.retry_ival))
+    return enc.Encode(msg)
+}
+
+func (self *DialogReplicator) run() {
+    var conn net.Conn
+    var enc *json.Encoder
+
+    for {
+        if conn == nil {
+            if conn, enc = self.connect(); conn == nil {
+                select {
+                case <-self.shutdown_chan:
+                    return
+                case <-time.After(self.retry_ival):
+                }
+                continue
+            }
+        }
+        var msg *replicationMsg
+        select {
+        case <-self.shutdown_chan:
+            conn.Close()
+            return
+        case msg = <-self.queue:
+        case <-time.After(self.ping_ival):
+            msg = &replicationMsg{ Op : replOpPing }
+        }
+        self.lock.Lock()
+        overflow := self.overflow
+        self.lock.Unlock()
+        if overflow {
+            conn.Close()
+            conn = nil
+            continue
+        }
+        if err := self.write(conn, enc, msg); err != nil {
+            self.config.ErrorLogger().Error("DialogReplicator::run: #1: " + err.Error())
+            conn.Close()
+            conn = nil
+        }
+    }
+}
+
+// DialogStandby mirrors the dialogs of the active instance. The link may
+// drop and be re-established by the active instance at any time, only when
+// nothing is heard from the active instance for the whole dead interval
+// the standby acquires the shared address and the takeover callback
+// receives the mirrored dialogs to rebuild the Ua objects with RestoreUA.
+type DialogStandby struct {
+    config          sippy_conf.Config
+    network         string
+    address         string
+    listener        net.Listener
+    states          map[string]*DialogState
+    lock            sync.Mutex
+    dead_ival       time.Duration
+    takeover_cb     func([]*DialogState)
+    acquire_cb      func() error
+    taken_over      bool
+    last_seen       time.Time
+    shutdown_chan   chan struct{}
+}
+
+func NewDialogStandby(config sippy_conf.Config, network, address string) *DialogStandby {
+    return &DialogStandby{
+        config          : config,
+        network         : network,
+        address         : address,
+        states          : make(map[string]*DialogState),
+        dead_ival       : 3 * time.Second,
+        shutdown_chan   : make(chan struct{}),
+    }
+}
+
+// SetDeadInterval sets how long the active instance may stay silent before
+// it is considered dead. It must be well above the ping and the reconnect
+// intervals of the replicator.
+func (self *DialogStandby) SetDeadInterval(ival time.Duration) {
+    self.dead_ival = ival
+}
+
+func (self *DialogStandby) SetTakeoverCb(takeover_cb func([]*DialogState)) {
+    self.takeover_cb = takeover_cb
+}
+
+// SetAcquireAddressCb sets the function that claims the shared address,
+// i.e. brings up the virtual IP. It is called before the takeover and an
+// error cancels the takeover until the active instance stays silent for
+// another dead interval.
+func (self *DialogStandby) SetAcquireAddressCb(acquire_cb func() error) {
+    self.acquire_cb = acquire_cb
+}
+
+func (self *DialogStandby) Start() error {
+    var err error
+
+    if self.network == "unix" {
+        os.Remove(self.address)
+    }
+    self.listener, err = net.Listen(self.network, self.address)
+    if err != nil {
+        return err
+    }
+    go self.run()
+    go self.watch()
+    return nil
+}
+
+func (self *DialogStandby) Shutdown() {
+    close(self.shutdown_chan)
+    self.listener.Close()
+}
+
+// GetStates returns the mirrored dialogs.
+func (self *DialogStandby) GetStates() []*DialogState {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    rval := make([]*DialogState, 0, len(self.states))
+    for _, state := range self.states {
+        rval = append(rval, state)
+    }
+    return rval
+}
+
+// Takeover acquires the shared address, stops mirroring and passes the
+// dialogs to the takeover callback. It is also called automatically when
+// the active instance dies.
+func (self *DialogStandby) Takeover() {
+    self.lock.Lock()
+    if self.taken_over {
+        self.lock.Unlock()
+        return
+    }
+    self.taken_over = true
+    self.lock.Unlock()
+    if self.acquire_cb != nil {
+        if err := self.acquire_cb(); err != nil {
+            self.config.ErrorLogger().Error("DialogStandby::Takeover: #1: " + err.Error())
+            self.lock.Lock()
+            self.taken_over = false
+            self.last_seen = time.Now()
+            self.lock.Unlock()
+            return
+        }
+    }
+    self.listener.Close()
+    if self.takeover_cb != nil {
+        self.takeover_cb(self.GetStates())
+    }
+}
+
+func (self *DialogStandby) IsTakenOver() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.taken_over
+}
+
+func (self *DialogStandby) run() {
+    for {
+        conn, err := self.listener.Accept()
+        if err != nil {
+            if ! self.IsTakenOver() {
+                self.config.ErrorLogger().Error("DialogStandby::run: #1: " + err.Error())
+            }
+            return
+        }
+        // only one active instance at a time
+        self.handleConn(conn)
+        if self.IsTakenOver() {
+            return
+        }
+    }
+}
+
+// watch starts the takeover once the active instance has been silent for
+// the dead interval. Nothing is done until the active instance connects
+// for the first time.
+func (self *DialogStandby) watch() {
+    for {
+        select {
+        case <-self.shutdown_chan:
+            return
+        case <-time.After(self.dead_ival / 4):
+        }
+        self.lock.Lock()
+        dead := ! self.taken_over && ! self.last_seen.IsZero() && time.Since(self.last_seen) > self.dead_ival
+        self.lock.Unlock()
+        if dead {
+            self.Takeover()
+        }
+        if self.IsTakenOver() {
+            return
+        }
+    }
+}
+
+// handleConn mirrors the updates until the link fails. The active
+// instance reconnects and resends the full state, so the failure alone
+// does not mean the active instance is dead.
+func (self *DialogStandby) handleConn(conn net.Conn) {
+    defer conn.Close()
+    dec := json.NewDecoder(conn)
+    for {
+        msg := &replicationMsg{}
+        conn.SetReadDeadline(time.Now().Add(self.dead_ival))
+        if err := dec.Decode(msg); err != nil {
+            if ! self.IsTakenOver() {
+                self.config.ErrorLogger().Error("DialogStandby::handleConn: #1: " + err.Error())
+            }
+            return
+        }
+        self.lock.Lock()
+        self.last_seen = time.Now()
+        switch msg.Op {
+        case replOpReset:
+            self.states = make(map[string]*DialogState)
+        case replOpSave:
+            if msg.State != nil {
+                self.states[msg.State.Key()] = msg.State
+            }
+        case replOpDelete:
+            delete(self.states, msg.Key)
+        }
+        self.lock.Unlock()
+    }
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/log"
+)
+
+func Test_DialogReplication(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sippy_repl")
+    if err != nil {
+        t.Fatal(err.Error())
+    }
+    defer os.RemoveAll(dir)
+    sock := filepath.Join(dir, "repl.sock")
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+
+    standby := NewDialogStandby(config, "unix", sock)
+    standby.SetDeadInterval(500 * time.Millisecond)
+    takeover_ch := make(chan []*DialogState, 1)
+    standby.SetTakeoverCb(func(states []*DialogState) { takeover_ch <- states })
+    var acquired int32
+    standby.SetAcquireAddressCb(func() error {
+        if atomic.AddInt32(&acquired, 1) == 1 {
+            return errors.New("the address is busy")
+        }
+        return nil
+    })
+    if err = standby.Start(); err != nil {
+        t.Fatal("Cannot start standby: " + err.Error())
+    }
+
+    active := NewDialogReplicator(config, "unix", sock, nil)
+    active.SetPingInterval(100 * time.Millisecond)
+    // both legs of the call share the Call-ID
+    active.Save(&DialogState{ CallId : "call1", LTag : "a", RTag : "b" })
+    active.Start()
+    active.Save(&DialogState{ CallId : "call1", LTag : "c", RTag : "d" })
+    active.Delete(dialogKey("call1", "a", "b"))
+
+    deadline := time.Now().Add(2 * time.Second)
+    for len(standby.GetStates()) != 1 || standby.GetStates()[0].LTag != "c" {
+        if time.Now().After(deadline) {
+            t.Fatal("The standby has not caught up with the active instance")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    // the heartbeats must keep the standby passive
+    time.Sleep(time.Second)
+    if standby.IsTakenOver() {
+        t.Fatal("Premature takeover")
+    }
+    // the link is lost but the active instance comes back in time
+    active.Shutdown()
+    active = NewDialogReplicator(config, "unix", sock, nil)
+    active.SetPingInterval(100 * time.Millisecond)
+    active.Save(&DialogState{ CallId : "call1", LTag : "c", RTag : "d" })
+    active.Start()
+    time.Sleep(time.Second)
+    if standby.IsTakenOver() || atomic.LoadInt32(&acquired) != 0 {
+        t.Fatal("The takeover must wait for the dead interval")
+    }
+    active.Shutdown()
+    select {
+    case states := <-takeover_ch:
+        if len(states) != 1 || states[0].LTag != "c" {
+            t.Fatal("Wrong set of dialogs taken over")
+        }
+        if atomic.LoadInt32(&acquired) != 2 {
+            t.Fatal("The takeover must wait until the shared address is acquired")
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("The standby has not taken over")
+    }
+    standby.Shutdown()
+}
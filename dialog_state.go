@@ -0,0 +1,395 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "crypto/md5"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+    "github.com/braams/sippy/types"
+)
+
+// DialogState is the snapshot of an established dialog that is enough
+// to rebuild the Ua after a restart. Timestamps are wall-clock seconds
+// since the epoch, zero when not set.
+type DialogState struct {
+    CallId          string
+    LTag            string
+    RTag            string
+    LUri            string
+    RUri            string
+    LCSeq           int
+    RCSeq           int
+    LContact        string
+    RTarget         string
+    RAddrHost       string
+    RAddrPort       string
+    Routes          []string
+    LSDP            string
+    LSDPType        string
+    RSDP            string
+    RSDPType        string
+    Origin          string
+    SetupTs         float64
+    ConnectTs       float64
+    CreditExpires   float64
+    KaInterval      time.Duration
+}
+
+// Key identifies the dialog. Both legs of a B2BUA call may share the
+// Call-ID so the tags are part of the key.
+func (self *DialogState) Key() string {
+    return dialogKey(self.CallId, self.LTag, self.RTag)
+}
+
+func dialogKey(call_id, ltag, rtag string) string {
+    return call_id + " " + ltag + " " + rtag
+}
+
+// DialogStore persists the dialog snapshots. The Delete takes the key
+// returned by DialogState.Key().
+type DialogStore interface {
+    Save(*DialogState) error
+    Delete(key string) error
+    Load() ([]*DialogState, error)
+}
+
+type fileDialogStore struct {
+    dir         string
+    lock        sync.Mutex
+    io_lock     sync.Mutex
+    pending     map[string]*DialogState
+    writing     bool
+    last_err    error
+}
+
+// NewFileDialogStore keeps each dialog in a separate JSON file in dir.
+// The files are written in the background so that the signalling is not
+// held up by the disk. The failure of a background write is returned by
+// the next Save or Delete.
+func NewFileDialogStore(dir string) (DialogStore, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    return &fileDialogStore{
+        dir     : dir,
+        pending : make(map[string]*DialogState),
+    }, nil
+}
+
+func (self *fileDialogStore) fname(key string) string {
+    return filepath.Join(self.dir, fmt.Sprintf("%x.json", md5.Sum([]byte(key))))
+}
+
+func (self *fileDialogStore) Save(state *DialogState) error {
+    return self.schedule(state.Key(), state)
+}
+
+func (self *fileDialogStore) Delete(key string) error {
+    return self.schedule(key, nil)
+}
+
+// schedule queues the write of the state or the removal when the state
+// is nil. Only the latest state of the dialog is written.
+func (self *fileDialogStore) schedule(key string, state *DialogState) error {
+    self.lock.Lock()
+    self.pending[key] = state
+    err := self.last_err
+    self.last_err = nil
+    start := ! self.writing
+    self.writing = true
+    self.lock.Unlock()
+    if start {
+        go self.writer()
+    }
+    return err
+}
+
+func (self *fileDialogStore) writer() {
+    for self.flush() {
+    }
+}
+
+// flush writes out the pending changes and reports whether there were any.
+func (self *fileDialogStore) flush() bool {
+    self.io_lock.Lock()
+    defer self.io_lock.Unlock()
+    self.lock.Lock()
+    batch := self.pending
+    if len(batch) == 0 {
+        self.writing = false
+        self.lock.Unlock()
+        return false
+    }
+    self.pending = make(map[string]*DialogState)
+    self.lock.Unlock()
+    for key, state := range batch {
+        var err error
+        if state == nil {
+            err = self.remove(key)
+        } else {
+            err = self.write(state)
+        }
+        if err != nil {
+            self.lock.Lock()
+            self.last_err = err
+            self.lock.Unlock()
+        }
+    }
+    return true
+}
+
+// must be called with the io_lock held
+func (self *fileDialogStore) write(state *DialogState) error {
+    data, err := json.Marshal(state)
+    if err != nil {
+        return err
+    }
+    fname := self.fname(state.Key())
+    if err = ioutil.WriteFile(fname + ".tmp", data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(fname + ".tmp", fname)
+}
+
+// must be called with the io_lock held
+func (self *fileDialogStore) remove(key string) error {
+    err := os.Remove(self.fname(key))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    return err
+}
+
+func (self *fileDialogStore) Load() ([]*DialogState, error) {
+    // make the pending changes visible first
+    self.lock.Lock()
+    pending := len(self.pending) > 0
+    self.lock.Unlock()
+    if pending {
+        self.flush()
+    }
+    self.io_lock.Lock()
+    defer self.io_lock.Unlock()
+    files, err := ioutil.ReadDir(self.dir)
+    if err != nil {
+        return nil, err
+    }
+    rval := make([]*DialogState, 0, len(files))
+    for _, file := range files {
+        if ! strings.HasSuffix(file.Name(), ".json") {
+            continue
+        }
+        data, err := ioutil.ReadFile(filepath.Join(self.dir, file.Name()))
+        if err != nil {
+            return nil, err
+        }
+        state := &DialogState{}
+        if err = json.Unmarshal(data, state); err != nil {
+            return nil, err
+        }
+        rval = append(rval, state)
+    }
+    return rval, nil
+}
+
+func monoTimeToFloat(t *sippy_time.MonoTime) float64 {
+    if t == nil {
+        return 0
+    }
+    return sippy_time.TimeToFloat(t.Realt())
+}
+
+func floatToMonoTime(t float64) (*sippy_time.MonoTime, error) {
+    if t == 0 {
+        return nil, nil
+    }
+    return sippy_time.NewMonoTime1(sippy_time.FloatToTime(t))
+}
+
+// GetDialogState takes a snapshot of the dialog.
+func (self *Ua) GetDialogState() *DialogState {
+    state := &DialogState{
+        CallId          : self.cId.CallId,
+        LTag            : self.ltag,
+        RTag            : self.getRTag(),
+        LUri            : self.lUri.StringBody(),
+        RUri            : self.rUri.StringBody(),
+        LCSeq           : self.lCSeq,
+        RCSeq           : self.rCSeq,
+        RTarget         : self.rTarget.String(),
+        Routes          : make([]string, len(self.routes)),
+        Origin          : self.origin,
+        SetupTs         : monoTimeToFloat(self.setup_ts),
+        ConnectTs       : monoTimeToFloat(self.connect_ts),
+        KaInterval      : self.kaInterval,
+    }
+    if self.lContact != nil {
+        state.LContact = self.lContact.StringBody()
+    }
+    if self.rAddr != nil {
+        state.RAddrHost, state.RAddrPort = self.rAddr.Host.String(), self.rAddr.Port.String()
+    }
+    for i, route := range self.routes {
+        state.Routes[i] = route.StringBody()
+    }
+    if self.lSDP != nil {
+        state.LSDP, state.LSDPType = self.lSDP.String(), self.lSDP.GetMtype()
+    }
+    if self.rSDP != nil {
+        state.RSDP, state.RSDPType = self.rSDP.String(), self.rSDP.GetMtype()
+    }
+    for _, t := range self.credit_times {
+        if state.CreditExpires == 0 || monoTimeToFloat(t) < state.CreditExpires {
+            state.CreditExpires = monoTimeToFloat(t)
+        }
+    }
+    return state
+}
+
+func (self *Ua) getRTag() string {
+    if self.rUri == nil {
+        return ""
+    }
+    rUri, err := self.rUri.GetBody()
+    if err != nil {
+        return ""
+    }
+    return rUri.GetTag()
+}
+
+// RestoreUA rebuilds a Ua in the Connected state from the snapshot and
+// registers it with the transaction manager. The local CSeq is advanced
+// to stay ahead of the requests sent after the snapshot was taken.
+func RestoreUA(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, state *DialogState, call_controller sippy_types.CallController, session_lock sync.Locker) (*Ua, error) {
+    var err error
+
+    self := NewUA(sip_tm, config, nil, call_controller, session_lock, nil)
+    self.cId = sippy_header.NewSipCallIdFromString(state.CallId)
+    self.lUri = sippy_header.CreateSipFrom(state.LUri)[0].(*sippy_header.SipFrom)
+    self.rUri = sippy_header.CreateSipTo(state.RUri)[0].(*sippy_header.SipTo)
+    lUri, err := self.lUri.GetBody()
+    if err != nil {
+        return nil, err
+    }
+    self.ltag = lUri.GetTag()
+    if self.rTarget, err = sippy_header.ParseSipURL(state.RTarget, false, config); err != nil {
+        return nil, err
+    }
+    if state.LContact != "" {
+        contacts := sippy_header.CreateSipContact(state.LContact)
+        if len(contacts) != 1 {
+            return nil, errors.New("RestoreUA: malformed Contact")
+        }
+        self.lContact = contacts[0].(*sippy_header.SipContact)
+    }
+    for _, route := range state.Routes {
+        for _, hf := range sippy_header.CreateSipRoute(route) {
+            self.routes = append(self.routes, hf.(*sippy_header.SipRoute))
+        }
+    }
+    if state.RAddrHost != "" {
+        self.rAddr = sippy_net.NewHostPort(state.RAddrHost, state.RAddrPort)
+    } else if len(self.routes) > 0 {
+        r0, err := self.routes[0].GetBody()
+        if err != nil {
+            return nil, err
+        }
+        self.rAddr = r0.GetUrl().GetAddr(config)
+    } else {
+        self.rAddr = self.rTarget.GetAddr(config)
+    }
+    self.rAddr0 = self.rAddr
+    self.lCSeq = state.LCSeq + 100
+    self.rCSeq = state.RCSeq
+    if state.LSDP != "" {
+        self.lSDP = NewMsgBody(state.LSDP, state.LSDPType)
+    }
+    if state.RSDP != "" {
+        self.rSDP = NewMsgBody(state.RSDP, state.RSDPType)
+    }
+    self.origin = state.Origin
+    if self.setup_ts, err = floatToMonoTime(state.SetupTs); err != nil {
+        return nil, err
+    }
+    if self.connect_ts, err = floatToMonoTime(state.ConnectTs); err != nil {
+        return nil, err
+    }
+    self.kaInterval = state.KaInterval
+    self.ChangeState(NewUaStateConnected(self, nil, "", config))
+    if state.CreditExpires != 0 {
+        credit_expires, err := floatToMonoTime(state.CreditExpires)
+        if err != nil {
+            return nil, err
+        }
+        self.credit_times[0] = credit_expires
+        now, _ := sippy_time.NewMonoTime()
+        self.StartCreditTimer(now)
+    }
+    sip_tm.RegConsumer(self, state.CallId)
+    return self, nil
+}
+
+// saveDialogState refreshes the stored snapshot of the established
+// dialog, so that the CSeq numbers, the target and the SDP stay current.
+// Nothing is saved when the dialog has not changed since the last time.
+func (self *Ua) saveDialogState() {
+    if self.dialog_store == nil || ! self.isConnected() {
+        return
+    }
+    state := self.GetDialogState()
+    if reflect.DeepEqual(state, self.dialog_saved) {
+        return
+    }
+    if err := self.dialog_store.Save(state); err != nil {
+        self.logError("UA::saveDialogState: #1: " + err.Error())
+        return
+    }
+    self.dialog_saved = state
+}
+
+// SetDialogStore enables saving the dialog state each time the Ua enters
+// the Connected state or the dialog is updated and removing it when the
+// Ua dies. The state of an already established dialog is saved at once.
+func (self *Ua) SetDialogStore(store DialogStore) {
+    self.dialog_store = store
+    self.dialog_saved = nil
+    self.saveDialogState()
+}
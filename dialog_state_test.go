@@ -0,0 +1,163 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/time"
+)
+
+type counting_dialog_store struct {
+    DialogStore
+    saves   int
+}
+
+func (self *counting_dialog_store) Save(state *DialogState) error {
+    self.saves++
+    return self.DialogStore.Save(state)
+}
+
+func Test_DialogRestore(t *testing.T) {
+    var err error
+
+    dir, err := ioutil.TempDir("", "sippy_dialogs")
+    if err != nil {
+        t.Fatal(err.Error())
+    }
+    defer os.RemoveAll(dir)
+    store, err := NewFileDialogStore(dir)
+    if err != nil {
+        t.Fatal("Cannot create dialog store: " + err.Error())
+    }
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    tfactory.feed([]string{
+        "INVITE sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKrestore1",
+        "Max-Forwards: 70",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>",
+        "Contact: <sip:100@1.1.1.1:5060>",
+        "Record-Route: <sip:2.2.2.2;lr>",
+        "Call-ID: restore-test@1.1.1.1",
+        "CSeq: 10 INVITE",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+    tfactory.get() // 100 Trying
+    cmap.lock.Lock()
+    counting := &counting_dialog_store{ DialogStore : store }
+    cmap.ua.(*Ua).SetDialogStore(counting)
+    cmap.answer()
+    cmap.lock.Unlock()
+    rtime, _ := sippy_time.NewMonoTime()
+    ok200, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse 200 OK: " + err.Error())
+    }
+    to, _ := ok200.GetTo().GetBody()
+    // the in-dialog requests must refresh the saved state
+    tfactory.feed([]string{
+        "OPTIONS sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKrestore2",
+        "Max-Forwards: 70",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>;tag=" + to.GetTag(),
+        "Call-ID: restore-test@1.1.1.1",
+        "CSeq: 11 OPTIONS",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+    tfactory.get() // 200 OK
+    // the unchanged dialog is not written again
+    cmap.lock.Lock()
+    cmap.ua.(*Ua).saveDialogState()
+    saves := counting.saves
+    cmap.lock.Unlock()
+    if saves != 2 {
+        t.Fatalf("Expected 2 saves of the dialog, got %d", saves)
+    }
+    cmap.sip_tm.Shutdown()
+
+    states, err := store.Load()
+    if err != nil {
+        t.Fatal("Cannot load dialogs: " + err.Error())
+    }
+    if len(states) != 1 {
+        t.Fatal("Expected one saved dialog")
+    }
+    assertStringEqual(states[0].CallId, "restore-test@1.1.1.1", t)
+    if states[0].RCSeq != 11 {
+        t.Fatal("Bad remote CSeq in the saved dialog")
+    }
+    assertStringEqual(states[0].RTag, "abc", t)
+    // the other leg of a B2BUA call has the same Call-ID
+    other := &DialogState{ CallId : states[0].CallId, LTag : "xyz", RTag : "abc" }
+    if err = store.Save(other); err != nil {
+        t.Fatal("Cannot save dialog: " + err.Error())
+    }
+    if err = store.Delete(other.Key()); err != nil {
+        t.Fatal("Cannot delete dialog: " + err.Error())
+    }
+    if states, _ = store.Load(); len(states) != 1 || states[0].LTag == "xyz" {
+        t.Fatal("Deleting a dialog must keep the other one with the same Call-ID")
+    }
+
+    config2, tfactory2 := newTestConfig()
+    cmap2 := NewTestCallMap(config2)
+    cmap2.sip_tm = startTestSipTM(t, config2, cmap2)
+    defer cmap2.sip_tm.Shutdown()
+    cmap2.lock.Lock()
+    ua, err := RestoreUA(cmap2.sip_tm, config2, states[0], cmap2, &cmap2.lock)
+    if err != nil {
+        cmap2.lock.Unlock()
+        t.Fatal("Cannot restore dialog: " + err.Error())
+    }
+    ua.SetDialogStore(store)
+    ua.RecvEvent(NewCCEventDisconnect(nil, rtime, ""))
+    cmap2.lock.Unlock()
+    bye, err := ParseSipRequest(tfactory2.get(), rtime, config2)
+    if err != nil {
+        t.Fatal("Cannot parse BYE: " + err.Error())
+    }
+    assertStringEqual(bye.GetMethod(), "BYE", t)
+    assertStringEqual(bye.GetCallId().CallId, "restore-test@1.1.1.1", t)
+    to, _ = bye.GetTo().GetBody()
+    assertStringEqual(to.GetTag(), "abc", t)
+    assertStringEqual(bye.GetRURI().String(), "sip:100@1.1.1.1:5060", t)
+    if len(bye.GetHFs("route")) != 1 || ! strings.Contains(bye.GetHFs("route")[0].String(), "2.2.2.2") {
+        t.Fatal("The BYE must follow the restored route set")
+    }
+}
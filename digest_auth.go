@@ -0,0 +1,398 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+)
+
+// DigestCredentialsFunc returns HA1 of the username in the realm computed
+// with the given algorithm (MD5, SHA-256 or SHA-512-256) and whether the
+// username is known at all. For the -sess algorithms it is still the hash
+// of username:realm:password, the session key is derived by the caller.
+type DigestCredentialsFunc func(req sippy_types.SipRequest, username, realm, algorithm string) (string, bool)
+
+// DigestPasswordCredentials makes the DigestCredentialsFunc out of the
+// plain text password lookup.
+func DigestPasswordCredentials(lookup func(username string) (string, bool)) DigestCredentialsFunc {
+    return func(req sippy_types.SipRequest, username, realm, algorithm string) (string, bool) {
+        password, ok := lookup(username)
+        if ! ok {
+            return "", false
+        }
+        if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+            algorithm = algorithm[:len(algorithm) - len("-sess")]
+        }
+        return sippy_header.DigestCalcHA1(algorithm, username, realm, password, "", ""), true
+    }
+}
+
+type digestNonceState struct {
+    nc          uint64
+    expires     time.Time
+}
+
+type digestFailures struct {
+    count       int
+    reset       time.Time
+}
+
+// DigestAuthenticator challenges the incoming requests and verifies
+// the digest responses (RFC 7616, RFC 8760). The nonces are signed with
+// a secret and carry the time they were issued at so that no state is
+// needed to validate them; the nonce counts are tracked to detect the
+// replays. The number of failed attempts is capped per source address.
+type DigestAuthenticator struct {
+    config          sippy_conf.Config
+    realm           string
+    credentials     DigestCredentialsFunc
+    secret          []byte
+    proxy           bool
+    algorithms      []string
+    qop             []string
+    nonce_ttl       time.Duration
+    max_failures    int
+    failures_ttl    time.Duration
+    lock            sync.Mutex
+    nonces          map[string]*digestNonceState
+    failures        map[string]*digestFailures
+    last_gc         time.Time
+}
+
+func NewDigestAuthenticator(config sippy_conf.Config, realm string, credentials DigestCredentialsFunc) *DigestAuthenticator {
+    secret := make([]byte, 32)
+    rand.Read(secret)
+    return &DigestAuthenticator{
+        config          : config,
+        realm           : realm,
+        credentials     : credentials,
+        secret          : secret,
+        algorithms      : []string{ "SHA-256", "MD5" },
+        qop             : []string{ "auth" },
+        nonce_ttl       : 5 * time.Minute,
+        max_failures    : 10,
+        failures_ttl    : 5 * time.Minute,
+        nonces          : make(map[string]*digestNonceState),
+        failures        : make(map[string]*digestFailures),
+        last_gc         : time.Now(),
+    }
+}
+
+// SetSecret sets the key the nonces are signed with. The instances
+// sharing the secret accept each other's nonces.
+func (self *DigestAuthenticator) SetSecret(secret []byte) {
+    self.secret = secret
+}
+
+// SetProxy makes the authenticator to use 407 and Proxy-Authorization
+// instead of 401 and Authorization.
+func (self *DigestAuthenticator) SetProxy(proxy bool) {
+    self.proxy = proxy
+}
+
+// SetAlgorithms sets the algorithms offered in the challenges, the most
+// preferred first.
+func (self *DigestAuthenticator) SetAlgorithms(algorithms ...string) {
+    self.algorithms = algorithms
+}
+
+// SetQop sets the qop values offered. No qop makes the authenticator
+// RFC 2069 compatible.
+func (self *DigestAuthenticator) SetQop(qop ...string) {
+    self.qop = qop
+}
+
+func (self *DigestAuthenticator) SetNonceTTL(ttl time.Duration) {
+    self.nonce_ttl = ttl
+}
+
+// SetMaxFailures limits the number of the failed attempts from a single
+// source address within the ttl. Zero max_failures disables the limit.
+func (self *DigestAuthenticator) SetMaxFailures(max_failures int, ttl time.Duration) {
+    self.max_failures = max_failures
+    self.failures_ttl = ttl
+}
+
+func (self *DigestAuthenticator) GetRealm() string {
+    return self.realm
+}
+
+// Authenticate verifies the credentials in the request. It returns the
+// parsed credentials and nil on success. Otherwise the response to be
+// sent is returned. It is intended to be called from
+// CallMap.OnNewDialog().
+func (self *DigestAuthenticator) Authenticate(req sippy_types.SipRequest) (*sippy_header.SipAuthorizationBody, sippy_types.SipResponse) {
+    var hf *sippy_header.SipAuthorization
+
+    source := ""
+    if req.GetSource() != nil {
+        source = req.GetSource().Host.String()
+    }
+    if self.isBlocked(source) {
+        return nil, req.GenResponse(403, "Forbidden", nil, nil)
+    }
+    if self.proxy {
+        if phf := req.GetSipProxyAuthorization(); phf != nil {
+            hf = phf.SipAuthorization
+        }
+    } else {
+        hf = req.GetSipAuthorization()
+    }
+    if hf == nil {
+        return nil, self.challenge(req, false)
+    }
+    auth, err := hf.GetBody()
+    if err != nil {
+        self.config.ErrorLogger().Error("DigestAuthenticator::Authenticate: #1: " + err.Error())
+        return nil, req.GenResponse(400, "Bad Request", nil, nil)
+    }
+    if auth.GetRealm() != self.realm || ! self.offered(auth.GetAlgorithm()) {
+        return nil, self.challenge(req, false)
+    }
+    if len(self.qop) > 0 && (! self.qopOffered(auth.GetQop()) || auth.GetNC() == "") {
+        // RFC 2069 response without the nonce count could be replayed
+        return nil, self.challenge(req, false)
+    }
+    if ! self.uriMatches(auth.GetURI(), req.GetRURI()) {
+        return nil, req.GenResponse(400, "Bad Request", nil, nil)
+    }
+    valid, stale := self.checkNonce(auth.GetNonce(), auth.GetNC())
+    if ! valid {
+        return nil, self.challenge(req, stale)
+    }
+    HA1, ok := self.credentials(req, auth.GetUsername(), self.realm, auth.GetAlgorithm())
+    HA1 = sippy_header.DigestCalcSessHA1(auth.GetAlgorithm(), HA1, auth.GetNonce(), auth.GetCNonce())
+    entity := ""
+    if req.GetBody() != nil {
+        entity = req.GetBody().String()
+    }
+    if ! ok || ! auth.VerifyHA1WithEntity(HA1, req.GetMethod(), entity) {
+        self.failed(source)
+        return nil, req.GenResponse(403, "Forbidden", nil, nil)
+    }
+    // the nonce count only advances for the genuine client
+    if auth.GetNC() != "" && ! self.advanceNonceCount(auth.GetNonce(), auth.GetNC()) {
+        return nil, self.challenge(req, true)
+    }
+    self.lock.Lock()
+    delete(self.failures, source)
+    self.lock.Unlock()
+    return auth, nil
+}
+
+func (self *DigestAuthenticator) offered(algorithm string) bool {
+    if algorithm == "" {
+        algorithm = "MD5"
+    }
+    for _, alg := range self.algorithms {
+        if strings.EqualFold(alg, algorithm) {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *DigestAuthenticator) qopOffered(qop string) bool {
+    for _, q := range self.qop {
+        if strings.EqualFold(q, qop) {
+            return true
+        }
+    }
+    return false
+}
+
+// uriMatches checks the digest-uri against the Request-URI (RFC 7616
+// section 3.4.6).
+func (self *DigestAuthenticator) uriMatches(uri string, ruri *sippy_header.SipURL) bool {
+    if uri == ruri.String() {
+        return true
+    }
+    url, err := sippy_header.ParseSipURL(uri, true, self.config)
+    if err != nil {
+        return false
+    }
+    port, rport := "", ""
+    if url.Port != nil {
+        port = url.Port.String()
+    }
+    if ruri.Port != nil {
+        rport = ruri.Port.String()
+    }
+    return url.Username == ruri.Username && strings.EqualFold(url.Host.String(), ruri.Host.String()) && port == rport
+}
+
+func (self *DigestAuthenticator) challenge(req sippy_types.SipRequest, stale bool) sippy_types.SipResponse {
+    var resp sippy_types.SipResponse
+
+    nonce := self.newNonce(time.Now())
+    if self.proxy {
+        resp = req.GenResponse(407, "Proxy Authentication Required", nil, nil)
+    } else {
+        resp = req.GenResponse(401, "Unauthorized", nil, nil)
+    }
+    for _, alg := range self.algorithms {
+        var hf sippy_header.SipHeader
+        var challenge *sippy_header.SipWWWAuthenticateBody
+
+        if self.proxy {
+            phf := sippy_header.NewSipProxyAuthenticate(self.realm, nonce)
+            challenge, _ = phf.GetBody()
+            hf = phf
+        } else {
+            whf := sippy_header.NewSipWWWAuthenticate(self.realm, nonce)
+            challenge, _ = whf.GetBody()
+            hf = whf
+        }
+        challenge.SetAlgorithm(alg)
+        challenge.SetQop(self.qop...)
+        challenge.SetStale(stale)
+        resp.AppendHeader(hf)
+    }
+    return resp
+}
+
+// newNonce returns hex(timestamp | random | HMAC(timestamp | random | realm)).
+func (self *DigestAuthenticator) newNonce(now time.Time) string {
+    buf := make([]byte, 16)
+    binary.BigEndian.PutUint64(buf, uint64(now.Unix()))
+    rand.Read(buf[8:])
+    return hex.EncodeToString(buf) + hex.EncodeToString(self.sign(buf))
+}
+
+func (self *DigestAuthenticator) sign(buf []byte) []byte {
+    mac := hmac.New(sha256.New, self.secret)
+    mac.Write(buf)
+    mac.Write([]byte(self.realm))
+    return mac.Sum(nil)[:16]
+}
+
+// checkNonce verifies the signature and the age of the nonce and that
+// the nonce count has not been used yet. The stale is true if the nonce
+// is ours but it could not be used anymore.
+func (self *DigestAuthenticator) checkNonce(nonce, nc string) (valid bool, stale bool) {
+    raw, err := hex.DecodeString(nonce)
+    if err != nil || len(raw) != 32 || ! hmac.Equal(raw[16:], self.sign(raw[:16])) {
+        return false, false
+    }
+    issued := time.Unix(int64(binary.BigEndian.Uint64(raw)), 0)
+    if time.Now().After(issued.Add(self.nonce_ttl)) {
+        return false, true
+    }
+    if nc == "" {
+        return true, false
+    }
+    ncval, err := strconv.ParseUint(nc, 16, 64)
+    if err != nil {
+        return false, false
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if state, ok := self.nonces[nonce]; ok && ncval <= state.nc {
+        // replay
+        return false, true
+    }
+    return true, false
+}
+
+// advanceNonceCount records the nonce count of the verified response. It
+// returns false if the same count has been used in the meantime. The
+// nonce must have passed checkNonce.
+func (self *DigestAuthenticator) advanceNonceCount(nonce, nc string) bool {
+    raw, _ := hex.DecodeString(nonce)
+    issued := time.Unix(int64(binary.BigEndian.Uint64(raw)), 0)
+    ncval, _ := strconv.ParseUint(nc, 16, 64)
+    now := time.Now()
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.gc(now)
+    state, ok := self.nonces[nonce]
+    if ! ok {
+        state = &digestNonceState{ expires : issued.Add(self.nonce_ttl) }
+        self.nonces[nonce] = state
+    }
+    if ncval <= state.nc {
+        return false
+    }
+    state.nc = ncval
+    return true
+}
+
+func (self *DigestAuthenticator) isBlocked(source string) bool {
+    if self.max_failures <= 0 {
+        return false
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.gc(time.Now())
+    failures, ok := self.failures[source]
+    return ok && failures.count >= self.max_failures && time.Now().Before(failures.reset)
+}
+
+func (self *DigestAuthenticator) failed(source string) {
+    if self.max_failures <= 0 {
+        return
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    failures, ok := self.failures[source]
+    if ! ok {
+        failures = &digestFailures{ reset : time.Now().Add(self.failures_ttl) }
+        self.failures[source] = failures
+    }
+    failures.count++
+}
+
+// gc drops the expired nonce and failure records. Must be called with
+// the lock held.
+func (self *DigestAuthenticator) gc(now time.Time) {
+    if now.Sub(self.last_gc) < time.Second {
+        return
+    }
+    self.last_gc = now
+    for nonce, state := range self.nonces {
+        if now.After(state.expires) {
+            delete(self.nonces, nonce)
+        }
+    }
+    for source, failures := range self.failures {
+        if now.After(failures.reset) {
+            delete(self.failures, source)
+        }
+    }
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+    "github.com/braams/sippy/types"
+)
+
+func Test_DigestAuthenticator(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    authenticator := NewDigestAuthenticator(config, "example.org", DigestPasswordCredentials(func(username string) (string, bool) {
+        return "secret", username == "100"
+    }))
+    authenticator.SetMaxFailures(2, time.Minute)
+    invite := func(auth sippy_header.SipHeader) *sipRequest {
+        lines := []string{
+            "INVITE sip:200@1.1.1.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 2.2.2.2:5060;branch=z9hG4bK1",
+            "From: <sip:100@1.1.1.1>;tag=12345",
+            "To: <sip:200@1.1.1.1>",
+            "Call-ID: digest-auth-test@2.2.2.2",
+            "CSeq: 1 INVITE",
+        }
+        if auth != nil {
+            lines = append(lines, auth.String())
+        }
+        lines = append(lines, "Content-Length: 0", "", "")
+        rtime, _ := sippy_time.NewMonoTime()
+        req, err := ParseSipRequest([]byte(strings.Join(lines, "\r\n")), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse INVITE: " + err.Error())
+        }
+        req.source = sippy_net.NewHostPort("2.2.2.2", "5060")
+        return req
+    }
+    expect := func(resp sippy_types.SipResponse, code int) {
+        if resp == nil {
+            if code != 0 {
+                t.Fatalf("Authenticated while expecting %d", code)
+            }
+            return
+        }
+        if scode, _ := resp.GetSCode(); scode != code {
+            t.Fatalf("Got %d while expecting %d", scode, code)
+        }
+    }
+
+    _, resp := authenticator.Authenticate(invite(nil))
+    expect(resp, 401)
+    if len(resp.GetSipWWWAuthenticates()) != 2 {
+        t.Fatal("Both SHA-256 and MD5 must be offered")
+    }
+    digest, err := newDigestClient(resp, nil)
+    if err != nil {
+        t.Fatal("Cannot parse the challenge: " + err.Error())
+    }
+    assertStringEqual(digest.challenge.GetAlgorithm(), "SHA-256", t)
+    auth := digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "secret", nil)
+    body, resp := authenticator.Authenticate(invite(auth))
+    expect(resp, 0)
+    assertStringEqual(body.GetUsername(), "100", t)
+
+    // The same nonce count again is a replay
+    _, resp = authenticator.Authenticate(invite(auth))
+    expect(resp, 401)
+    challenge, _ := resp.GetSipWWWAuthenticate().GetBody()
+    if ! challenge.GetStale() {
+        t.Fatal("The replayed nonce must be reported stale")
+    }
+    _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "secret", nil)))
+    expect(resp, 0)
+
+    // The forged response does not burn the nonce counts of the client
+    saved_nc := digest.nc
+    digest.nc = 0x1000
+    _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "forged", nil)))
+    expect(resp, 403)
+    digest.nc = saved_nc
+    _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "secret", nil)))
+    expect(resp, 0)
+
+    // RFC 2069 response is not accepted when qop has been offered
+    _, resp = authenticator.Authenticate(invite(sippy_header.NewSipAuthorization("example.org",
+        digest.challenge.GetNonce(), "INVITE", "sip:200@1.1.1.1", "100", "secret")))
+    expect(resp, 401)
+
+    // The digest-uri must match the Request-URI
+    _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:300@1.1.1.1", "100", "secret", nil)))
+    expect(resp, 400)
+
+    // Expired nonce
+    old := sippy_header.NewSipWWWAuthenticate("example.org", authenticator.newNonce(time.Now().Add(-time.Hour)))
+    old_body, _ := old.GetBody()
+    old_body.SetQop("auth")
+    auth = (&digestClient{ challenge : old_body }).authorization("INVITE", "sip:200@1.1.1.1", "100", "secret", nil)
+    _, resp = authenticator.Authenticate(invite(auth))
+    expect(resp, 401)
+    if challenge, _ = resp.GetSipWWWAuthenticate().GetBody(); ! challenge.GetStale() {
+        t.Fatal("The expired nonce must be reported stale")
+    }
+
+    // Failures are capped per source
+    for i := 0; i < 2; i++ {
+        _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "wrong", nil)))
+        expect(resp, 403)
+    }
+    _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "secret", nil)))
+    expect(resp, 403)
+}
+
+func Test_DigestAuthenticatorSess(t *testing.T) {
+    // RFC 2617 section 3.5 credentials
+    HA1 := sippy_header.DigestCalcHA1("MD5-sess", "Mufasa", "testrealm@host.com", "Circle Of Life",
+        "dcd98b7102dd2f0e8b11d0f600bfb0c093", "0a4f113b")
+    assertStringEqual(HA1, "5edb191b66dce1584c16cb7e7346fcee", t)
+
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    authenticator := NewDigestAuthenticator(config, "example.org", DigestPasswordCredentials(func(username string) (string, bool) {
+        return "secret", username == "100"
+    }))
+    authenticator.SetAlgorithms("MD5-sess")
+    rtime, _ := sippy_time.NewMonoTime()
+    invite := func(auth sippy_header.SipHeader) *sipRequest {
+        lines := []string{
+            "INVITE sip:200@1.1.1.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 2.2.2.2:5060;branch=z9hG4bK1",
+            "From: <sip:100@1.1.1.1>;tag=12345",
+            "To: <sip:200@1.1.1.1>",
+            "Call-ID: digest-sess-test@2.2.2.2",
+            "CSeq: 1 INVITE",
+        }
+        if auth != nil {
+            lines = append(lines, auth.String())
+        }
+        req, err := ParseSipRequest([]byte(strings.Join(append(lines, "Content-Length: 0", "", ""), "\r\n")), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse INVITE: " + err.Error())
+        }
+        req.source = sippy_net.NewHostPort("2.2.2.2", "5060")
+        return req
+    }
+    _, resp := authenticator.Authenticate(invite(nil))
+    if resp == nil || resp.GetSCodeNum() != 401 {
+        t.Fatal("Expected the challenge")
+    }
+    digest, err := newDigestClient(resp, nil)
+    if err != nil {
+        t.Fatal("Cannot parse the challenge: " + err.Error())
+    }
+    _, resp = authenticator.Authenticate(invite(digest.authorization("INVITE", "sip:200@1.1.1.1", "100", "secret", nil)))
+    if resp != nil {
+        t.Fatalf("MD5-sess response has been rejected with %d", resp.GetSCodeNum())
+    }
+}
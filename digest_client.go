@@ -0,0 +1,140 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "crypto/rand"
+    "errors"
+    "fmt"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+)
+
+// digestClient keeps the client side of the digest authentication: the
+// challenge picked out of a 401/407 response and the nonce count used
+// with that challenge (RFC 7616).
+type digestClient struct {
+    challenge   *sippy_header.SipWWWAuthenticateBody
+    proxy       bool
+    nc          int
+}
+
+// newDigestClient picks the strongest supported challenge out of the
+// WWW-Authenticate (401) or Proxy-Authenticate (407) headers. The prev
+// client is reused when the server has challenged with the same nonce so
+// that the nonce count keeps growing.
+func newDigestClient(resp sippy_types.SipResponse, prev *digestClient) (*digestClient, error) {
+    var challenges []*sippy_header.SipWWWAuthenticateBody
+
+    code, _ := resp.GetSCode()
+    proxy := code == 407
+    if proxy {
+        for _, hf := range resp.GetSipProxyAuthenticates() {
+            body, err := hf.GetBody()
+            if err != nil {
+                return nil, err
+            }
+            challenges = append(challenges, body)
+        }
+    } else {
+        for _, hf := range resp.GetSipWWWAuthenticates() {
+            body, err := hf.GetBody()
+            if err != nil {
+                return nil, err
+            }
+            challenges = append(challenges, body)
+        }
+    }
+    challenge := pickDigestChallenge(challenges)
+    if challenge == nil {
+        return nil, errors.New("no supported digest challenge")
+    }
+    if prev != nil && prev.proxy == proxy && prev.challenge.GetNonce() == challenge.GetNonce() &&
+      prev.challenge.GetAlgorithm() == challenge.GetAlgorithm() {
+        prev.challenge = challenge
+        return prev, nil
+    }
+    return &digestClient{
+        challenge   : challenge,
+        proxy       : proxy,
+    }, nil
+}
+
+func pickDigestChallenge(challenges []*sippy_header.SipWWWAuthenticateBody) *sippy_header.SipWWWAuthenticateBody {
+    var rval *sippy_header.SipWWWAuthenticateBody
+    best := 0
+    for _, challenge := range challenges {
+        if strength := sippy_header.DigestAlgorithmStrength(challenge.GetAlgorithm()); strength > best {
+            rval, best = challenge, strength
+        }
+    }
+    return rval
+}
+
+func (self *digestClient) GetNonce() string {
+    return self.challenge.GetNonce()
+}
+
+func (self *digestClient) GetRealm() string {
+    return self.challenge.GetRealm()
+}
+
+// authorization builds the Authorization/Proxy-Authorization header. The
+// qop=auth-int is used only when the server does not offer qop=auth.
+func (self *digestClient) authorization(method, uri, username, password string, body sippy_types.MsgBody) sippy_header.SipHeader {
+    var qop, nc, cnonce, entity string
+
+    if self.challenge.HasQop("auth") {
+        qop = "auth"
+    } else if self.challenge.HasQop("auth-int") {
+        qop = "auth-int"
+        if body != nil {
+            entity = body.String()
+        }
+    }
+    if qop != "" {
+        buf := make([]byte, 8)
+        rand.Read(buf)
+        cnonce = fmt.Sprintf("%x", buf)
+        self.nc++
+        nc = fmt.Sprintf("%08x", self.nc)
+    }
+    auth := sippy_header.NewSipAuthorizationWithParams(self.challenge, method, uri, username, password, qop, nc, cnonce, entity)
+    if self.proxy {
+        return sippy_header.NewSipProxyAuthorizationFromAuthorization(auth)
+    }
+    return auth
+}
+
+// authFunc adapts the client to the NewSipXXXAuthorizationFunc taken by
+// the GenRequest() and friends.
+func (self *digestClient) authFunc(body sippy_types.MsgBody) sippy_header.NewSipXXXAuthorizationFunc {
+    return func(realm, nonce, method, uri, username, password string) sippy_header.SipHeader {
+        return self.authorization(method, uri, username, password, body)
+    }
+}
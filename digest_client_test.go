@@ -0,0 +1,92 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/time"
+)
+
+func Test_DigestAlgorithms(t *testing.T) {
+    // RFC 7616 section 3.9.1
+    for alg, expected := range map[string]string{
+        "MD5"       : "8ca523f5e9506fed4657c9700eebdbec",
+        "SHA-256"   : "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+    } {
+        HA1 := sippy_header.DigestCalcHA1(alg, "Mufasa", "http-auth@example.org", "Circle of Life", "", "")
+        response := sippy_header.DigestCalcResponseAlg(alg, HA1, "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", "00000001",
+            "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", "auth", "GET", "/dir/index.html", "")
+        assertStringEqual(response, expected, t)
+    }
+}
+
+func Test_DigestClient(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rtime, _ := sippy_time.NewMonoTime()
+    resp, err := ParseSipResponse([]byte("SIP/2.0 401 Unauthorized\r\n" +
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK1\r\n" +
+        "From: <sip:100@1.1.1.1>;tag=1\r\n" +
+        "To: <sip:100@1.1.1.1>;tag=2\r\n" +
+        "Call-ID: digest\r\n" +
+        "CSeq: 1 REGISTER\r\n" +
+        "WWW-Authenticate: Digest realm=\"example.org\",nonce=\"abc\",algorithm=MD5,qop=\"auth\"\r\n" +
+        "WWW-Authenticate: Digest realm=\"example.org\",nonce=\"abc\",algorithm=SHA-512-256,qop=\"auth,auth-int\",opaque=\"xyz\"\r\n" +
+        "WWW-Authenticate: Digest realm=\"example.org\",nonce=\"abc\",algorithm=SHA-256,qop=\"auth\"\r\n" +
+        "Content-Length: 0\r\n\r\n"), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    digest, err := newDigestClient(resp, nil)
+    if err != nil {
+        t.Fatal("Cannot pick a challenge: " + err.Error())
+    }
+    assertStringEqual(digest.challenge.GetAlgorithm(), "SHA-512-256", t)
+    for _, nc := range []string{ "00000001", "00000002" } {
+        auth := digest.authorization("REGISTER", "sip:example.org", "100", "secret", nil).(*sippy_header.SipAuthorization)
+        s := auth.String()
+        if ! strings.Contains(s, "nc=" + nc) || ! strings.Contains(s, "opaque=\"xyz\"") || ! strings.Contains(s, "algorithm=SHA-512-256") {
+            t.Fatal("Bad Authorization: " + s)
+        }
+        body, err := sippy_header.CreateSipAuthorization(auth.StringBody())[0].(*sippy_header.SipAuthorization).GetBody()
+        if err != nil {
+            t.Fatal("Cannot parse Authorization: " + err.Error())
+        }
+        HA1 := sippy_header.DigestCalcHA1(body.GetAlgorithm(), "100", "example.org", "secret", "abc", "")
+        if ! body.VerifyHA1(HA1, "REGISTER") {
+            t.Fatal("Authorization does not verify: " + s)
+        }
+    }
+    digest2, _ := newDigestClient(resp, digest)
+    if digest2 != digest {
+        t.Fatal("Nonce count is not kept for the same nonce")
+    }
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "strings"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+)
+
+// The dialects the redirection history is sent in on the outgoing leg.
+const (
+    DIVERSION_DIALECT_NONE          = ""
+    DIVERSION_DIALECT_DIVERSION     = "diversion"
+    DIVERSION_DIALECT_HISTORY_INFO  = "history-info"
+)
+
+// The History-Info entries rendered from the redirection history are
+// limited like the hops of the request.
+const DIVERSION_MAX_ENTRIES = 70
+
+// Diversion reason to the redirection cause (RFC 4458) mapping as per
+// RFC 6044.
+var diversion_reason_to_cause = map[string]int{
+    "unknown"           : 404,
+    "user-busy"         : 486,
+    "no-answer"         : 408,
+    "unconditional"     : 302,
+    "deflection"        : 487,
+    "unavailable"       : 503,
+    "time-of-day"       : 404,
+    "do-not-disturb"    : 404,
+    "follow-me"         : 404,
+    "out-of-service"    : 404,
+    "away"              : 404,
+}
+
+var diversion_cause_to_reason = map[int]string{
+    404 : "unknown",
+    486 : "user-busy",
+    408 : "no-answer",
+    302 : "unconditional",
+    487 : "deflection",
+    480 : "deflection",
+    503 : "unavailable",
+}
+
+// DiversionInfo is the dialect neutral description of a single
+// redirection. Address is the party the call has been diverted from.
+type DiversionInfo struct {
+    Address *sippy_header.SipAddress
+    Reason  string
+    Counter int
+}
+
+func (self *DiversionInfo) GetCopy() *DiversionInfo {
+    return &DiversionInfo{
+        Address : self.Address.GetCopy(),
+        Reason  : self.Reason,
+        Counter : self.Counter,
+    }
+}
+
+// ParseDiversion extracts the redirection history from the Diversion
+// headers or, when there are none, from the History-Info headers. The
+// most recent redirection comes first, like in the Diversion header.
+func ParseDiversion(msg sippy_types.SipMsg) ([]*DiversionInfo, error) {
+    rval := []*DiversionInfo{}
+    for _, hf := range msg.GetHFs("diversion") {
+        div, ok := hf.(*sippy_header.SipDiversion)
+        if ! ok {
+            continue
+        }
+        addr, err := div.GetBody()
+        if err != nil {
+            return nil, err
+        }
+        info := &DiversionInfo{
+            Address : addr.GetCopy(),
+            Reason  : strings.Trim(addr.GetParam("reason"), "\""),
+            Counter : 1,
+        }
+        if counter, err := strconv.Atoi(addr.GetParam("counter")); err == nil {
+            info.Counter = counter
+        }
+        info.Address.DelParam("reason")
+        info.Address.DelParam("counter")
+        rval = append(rval, info)
+    }
+    if len(rval) > 0 {
+        return rval, nil
+    }
+    entries := []*sippy_header.SipAddress{}
+    for _, hf := range msg.GetHFs("history-info") {
+        hi, ok := hf.(*sippy_header.SipHistoryInfo)
+        if ! ok {
+            continue
+        }
+        addr, err := hi.GetBody()
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, addr)
+    }
+    for i := 0; i < len(entries) - 1; i++ {
+        cause, err := strconv.Atoi(entries[i + 1].GetUrl().GetParam("cause"))
+        if err != nil {
+            cause = reasonCause(entries[i].GetUrl().GetHeader("reason"))
+        }
+        if cause == 0 {
+            // retargeting that is not a diversion
+            continue
+        }
+        reason, ok := diversion_cause_to_reason[cause]
+        if ! ok {
+            reason = "unknown"
+        }
+        addr := sippy_header.NewSipAddress(entries[i].GetName(), entries[i].GetUrl().GetCopy())
+        addr.GetUrl().DelHeader("reason")
+        addr.GetUrl().DelParam("cause")
+        rval = append([]*DiversionInfo{ &DiversionInfo{ Address : addr, Reason : reason, Counter : 1 } }, rval...)
+    }
+    return rval, nil
+}
+
+// reasonCause extracts the cause from the Reason header value embedded in
+// the History-Info entry, e.g. "SIP;cause=302".
+func reasonCause(reason string) int {
+    params := strings.Split(reason, ";")
+    if strings.ToUpper(strings.TrimSpace(params[0])) != "SIP" {
+        return 0
+    }
+    for _, param := range params[1:] {
+        nv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+        if len(nv) == 2 && strings.ToLower(nv[0]) == "cause" {
+            cause, _ := strconv.Atoi(nv[1])
+            return cause
+        }
+    }
+    return 0
+}
+
+// DiversionHeaders renders the redirection history as Diversion headers.
+func DiversionHeaders(divs []*DiversionInfo, config sippy_conf.Config) []sippy_header.SipHeader {
+    rval := make([]sippy_header.SipHeader, len(divs))
+    for i, div := range divs {
+        addr := div.Address.GetCopy()
+        reason := div.Reason
+        if reason == "" {
+            reason = "unknown"
+        }
+        addr.SetParam("reason", reason)
+        if div.Counter > 1 {
+            addr.SetParam("counter", strconv.Itoa(div.Counter))
+        }
+        rval[i] = sippy_header.NewSipDiversion(addr, config)
+    }
+    return rval
+}
+
+// HistoryInfoHeaders renders the redirection history as History-Info
+// headers ending with the entry for the current target.
+func HistoryInfoHeaders(divs []*DiversionInfo, target *sippy_header.SipURL, config sippy_conf.Config) []sippy_header.SipHeader {
+    if len(divs) == 0 {
+        return []sippy_header.SipHeader{}
+    }
+    // a Diversion with the counter stands for as many redirections, the
+    // counter comes from the peer so it is capped
+    expanded := make([]*DiversionInfo, 0, len(divs))
+    for _, div := range divs {
+        for n := 0; n < div.Counter || n == 0; n++ {
+            if len(expanded) == DIVERSION_MAX_ENTRIES {
+                break
+            }
+            expanded = append(expanded, div)
+        }
+    }
+    divs = expanded
+    rval := make([]sippy_header.SipHeader, 0, len(divs) + 1)
+    index := "1"
+    cause := 0
+    for i := len(divs); i >= 0; i-- {
+        var addr *sippy_header.SipAddress
+        if i > 0 {
+            addr = sippy_header.NewSipAddress(divs[i - 1].Address.GetName(), divs[i - 1].Address.GetUrl().GetCopy())
+        } else {
+            addr = sippy_header.NewSipAddress("", target.GetCopy())
+        }
+        addr.GetUrl().DelParam("cause")
+        if cause != 0 {
+            addr.GetUrl().SetParam("cause", strconv.Itoa(cause))
+            prev_index := index
+            index += ".1"
+            addr.SetParam("mp", prev_index)
+        }
+        addr.SetParam("index", index)
+        if i > 0 {
+            var ok bool
+            if cause, ok = diversion_reason_to_cause[divs[i - 1].Reason]; ! ok {
+                cause = 404
+            }
+            addr.GetUrl().SetHeader("reason", "SIP;cause=" + strconv.Itoa(cause))
+        }
+        rval = append(rval, sippy_header.NewSipHistoryInfo(addr, config))
+    }
+    return rval
+}
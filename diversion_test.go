@@ -0,0 +1,120 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/time"
+)
+
+func Test_DiversionInterworking(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rtime, _ := sippy_time.NewMonoTime()
+    invite := []string{
+        "INVITE sip:300@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKdiv1",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>",
+        "Call-ID: diversion-test@1.1.1.1",
+        "CSeq: 1 INVITE",
+        "Contact: <sip:100@1.1.1.1>",
+    }
+    req, err := ParseSipRequest([]byte(strings.Join(append(invite,
+        "Diversion: <sip:250@192.168.0.1>;reason=no-answer",
+        "Diversion: <sip:200@192.168.0.1>;reason=user-busy",
+        "Content-Length: 0", "", ""), "\r\n")), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    divs, err := ParseDiversion(req)
+    if err != nil {
+        t.Fatal("Cannot parse Diversion: " + err.Error())
+    }
+    if len(divs) != 2 {
+        t.Fatal("Expected two diversions")
+    }
+    hi := []string{}
+    for _, hf := range HistoryInfoHeaders(divs, req.GetRURI(), config) {
+        hi = append(hi, hf.String())
+    }
+    if len(hi) != 3 || ! strings.Contains(hi[1], "cause=486") || ! strings.Contains(hi[2], "cause=408") {
+        t.Fatal("Bad History-Info: " + strings.Join(hi, "\n"))
+    }
+    req, err = ParseSipRequest([]byte(strings.Join(append(append(invite, hi...),
+        "Content-Length: 0", "", ""), "\r\n")), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    divs, err = ParseDiversion(req)
+    if err != nil {
+        t.Fatal("Cannot parse History-Info: " + err.Error())
+    }
+    if len(divs) != 2 {
+        t.Fatal("Expected two diversions")
+    }
+    assertStringEqual(divs[0].Address.GetUrl().Username, "250", t)
+    assertStringEqual(divs[0].Reason, "no-answer", t)
+    assertStringEqual(divs[1].Address.GetUrl().Username, "200", t)
+    assertStringEqual(divs[1].Reason, "user-busy", t)
+    for _, hf := range DiversionHeaders(divs, config) {
+        div, _ := hf.(*sippy_header.SipDiversion).GetBody()
+        if div.GetUrl().GetParam("cause") != "" || div.GetUrl().GetHeader("reason") != "" {
+            t.Fatal("History-Info artifacts leaked into Diversion: " + hf.String())
+        }
+    }
+
+    // The counter expands into as many History-Info entries
+    req, err = ParseSipRequest([]byte(strings.Join(append(invite,
+        "Diversion: <sip:200@192.168.0.1>;reason=unconditional;counter=2",
+        "Content-Length: 0", "", ""), "\r\n")), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    divs, err = ParseDiversion(req)
+    if err != nil || len(divs) != 1 || divs[0].Counter != 2 {
+        t.Fatal("Cannot parse the Diversion counter")
+    }
+    hi = []string{}
+    for _, hf := range HistoryInfoHeaders(divs, req.GetRURI(), config) {
+        hi = append(hi, hf.String())
+    }
+    if len(hi) != 3 || ! strings.Contains(hi[1], "cause=302") || ! strings.Contains(hi[2], "cause=302") {
+        t.Fatal("Bad History-Info for the counter: " + strings.Join(hi, "\n"))
+    }
+
+    // The huge counter from the peer is capped
+    hfs := HistoryInfoHeaders([]*DiversionInfo{ &DiversionInfo{ Address : divs[0].Address, Reason : "unconditional", Counter : 1000000 } },
+        req.GetRURI(), config)
+    if len(hfs) != DIVERSION_MAX_ENTRIES + 1 {
+        t.Fatalf("Expected %d History-Info entries, got %d", DIVERSION_MAX_ENTRIES + 1, len(hfs))
+    }
+}
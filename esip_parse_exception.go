@@ -27,14 +27,106 @@
 package sippy
 
 import (
+    "fmt"
+
     "github.com/braams/sippy/types"
 )
 
+type SipParseErrorKind int
+
+const (
+    SipParseErrorMalformed SipParseErrorKind = iota
+    SipParseErrorMissing
+    SipParseErrorDuplicate
+)
+
+func (self SipParseErrorKind) String() string {
+    switch self {
+    case SipParseErrorMissing:
+        return "missing"
+    case SipParseErrorDuplicate:
+        return "duplicate"
+    }
+    return "malformed"
+}
+
+// ESipParseException describes the problem found in the message received.
+// The problems with the headers carry the header name, the value as it has
+// been received and the byte offset of the header line in the message,
+// which is -1 when there is no such line.
 type ESipParseException struct {
     sip_response    sippy_types.SipResponse
     msg             string
+    kind            SipParseErrorKind
+    hf_name         string
+    raw_value       string
+    offset          int
+    code            int
+}
+
+func newESipHFParseException(kind SipParseErrorKind, hf_name, raw_value string, offset int, msg string) *ESipParseException {
+    return &ESipParseException{
+        msg         : msg,
+        kind        : kind,
+        hf_name     : hf_name,
+        raw_value   : raw_value,
+        offset      : offset,
+        code        : 400,
+    }
+}
+
+// description tells what is wrong without the value received, so that it
+// can be sent back in the Warning header.
+func (self *ESipParseException) description() string {
+    if self.hf_name == "" {
+        return self.msg
+    }
+    var s string
+    switch self.kind {
+    case SipParseErrorMissing:
+        s = "Missing " + self.hf_name + " header"
+    case SipParseErrorDuplicate:
+        s = "Multiple " + self.hf_name + " headers"
+    default:
+        s = "Malformed " + self.hf_name + " header"
+    }
+    if self.msg != "" {
+        s += ": " + self.msg
+    }
+    return s
 }
 
 func (self *ESipParseException) Error() string {
-    return self.msg
+    s := self.description()
+    if self.offset >= 0 && self.hf_name != "" {
+        s += fmt.Sprintf(" at offset %d", self.offset)
+    }
+    if self.raw_value != "" {
+        s += fmt.Sprintf(" in '%s'", self.raw_value)
+    }
+    return s
+}
+
+func (self *ESipParseException) GetKind() SipParseErrorKind {
+    return self.kind
+}
+
+// GetHFName returns the name of the offending header as received or an
+// empty string when the problem is not with a header.
+func (self *ESipParseException) GetHFName() string {
+    return self.hf_name
+}
+
+func (self *ESipParseException) GetRawValue() string {
+    return self.raw_value
+}
+
+func (self *ESipParseException) GetOffset() int {
+    return self.offset
+}
+
+// GetSipResponse returns the response to be sent back to the originator
+// of the request or nil if there is none.
+func (self *ESipParseException) GetSipResponse() sippy_types.SipResponse {
+    return self.sip_response
 }
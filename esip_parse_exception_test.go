@@ -0,0 +1,105 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/time"
+)
+
+func Test_ParseErrors(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rtime, _ := sippy_time.NewMonoTime()
+    request := func(extra ...string) string {
+        return strings.Join(append([]string{
+            "OPTIONS sip:200@192.168.0.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK1234",
+            "Max-Forwards: 70",
+            "To: <sip:200@192.168.0.1>",
+            "Call-ID: perr@1.1.1.1",
+        }, extra...), "\r\n") + "\r\n\r\n"
+    }
+    parse := func(msg string) *ESipParseException {
+        _, err := ParseSipRequest([]byte(msg), rtime, config)
+        perr, ok := err.(*ESipParseException)
+        if !ok {
+            t.Fatalf("Got '%v' while expecting ESipParseException", err)
+        }
+        return perr
+    }
+
+    perr := parse(request("CSeq: 1 OPTIONS"))
+    if perr.GetKind() != SipParseErrorMissing || perr.GetHFName() != "From" || perr.GetOffset() != -1 {
+        t.Fatal("Missing From must be reported as such: " + perr.Error())
+    }
+    if perr.GetSipResponse() != nil {
+        t.Fatal("There must be no response without the From header")
+    }
+
+    msg := request("From: <sip:100@1.1.1.1>;tag=abc", "CSeq: one OPTIONS")
+    perr = parse(msg)
+    if perr.GetKind() != SipParseErrorMalformed || perr.GetHFName() != "CSeq" {
+        t.Fatal("Malformed CSeq must be reported as such: " + perr.Error())
+    }
+    assertStringEqual(perr.GetRawValue(), "one OPTIONS", t)
+    if perr.GetOffset() != strings.Index(msg, "CSeq:") {
+        t.Fatalf("Got offset %d while expecting %d", perr.GetOffset(), strings.Index(msg, "CSeq:"))
+    }
+    resp := perr.GetSipResponse()
+    if resp == nil {
+        t.Fatal("The malformed request must be answered")
+    }
+    if code, _ := resp.GetSCode(); code != 400 {
+        t.Fatalf("Got %d while expecting 400", code)
+    }
+    if warning := resp.GetFirstHF("Warning").StringBody(); !strings.HasSuffix(warning, "\"Malformed CSeq header: strconv.Atoi: parsing 'one': invalid syntax\"") {
+        t.Fatal("The Warning header must name the problem: " + warning)
+    }
+
+    perr = parse(request("f: <sip:100@1.1.1.1>;tag=abc", "CSeq: 1 OPTIONS", "Content-Length: 10"))
+    if perr.GetHFName() != "Content-Length" || perr.GetRawValue() != "10" || perr.GetOffset() < 0 {
+        t.Fatal("Truncated body must be reported against Content-Length: " + perr.Error())
+    }
+
+    // Only the top Via is checked unless the parser is strict
+    msg = request("From: <sip:100@1.1.1.1>;tag=abc", "CSeq: 1 OPTIONS", "Via: bogus")
+    if _, err := ParseSipRequest([]byte(msg), rtime, config); err != nil {
+        t.Fatal("Malformed non-top Via must be accepted: " + err.Error())
+    }
+    config.SetStrictParser(true)
+    if perr = parse(msg); perr.GetHFName() != "Via" {
+        t.Fatal("Malformed non-top Via must be reported by the strict parser: " + perr.Error())
+    }
+    perr = parse(request("From: <sip:100@1.1.1.1>;tag=abc", "CSeq: 1 OPTIONS", "t: <sip:300@192.168.0.1>"))
+    if perr.GetKind() != SipParseErrorDuplicate || perr.GetHFName() != "t" {
+        t.Fatal("Second To must be reported as duplicate: " + perr.Error())
+    }
+}
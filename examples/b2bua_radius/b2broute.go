@@ -34,7 +34,6 @@ import (
     "time"
 
     "github.com/braams/sippy"
-    "github.com/braams/sippy/conf"
     "github.com/braams/sippy/headers"
     "github.com/braams/sippy/net"
 )
@@ -68,6 +67,9 @@ type B2BRoute struct {
     extra_headers   []sippy_header.SipHeader
     rtpp            bool
     outbound_proxy  *sippy_net.HostPort
+    translator      *sippy.NumberTranslator
+    media_security  string
+    ms_set          bool
     rnum            int
 }
 /*
@@ -84,7 +86,7 @@ class B2BRoute(object):
     ainfo = nil
 */
 
-func NewB2BRoute(sroute string, global_config sippy_conf.Config) (*B2BRoute, error) {
+func NewB2BRoute(sroute string, global_config *myConfigParser) (*B2BRoute, error) {
     var hostport []string
     var err error
 
@@ -210,6 +212,21 @@ func NewB2BRoute(sroute string, global_config sippy_conf.Config) (*B2BRoute, err
                 return nil, errors.New("Error parsing the rtpp '" + av[1] + "': " + err.Error())
             }
             self.rtpp = (v != 0)
+        case "tr":
+            var v string
+            v, err = url.QueryUnescape(av[1])
+            if err == nil {
+                self.translator, err = sippy.ParseNumberTranslator(v, global_config.numbering_plan)
+            }
+            if err != nil {
+                return nil, errors.New("Error parsing the tr '" + av[1] + "': " + err.Error())
+            }
+        case "srtp":
+            self.media_security, err = parseMediaSecurity(av[1])
+            if err != nil {
+                return nil, errors.New("Error parsing the srtp '" + av[1] + "': " + err.Error())
+            }
+            self.ms_set = true
         case "op":
             host_port := strings.SplitN(av[1], ":", 2)
             if len(host_port) == 1 {
@@ -268,6 +285,16 @@ func (self *B2BRoute) getCopy() *B2BRoute {
     return &cself
 }
 
+// isAlive reports whether the health monitor considers the next hop
+// of the route reachable.
+func (self *B2BRoute) isAlive(source *sippy_net.HostPort) bool {
+    if global_health_monitor == nil || self.hostport == "sip-ua" {
+        return true
+    }
+    nh_address, _ := self.getNHAddr(source)
+    return global_health_monitor.IsUp(nh_address)
+}
+
 func (self *B2BRoute) getNHAddr(source *sippy_net.HostPort) (*sippy_net.HostPort, bool) {
     src_ip := net.ParseIP(source.Host.String())
     if src_ip == nil {
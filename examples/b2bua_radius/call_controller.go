@@ -93,9 +93,80 @@ func NewCallController(id int64, remote_ip *sippy_net.MyAddress, source *sippy_n
     self.uaA.SetDiscCb(self.aDisc)
     self.uaA.SetFailCb(self.aFail)
     self.uaA.SetDeadCb(self.aDead)
+    self.uaA.SetTrustDomain(self.global_config.trust_domain)
+    self.uaA.SetPAIAsCLI(self.global_config.pai_as_cli)
+    if self.global_config.header_rules != nil {
+        self.uaA.SetHeaderRules(self.global_config.header_rules, "A")
+    }
+    if self.global_config.codecs_a != nil {
+        sippy.NewSdpNegotiator(self.global_config.codecs_a).Attach(self.uaA)
+    }
+    if global_dialog_store != nil {
+        self.uaA.(*sippy.Ua).SetDialogStore(global_dialog_store)
+    }
     return self
 }
 
+// restoreCallController rebuilds a connected call from the dialogs
+// saved before the restart or mirrored from the active B2BUA. Either leg may be missing, in that
+// case the remaining leg is disconnected right away. The RTPproxy
+// sessions are not restored.
+func restoreCallController(id int64, global_config *myConfigParser, sip_tm sippy_types.SipTransactionManager, stateA, stateO *sippy.DialogState) (*callController, error) {
+    self := &callController{
+        id              : id,
+        global_config   : global_config,
+        state           : CCStateConnected,
+        routes          : make([]*B2BRoute, 0),
+        lock            : new(sync.Mutex),
+        huntstop_scodes : make([]int, 0),
+        proxied         : false,
+        sip_tm          : sip_tm,
+        acctA           : NewFakeAccounting(),
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if stateA == nil {
+        stateA, stateO = stateO, nil
+    }
+    uaA, err := sippy.RestoreUA(sip_tm, global_config, stateA, self, self.lock)
+    if err != nil {
+        return nil, err
+    }
+    self.uaA = uaA
+    self.cId = sippy_header.NewSipCallIdFromString(stateA.CallId)
+    self.uaA.SetLocalUA(sippy_header.NewSipUserAgent(self.global_config.GetMyUAName()))
+    self.uaA.SetDiscCb(self.aDisc)
+    self.uaA.SetDeadCb(self.aDead)
+    if self.global_config.header_rules != nil {
+        self.uaA.SetHeaderRules(self.global_config.header_rules, "A")
+    }
+    if global_dialog_store != nil {
+        uaA.SetDialogStore(global_dialog_store)
+    }
+    if stateO == nil {
+        self.uaA.Disconnect(nil)
+        return self, nil
+    }
+    uaO, err := sippy.RestoreUA(sip_tm, global_config, stateO, self, self.lock)
+    if err != nil {
+        self.uaA.Disconnect(nil)
+        return self, err
+    }
+    self.uaO = uaO
+    self.uaO.SetLocalUA(sippy_header.NewSipUserAgent(self.global_config.GetMyUAName()))
+    self.uaO.SetDeadCb(self.oDead)
+    if self.global_config.header_rules != nil {
+        self.uaO.SetHeaderRules(self.global_config.header_rules, "O")
+    }
+    if self.global_config.topology_hider != nil {
+        self.uaO.SetTopologyHider(self.global_config.topology_hider)
+    }
+    if global_dialog_store != nil {
+        uaO.SetDialogStore(global_dialog_store)
+    }
+    return self, nil
+}
+
 func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA) {
     if ua == self.uaA {
         if self.state == CCStateIdle {
@@ -116,26 +187,6 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 self.state = CCStateDead
                 return
             }
-/*
-            if body != nil && self.global_config.has_key('_allowed_pts') {
-                try:
-                    body.parse()
-                except:
-                    self.uaA.RecvEvent(CCEventFail((400, "Malformed SDP Body"), rtime = event.rtime))
-                    self.state = CCStateDead
-                    return
-                allowed_pts = self.global_config['_allowed_pts']
-                mbody = body.content.sections[0].m_header
-                if mbody.transport.lower() == "rtp/avp" {
-                    old_len = len(mbody.formats)
-                    mbody.formats = [x for x in mbody.formats if x in allowed_pts]
-                    if len(mbody.formats) == 0 {
-                        self.uaA.RecvEvent(CCEventFail((488, "Not Acceptable Here")))
-                        self.state = CCStateDead
-                        return
-                    if old_len > len(mbody.formats) {
-                        body.content.sections[0].optimize_a()
-*/
             if strings.HasPrefix(self.cld, "nat-") {
                 self.cld = self.cld[4:]
                 if ev_try.GetBody() != nil {
@@ -143,12 +194,8 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 }
                 event = sippy.NewCCEventTry(self.cId, self.cGUID, self.cli, self.cld, ev_try.GetBody(), ev_try.GetSipAuthorization(), self.caller_name, nil, "")
             }
-/*
-            if self.global_config.has_key('static_tr_in') {
-                self.cld = re_replace(self.global_config['static_tr_in'], self.cld)
-                event = sippy.NewCCEventTry(self.cId, self.cGUID, self.cli, self.cld, body, auth, self.caller_name)
-            }
-*/
+            self.cli, self.cld, self.caller_name = self.global_config.tr_in_sources.Lookup(self.source).Translate(self.cli, self.cld, self.caller_name)
+            self.cli, self.cld, self.caller_name = self.global_config.static_tr_in.Translate(self.cli, self.cld, self.caller_name)
             if len(global_rtp_proxy_clients) > 0 {
                 var err error
                 self.rtp_proxy_session, err = sippy.NewRtp_proxy_session(self.global_config, global_rtp_proxy_clients, self.cId.CallId, "", "", self.global_config.b2bua_socket, /*notify_tag*/ fmt.Sprintf("r%%20%d", self.id), self.lock, nil /* callee_origin */)
@@ -159,6 +206,8 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 }
                 self.rtp_proxy_session.SetCalleeRaddress(sippy_net.NewHostPort(self.remote_ip.String(), "5060"))
                 self.rtp_proxy_session.SetInsertNortpp(true)
+                self.rtp_proxy_session.SetSrtpModule(self.global_config.srtp_module)
+                self.rtp_proxy_session.SetCallerMediaSecurity(self.global_config.srtp_a)
             }
             self.eTry = ev_try
             self.state = CCStateWaitRoute
@@ -197,10 +246,10 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 }
             }
             if ! huntstop {
-                route := self.routes[0]
-                self.routes = self.routes[1:]
-                self.placeOriginate(route)
-                return
+                if route := self.nextRoute(); route != nil {
+                    self.placeOriginate(route)
+                    return
+                }
             }
         }
         self.uaA.RecvEvent(event)
@@ -277,19 +326,37 @@ func (self *callController) rDone(/*results*/) {
         self.state = CCStateDead
         return
     }
+    route := self.nextRoute()
+    if route == nil {
+        self.uaA.RecvEvent(sippy.NewCCEventFail(503, "Service Unavailable", nil, ""))
+        self.state = CCStateDead
+        return
+    }
     self.state = CCStateARComplete
-    route := self.routes[0]
-    self.routes = self.routes[1:]
     self.placeOriginate(route)
 }
 
+// nextRoute pops the routes until it finds one with a live next hop.
+func (self *callController) nextRoute() *B2BRoute {
+    for len(self.routes) > 0 {
+        route := self.routes[0]
+        self.routes = self.routes[1:]
+        if route.isAlive(self.source) {
+            return route
+        }
+    }
+    return nil
+}
+
 func (self *callController) placeOriginate(oroute *B2BRoute) {
     //cId, cGUID, cli, cld, body, auth, caller_name = self.eTry.getData()
-    cld := oroute.cld
     self.huntstop_scodes = oroute.huntstop_scodes
-    //if self.global_config.has_key('static_tr_out') {
-    //    cld = re_replace(self.global_config['static_tr_out'], cld)
-    //}
+    caller_name := oroute.caller_name
+    if caller_name == "" {
+        caller_name = self.caller_name
+    }
+    cli, cld, caller_name := oroute.translator.Translate(oroute.cli, oroute.cld, caller_name)
+    cli, cld, caller_name = self.global_config.static_tr_out.Translate(cli, cld, caller_name)
     var nh_address *sippy_net.HostPort
     if oroute.hostport == "sip-ua" {
         //host = self.source[0]
@@ -319,6 +386,17 @@ func (self *callController) placeOriginate(oroute *B2BRoute) {
     //self.uaO.SetConnCbs([]sippy_types.OnConnectListener{ self.oConn })
     self.uaO.SetExtraHeaders(oroute.extra_headers)
     self.uaO.SetDeadCb(self.oDead)
+    self.uaO.SetTrustDomain(self.global_config.trust_domain)
+    self.uaO.SetDiversionDialect(self.global_config.diversion_dialect)
+    if self.global_config.header_rules != nil {
+        self.uaO.SetHeaderRules(self.global_config.header_rules, "O")
+    }
+    if self.global_config.topology_hider != nil {
+        self.uaO.SetTopologyHider(self.global_config.topology_hider)
+    }
+    if global_dialog_store != nil {
+        self.uaO.(*sippy.Ua).SetDialogStore(global_dialog_store)
+    }
     self.uaO.SetLocalUA(sippy_header.NewSipUserAgent(self.global_config.GetMyUAName()))
     if oroute.outbound_proxy != nil && self.source.String() != oroute.outbound_proxy.String() {
         self.uaO.SetOutboundProxy(oroute.outbound_proxy)
@@ -328,11 +406,19 @@ func (self *callController) placeOriginate(oroute *B2BRoute) {
         self.uaO.SetOnLocalSdpChange(self.rtp_proxy_session.OnCallerSdpChange)
         self.uaO.SetOnRemoteSdpChange(self.rtp_proxy_session.OnCalleeSdpChange)
         self.rtp_proxy_session.SetCallerRaddress(nh_address)
+        if oroute.ms_set {
+            self.rtp_proxy_session.SetCalleeMediaSecurity(oroute.media_security)
+        } else {
+            self.rtp_proxy_session.SetCalleeMediaSecurity(self.global_config.srtp_o)
+        }
         if self.eTry.GetBody() != nil {
             body = self.eTry.GetBody().GetCopy()
         }
         self.proxied = true
     }
+    if self.global_config.codecs_o != nil {
+        sippy.NewSdpNegotiator(self.global_config.codecs_o).Attach(self.uaO)
+    }
     self.uaO.SetKaInterval(self.global_config.keepalive_orig)
     //if oroute.params.has_key('group_timeout') {
     //    timeout, skipto = oroute.params['group_timeout']
@@ -343,11 +429,7 @@ func (self *callController) placeOriginate(oroute *B2BRoute) {
     //} else {
         cId := sippy_header.NewSipCallIdFromString(self.eTry.GetSipCallId().CallId + fmt.Sprintf("-b2b_%d", oroute.rnum))
     //}
-    caller_name := oroute.caller_name
-    if caller_name == "" {
-        caller_name = self.caller_name
-    }
-    event := sippy.NewCCEventTry(cId, self.eTry.GetSipCiscoGUID(), oroute.cli, cld, body, self.eTry.GetSipAuthorization(), caller_name, nil, "")
+    event := sippy.NewCCEventTry(cId, self.eTry.GetSipCiscoGUID(), cli, cld, body, self.eTry.GetSipAuthorization(), caller_name, nil, "")
     //if self.eTry.max_forwards != nil {
     //    event.max_forwards = self.eTry.max_forwards - 1
     //    if event.max_forwards <= 0 {
@@ -357,6 +439,9 @@ func (self *callController) placeOriginate(oroute *B2BRoute) {
     //    }
     //}
     event.SetReason(self.eTry.GetReason())
+    event.SetPAI(self.eTry.GetPAI())
+    event.SetPrivacy(self.eTry.GetPrivacy())
+    event.SetDiversion(self.eTry.GetDiversion())
     self.uaO.RecvEvent(event)
 }
 
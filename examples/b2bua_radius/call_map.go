@@ -37,6 +37,7 @@ import (
     "syscall"
     "time"
 
+    "github.com/braams/sippy"
     "github.com/braams/sippy/headers"
     "github.com/braams/sippy/time"
     "github.com/braams/sippy/types"
@@ -75,6 +76,8 @@ func NewCallMap(global_config *myConfigParser) *callMap {
     go func() {
         sighup_ch := make(chan os.Signal, 1)
         signal.Notify(sighup_ch, syscall.SIGHUP)
+        sigusr1_ch := make(chan os.Signal, 1)
+        signal.Notify(sigusr1_ch, syscall.SIGUSR1)
         sigusr2_ch := make(chan os.Signal, 1)
         signal.Notify(sigusr2_ch, syscall.SIGUSR2)
         sigprof_ch := make(chan os.Signal, 1)
@@ -85,6 +88,8 @@ func NewCallMap(global_config *myConfigParser) *callMap {
             select {
             case <-sighup_ch:
                 self.discAll(syscall.SIGHUP)
+            case <-sigusr1_ch:
+                self.reloadHeaderRules()
             case <-sigusr2_ch:
                 self.toggleDebug()
             case <-sigprof_ch:
@@ -143,25 +148,11 @@ func (self *callMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.S
         if ! self.global_config.checkIP(source.Host.String())  {
             return nil, nil, req.GenResponse(403, "Forbidden", nil, nil)
         }
-/*
-        var challenge *sippy_header.SipWWWAuthenticate
-        if self.global_config.auth_enable {
-            // Prepare challenge if no authorization header is present.
-            // Depending on configuration, we might try remote ip auth
-            // first and then challenge it or challenge immediately.
-            if self.global_config["digest_auth"] && req.countHFs("authorization") == 0 {
-                challenge = NewSipWWWAuthenticate()
-                challenge.getBody().realm = req.getRURI().host
-            }
-            // Send challenge immediately if digest is the
-            // only method of authenticating
-            if challenge != nil && self.global_config.getdefault("digest_auth_only", false) {
-                resp = req.GenResponse(401, "Unauthorized")
-                resp.appendHeader(challenge)
-                return resp, nil, nil
+        if self.global_config.digest_auth != nil {
+            if _, resp := self.global_config.digest_auth.Authenticate(req); resp != nil {
+                return nil, nil, resp
             }
         }
-*/
         pass_headers := []sippy_header.SipHeader{}
         for _, header := range self.global_config.pass_headers {
             hfs := req.GetHFs(header)
@@ -179,6 +170,24 @@ func (self *callMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.S
         self.ccmap_lock.Unlock()
         return cc.uaA, cc.uaA, nil
     }
+    if req.GetMethod() == "MESSAGE" && global_static_route != nil {
+        source := req.GetSource()
+        if ! self.global_config.checkIP(source.Host.String())  {
+            return nil, nil, req.GenResponse(403, "Forbidden", nil, nil)
+        }
+        if ! global_static_route.isAlive(source) {
+            return nil, nil, req.GenResponse(503, "Service Unavailable", nil, nil)
+        }
+        nh_address, _ := global_static_route.getNHAddr(source)
+        cld := req.GetRURI().Username
+        if global_static_route.cld_set {
+            cld = global_static_route.cld
+        }
+        ruri := sippy_header.NewSipURL(cld, nh_address.Host, nh_address.Port, false)
+        relay := sippy.NewMessageRelay(self.sip_tm, self.global_config, nh_address, ruri)
+        relay.SetPassHeaders(self.global_config.pass_headers)
+        return nil, relay, nil
+    }
     if self.proxy != nil && (req.GetMethod() == "REGISTER" || req.GetMethod() == "SUBSCRIBE") {
         return nil, self.proxy, nil
     }
@@ -213,6 +222,16 @@ func (self *callMap) toggleDebug() {
     self.debug_mode = ! self.debug_mode
 }
 
+func (self *callMap) reloadHeaderRules() {
+    if self.global_config.header_rules == nil {
+        return
+    }
+    println("Signal received, reloading header rules")
+    if err := self.global_config.header_rules.Reload(); err != nil {
+        self.global_config.ErrorLogger().Error("CallMap::reloadHeaderRules: #1: " + err.Error())
+    }
+}
+
 func (self *callMap) safeRestart() {
     println("Signal received, scheduling safe restart")
     self.safe_restart = true
@@ -361,6 +380,51 @@ func (self *callMap) recvCommand(data string) string {
     }
 }
 
+// restoreCalls takes over the calls saved before the restart or the ones
+// of the failed active B2BUA. The
+// originate legs are paired with the answer legs by the "-b2b_N" Call-ID
+// suffix.
+func (self *callMap) restoreCalls(states []*sippy.DialogState) {
+    legsA := make(map[string]*sippy.DialogState)
+    legsO := make(map[string]*sippy.DialogState)
+    for _, state := range states {
+        if idx := strings.LastIndex(state.CallId, "-b2b_"); idx > 0 {
+            legsO[state.CallId[:idx]] = state
+        } else {
+            legsA[state.CallId] = state
+        }
+    }
+    for call_id := range legsO {
+        if _, ok := legsA[call_id]; ! ok {
+            legsA[call_id] = nil
+        }
+    }
+    for call_id, stateA := range legsA {
+        self.cc_id_lock.Lock()
+        id := self.cc_id
+        self.cc_id++
+        self.cc_id_lock.Unlock()
+        cc, err := restoreCallController(id, self.global_config, self.sip_tm, stateA, legsO[call_id])
+        if err != nil {
+            self.global_config.ErrorLogger().Error("CallMap::restoreCalls: #1: " + err.Error())
+            // do not try to restore the broken dialogs again
+            if global_dialog_store != nil {
+                for _, state := range []*sippy.DialogState{ stateA, legsO[call_id] } {
+                    if state != nil {
+                        global_dialog_store.Delete(state.Key())
+                    }
+                }
+            }
+        }
+        if cc == nil {
+            continue
+        }
+        self.ccmap_lock.Lock()
+        self.ccmap[id] = cc
+        self.ccmap_lock.Unlock()
+    }
+}
+
 func (self *callMap) DropCC(cc_id int64) {
     self.ccmap_lock.Lock()
     delete(self.ccmap, cc_id)
@@ -27,6 +27,7 @@
 package main
 
 import (
+    "os/exec"
     "strings"
 
     "github.com/braams/sippy"
@@ -37,6 +38,8 @@ import (
 var global_static_route *B2BRoute
 var global_rtp_proxy_clients []sippy_types.RtpProxyClient
 var global_cmap *callMap
+var global_health_monitor *sippy.HealthMonitor
+var global_dialog_store sippy.DialogStore
 /*
 from sippy.Timeout import Timeout
 from sippy.Signal import Signal
@@ -192,5 +195,51 @@ func main() {
         file(global_config['pidfile'], 'w').write(str(os.getpid()) + '\n')
         Signal(SIGUSR1, reopen, SIGUSR1, global_config['logfile'])
 */
+    if global_config.health_check_ival > 0 && global_static_route != nil {
+        global_health_monitor = sippy.NewHealthMonitor(sip_tm, global_config)
+        global_health_monitor.SetInterval(global_config.health_check_ival)
+        for _, ainfo := range global_static_route.ainfo {
+            global_health_monitor.AddDestination(ainfo.HostPort(), nil)
+        }
+    }
+    var file_store sippy.DialogStore
+    if global_config.dialog_dir != "" {
+        file_store, err = sippy.NewFileDialogStore(global_config.dialog_dir)
+        if err != nil {
+            println("Cannot initialize the dialog store: " + err.Error())
+            return
+        }
+        global_dialog_store = file_store
+    }
+    if global_config.repl_peer != "" {
+        arr := strings.SplitN(global_config.repl_peer, ":", 2)
+        replicator := sippy.NewDialogReplicator(global_config, arr[0], arr[1], file_store)
+        replicator.Start()
+        global_dialog_store = replicator
+    }
+    if file_store != nil {
+        states, err := file_store.Load()
+        if err != nil {
+            println("Cannot load the dialogs: " + err.Error())
+            return
+        }
+        global_cmap.restoreCalls(states)
+    }
+    if global_config.repl_listen != "" {
+        arr := strings.SplitN(global_config.repl_listen, ":", 2)
+        standby := sippy.NewDialogStandby(global_config, arr[0], arr[1])
+        standby.SetTakeoverCb(global_cmap.restoreCalls)
+        standby.SetDeadInterval(global_config.repl_dead_ival)
+        if global_config.repl_acquire_cmd != "" {
+            standby.SetAcquireAddressCb(func() error {
+                return exec.Command("/bin/sh", "-c", global_config.repl_acquire_cmd).Run()
+            })
+        }
+        err = standby.Start()
+        if err != nil {
+            println("Cannot start the standby listener: " + err.Error())
+            return
+        }
+    }
     sip_tm.Run()
 }
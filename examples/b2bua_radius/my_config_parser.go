@@ -29,10 +29,12 @@ package main
 import (
     "errors"
     "flag"
+    "io/ioutil"
     "strconv"
     "strings"
     "time"
 
+    "github.com/braams/sippy"
     "github.com/braams/sippy/conf"
     "github.com/braams/sippy/log"
     "github.com/braams/sippy/net"
@@ -51,6 +53,51 @@ type myConfigParser struct {
     b2bua_socket        string
     hrtb_retr_ival      time.Duration
     hrtb_ival           time.Duration
+    health_check_ival   time.Duration
+    repl_peer           string
+    repl_listen         string
+    repl_dead_ival      time.Duration
+    repl_acquire_cmd    string
+    dialog_dir          string
+    trust_domain        *sippy_net.TrustDomain
+    pai_as_cli          bool
+    diversion_dialect   string
+    digest_auth         *sippy.DigestAuthenticator
+    header_rules        *sippy.HeaderRuleSet
+    topology_hider      *sippy.TopologyHider
+    numbering_plan      *sippy.NumberingPlan
+    static_tr_in        *sippy.NumberTranslator
+    static_tr_out       *sippy.NumberTranslator
+    tr_in_sources       *sippy.NumberTranslationTable
+    codecs_a            *sippy.CodecPolicy
+    codecs_o            *sippy.CodecPolicy
+    srtp_a              string
+    srtp_o              string
+    srtp_module         string
+}
+
+func parseMediaSecurity(s string) (string, error) {
+    switch strings.ToLower(s) {
+    case "", "pass":
+        return sippy.MEDIA_SECURITY_PASS, nil
+    case "rtp":
+        return sippy.MEDIA_SECURITY_RTP, nil
+    case "srtp":
+        return sippy.MEDIA_SECURITY_SRTP, nil
+    }
+    return "", errors.New("should be either \"srtp\", \"rtp\" or \"pass\"")
+}
+
+// stringList is the flag that can be given several times.
+type stringList []string
+
+func (self *stringList) String() string {
+    return strings.Join(*self, " ")
+}
+
+func (self *stringList) Set(v string) error {
+    *self = append(*self, v)
+    return nil
 }
 
 func NewMyConfigParser() *myConfigParser {
@@ -145,6 +192,20 @@ func (self *myConfigParser) Parse() error {
             global_config.check_and_set('static_tr_out', a)
             continue
 */
+    var static_tr_in, static_tr_out, static_tr_in_short, static_tr_out_short string
+    flag.StringVar(&static_tr_in_short, "t", "", "static_tr_in")
+    flag.StringVar(&static_tr_in, "static_tr_in", "", "translation rules to apply to all incoming (ingress) " +
+                                "calls, i.e. \"cld:s/^00/+/;cli:s/^0/+44/;cld:e164\"")
+    flag.StringVar(&static_tr_out_short, "T", "", "static_tr_out")
+    flag.StringVar(&static_tr_out, "static_tr_out", "", "translation rules to apply to all outgoing (egress) " +
+                                "calls, the per route rules are given in the \"tr\" route parameter")
+    var tr_in_sources stringList
+    flag.Var(&tr_in_sources, "tr_in_source", "translation rules to apply to the incoming calls from the " +
+                                "given sources in the format \"addr[,addr...]=rules\", can be given several times")
+    numbering_plan := &sippy.NumberingPlan{}
+    flag.StringVar(&numbering_plan.CountryCode, "country_code", "", "country code to normalize the numbers to E.164")
+    flag.StringVar(&numbering_plan.InternationalPrefix, "intl_prefix", "00", "international call prefix")
+    flag.StringVar(&numbering_plan.NationalPrefix, "national_prefix", "0", "national (trunk) call prefix")
     var ka_level, keepalive_ans, keepalive_orig int
     flag.IntVar(&ka_level, "k", 0, "keepalive level")
     flag.IntVar(&keepalive_ans, "keepalive_ans", 0, "send periodic \"keep-alive\" re-INVITE requests on " +
@@ -203,6 +264,52 @@ func (self *myConfigParser) Parse() error {
     flag.StringVar(&rtp_proxy_client, "rtp_proxy_client", "", "RTPproxy control socket. Address in the format \"udp:host[:port]\"")
     flag.StringVar(&self.sip_proxy, "sip_proxy", "", "address of the helper proxy to handle \"REGISTER\" " +
                                  "and \"SUBSCRIBE\" messages. Address in the format \"host[:port]\"")
+    var health_check_ival int
+    flag.IntVar(&health_check_ival, "health_check_ival", 0, "send \"OPTIONS\" requests to the route destinations " +
+                                "with the given period and skip the destinations that " +
+                                "do not respond (seconds, 0 to disable)")
+    flag.StringVar(&self.repl_peer, "repl_peer", "", "address of the standby B2BUA to mirror the dialogs to " +
+                                "in the format \"tcp:host:port\" or \"unix:path\"")
+    flag.StringVar(&self.repl_listen, "repl_listen", "", "run as the standby B2BUA receiving the dialogs at the " +
+                                "given address in the format \"tcp:host:port\" or \"unix:path\"")
+    var repl_dead_ival int
+    flag.IntVar(&repl_dead_ival, "repl_dead_ival", 3, "take over the calls when the active B2BUA has not been " +
+                                "heard of for the given period (seconds)")
+    flag.StringVar(&self.repl_acquire_cmd, "repl_acquire_cmd", "", "shell command that brings up the shared " +
+                                "address before the takeover, the takeover is postponed if it fails")
+    flag.StringVar(&self.dialog_dir, "dialog_dir", "", "directory to keep the established dialogs in, " +
+                                "the calls found there are restored on startup")
+    var trust_domain string
+    flag.StringVar(&trust_domain, "trust_domain", "", "comma-separated list of IP addresses, networks or host names " +
+                                "allowed to send and receive \"P-Asserted-Identity\"")
+    flag.BoolVar(&self.pai_as_cli, "pai_as_cli", false, "take the calling number from the trusted " +
+                                "\"P-Asserted-Identity\" instead of \"From\"")
+    flag.StringVar(&self.diversion_dialect, "diversion_dialect", "", "send the redirection history to the " +
+                                "called party as \"diversion\" or \"history-info\" headers")
+    var digest_users string
+    flag.StringVar(&digest_users, "digest_users", "", "file with the \"username:password\" lines to enable " +
+                                "SIP Digest authentication of incoming INVITE requests")
+    var topology_hiding string
+    flag.StringVar(&topology_hiding, "topology_hiding", "", "comma-separated list of the internal IP addresses, " +
+                                "networks or host names to keep out of the messages sent to the called party")
+    var header_rules string
+    flag.StringVar(&header_rules, "header_rules", "", "JSON file with the header manipulation rules, " +
+                                "re-read on SIGUSR1")
+    var allowed_pts string
+    flag.StringVar(&allowed_pts, "allowed_pts", "", "comma-separated list of the payload types or codec names " +
+                                "accepted from the calling party, the call is rejected with 488 if none is offered")
+    var codecs_a string
+    flag.StringVar(&codecs_a, "codecs_a", "", "codec policy of the calling party leg in the " +
+                                "\"allow=PCMU,PCMA;deny=G729;prefer=PCMA\" form")
+    var codecs_o string
+    flag.StringVar(&codecs_o, "codecs_o", "", "codec policy of the called party leg in the " +
+                                "\"allow=PCMU,PCMA;deny=G729;prefer=PCMA\" form")
+    flag.StringVar(&self.srtp_a, "srtp_a", "", "media security of the calling party leg: \"srtp\", \"rtp\" " +
+                                "or \"pass\" to relay it as is")
+    flag.StringVar(&self.srtp_o, "srtp_o", "", "media security of the called party leg: \"srtp\", \"rtp\" " +
+                                "or \"pass\" to relay it as is, can be overridden by the \"srtp\" route parameter")
+    flag.StringVar(&self.srtp_module, "srtp_module", "", "reference of the RTPproxy module that does the " +
+                                "SRTP encryption and decryption, i.e. \"M5:1\"")
     var sip_port int
     flag.IntVar(&sip_port, "p", 5060, "sip_port")
     flag.IntVar(&sip_port, "sip_port", 5060, "local UDP port to listen for incoming SIP requests")
@@ -211,6 +318,16 @@ func (self *myConfigParser) Parse() error {
     if sip_port <= 0 || sip_port > 65535 {
         return errors.New("sip_port should be in the range 1-65535")
     }
+    switch self.diversion_dialect {
+    case sippy.DIVERSION_DIALECT_NONE, sippy.DIVERSION_DIALECT_DIVERSION, sippy.DIVERSION_DIALECT_HISTORY_INFO:
+    default:
+        return errors.New("diversion_dialect should be either \"diversion\" or \"history-info\"")
+    }
+    for _, addr := range []string{ self.repl_peer, self.repl_listen } {
+        if addr != "" && ! strings.HasPrefix(addr, "tcp:") && ! strings.HasPrefix(addr, "unix:") {
+            return errors.New("replication address should start with \"tcp:\" or \"unix:\"")
+        }
+    }
 
     rtp_proxy_clients += "," + rtp_proxy_client
     arr := strings.Split(rtp_proxy_clients, ",")
@@ -254,6 +371,13 @@ func (self *myConfigParser) Parse() error {
     if keepalive_orig > 0 {
         self.keepalive_orig = time.Duration(keepalive_orig) * time.Second
     }
+    if trust_domain != "" {
+        var err error
+        self.trust_domain, err = sippy_net.NewTrustDomain(strings.Split(trust_domain, ",")...)
+        if err != nil {
+            return err
+        }
+    }
     error_logger := sippy_log.NewErrorLogger()
     sip_logger, err := sippy_log.NewSipLogger("b2bua", logfile)
     if err != nil {
@@ -261,8 +385,108 @@ func (self *myConfigParser) Parse() error {
     }
     self.hrtb_ival = time.Duration(hrtb_ival) * time.Second
     self.hrtb_retr_ival = time.Duration(hrtb_retr_ival) * time.Second
+    self.health_check_ival = time.Duration(health_check_ival) * time.Second
+    if repl_dead_ival <= 0 {
+        return errors.New("repl_dead_ival should be positive")
+    }
+    self.repl_dead_ival = time.Duration(repl_dead_ival) * time.Second
     self.Config = sippy_conf.NewConfig(error_logger, sip_logger)
     self.SetMyPort(sippy_net.NewMyPort(strconv.Itoa(sip_port)))
+    if numbering_plan.CountryCode != "" {
+        self.numbering_plan = numbering_plan
+    }
+    if static_tr_in_short != "" {
+        if static_tr_in != "" {
+            return errors.New("-t and -static_tr_in cannot be given together")
+        }
+        static_tr_in = static_tr_in_short
+    }
+    if static_tr_out_short != "" {
+        if static_tr_out != "" {
+            return errors.New("-T and -static_tr_out cannot be given together")
+        }
+        static_tr_out = static_tr_out_short
+    }
+    if static_tr_in != "" {
+        if self.static_tr_in, err = sippy.ParseNumberTranslator(static_tr_in, self.numbering_plan); err != nil {
+            return errors.New("static_tr_in: " + err.Error())
+        }
+    }
+    if static_tr_out != "" {
+        if self.static_tr_out, err = sippy.ParseNumberTranslator(static_tr_out, self.numbering_plan); err != nil {
+            return errors.New("static_tr_out: " + err.Error())
+        }
+    }
+    if len(tr_in_sources) > 0 {
+        self.tr_in_sources = sippy.NewNumberTranslationTable()
+        for _, entry := range tr_in_sources {
+            arr := strings.SplitN(entry, "=", 2)
+            if len(arr) != 2 {
+                return errors.New("tr_in_source should be in the format \"addr[,addr...]=rules\"")
+            }
+            sources, err := sippy_net.NewTrustDomain(strings.Split(arr[0], ",")...)
+            if err != nil {
+                return errors.New("tr_in_source: " + err.Error())
+            }
+            translator, err := sippy.ParseNumberTranslator(arr[1], self.numbering_plan)
+            if err != nil {
+                return errors.New("tr_in_source: " + err.Error())
+            }
+            self.tr_in_sources.Add(sources, translator)
+        }
+    }
+    if topology_hiding != "" {
+        internal, err := sippy_net.NewTrustDomain(strings.Split(topology_hiding, ",")...)
+        if err != nil {
+            return err
+        }
+        self.topology_hider = sippy.NewTopologyHider(internal, self.Config)
+    }
+    if codecs_a != "" || allowed_pts != "" {
+        self.codecs_a, err = sippy.ParseCodecPolicy(codecs_a + ";allow=" + allowed_pts)
+        if err != nil {
+            return errors.New("codecs_a: " + err.Error())
+        }
+    }
+    if codecs_o != "" {
+        self.codecs_o, err = sippy.ParseCodecPolicy(codecs_o)
+        if err != nil {
+            return errors.New("codecs_o: " + err.Error())
+        }
+    }
+    if self.srtp_a, err = parseMediaSecurity(self.srtp_a); err != nil {
+        return errors.New("srtp_a: " + err.Error())
+    }
+    if self.srtp_o, err = parseMediaSecurity(self.srtp_o); err != nil {
+        return errors.New("srtp_o: " + err.Error())
+    }
+    if (self.srtp_a != sippy.MEDIA_SECURITY_PASS || self.srtp_o != sippy.MEDIA_SECURITY_PASS) && self.srtp_module == "" {
+        return errors.New("srtp_module is required to terminate SRTP")
+    }
+    if header_rules != "" {
+        self.header_rules, err = sippy.LoadHeaderRuleSet(header_rules, self.Config)
+        if err != nil {
+            return err
+        }
+    }
+    if digest_users != "" {
+        data, err := ioutil.ReadFile(digest_users)
+        if err != nil {
+            return err
+        }
+        passwords := make(map[string]string)
+        for _, line := range strings.Split(string(data), "\n") {
+            arr := strings.SplitN(strings.TrimSpace(line), ":", 2)
+            if len(arr) == 2 && arr[0] != "" {
+                passwords[arr[0]] = arr[1]
+            }
+        }
+        self.digest_auth = sippy.NewDigestAuthenticator(self.Config, self.GetMyAddress().String(),
+            sippy.DigestPasswordCredentials(func(username string) (string, bool) {
+                password, ok := passwords[username]
+                return password, ok
+            }))
+    }
     return nil
 }
 /*
@@ -0,0 +1,110 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/time"
+)
+
+func Test_ReInviteGlare(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    sdp := []string{
+        "v=0",
+        "o=user1 53655765 2353687637 IN IP4 1.1.1.1",
+        "s=-",
+        "c=IN IP4 1.1.1.1",
+        "t=0 0",
+        "m=audio 11111 RTP/AVP 0",
+        "a=rtpmap:0 PCMU/8000",
+        "",
+    }
+    tfactory.feed(append([]string{
+        "INVITE sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKglare1",
+        "Max-Forwards: 70",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>",
+        "Contact: <sip:100@1.1.1.1:5060>",
+        "Call-ID: glare-test@1.1.1.1",
+        "CSeq: 1 INVITE",
+        "Content-Type: application/sdp",
+        "Content-Length: 126",
+        "",
+    }, sdp...))
+    tfactory.get() // 100 Trying
+    cmap.lock.Lock()
+    cmap.answer()
+    cmap.lock.Unlock()
+    resp := string(tfactory.get()) // 200 OK
+    totag := resp[strings.Index(resp, "To: "):]
+    totag = totag[:strings.Index(totag, "\r\n")]
+    tfactory.feed([]string{
+        "ACK sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKglare2",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        totag,
+        "Call-ID: glare-test@1.1.1.1",
+        "CSeq: 1 ACK",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+
+    rtime, _ := sippy_time.NewMonoTime()
+    hold := strings.Replace(strings.Join(sdp, "\r\n"), "1.1.1.1", "0.0.0.0", -1)
+    cmap.lock.Lock()
+    cmap.ua.RecvEvent(NewCCEventUpdate(rtime, "", nil, nil, NewMsgBody(hold, "application/sdp")))
+    cmap.lock.Unlock()
+    reinvite, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse re-INVITE: " + err.Error())
+    }
+    tfactory.feed([]string{ reinvite.GenResponse(491, "Request Pending", nil, nil).LocalStr(nil, false) })
+    ack, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse ACK: " + err.Error())
+    }
+    assertStringEqual(ack.GetMethod(), "ACK", t)
+    retry, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse re-INVITE: " + err.Error())
+    }
+    assertStringEqual(retry.GetMethod(), "INVITE", t)
+    cseq1, _ := reinvite.GetCSeq().GetBody()
+    cseq2, _ := retry.GetCSeq().GetBody()
+    if cseq2.CSeq <= cseq1.CSeq {
+        t.Fatal("The retried re-INVITE must use a new CSeq")
+    }
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "regexp"
+    "strings"
+    "sync"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+)
+
+// HeaderRule describes a change of the outgoing messages. The actions are
+// applied when all the non-empty criteria match.
+type HeaderRule struct {
+    Name        string
+    Message     string          // "request", "response" or empty for both
+    Methods     []string        // request method or the CSeq method of the response
+    Codes       []string        // response codes like "183", "18x" or "4xx"
+    Leg         string          // "A", "O" or empty for both
+    Peer        string          // regexp for the host:port of the peer
+    Actions     []*HeaderAction
+    peer_re     *regexp.Regexp
+}
+
+// HeaderAction is one of "add", "remove", "rename" or "rewrite" applied
+// either to the Header or to the RURI part ("user", "host", "port" or
+// "uri"). The Match regexp selects the values to act upon, its capture
+// groups can be referred in the Value as $1, $2 etc. when rewriting.
+type HeaderAction struct {
+    Op          string
+    Header      string
+    RURI        string
+    Match       string
+    Value       string
+    To          string
+    match_re    *regexp.Regexp
+}
+
+// The headers maintained by the stack itself.
+var header_rules_protected = map[string]bool{
+    "via"               : true,
+    "route"             : true,
+    "cseq"              : true,
+    "call-id"           : true,
+    "content-length"    : true,
+    "content-type"      : true,
+}
+
+// The headers that cannot be added or taken away from the message.
+var header_rules_mandatory = map[string]bool{
+    "from"  : true,
+    "to"    : true,
+}
+
+func (self *HeaderRule) compile() error {
+    var err error
+
+    switch self.Message {
+    case "", "request", "response":
+    default:
+        return errors.New("unknown message type '" + self.Message + "'")
+    }
+    switch self.Leg {
+    case "", "A", "O":
+    default:
+        return errors.New("unknown leg '" + self.Leg + "'")
+    }
+    for _, code := range self.Codes {
+        if len(code) != 3 || strings.Trim(strings.ToLower(code), "0123456789x") != "" {
+            return errors.New("bad response code '" + code + "'")
+        }
+    }
+    if self.Peer != "" {
+        if self.peer_re, err = regexp.Compile(self.Peer); err != nil {
+            return err
+        }
+    }
+    for i, action := range self.Actions {
+        if err = action.compile(); err != nil {
+            return fmt.Errorf("action #%d: %s", i + 1, err.Error())
+        }
+    }
+    return nil
+}
+
+func (self *HeaderAction) compile() error {
+    var err error
+
+    if self.Match != "" {
+        if self.match_re, err = regexp.Compile(self.Match); err != nil {
+            return err
+        }
+    }
+    if self.RURI != "" {
+        if self.Op != "rewrite" {
+            return errors.New("only rewrite is supported for the Request-URI")
+        }
+        switch self.RURI {
+        case "user", "host", "port", "uri":
+        default:
+            return errors.New("unknown Request-URI part '" + self.RURI + "'")
+        }
+        return nil
+    }
+    name := canonicalHFName(strings.ToLower(self.Header))
+    if name == "" {
+        return errors.New("header is not specified")
+    }
+    if header_rules_protected[name] {
+        return errors.New("header " + self.Header + " cannot be changed")
+    }
+    switch self.Op {
+    case "add", "remove":
+    case "rename":
+        to := canonicalHFName(strings.ToLower(self.To))
+        if to == "" {
+            return errors.New("new header name is not specified")
+        }
+        if header_rules_protected[to] || header_rules_mandatory[to] {
+            return errors.New("header " + self.Header + " cannot be renamed to " + self.To)
+        }
+    case "rewrite":
+        if self.match_re == nil {
+            return errors.New("rewrite requires the match")
+        }
+        return nil
+    default:
+        return errors.New("unknown operation '" + self.Op + "'")
+    }
+    if header_rules_mandatory[name] {
+        return errors.New("header " + self.Header + " cannot be changed")
+    }
+    return nil
+}
+
+func (self *HeaderRule) matches(method string, code int, leg string, peer *sippy_net.HostPort) bool {
+    if self.Message == "request" && code != 0 || self.Message == "response" && code == 0 {
+        return false
+    }
+    if self.Leg != "" && self.Leg != leg {
+        return false
+    }
+    if len(self.Methods) > 0 {
+        found := false
+        for _, m := range self.Methods {
+            if strings.ToUpper(m) == method {
+                found = true
+                break
+            }
+        }
+        if ! found {
+            return false
+        }
+    }
+    if len(self.Codes) > 0 {
+        if code == 0 {
+            return false
+        }
+        scode := fmt.Sprintf("%03d", code)
+        found := false
+        for _, c := range self.Codes {
+            found = true
+            for i := 0; i < 3; i++ {
+                if c[i] != 'x' && c[i] != 'X' && c[i] != scode[i] {
+                    found = false
+                    break
+                }
+            }
+            if found {
+                break
+            }
+        }
+        if ! found {
+            return false
+        }
+    }
+    if self.peer_re != nil && (peer == nil || ! self.peer_re.MatchString(peer.String())) {
+        return false
+    }
+    return true
+}
+
+func (self *HeaderAction) applyToHeaders(msg sippy_types.SipMsg, config sippy_conf.Config) error {
+    switch self.Op {
+    case "add":
+        hfs, err := ParseSipHeader(self.Header + ": " + self.Value, config)
+        if err != nil {
+            return err
+        }
+        for _, hf := range hfs {
+            msg.AppendHeader(hf)
+        }
+        return nil
+    }
+    for _, hf := range msg.GetHFs(self.Header) {
+        body := hf.StringBody()
+        if self.match_re != nil && ! self.match_re.MatchString(body) {
+            continue
+        }
+        switch self.Op {
+        case "remove":
+            msg.RemoveHeader(hf)
+        case "rename":
+            hfs, err := ParseSipHeader(self.To + ": " + body, config)
+            if err != nil {
+                return err
+            }
+            msg.ReplaceHeader(hf, hfs...)
+        case "rewrite":
+            hfs, err := ParseSipHeader(hf.Name() + ": " + self.match_re.ReplaceAllString(body, self.Value), config)
+            if err != nil {
+                return err
+            }
+            msg.ReplaceHeader(hf, hfs...)
+        }
+    }
+    return nil
+}
+
+// applyToRURI rewrites the Request-URI. The request without the Route set
+// that has been going to the Request-URI host follows the new one.
+func (self *HeaderAction) applyToRURI(req sippy_types.SipRequest, config sippy_conf.Config) error {
+    old_addr := req.GetRURI().GetAddr(config)
+    ruri := req.GetRURI().GetCopy()
+    var value string
+    switch self.RURI {
+    case "user":
+        value = ruri.Username
+    case "host":
+        value = ruri.Host.String()
+    case "port":
+        if ruri.Port != nil {
+            value = ruri.Port.String()
+        }
+    case "uri":
+        value = ruri.String()
+    }
+    if self.match_re != nil {
+        if ! self.match_re.MatchString(value) {
+            return nil
+        }
+        value = self.match_re.ReplaceAllString(value, self.Value)
+    } else {
+        value = self.Value
+    }
+    switch self.RURI {
+    case "user":
+        ruri.Username = value
+    case "host":
+        if value == "" {
+            return errors.New("empty Request-URI host")
+        }
+        ruri.Host = sippy_net.NewMyAddress(value)
+    case "port":
+        if value == "" {
+            ruri.Port = nil
+        } else {
+            ruri.Port = sippy_net.NewMyPort(value)
+        }
+    case "uri":
+        var err error
+        if ruri, err = sippy_header.ParseSipURL(value, false, config); err != nil {
+            return err
+        }
+    }
+    req.SetRURI(ruri)
+    if self.RURI != "user" && len(req.GetHFs("route")) == 0 && req.GetTarget() != nil && req.GetTarget().String() == old_addr.String() {
+        req.SetTarget(ruri.GetAddr(config))
+    }
+    return nil
+}
+
+// HeaderRuleSet applies the header rules to the outgoing messages. It
+// can be installed on the Ua with the leg or on the transaction manager.
+// The rules without the leg criterion apply in both places, so the same
+// rule set should not be installed in both of them.
+type HeaderRuleSet struct {
+    lock    sync.RWMutex
+    rules   []*HeaderRule
+    fname   string
+    config  sippy_conf.Config
+}
+
+func NewHeaderRuleSet(rules []*HeaderRule, config sippy_conf.Config) (*HeaderRuleSet, error) {
+    self := &HeaderRuleSet{
+        config  : config,
+    }
+    if err := self.SetRules(rules); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+// LoadHeaderRuleSet reads the rules from the JSON file with the list of
+// the HeaderRule objects.
+func LoadHeaderRuleSet(fname string, config sippy_conf.Config) (*HeaderRuleSet, error) {
+    self := &HeaderRuleSet{
+        fname   : fname,
+        config  : config,
+    }
+    if err := self.Reload(); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+// Reload reads the file again. The rules in effect are kept if the file
+// cannot be loaded.
+func (self *HeaderRuleSet) Reload() error {
+    if self.fname == "" {
+        return errors.New("the rules have not been loaded from a file")
+    }
+    data, err := ioutil.ReadFile(self.fname)
+    if err != nil {
+        return err
+    }
+    var rules []*HeaderRule
+    if err = json.Unmarshal(data, &rules); err != nil {
+        return errors.New(self.fname + ": " + err.Error())
+    }
+    if err = self.SetRules(rules); err != nil {
+        return errors.New(self.fname + ": " + err.Error())
+    }
+    return nil
+}
+
+func (self *HeaderRuleSet) SetRules(rules []*HeaderRule) error {
+    for i, rule := range rules {
+        if err := rule.compile(); err != nil {
+            return fmt.Errorf("rule #%d (%s): %s", i + 1, rule.Name, err.Error())
+        }
+    }
+    self.lock.Lock()
+    self.rules = rules
+    self.lock.Unlock()
+    return nil
+}
+
+func (self *HeaderRuleSet) getRules() []*HeaderRule {
+    self.lock.RLock()
+    defer self.lock.RUnlock()
+    return self.rules
+}
+
+func (self *HeaderRuleSet) ApplyToRequest(req sippy_types.SipRequest, leg string) {
+    method := req.GetMethod()
+    for _, rule := range self.getRules() {
+        if ! rule.matches(method, 0, leg, req.GetTarget()) {
+            continue
+        }
+        for _, action := range rule.Actions {
+            var err error
+            if action.RURI != "" {
+                err = action.applyToRURI(req, self.config)
+            } else {
+                err = action.applyToHeaders(req, self.config)
+            }
+            if err != nil {
+                self.config.ErrorLogger().Error("HeaderRuleSet::ApplyToRequest: #1: " + rule.Name + ": " + err.Error())
+            }
+        }
+    }
+}
+
+func (self *HeaderRuleSet) ApplyToResponse(resp sippy_types.SipResponse, leg string) {
+    var peer *sippy_net.HostPort
+    method := ""
+    if cseq, err := resp.GetCSeq().GetBody(); err == nil {
+        method = cseq.Method
+    }
+    if vias := resp.GetVias(); len(vias) > 0 {
+        if via0, err := vias[0].GetBody(); err == nil {
+            peer = via0.GetTAddr(self.config)
+        }
+    }
+    for _, rule := range self.getRules() {
+        if ! rule.matches(method, resp.GetSCodeNum(), leg, peer) {
+            continue
+        }
+        for _, action := range rule.Actions {
+            if action.RURI != "" {
+                continue
+            }
+            if err := action.applyToHeaders(resp, self.config); err != nil {
+                self.config.ErrorLogger().Error("HeaderRuleSet::ApplyToResponse: #1: " + rule.Name + ": " + err.Error())
+            }
+        }
+    }
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+const test_header_rules = `[
+    {
+        "Name"      : "carrier",
+        "Message"   : "request",
+        "Methods"   : [ "INVITE" ],
+        "Leg"       : "O",
+        "Peer"      : "^2\\.2\\.2\\.2:",
+        "Actions"   : [
+            { "Op" : "rewrite", "RURI" : "user", "Match" : "^00(\\d+)$", "Value" : "+$1" },
+            { "Op" : "rewrite", "Header" : "From", "Match" : "@[^;>]+", "Value" : "@carrier.example.com" },
+            { "Op" : "remove", "Header" : "X-Internal" },
+            { "Op" : "rename", "Header" : "X-Acct", "To" : "X-Account" },
+            { "Op" : "add", "Header" : "X-Carrier", "Value" : "yes" }
+        ]
+    },
+    {
+        "Name"      : "ringing",
+        "Codes"     : [ "18x" ],
+        "Actions"   : [
+            { "Op" : "remove", "Header" : "Server" }
+        ]
+    }
+]`
+
+func Test_HeaderRules(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+
+    dir, err := ioutil.TempDir("", "sippy_rules")
+    if err != nil {
+        t.Fatal(err.Error())
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "rules.json")
+    if err = ioutil.WriteFile(fname, []byte(test_header_rules), 0600); err != nil {
+        t.Fatal(err.Error())
+    }
+    rules, err := LoadHeaderRuleSet(fname, config)
+    if err != nil {
+        t.Fatal("Cannot load the rules: " + err.Error())
+    }
+
+    for _, nh := range []string{ "2.2.2.2", "3.3.3.3" } {
+        ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort(nh, "5060"), cmap, &cmap.lock, nil)
+        ua.SetHeaderRules(rules, "O")
+        ua.SetExtraHeaders([]sippy_header.SipHeader{
+            sippy_header.NewSipGenericHF("X-Internal", "secret"),
+            sippy_header.NewSipGenericHF("X-Acct", "42"),
+        })
+        event := NewCCEventTry(nil, nil, "100", "0015551234567", nil, nil, "Alice", nil, "")
+        cmap.lock.Lock()
+        ua.RecvEvent(event)
+        cmap.lock.Unlock()
+        rtime, _ := sippy_time.NewMonoTime()
+        req, err := ParseSipRequest(tfactory.get(), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse INVITE: " + err.Error())
+        }
+        from, _ := req.GetFrom().GetBody()
+        if nh == "3.3.3.3" {
+            assertStringEqual(req.GetRURI().Username, "0015551234567", t)
+            if req.GetFirstHF("X-Internal") == nil || req.GetFirstHF("X-Carrier") != nil {
+                t.Fatal("The rule has been applied to the wrong peer")
+            }
+            continue
+        }
+        assertStringEqual(req.GetRURI().Username, "+15551234567", t)
+        assertStringEqual(from.GetUrl().Host.String(), "carrier.example.com", t)
+        if from.GetTag() == "" {
+            t.Fatal("From tag has been lost")
+        }
+        if req.GetFirstHF("X-Internal") != nil {
+            t.Fatal("X-Internal has not been removed")
+        }
+        if req.GetFirstHF("X-Acct") != nil || req.GetFirstHF("X-Account") == nil {
+            t.Fatal("X-Acct has not been renamed")
+        }
+        assertStringEqual(req.GetFirstHF("X-Account").StringBody(), "42", t)
+        assertStringEqual(req.GetFirstHF("X-Carrier").StringBody(), "yes", t)
+
+        resp := req.GenResponse(183, "Session Progress", nil, sippy_header.NewSipServer("test"))
+        rules.ApplyToResponse(resp, "A")
+        if resp.GetSipServer() != nil {
+            t.Fatal("Server has not been removed from 183")
+        }
+        resp = req.GenResponse(200, "OK", nil, sippy_header.NewSipServer("test"))
+        rules.ApplyToResponse(resp, "A")
+        if resp.GetSipServer() == nil {
+            t.Fatal("Server has been removed from 200")
+        }
+    }
+
+    // The broken file must not replace the rules in effect
+    if err = ioutil.WriteFile(fname, []byte(`[ { "Actions" : [ { "Op" : "remove", "Header" : "Via" } ] } ]`), 0600); err != nil {
+        t.Fatal(err.Error())
+    }
+    if err = rules.Reload(); err == nil {
+        t.Fatal("Via removal has been accepted")
+    }
+    if len(rules.getRules()) != 2 {
+        t.Fatal("The rules have been lost on the failed reload")
+    }
+    if err = ioutil.WriteFile(fname, []byte(`[ { "Name" : "one", "Actions" : [] } ]`), 0600); err != nil {
+        t.Fatal(err.Error())
+    }
+    if err = rules.Reload(); err != nil {
+        t.Fatal("Cannot reload the rules: " + err.Error())
+    }
+    assertStringEqual(rules.getRules()[0].Name, "one", t)
+}
+
+func Test_HeaderRulesRURIHost(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rules, err := NewHeaderRuleSet([]*HeaderRule{
+        &HeaderRule{ Actions : []*HeaderAction{
+            &HeaderAction{ Op : "rewrite", RURI : "host", Match : "^2\\.2\\.2\\.2$", Value : "4.4.4.4" },
+        }},
+    }, config)
+    if err != nil {
+        t.Fatal("Cannot create the rules: " + err.Error())
+    }
+    ruri := sippy_header.NewSipURL("200", sippy_net.NewMyAddress("2.2.2.2"), sippy_net.NewMyPort("5060"), false)
+    for _, proxy := range []*sippy_net.HostPort{ nil, sippy_net.NewHostPort("3.3.3.3", "5060") } {
+        to := sippy_header.NewSipTo(sippy_header.NewSipAddress("", ruri.GetCopy()), config)
+        from := sippy_header.NewSipFrom(sippy_header.NewSipAddress("", sippy_header.NewSipURL("100", nil, nil, false)), config)
+        req, err := NewSipRequest("INVITE", ruri.GetCopy(), "", to, from, nil, 1, sippy_header.GenerateSipCallId(config),
+            nil, nil, nil, nil, proxy, nil, nil, nil, config)
+        if err != nil {
+            t.Fatal("Cannot create INVITE: " + err.Error())
+        }
+        rules.ApplyToRequest(req, "")
+        assertStringEqual(req.GetRURI().Host.String(), "4.4.4.4", t)
+        if proxy == nil {
+            // the request follows the new Request-URI
+            assertStringEqual(req.GetTarget().String(), "4.4.4.4:5060", t)
+        } else {
+            // the outbound proxy is kept
+            assertStringEqual(req.GetTarget().String(), "3.3.3.3:5060", t)
+        }
+    }
+}
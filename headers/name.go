@@ -61,3 +61,18 @@ func (self compactName) Name() string {
 func (self compactName) CompactName() string {
     return self.compact_name
 }
+
+// HFName provides Name() and CompactName() to the custom header types
+// registered with sippy.RegisterSipHeader().
+type HFName struct {
+    compactName
+}
+
+// NewHFName creates the name of a custom header. The compact_name may be
+// empty.
+func NewHFName(name, compact_name string) HFName {
+    if compact_name == "" {
+        compact_name = name
+    }
+    return HFName{ newCompactName(name, compact_name) }
+}
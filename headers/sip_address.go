@@ -57,6 +57,9 @@ func ParseSipAddress(address string, relaxedparser bool, config sippy_conf.Confi
         q : 1.0,
     }
 
+    if address == "" {
+        return nil, errors.New("ParseSipAddress: empty address")
+    }
     if strings.HasPrefix(strings.ToLower(address), "sip:") && strings.Index(address, "<") == -1 {
         parts := strings.SplitN(address, ";", 2)
         self.url, err = ParseSipURL(parts[0], relaxedparser, config)
@@ -223,6 +226,10 @@ func (self *SipAddress) SetParam(name, value string) {
     self.params[name] = &value
 }
 
+func (self *SipAddress) DelParam(name string) {
+    delete(self.params, name)
+}
+
 func (self *SipAddress) GetName() string {
     return self.name
 }
@@ -62,9 +62,10 @@ func createSipAddressHFs(body string) []*sipAddressHF {
     for {
         idx := strings.IndexRune(body[pidx:], ',')
         if idx == -1 {
-            addresses = append(addresses, body[pidx:])
+            addresses = append(addresses, body)
             break
         }
+        idx += pidx
         onum, cnum, qnum := 0, 0, 0
         for _, r := range body[:idx] {
             switch r {
@@ -127,3 +128,22 @@ func (self *sipAddressHF) LocalStringBody(hostport *sippy_net.HostPort) string {
     }
     return self.string_body
 }
+
+func (self *sipAddressHF) getUser() (string, error) {
+    addr, err := self.GetBody()
+    if err == nil {
+        return addr.GetUrl().Username, nil
+    }
+    s := self.string_body
+    if idx := strings.IndexRune(s, '<'); idx != -1 {
+        s = s[idx + 1:]
+        if idx = strings.IndexRune(s, '>'); idx != -1 {
+            s = s[:idx]
+        }
+    }
+    s = strings.TrimSpace(s)
+    if ! strings.HasPrefix(strings.ToLower(s), "tel:") {
+        return "", err
+    }
+    return strings.SplitN(s[4:], ";", 2)[0], nil
+}
@@ -28,8 +28,11 @@ package sippy_header
 
 import (
     "crypto/md5"
+    "crypto/sha256"
+    "crypto/sha512"
     "errors"
     "fmt"
+    "hash"
     "strings"
 
     "github.com/braams/sippy/net"
@@ -47,6 +50,8 @@ type SipAuthorizationBody struct {
     qop         string
     nc          string
     cnonce      string
+    algorithm   string
+    opaque      string
     otherparams string
 }
 
@@ -73,6 +78,39 @@ func NewSipAuthorization(realm, nonce, method, uri, username, password string) *
     }
 }
 
+// NewSipAuthorizationWithParams answers the challenge using its algorithm
+// and opaque. The qop, nc and cnonce are chosen by the caller, the entity
+// is the message body hashed for qop=auth-int.
+func NewSipAuthorizationWithParams(challenge *SipWWWAuthenticateBody, method, uri, username, password, qop, nc, cnonce, entity string) *SipAuthorization {
+    alg := challenge.GetAlgorithm()
+    realm, nonce := challenge.GetRealm(), challenge.GetNonce()
+    hentity := ""
+    if qop == "auth-int" {
+        hentity = DigestCalcHEntity(alg, entity)
+    }
+    HA1 := DigestCalcHA1(alg, username, realm, password, nonce, cnonce)
+    response := DigestCalcResponseAlg(alg, HA1, nonce, nc, cnonce, qop, method, uri, hentity)
+    return &SipAuthorization{
+        normalName : _sip_authorization_name,
+        body    : &SipAuthorizationBody{
+            realm   : realm,
+            nonce   : nonce,
+            uri     : uri,
+            username : username,
+            response : response,
+            qop     : qop,
+            nc      : nc,
+            cnonce  : cnonce,
+            algorithm : alg,
+            opaque  : challenge.GetOpaque(),
+        },
+    }
+}
+
+func NewSipAuthorizationAsIface(realm, nonce, method, uri, username, password string) SipHeader {
+    return NewSipAuthorization(realm, nonce, method, uri, username, password)
+}
+
 func CreateSipAuthorization(body string) []SipHeader {
     self := createSipAuthorizationObj(body)
     return []SipHeader{ self }
@@ -92,8 +130,8 @@ func newSipAuthorizationBody(body string) (*SipAuthorizationBody, error) {
     if len(arr) != 2 {
         return nil, errors.New("Error parsing authorization (1)")
     }
-    for _, param := range strings.Split(arr[1], ",") {
-        kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+    for _, param := range splitAuthParams(arr[1]) {
+        kv := strings.SplitN(param, "=", 2)
         if len(kv) != 2 {
             return nil, errors.New("Error parsing authorization (2)")
         }
@@ -115,6 +153,10 @@ func newSipAuthorizationBody(body string) (*SipAuthorizationBody, error) {
             self.cnonce = strings.Trim(value, "\"")
         case "nc":
             self.nc = strings.Trim(value, "\"")
+        case "algorithm":
+            self.algorithm = strings.Trim(value, "\"")
+        case "opaque":
+            self.opaque = strings.Trim(value, "\"")
         default:
             self.otherparams += "," + param
         }
@@ -125,8 +167,14 @@ func newSipAuthorizationBody(body string) (*SipAuthorizationBody, error) {
 func (self *SipAuthorizationBody) String() string {
     rval := "Digest username=\"" + self.username + "\",realm=\"" + self.realm + "\",nonce=\"" + self.nonce +
         "\",uri=\"" + self.uri + "\",response=\"" + self.response + "\""
+    if self.algorithm != "" {
+        rval += ",algorithm=" + self.algorithm
+    }
     if self.qop != "" {
-        rval += ",nc=\"" + self.nc + "\",cnonce=\"" + self.cnonce + "\",qop=" + self.qop
+        rval += ",nc=" + self.nc + ",cnonce=\"" + self.cnonce + "\",qop=" + self.qop
+    }
+    if self.opaque != "" {
+        rval += ",opaque=\"" + self.opaque + "\""
     }
     return rval + self.otherparams
 }
@@ -140,8 +188,53 @@ func (self *SipAuthorizationBody) GetUsername() string {
     return self.username
 }
 
+func (self *SipAuthorizationBody) GetRealm() string {
+    return self.realm
+}
+
+func (self *SipAuthorizationBody) GetNonce() string {
+    return self.nonce
+}
+
+func (self *SipAuthorizationBody) GetAlgorithm() string {
+    return self.algorithm
+}
+
+func (self *SipAuthorizationBody) GetQop() string {
+    return self.qop
+}
+
+func (self *SipAuthorizationBody) GetNC() string {
+    return self.nc
+}
+
+func (self *SipAuthorizationBody) GetCNonce() string {
+    return self.cnonce
+}
+
+func (self *SipAuthorizationBody) GetURI() string {
+    return self.uri
+}
+
+func (self *SipAuthorizationBody) GetOpaque() string {
+    return self.opaque
+}
+
 func (self *SipAuthorizationBody) VerifyHA1(HA1, method string) bool {
-    response := DigestCalcResponse(HA1, self.nonce, self.nc, self.cnonce, self.qop, method, self.uri, "")
+    return self.VerifyHA1WithEntity(HA1, method, "")
+}
+
+// VerifyHA1WithEntity is VerifyHA1 that also takes the message body
+// into account when the client has used qop=auth-int.
+func (self *SipAuthorizationBody) VerifyHA1WithEntity(HA1, method, entity string) bool {
+    if ! DigestAlgorithmSupported(self.algorithm) {
+        return false
+    }
+    hentity := ""
+    if self.qop == "auth-int" {
+        hentity = DigestCalcHEntity(self.algorithm, entity)
+    }
+    response := DigestCalcResponseAlg(self.algorithm, HA1, self.nonce, self.nc, self.cnonce, self.qop, method, self.uri, hentity)
     return response == self.response
 }
 
@@ -193,30 +286,115 @@ func (self *SipAuthorization) GetCopyAsIface() SipHeader {
     return self.GetCopy()
 }
 
-func DigestCalcHA1(pszAlg, pszUserName, pszRealm, pszPassword, pszNonce, pszCNonce string) string {
-    s := pszUserName + ":" + pszRealm + ":" + pszPassword
-    HA1 := md5.Sum([]byte(s))
-    if pszAlg == "md5-sess" {
-        s2 := make([]byte, len(HA1))
-        for i, b := range HA1 {
-            s2[i] = b
+// splitAuthParams splits a comma separated list of the auth-params
+// leaving alone the commas inside of the quoted strings.
+func splitAuthParams(s string) []string {
+    rval := []string{}
+    quoted := false
+    start := 0
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+        case '"':
+            quoted = ! quoted
+        case '\\':
+            if quoted { i++ }
+        case ',':
+            if ! quoted {
+                if param := strings.TrimSpace(s[start:i]); param != "" {
+                    rval = append(rval, param)
+                }
+                start = i + 1
+            }
         }
-        s2 = append(s2, []byte(":" + pszNonce + ":" + pszCNonce)...)
-        HA1 = md5.Sum(s2)
     }
-    return fmt.Sprintf("%x", HA1)
+    if param := strings.TrimSpace(s[start:]); param != "" {
+        rval = append(rval, param)
+    }
+    return rval
+}
+
+// digestHash returns the hash function for the given digest algorithm
+// (RFC 7616, RFC 8760) or nil when the algorithm is not supported. The
+// "-sess" suffix does not affect the hash function.
+func digestHash(alg string) func() hash.Hash {
+    switch strings.TrimSuffix(strings.ToUpper(alg), "-SESS") {
+    case "", "MD5":
+        return md5.New
+    case "SHA-256":
+        return sha256.New
+    case "SHA-512-256":
+        return sha512.New512_256
+    }
+    return nil
+}
+
+func digestHex(alg, s string) string {
+    h := digestHash(alg)()
+    h.Write([]byte(s))
+    return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func DigestAlgorithmSupported(alg string) bool {
+    return digestHash(alg) != nil
+}
+
+// DigestAlgorithmStrength ranks the supported algorithms so that the
+// client could pick the strongest one out of several challenges. The
+// unsupported algorithms are ranked 0.
+func DigestAlgorithmStrength(alg string) int {
+    switch strings.TrimSuffix(strings.ToUpper(alg), "-SESS") {
+    case "", "MD5":
+        return 1
+    case "SHA-256":
+        return 2
+    case "SHA-512-256":
+        return 3
+    }
+    return 0
+}
+
+// DigestCalcHEntity calculates H(entity-body) for qop=auth-int.
+func DigestCalcHEntity(alg, entity string) string {
+    if ! DigestAlgorithmSupported(alg) {
+        return ""
+    }
+    return digestHex(alg, entity)
+}
+
+func DigestCalcHA1(pszAlg, pszUserName, pszRealm, pszPassword, pszNonce, pszCNonce string) string {
+    if ! DigestAlgorithmSupported(pszAlg) {
+        return ""
+    }
+    HA1 := digestHex(pszAlg, pszUserName + ":" + pszRealm + ":" + pszPassword)
+    return DigestCalcSessHA1(pszAlg, HA1, pszNonce, pszCNonce)
+}
+
+// DigestCalcSessHA1 turns HA1 of username:realm:password into the session
+// key for the -sess algorithms and returns it unchanged for the others.
+func DigestCalcSessHA1(pszAlg, HA1, pszNonce, pszCNonce string) string {
+    if ! strings.HasSuffix(strings.ToLower(pszAlg), "-sess") {
+        return HA1
+    }
+    return digestHex(pszAlg, HA1 + ":" + pszNonce + ":" + pszCNonce)
 }
 
 func DigestCalcResponse(HA1, pszNonce string, pszNonceCount, pszCNonce, pszQop, pszMethod, pszDigestUri, pszHEntity string) string {
+    return DigestCalcResponseAlg("MD5", HA1, pszNonce, pszNonceCount, pszCNonce, pszQop, pszMethod, pszDigestUri, pszHEntity)
+}
+
+func DigestCalcResponseAlg(pszAlg, HA1, pszNonce string, pszNonceCount, pszCNonce, pszQop, pszMethod, pszDigestUri, pszHEntity string) string {
+    if ! DigestAlgorithmSupported(pszAlg) {
+        return ""
+    }
     s := pszMethod + ":" + pszDigestUri
     if pszQop == "auth-int" {
         s += ":" + pszHEntity
     }
-    HA2 := fmt.Sprintf("%x", md5.Sum([]byte(s)))
+    HA2 := digestHex(pszAlg, s)
     s = HA1 + ":" + pszNonce + ":"
     if pszNonceCount != "" && pszCNonce != "" { // pszQop:
         s += pszNonceCount + ":" + pszCNonce + ":" + pszQop + ":"
     }
     s += HA2
-    return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+    return digestHex(pszAlg, s)
 }
@@ -27,6 +27,7 @@
 package sippy_header
 
 import (
+    "errors"
     "strconv"
 
     "github.com/braams/sippy/net"
@@ -71,6 +72,9 @@ func CreateSipCSeq(body string) []SipHeader {
 
 func (self *SipCSeq) parse() error {
     arr := sippy_utils.FieldsN(self.string_body, 2)
+    if len(arr) == 0 {
+        return errors.New("Empty CSeq field")
+    }
     cseq, err := strconv.Atoi(arr[0])
     if err != nil {
         return err
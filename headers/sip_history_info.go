@@ -0,0 +1,86 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_header
+
+import (
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/conf"
+)
+
+type SipHistoryInfo struct {
+    normalName
+    *sipAddressHF
+}
+
+var _sip_history_info_name normalName = newNormalName("History-Info")
+
+func NewSipHistoryInfo(addr *SipAddress, config sippy_conf.Config) *SipHistoryInfo {
+    return &SipHistoryInfo{
+        normalName   : _sip_history_info_name,
+        sipAddressHF : newSipAddressHF(addr, config),
+    }
+}
+
+func CreateSipHistoryInfo(body string) []SipHeader {
+    addresses := createSipAddressHFs(body)
+    rval := make([]SipHeader, len(addresses))
+    for i, addr := range addresses {
+        rval[i] = &SipHistoryInfo{
+            normalName   : _sip_history_info_name,
+            sipAddressHF : addr,
+        }
+    }
+    return rval
+}
+
+func (self *SipHistoryInfo) String() string {
+    return self.LocalStr(nil, false)
+}
+
+func (self *SipHistoryInfo) LocalStr(hostport *sippy_net.HostPort, compact bool) string {
+    return self.Name() + ": " + self.LocalStringBody(hostport)
+}
+
+func (self *SipHistoryInfo) GetCopy() *SipHistoryInfo {
+    return &SipHistoryInfo{
+        normalName   : _sip_history_info_name,
+        sipAddressHF : self.sipAddressHF.getCopy(),
+    }
+}
+
+func (self *SipHistoryInfo) GetCopyAsIface() SipHeader {
+    return self.GetCopy()
+}
+
+// GetIndex returns the hi-index of the entry (RFC 7044), e.g. "1.1".
+func (self *SipHistoryInfo) GetIndex() (string, error) {
+    addr, err := self.GetBody()
+    if err != nil {
+        return "", err
+    }
+    return addr.GetParam("index"), nil
+}
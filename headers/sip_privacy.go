@@ -0,0 +1,94 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_header
+
+import (
+    "strings"
+
+    "github.com/braams/sippy/net"
+)
+
+type SipPrivacy struct {
+    normalName
+    Values  []string
+}
+
+var _sip_privacy_name normalName = newNormalName("Privacy")
+
+func CreateSipPrivacy(body string) []SipHeader {
+    self := &SipPrivacy{
+        normalName  : _sip_privacy_name,
+        Values      : make([]string, 0),
+    }
+    for _, value := range strings.Split(body, ";") {
+        value = strings.TrimSpace(value)
+        if value != "" {
+            self.Values = append(self.Values, strings.ToLower(value))
+        }
+    }
+    return []SipHeader{ self }
+}
+
+func NewSipPrivacy(values ...string) *SipPrivacy {
+    return &SipPrivacy{
+        normalName  : _sip_privacy_name,
+        Values      : values,
+    }
+}
+
+// Has reports whether the given privacy type (RFC 3323/3325) is requested.
+func (self *SipPrivacy) Has(value string) bool {
+    for _, v := range self.Values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *SipPrivacy) StringBody() string {
+    return strings.Join(self.Values, ";")
+}
+
+func (self *SipPrivacy) String() string {
+    return self.LocalStr(nil, false)
+}
+
+func (self *SipPrivacy) LocalStr(hostport *sippy_net.HostPort, compact bool) string {
+    return self.Name() + ": " + self.StringBody()
+}
+
+func (self *SipPrivacy) GetCopy() *SipPrivacy {
+    return &SipPrivacy{
+        normalName  : _sip_privacy_name,
+        Values      : append([]string{}, self.Values...),
+    }
+}
+
+func (self *SipPrivacy) GetCopyAsIface() SipHeader {
+    return self.GetCopy()
+}
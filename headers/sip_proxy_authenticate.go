@@ -32,6 +32,14 @@ type SipProxyAuthenticate struct {
 
 var _sip_proxy_authenticate_name normalName = newNormalName("Proxy-Authenticate")
 
+func NewSipProxyAuthenticate(realm, nonce string) *SipProxyAuthenticate {
+    super := NewSipWWWAuthenticate(realm, nonce)
+    super.normalName = _sip_proxy_authenticate_name
+    return &SipProxyAuthenticate{
+        SipWWWAuthenticate : super,
+    }
+}
+
 func CreateSipProxyAuthenticate(body string) []SipHeader {
     super := createSipWWWAuthenticateObj(body)
     super.normalName = _sip_proxy_authenticate_name
@@ -40,6 +40,13 @@ func NewSipProxyAuthorization(realm, nonce, method, uri, username, password stri
     }
 }
 
+func NewSipProxyAuthorizationFromAuthorization(super *SipAuthorization) *SipProxyAuthorization {
+    super.normalName = _sip_proxy_authorization_name
+    return &SipProxyAuthorization{
+        SipAuthorization : super,
+    }
+}
+
 func CreateSipProxyAuthorization(body string) []SipHeader {
     super := createSipAuthorizationObj(body)
     super.normalName = _sip_proxy_authorization_name
@@ -99,6 +99,40 @@ func (self *SipReason) parse() error {
     return nil
 }
 
+func (self *SipReason) getBody() (*sipReasonBody, error) {
+    if self.body == nil {
+        if err := self.parse(); err != nil {
+            return nil, err
+        }
+    }
+    return self.body, nil
+}
+
+// GetProtocol returns the protocol of the cause, e.g. "SIP" or "Q.850".
+func (self *SipReason) GetProtocol() (string, error) {
+    body, err := self.getBody()
+    if err != nil {
+        return "", err
+    }
+    return body.protocol, nil
+}
+
+func (self *SipReason) GetCause() (string, error) {
+    body, err := self.getBody()
+    if err != nil {
+        return "", err
+    }
+    return body.cause, nil
+}
+
+func (self *SipReason) GetText() (string, error) {
+    body, err := self.getBody()
+    if err != nil {
+        return "", err
+    }
+    return body.reason, nil
+}
+
 func (self *SipReason) StringBody() string {
     if self.body != nil {
         return self.body.String()
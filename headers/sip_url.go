@@ -99,7 +99,7 @@ func ParseSipURL(url string, relaxedparser bool, config sippy_conf.Config) (*Sip
     case "sips":
         return self, self.parseSipURL(parts[1], relaxedparser)
     case "tel":
-        if config.AutoConvertTelUrl() {
+        if config != nil && config.AutoConvertTelUrl() {
             self.convertTelUrl(parts[1], relaxedparser, config)
             return self, nil
         }
@@ -109,6 +109,8 @@ func ParseSipURL(url string, relaxedparser bool, config sippy_conf.Config) (*Sip
 
 func (self *SipURL) convertTelUrl(url string, relaxedparser bool, config sippy_conf.Config) {
     self.scheme = "sip"
+    // RFC 3261 section 19.1.6
+    self.usertype = "phone"
 
     if relaxedparser {
         self.Host = sippy_net.NewMyAddress("")
@@ -175,9 +177,14 @@ func (self *SipURL) parseSipURL(url string, relaxedparser bool) error {
     var parseport *string = nil
     if relaxedparser && len(hostport) == 0 {
         self.Host = sippy_net.NewMyAddress("")
+    } else if len(hostport) == 0 {
+        return errors.New("host is not present")
     } else if hostport[0] == '[' {
         // IPv6 host
         hpparts := strings.SplitN(hostport, "]", 2)
+        if len(hpparts) != 2 {
+            return errors.New("bad IPv6 host: " + hostport)
+        }
         self.Host = sippy_net.NewMyAddress(hpparts[0] + "]")
         if len(hpparts[1]) > 0 {
             hpparts = strings.SplitN(hpparts[1], ":", 2)
@@ -331,9 +338,63 @@ func (self *SipURL) LocalStr(hostport *sippy_net.HostPort) string {
 
 func (self *SipURL) GetCopy() *SipURL {
     ret := *self
+    ret.other = append([]string{}, self.other...)
+    ret.headers = make(map[string]string, len(self.headers))
+    for k, v := range self.headers {
+        ret.headers[k] = v
+    }
     return &ret
 }
 
+// GetHeader returns the value of the URI header (the "?name=value" part).
+func (self *SipURL) GetHeader(name string) string {
+    return self.headers[strings.ToLower(name)]
+}
+
+func (self *SipURL) SetHeader(name, value string) {
+    if self.headers == nil {
+        self.headers = make(map[string]string)
+    }
+    self.headers[strings.ToLower(name)] = value
+}
+
+func (self *SipURL) DelHeader(name string) {
+    delete(self.headers, strings.ToLower(name))
+}
+
+// GetParam returns the value of the URI parameter that has no dedicated
+// field, e.g. "cause" (RFC 4458).
+func (self *SipURL) GetParam(name string) string {
+    for _, p := range self.other {
+        nv := strings.SplitN(p, "=", 2)
+        if len(nv) == 2 && strings.ToLower(nv[0]) == strings.ToLower(name) {
+            return nv[1]
+        }
+    }
+    return ""
+}
+
+func (self *SipURL) DelParam(name string) {
+    other := make([]string, 0, len(self.other))
+    for _, p := range self.other {
+        if strings.ToLower(strings.SplitN(p, "=", 2)[0]) != strings.ToLower(name) {
+            other = append(other, p)
+        }
+    }
+    self.other = other
+}
+
+func (self *SipURL) SetParam(name, value string) {
+    for i, p := range self.other {
+        nv := strings.SplitN(p, "=", 2)
+        if strings.ToLower(nv[0]) == strings.ToLower(name) {
+            self.other[i] = name + "=" + value
+            return
+        }
+    }
+    self.other = append(self.other, name + "=" + value)
+}
+
 func (self *SipURL) GetAddr(config sippy_conf.Config) *sippy_net.HostPort {
     if self.Port != nil {
         return sippy_net.NewHostPort(self.Host.String(), self.Port.String())
@@ -341,6 +402,12 @@ func (self *SipURL) GetAddr(config sippy_conf.Config) *sippy_net.HostPort {
     return sippy_net.NewHostPort(self.Host.String(), config.SipPort().String())
 }
 
+// GetUsertype returns the value of the "user" parameter, i.e. "phone" for
+// the telephone number.
+func (self *SipURL) GetUsertype() string {
+    return self.usertype
+}
+
 func (self *SipURL) SetUserparams(userparams []string) {
     self.userparams = userparams
 }
@@ -31,6 +31,7 @@ import (
     "errors"
     "fmt"
     "net"
+    "regexp"
     "strings"
 
     "github.com/braams/sippy/conf"
@@ -79,8 +80,15 @@ func CreateSipVia(body string) []SipHeader {
     return rval
 }
 
+// The sent-protocol may have LWS around the slashes (RFC 3261 25.1).
+var sip_via_proto_lws = regexp.MustCompile(`\s*/\s*`)
+
 func (self *SipVia) parse() error {
-    arr := sippy_utils.FieldsN(self.string_body, 2)
+    body := self.string_body
+    if sip_via_proto_lws.MatchString(body) {
+        body = sip_via_proto_lws.ReplaceAllString(body, "/")
+    }
+    arr := sippy_utils.FieldsN(body, 2)
     if len(arr) != 2 {
         return errors.New("Bad via: '" + self.string_body + "'")
     }
@@ -92,8 +100,10 @@ func (self *SipVia) parse() error {
     for _, param := range arr[1:] {
         param = strings.TrimSpace(param)
         sparam := strings.SplitN(param, "=", 2)
+        sparam[0] = strings.TrimSpace(sparam[0])
         val = nil
         if len(sparam) == 2 {
+            sparam[1] = strings.TrimSpace(sparam[1])
             val = &sparam[1]
         }
         switch sparam[0] {
@@ -122,6 +132,7 @@ func (self *SipVia) parse() error {
             }
         }
     }
+    arr[0] = strings.TrimSpace(arr[0])
     host, port, err := net.SplitHostPort(arr[0])
     if err != nil {
         via.host = sippy_net.NewMyAddress(arr[0])
@@ -37,8 +37,12 @@ import (
 )
 
 type SipWWWAuthenticateBody struct {
-    realm *sippy_net.MyAddress
-    nonce string
+    realm       *sippy_net.MyAddress
+    nonce       string
+    algorithm   string
+    qop         []string
+    opaque      string
+    stale       bool
 }
 
 type SipWWWAuthenticate struct {
@@ -50,7 +54,9 @@ type SipWWWAuthenticate struct {
 var _sip_www_authenticate_name normalName = newNormalName("WWW-Authenticate")
 
 func CreateSipWWWAuthenticate(body string) []SipHeader {
-    return []SipHeader{ createSipWWWAuthenticateObj(body) }
+    self := createSipWWWAuthenticateObj(body)
+    self.normalName = _sip_www_authenticate_name
+    return []SipHeader{ self }
 }
 
 func NewSipWWWAuthenticateWithRealm(realm string) *SipWWWAuthenticate {
@@ -60,6 +66,16 @@ func NewSipWWWAuthenticateWithRealm(realm string) *SipWWWAuthenticate {
     }
 }
 
+func NewSipWWWAuthenticate(realm, nonce string) *SipWWWAuthenticate {
+    return &SipWWWAuthenticate{
+        normalName  : _sip_www_authenticate_name,
+        body        : &SipWWWAuthenticateBody{
+            realm : sippy_net.NewMyAddress(realm),
+            nonce : nonce,
+        },
+    }
+}
+
 func newSipWWWAutenticateBody(realm string) *SipWWWAuthenticateBody {
     buf := make([]byte, 20)
     rand.Read(buf)
@@ -81,16 +97,32 @@ func (self *SipWWWAuthenticate) parse() error {
         return errors.New("Error parsing authentication (1)")
     }
     body := &SipWWWAuthenticateBody{}
-    for _, part := range strings.Split(tmp[1], ",") {
-        arr := strings.SplitN(strings.TrimSpace(part), "=", 2)
+    for _, part := range splitAuthParams(tmp[1]) {
+        arr := strings.SplitN(part, "=", 2)
         if len(arr) != 2 { continue }
-        switch arr[0] {
+        value := strings.Trim(arr[1], "\"")
+        switch strings.ToLower(arr[0]) {
         case "realm":
-            body.realm = sippy_net.NewMyAddress(strings.Trim(arr[1], "\""))
+            body.realm = sippy_net.NewMyAddress(value)
         case "nonce":
-            body.nonce = strings.Trim(arr[1], "\"")
+            body.nonce = value
+        case "algorithm":
+            body.algorithm = value
+        case "opaque":
+            body.opaque = value
+        case "stale":
+            body.stale = strings.ToLower(value) == "true"
+        case "qop":
+            for _, qop := range strings.Split(value, ",") {
+                if qop = strings.TrimSpace(qop); qop != "" {
+                    body.qop = append(body.qop, qop)
+                }
+            }
         }
     }
+    if body.realm == nil {
+        body.realm = sippy_net.NewMyAddress("")
+    }
     self.body = body
     return nil
 }
@@ -124,10 +156,24 @@ func (self *SipWWWAuthenticate) LocalStringBody(hostport *sippy_net.HostPort) st
 }
 
 func (self *SipWWWAuthenticateBody) localString(hostport *sippy_net.HostPort) string {
+    realm := self.realm.String()
     if hostport != nil && self.realm.IsSystemDefault() {
-        return "Digest realm=\"" + hostport.Host.String() + "\",nonce=\"" + self.nonce + "\""
+        realm = hostport.Host.String()
+    }
+    rval := "Digest realm=\"" + realm + "\",nonce=\"" + self.nonce + "\""
+    if self.algorithm != "" {
+        rval += ",algorithm=" + self.algorithm
+    }
+    if len(self.qop) > 0 {
+        rval += ",qop=\"" + strings.Join(self.qop, ",") + "\""
     }
-    return "Digest realm=\"" + self.realm.String() + "\",nonce=\"" + self.nonce + "\""
+    if self.opaque != "" {
+        rval += ",opaque=\"" + self.opaque + "\""
+    }
+    if self.stale {
+        rval += ",stale=true"
+    }
+    return rval
 }
 
 func (self *SipWWWAuthenticateBody) GetRealm() string {
@@ -138,16 +184,60 @@ func (self *SipWWWAuthenticateBody) GetNonce() string {
     return self.nonce
 }
 
+func (self *SipWWWAuthenticateBody) GetAlgorithm() string {
+    return self.algorithm
+}
+
+func (self *SipWWWAuthenticateBody) SetAlgorithm(algorithm string) {
+    self.algorithm = algorithm
+}
+
+func (self *SipWWWAuthenticateBody) GetQop() []string {
+    return self.qop
+}
+
+func (self *SipWWWAuthenticateBody) SetQop(qop ...string) {
+    self.qop = qop
+}
+
+func (self *SipWWWAuthenticateBody) HasQop(qop string) bool {
+    for _, q := range self.qop {
+        if strings.ToLower(q) == qop {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *SipWWWAuthenticateBody) GetOpaque() string {
+    return self.opaque
+}
+
+func (self *SipWWWAuthenticateBody) SetOpaque(opaque string) {
+    self.opaque = opaque
+}
+
+func (self *SipWWWAuthenticateBody) GetStale() bool {
+    return self.stale
+}
+
+func (self *SipWWWAuthenticateBody) SetStale(stale bool) {
+    self.stale = stale
+}
+
 func (self *SipWWWAuthenticate) GetCopy() *SipWWWAuthenticate {
     tmp := *self
     if self.body != nil {
-        self.body = self.body.getCopy()
+        tmp.body = self.body.getCopy()
     }
     return &tmp
 }
 
 func (self *SipWWWAuthenticateBody) getCopy() *SipWWWAuthenticateBody {
     tmp := *self
+    if self.qop != nil {
+        tmp.qop = append([]string{}, self.qop...)
+    }
     return &tmp
 }
 
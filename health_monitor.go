@@ -0,0 +1,254 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+)
+
+// HealthMonitor probes destinations with out-of-dialog OPTIONS requests
+// and tracks whether each of them is up. A destination changes its
+// state only after the configured number of consecutive probe results.
+type HealthMonitor struct {
+    sip_tm          sippy_types.SipTransactionManager
+    config          sippy_conf.Config
+    lock            sync.Mutex
+    interval        time.Duration
+    probe_timeout   time.Duration
+    up_threshold    int
+    down_threshold  int
+    dests           map[string]*healthDest
+    status_cb       func(*sippy_net.HostPort, bool)
+}
+
+type healthDest struct {
+    monitor         *HealthMonitor
+    nh_address      *sippy_net.HostPort
+    ruri            *sippy_header.SipURL
+    up              bool
+    successes       int
+    failures        int
+    inflight        *healthProbe
+    timer           *Timeout
+    stopped         bool
+}
+
+type healthProbe struct {
+    tr              sippy_types.ClientTransaction
+    timer           *Timeout
+}
+
+func NewHealthMonitor(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config) *HealthMonitor {
+    return &HealthMonitor{
+        sip_tm          : sip_tm,
+        config          : config,
+        interval        : 30 * time.Second,
+        probe_timeout   : 5 * time.Second,
+        up_threshold    : 2,
+        down_threshold  : 2,
+        dests           : make(map[string]*healthDest),
+    }
+}
+
+// SetInterval sets the period between probes. It only affects the
+// destinations added afterwards.
+func (self *HealthMonitor) SetInterval(interval time.Duration) {
+    self.interval = interval
+}
+
+// SetProbeTimeout sets how long to wait for the response to a probe
+// before counting it as failed. It only affects the destinations added
+// afterwards.
+func (self *HealthMonitor) SetProbeTimeout(timeout time.Duration) {
+    self.probe_timeout = timeout
+}
+
+// SetThresholds sets how many consecutive successful probes bring a
+// destination up and how many consecutive failed ones bring it down.
+func (self *HealthMonitor) SetThresholds(up_threshold, down_threshold int) {
+    self.up_threshold = up_threshold
+    self.down_threshold = down_threshold
+}
+
+// SetStatusCb installs the callback invoked when a destination changes
+// its state. The callback is called with the monitor lock held and must
+// not call back into the monitor.
+func (self *HealthMonitor) SetStatusCb(status_cb func(*sippy_net.HostPort, bool)) {
+    self.status_cb = status_cb
+}
+
+// AddDestination starts probing nh_address. When ruri is nil the
+// OPTIONS requests are addressed to sip:host:port of the destination.
+// The destination is considered up until the probes prove otherwise.
+func (self *HealthMonitor) AddDestination(nh_address *sippy_net.HostPort, ruri *sippy_header.SipURL) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    key := nh_address.String()
+    if _, ok := self.dests[key]; ok {
+        return
+    }
+    if ruri == nil {
+        ruri = sippy_header.NewSipURL("", nh_address.Host, nh_address.Port, false)
+    }
+    dest := &healthDest{
+        monitor         : self,
+        nh_address      : nh_address,
+        ruri            : ruri,
+        up              : true,
+    }
+    self.dests[key] = dest
+    // the lock is shared with the transactions so probe once it is released
+    StartTimeout(dest.probe, &self.lock, 0, 1, self.config.ErrorLogger())
+    dest.timer = StartTimeout(dest.probe, &self.lock, self.interval, -1, self.config.ErrorLogger())
+}
+
+func (self *HealthMonitor) RemoveDestination(nh_address *sippy_net.HostPort) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    key := nh_address.String()
+    if dest, ok := self.dests[key]; ok {
+        dest.stop()
+        delete(self.dests, key)
+    }
+}
+
+// IsUp reports whether the destination is alive. Destinations that are
+// not monitored are always reported as up.
+func (self *HealthMonitor) IsUp(nh_address *sippy_net.HostPort) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    dest, ok := self.dests[nh_address.String()]
+    return ! ok || dest.up
+}
+
+// GetStatus returns the current state of all monitored destinations.
+func (self *HealthMonitor) GetStatus() map[string]bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    rval := make(map[string]bool, len(self.dests))
+    for key, dest := range self.dests {
+        rval[key] = dest.up
+    }
+    return rval
+}
+
+func (self *HealthMonitor) Stop() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for key, dest := range self.dests {
+        dest.stop()
+        delete(self.dests, key)
+    }
+}
+
+func (self *healthDest) stop() {
+    self.stopped = true
+    self.timer.Cancel()
+    if self.inflight != nil {
+        self.inflight.timer.Cancel()
+        self.inflight = nil
+    }
+}
+
+func (self *healthDest) probe() {
+    if self.inflight != nil || self.stopped {
+        return
+    }
+    config := self.monitor.config
+    from := sippy_header.NewSipAddress("", sippy_header.NewSipURL("ping", config.GetMyAddress(), config.GetMyPort(), false))
+    from.GenTag()
+    to := sippy_header.NewSipAddress("", self.ruri.GetCopy())
+    req, err := NewSipRequest("OPTIONS", /*ruri*/ self.ruri.GetCopy(), /*sipver*/ "",
+                    sippy_header.NewSipTo(to, config), sippy_header.NewSipFrom(from, config),
+                    /*via*/ nil, /*cseq*/ 1, sippy_header.GenerateSipCallId(config), /*maxforwards*/ nil,
+                    /*body*/ nil, /*contact*/ nil, /*routes*/ nil, self.nh_address, /*cguid*/ nil,
+                    sippy_header.NewSipUserAgent(config.GetMyUAName()), /*expires*/ nil, config)
+    if err != nil {
+        config.ErrorLogger().Error("HealthMonitor::probe: #1: " + err.Error())
+        return
+    }
+    tr, err := self.monitor.sip_tm.BeginNewClientTransaction(req, self, &self.monitor.lock, nil, nil, nil)
+    if err != nil {
+        config.ErrorLogger().Error("HealthMonitor::probe: #2: " + err.Error())
+        self.update(false)
+        return
+    }
+    probe := &healthProbe{ tr : tr }
+    probe.timer = StartTimeout(func() { self.probeTimeout(probe) }, &self.monitor.lock, self.monitor.probe_timeout, 1, config.ErrorLogger())
+    self.inflight = probe
+}
+
+// probeTimeout fails the probe well before the transaction times out,
+// the late response is ignored.
+func (self *healthDest) probeTimeout(probe *healthProbe) {
+    if self.inflight != probe {
+        return
+    }
+    self.inflight = nil
+    self.update(false)
+}
+
+func (self *healthDest) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
+    code, _ := resp.GetSCode()
+    if code < 200 || self.inflight == nil || self.inflight.tr != tr {
+        return
+    }
+    self.inflight.timer.Cancel()
+    self.inflight = nil
+    // Any final response proves the peer is alive except the locally
+    // generated timeout and an explicit overload indication.
+    self.update(code != 408 && code != 503)
+}
+
+func (self *healthDest) update(success bool) {
+    if success {
+        self.failures = 0
+        self.successes++
+        if ! self.up && self.successes >= self.monitor.up_threshold {
+            self.setUp(true)
+        }
+    } else {
+        self.successes = 0
+        self.failures++
+        if self.up && self.failures >= self.monitor.down_threshold {
+            self.setUp(false)
+        }
+    }
+}
+
+func (self *healthDest) setUp(up bool) {
+    self.up = up
+    if self.monitor.status_cb != nil {
+        self.monitor.status_cb(self.nh_address, up)
+    }
+}
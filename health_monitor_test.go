@@ -0,0 +1,101 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "testing"
+    "time"
+
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+func Test_HealthMonitor(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+
+    monitor := NewHealthMonitor(cmap.sip_tm, config)
+    defer monitor.Stop()
+    monitor.SetInterval(time.Hour)
+    monitor.SetThresholds(1, 1)
+    status_ch := make(chan bool, 10)
+    monitor.SetStatusCb(func(_ *sippy_net.HostPort, up bool) { status_ch <- up })
+    gw := sippy_net.NewHostPort("1.1.1.1", "5060")
+    monitor.AddDestination(gw, nil)
+
+    probe := func(code int, reason string, expect bool) {
+        rtime, _ := sippy_time.NewMonoTime()
+        req, err := ParseSipRequest(tfactory.get(), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse OPTIONS: " + err.Error())
+        }
+        assertStringEqual(req.GetMethod(), "OPTIONS", t)
+        tfactory.feed([]string{ req.GenResponse(code, reason, nil, nil).LocalStr(nil, false) })
+        select {
+        case up := <-status_ch:
+            if up != expect || monitor.IsUp(gw) != expect {
+                t.Fatalf("Unexpected state after %d", code)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("No state change after %d", code)
+        }
+    }
+    probe(503, "Service Unavailable", false)
+    monitor.lock.Lock()
+    monitor.dests[gw.String()].probe()
+    monitor.lock.Unlock()
+    probe(200, "OK", true)
+
+    // the unanswered probe fails long before the transaction times out
+    monitor.lock.Lock()
+    monitor.probe_timeout = 100 * time.Millisecond
+    monitor.dests[gw.String()].probe()
+    monitor.lock.Unlock()
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse OPTIONS: " + err.Error())
+    }
+    select {
+    case up := <-status_ch:
+        if up {
+            t.Fatal("The destination must be down after the probe timeout")
+        }
+    case <-time.After(time.Second):
+        t.Fatal("No state change after the probe timeout")
+    }
+    tfactory.feed([]string{ req.GenResponse(200, "OK", nil, nil).LocalStr(nil, false) })
+    select {
+    case <-status_ch:
+        t.Fatal("The late response must be ignored")
+    case <-time.After(300 * time.Millisecond):
+    }
+}
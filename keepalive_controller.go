@@ -27,7 +27,6 @@
 package sippy
 
 import (
-    "github.com/braams/sippy/headers"
     "github.com/braams/sippy/conf"
     "github.com/braams/sippy/types"
 )
@@ -35,6 +34,7 @@ import (
 type keepaliveController struct {
     ua          sippy_types.UA
     triedauth   bool
+    digest      *digestClient
     ka_tr       sippy_types.ClientTransaction
     keepalives  int
     config      sippy_conf.Config
@@ -56,7 +56,6 @@ func newKeepaliveController(ua sippy_types.UA, config sippy_conf.Config) *keepal
 
 func (self *keepaliveController) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
     var err error
-    var challenge *sippy_header.SipWWWAuthenticateBody
     var req sippy_types.SipRequest
 
     if _, ok := self.ua.GetState().(*UaStateConnected); ! ok {
@@ -64,12 +63,12 @@ func (self *keepaliveController) RecvResponse(resp sippy_types.SipResponse, tr s
     }
     code, _ := resp.GetSCode()
     if code == 401 && resp.GetSipWWWAuthenticate() != nil && self.ua.GetUsername() != "" && self.ua.GetPassword() != "" && ! self.triedauth {
-        challenge, err = resp.GetSipWWWAuthenticate().GetBody()
+        self.digest, err = newDigestClient(resp, self.digest)
         if err != nil {
             self.config.ErrorLogger().Error("error parsing 401 auth: " + err.Error())
             return
         }
-        req, err = self.ua.GenRequest("INVITE", self.ua.GetLSDP(), challenge.GetNonce(), challenge.GetRealm(), nil)
+        req, err = self.ua.GenRequest("INVITE", self.ua.GetLSDP(), self.digest.GetNonce(), self.digest.GetRealm(), self.digest.authFunc(self.ua.GetLSDP()))
         if err != nil {
             self.config.ErrorLogger().Error("Cannot create INVITE: " + err.Error())
             return
@@ -83,12 +82,12 @@ func (self *keepaliveController) RecvResponse(resp sippy_types.SipResponse, tr s
         return
     }
     if code == 407 && resp.GetSipProxyAuthenticate() != nil && self.ua.GetUsername() != "" && self.ua.GetPassword() != "" && ! self.triedauth {
-        challenge, err = resp.GetSipProxyAuthenticate().GetBody()
+        self.digest, err = newDigestClient(resp, self.digest)
         if err != nil {
             self.config.ErrorLogger().Error("error parsing 407 auth: " + err.Error())
             return
         }
-        req, err = self.ua.GenRequest("INVITE", self.ua.GetLSDP(), challenge.GetNonce(), challenge.GetRealm(), sippy_header.NewSipProxyAuthorization)
+        req, err = self.ua.GenRequest("INVITE", self.ua.GetLSDP(), self.digest.GetNonce(), self.digest.GetRealm(), self.digest.authFunc(self.ua.GetLSDP()))
         if err != nil {
             self.config.ErrorLogger().Error("Cannot create INVITE: " + err.Error())
             return
@@ -0,0 +1,103 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+)
+
+// lazyHF is a placeholder for a header received from the network that
+// has not been asked for yet. It refers to the header line in the buffer
+// of the message, so the header is sent out again exactly as received
+// unless it is parsed and modified. Only the body of a folded header is
+// kept separately.
+type lazyHF struct {
+    buf     string
+    start   int
+    colon   int
+    end     int
+    folded  string
+}
+
+func newLazyHF(buf string, start, colon, end int, folded string) *lazyHF {
+    return &lazyHF{
+        buf     : buf,
+        start   : start,
+        colon   : colon,
+        end     : end,
+        folded  : folded,
+    }
+}
+
+// is tells whether the header has the full or the compact name.
+func (self *lazyHF) is(key, compact string) bool {
+    name := self.Name()
+    return strings.EqualFold(name, key) || (compact != "" && strings.EqualFold(name, compact))
+}
+
+// parse builds the typed headers, the key is the lower case full name.
+func (self *lazyHF) parse(key string) []sippy_header.SipHeader {
+    factory, ok := lookupSipHeaderFactory(key)
+    if ok {
+        return factory(self.StringBody())
+    }
+    return []sippy_header.SipHeader{ sippy_header.NewSipGenericHF(strings.Title(self.Name()), self.StringBody()) }
+}
+
+func (self *lazyHF) Name() string {
+    return strings.TrimSpace(self.buf[self.start:self.colon])
+}
+
+func (self *lazyHF) CompactName() string {
+    return self.Name()
+}
+
+func (self *lazyHF) String() string {
+    if self.folded != "" {
+        return self.Name() + ": " + self.folded
+    }
+    return self.buf[self.start:self.end]
+}
+
+func (self *lazyHF) StringBody() string {
+    if self.folded != "" {
+        return self.folded
+    }
+    return strings.TrimSpace(self.buf[self.colon + 1:self.end])
+}
+
+func (self *lazyHF) LocalStr(hostport *sippy_net.HostPort, compact bool) string {
+    return self.String()
+}
+
+func (self *lazyHF) GetCopyAsIface() sippy_header.SipHeader {
+    cself := *self
+    return &cself
+}
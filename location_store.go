@@ -0,0 +1,117 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+)
+
+// Binding is a single contact registered for an address of record.
+type Binding struct {
+    Contact     *sippy_header.SipAddress
+    Path        []*sippy_header.SipAddress
+    Q           float64
+    Expires     time.Time
+    CallId      string
+    CSeq        int
+    Source      *sippy_net.HostPort
+}
+
+func (self *Binding) GetCopy() *Binding {
+    rval := *self
+    rval.Contact = self.Contact.GetCopy()
+    rval.Path = make([]*sippy_header.SipAddress, len(self.Path))
+    for i, path := range self.Path {
+        rval.Path[i] = path.GetCopy()
+    }
+    return &rval
+}
+
+// ExpiresIn returns the number of seconds the binding remains valid.
+func (self *Binding) ExpiresIn(now time.Time) int {
+    return int((self.Expires.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// GetRoutes returns the Route header fields required to reach the
+// contact according to the Path recorded at registration time.
+func (self *Binding) GetRoutes(config sippy_conf.Config) []*sippy_header.SipRoute {
+    routes := make([]*sippy_header.SipRoute, len(self.Path))
+    for i, path := range self.Path {
+        routes[i] = sippy_header.NewSipRoute(path.GetCopy(), config)
+    }
+    return routes
+}
+
+// LocationStore persists the bindings of the registrar. The registrar
+// serializes updates, so an implementation only has to make each call
+// atomic. Expired bindings may be returned, the caller filters them out.
+type LocationStore interface {
+    Get(aor string) []*Binding
+    Set(aor string, bindings []*Binding)
+}
+
+type memLocationStore struct {
+    lock        sync.Mutex
+    bindings    map[string][]*Binding
+}
+
+func NewMemLocationStore() LocationStore {
+    return &memLocationStore{
+        bindings    : make(map[string][]*Binding),
+    }
+}
+
+func (self *memLocationStore) Get(aor string) []*Binding {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    now := time.Now()
+    rval := make([]*Binding, 0, len(self.bindings[aor]))
+    for _, binding := range self.bindings[aor] {
+        if binding.Expires.After(now) {
+            rval = append(rval, binding.GetCopy())
+        }
+    }
+    if len(rval) == 0 {
+        delete(self.bindings, aor)
+    }
+    return rval
+}
+
+func (self *memLocationStore) Set(aor string, bindings []*Binding) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if len(bindings) == 0 {
+        delete(self.bindings, aor)
+        return
+    }
+    self.bindings[aor] = bindings
+}
@@ -20,6 +20,7 @@ type test_call_map struct {
     ua          sippy_types.UA
     lock        sync.Mutex
     msg_body    sippy_types.MsgBody
+    event       sippy_types.CCEvent
 }
 
 func NewTestSipLogger() sippy_log.SipLogger {
@@ -41,7 +42,8 @@ func (self *test_call_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_type
     return self.ua, self.ua, nil
 }
 
-func (self *test_call_map) RecvEvent(sippy_types.CCEvent, sippy_types.UA) {
+func (self *test_call_map) RecvEvent(event sippy_types.CCEvent, ua sippy_types.UA) {
+    self.event = event
 }
 
 func (self *test_call_map) disconnect() {
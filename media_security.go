@@ -0,0 +1,168 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
+    "strings"
+
+    "github.com/braams/sippy/sdp"
+)
+
+// The media security policies of the call leg. With MEDIA_SECURITY_PASS
+// on both legs the RTP/SAVP streams are relayed untouched as before.
+// Otherwise the RTPproxy terminates SRTP, so that the leg forced to
+// MEDIA_SECURITY_SRTP gets SDES (RFC 4568) keys generated by the B2BUA and
+// the leg forced to MEDIA_SECURITY_RTP gets plain RTP. The MEDIA_SECURITY_PASS
+// leg gets what its endpoint has been using or, until it is known, what
+// the other endpoint uses.
+const (
+    MEDIA_SECURITY_PASS = ""
+    MEDIA_SECURITY_RTP  = "rtp"
+    MEDIA_SECURITY_SRTP = "srtp"
+)
+
+const SRTP_DEFAULT_SUITE = "AES_CM_128_HMAC_SHA1_80"
+
+// The crypto suites with the 128 bit key and 112 bit salt
+var srtp_suites = map[string]bool{
+    "AES_CM_128_HMAC_SHA1_80"   : true,
+    "AES_CM_128_HMAC_SHA1_32"   : true,
+}
+
+func genSrtpKey() (string, error) {
+    buf := make([]byte, 30)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func (self *_rtpps_side) setSecurity(policy string) {
+    self.security = policy
+    self.srtp, self.srtp_known = false, false
+    self.cryptos, self.srtp_keys = nil, nil
+}
+
+// srtpOut tells whether the SRTP should be sent towards the endpoint of
+// this side.
+func (self *_rtpps_side) srtpOut(other_srtp bool) bool {
+    switch self.security {
+    case MEDIA_SECURITY_SRTP:
+        return true
+    case MEDIA_SECURITY_RTP:
+        return false
+    }
+    if self.srtp_known {
+        return self.srtp
+    }
+    return other_srtp
+}
+
+// secure rewrites the RTP stream of the SDP received from the endpoint of
+// this side for the endpoint of the other side according to the media
+// security policies of both legs. It returns the RTPproxy subcommands
+// that make the proxy decrypt the packets received from this endpoint
+// with its key ("D") and encrypt the packets relayed to the other one
+// with the key advertised to it ("E").
+func (self *_rtpps_side) secure(sect *sippy_sdp.SdpMediaDescription, idx int) ([]string, error) {
+    mhdr := sect.GetMHeader()
+    transport := strings.ToUpper(mhdr.GetTransport())
+    if transport != "RTP/AVP" && transport != "RTP/SAVP" {
+        return nil, nil
+    }
+    if self.security == MEDIA_SECURITY_PASS && self.otherside.security == MEDIA_SECURITY_PASS {
+        return nil, nil
+    }
+    if mhdr.GetPort() == "0" {
+        // the stream is disabled, there is nothing to protect
+        return nil, nil
+    }
+    if self.owner.srtp_module == "" {
+        return nil, fmt.Errorf("the RTPproxy SRTP module is not configured")
+    }
+    var in_crypto *sippy_sdp.SdpCrypto
+    if transport == "RTP/SAVP" {
+        for _, crypto := range sect.GetCryptos() {
+            if srtp_suites[crypto.GetSuite()] && crypto.GetKey() != "" {
+                in_crypto = crypto
+                break
+            }
+        }
+        if in_crypto == nil {
+            return nil, &ESdpNotAcceptable{ "No supported SRTP crypto suite" }
+        }
+    }
+    switch {
+    case self.security == MEDIA_SECURITY_SRTP && in_crypto == nil:
+        return nil, &ESdpNotAcceptable{ "SRTP is required" }
+    case self.security == MEDIA_SECURITY_RTP && in_crypto != nil:
+        return nil, &ESdpNotAcceptable{ "Plain RTP is required" }
+    }
+    if self.cryptos == nil {
+        self.cryptos = make(map[int]*sippy_sdp.SdpCrypto)
+    }
+    self.cryptos[idx] = in_crypto
+    self.srtp = in_crypto != nil
+    self.srtp_known = true
+
+    subcommands := []string{}
+    if in_crypto != nil {
+        subcommands = append(subcommands, fmt.Sprintf("%s D %s inline:%s", self.owner.srtp_module, in_crypto.GetSuite(), in_crypto.GetKey()))
+    }
+    sect.RemoveAttributes("crypto")
+    if !self.otherside.srtpOut(in_crypto != nil) {
+        mhdr.SetTransport("RTP/AVP")
+        return subcommands, nil
+    }
+    // The tag and suite of the crypto attribute previously received from
+    // the other endpoint are mirrored, so that it can be accepted as the
+    // answer (RFC 4568 section 7.1.3).
+    tag, suite := 1, SRTP_DEFAULT_SUITE
+    if prev := self.otherside.cryptos[idx]; prev != nil {
+        tag, suite = prev.GetTag(), prev.GetSuite()
+    } else if in_crypto != nil {
+        suite = in_crypto.GetSuite()
+    }
+    if self.otherside.srtp_keys == nil {
+        self.otherside.srtp_keys = make(map[int]string)
+    }
+    key, ok := self.otherside.srtp_keys[idx]
+    if !ok {
+        var err error
+        if key, err = genSrtpKey(); err != nil {
+            return nil, err
+        }
+        self.otherside.srtp_keys[idx] = key
+    }
+    mhdr.SetTransport("RTP/SAVP")
+    sect.AddAttribute(sippy_sdp.NewSdpCrypto(tag, suite, key))
+    subcommands = append(subcommands, fmt.Sprintf("%s E %s inline:%s", self.owner.srtp_module, suite, key))
+    return subcommands, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/sdp"
+)
+
+func newTestMediaSection(m string, attrs ...string) *sippy_sdp.SdpMediaDescription {
+    sect := sippy_sdp.NewSdpMediaDescription()
+    sect.AddHeader("m", m)
+    sect.AddHeader("c", "IN IP4 1.1.1.1")
+    for _, attr := range attrs {
+        sect.AddHeader("a", attr)
+    }
+    return sect
+}
+
+func Test_MediaSecurity(t *testing.T) {
+    rtpps := &Rtp_proxy_session{ srtp_module : "M5:1" }
+    rtpps.caller.otherside, rtpps.callee.otherside = &rtpps.callee, &rtpps.caller
+    rtpps.caller.owner, rtpps.callee.owner = rtpps, rtpps
+
+    // Nothing is touched unless a policy is set
+    sect := newTestMediaSection("audio 10000 RTP/SAVP 0", "crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR")
+    subc, err := rtpps.caller.secure(sect, 0)
+    if err != nil || len(subc) != 0 || len(sect.GetCryptos()) != 1 {
+        t.Fatal("The SRTP stream has been changed without the policy")
+    }
+
+    // SRTP handset on the caller leg, RTP trunk on the callee one
+    rtpps.SetCallerMediaSecurity(MEDIA_SECURITY_SRTP)
+    rtpps.SetCalleeMediaSecurity(MEDIA_SECURITY_RTP)
+    sect = newTestMediaSection("audio 10000 RTP/SAVP 0",
+        "crypto:2 AES_CM_128_HMAC_SHA1_32 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:32")
+    subc, err = rtpps.caller.secure(sect, 0)
+    if err != nil {
+        t.Fatal("Cannot process the offer: " + err.Error())
+    }
+    assertStringEqual(sect.String(), "m=audio 10000 RTP/AVP 0\r\nc=IN IP4 1.1.1.1\r\n", t)
+    assertStringEqual(strings.Join(subc, " && "), "M5:1 D AES_CM_128_HMAC_SHA1_32 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR", t)
+
+    sect = newTestMediaSection("audio 20000 RTP/AVP 0")
+    subc, err = rtpps.callee.secure(sect, 0)
+    if err != nil {
+        t.Fatal("Cannot process the answer: " + err.Error())
+    }
+    cryptos := sect.GetCryptos()
+    if sect.GetMHeader().GetTransport() != "RTP/SAVP" || len(cryptos) != 1 || len(cryptos[0].GetKey()) != 40 {
+        t.Fatal("No SRTP key generated for the caller: " + sect.String())
+    }
+    if cryptos[0].GetTag() != 2 || cryptos[0].GetSuite() != "AES_CM_128_HMAC_SHA1_32" {
+        t.Fatal("The answer does not match the crypto offered: " + sect.String())
+    }
+    key := cryptos[0].GetKey()
+    assertStringEqual(strings.Join(subc, " && "), "M5:1 E AES_CM_128_HMAC_SHA1_32 inline:" + key, t)
+
+    // The key is kept across the re-offers
+    sect = newTestMediaSection("audio 20002 RTP/AVP 0")
+    if _, err = rtpps.callee.secure(sect, 0); err != nil {
+        t.Fatal("Cannot process the re-offer: " + err.Error())
+    }
+    assertStringEqual(sect.GetCryptos()[0].GetKey(), key, t)
+
+    // The policies are enforced
+    sect = newTestMediaSection("audio 10000 RTP/AVP 0")
+    if _, err = rtpps.caller.secure(sect, 0); err == nil {
+        t.Fatal("Plain RTP has been accepted from the SRTP leg")
+    }
+    if code, _ := sdpFailure(err); code != 488 {
+        t.Fatal("Unexpected rejection code")
+    }
+    sect = newTestMediaSection("audio 20000 RTP/SAVP 0", "crypto:1 F8_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR")
+    if _, err = rtpps.callee.secure(sect, 0); err == nil {
+        t.Fatal("SRTP has been accepted from the RTP leg")
+    }
+
+    // The disabled streams are left alone
+    sect = newTestMediaSection("video 0 RTP/AVP 31")
+    if subc, err = rtpps.caller.secure(sect, 1); err != nil || len(subc) != 0 {
+        t.Fatal("The rejected stream must not be checked against the policy")
+    }
+    assertStringEqual(sect.String(), "m=video 0 RTP/AVP 31\r\nc=IN IP4 1.1.1.1\r\n", t)
+}
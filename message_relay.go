@@ -0,0 +1,151 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "sync"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+    "github.com/braams/sippy/utils"
+)
+
+// MessageRelay forwards an out-of-dialog MESSAGE (RFC 3428) as a new
+// request with the same body and content type and returns the final
+// response of the far end to the originator. It is intended to be
+// returned as the request receiver from CallMap.OnNewDialog().
+type MessageRelay struct {
+    sip_tm          sippy_types.SipTransactionManager
+    config          sippy_conf.Config
+    nh_address      *sippy_net.HostPort
+    ruri            *sippy_header.SipURL
+    local_ua        *sippy_header.SipUserAgent
+    pass_headers    []string
+}
+
+// The end-to-end headers of a MESSAGE that are relayed along with the body.
+var message_pass_headers = []string{ "subject", "date", "expires", "priority", "in-reply-to", "reply-to", "organization" }
+
+// messagePassHeaders collects the headers of the MESSAGE to be passed on,
+// both the standard ones and the extra ones named by the application.
+func messagePassHeaders(req sippy_types.SipRequest, names []string) []sippy_header.SipHeader {
+    rval := []sippy_header.SipHeader{}
+    seen := make(map[string]bool)
+    for _, name := range append(message_pass_headers, names...) {
+        name = strings.ToLower(name)
+        if ! seen[name] {
+            seen[name] = true
+            rval = append(rval, req.GetHFs(name)...)
+        }
+    }
+    return rval
+}
+
+// NewMessageRelay creates a relay sending the request to nh_address.
+// When ruri is nil the Request-URI of the incoming request is kept.
+func NewMessageRelay(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, nh_address *sippy_net.HostPort, ruri *sippy_header.SipURL) *MessageRelay {
+    return &MessageRelay{
+        sip_tm          : sip_tm,
+        config          : config,
+        nh_address      : nh_address,
+        ruri            : ruri,
+        local_ua        : sippy_header.NewSipUserAgent(config.GetMyUAName()),
+    }
+}
+
+func (self *MessageRelay) SetLocalUA(local_ua *sippy_header.SipUserAgent) {
+    self.local_ua = local_ua
+}
+
+// SetPassHeaders names the headers to be relayed in addition to the
+// standard end-to-end ones.
+func (self *MessageRelay) SetPassHeaders(names []string) {
+    self.pass_headers = names
+}
+
+func (self *MessageRelay) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.Ua_context {
+    server := self.local_ua.AsSipServer()
+    if req.GetMethod() != "MESSAGE" {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(501, "Not Implemented", nil, server) }
+    }
+    var max_forwards *sippy_header.SipMaxForwards
+    if req.GetMaxForwards() != nil {
+        mf_body, err := req.GetMaxForwards().GetBody()
+        if err != nil {
+            self.config.ErrorLogger().Error("MessageRelay::RecvRequest: #1: " + err.Error())
+            return &sippy_types.Ua_context{ Response : req.GenResponse(400, "Bad Request", nil, server) }
+        }
+        if mf_body.Number <= 1 {
+            return &sippy_types.Ua_context{ Response : req.GenResponse(483, "Too Many Hops", nil, server) }
+        }
+        max_forwards = sippy_header.NewSipMaxForwards(mf_body.Number - 1)
+    }
+    from, err := req.GetFrom().GetBody()
+    if err != nil {
+        self.config.ErrorLogger().Error("MessageRelay::RecvRequest: #2: " + err.Error())
+        return &sippy_types.Ua_context{ Response : req.GenResponse(400, "Bad Request", nil, server) }
+    }
+    to, err := req.GetTo().GetBody()
+    if err != nil {
+        self.config.ErrorLogger().Error("MessageRelay::RecvRequest: #3: " + err.Error())
+        return &sippy_types.Ua_context{ Response : req.GenResponse(400, "Bad Request", nil, server) }
+    }
+    ruri := self.ruri
+    if ruri == nil {
+        ruri = req.GetRURI()
+    }
+    from = from.GetCopy()
+    from.SetTag(sippy_utils.GenTag())
+    var body sippy_types.MsgBody
+    if req.GetBody() != nil {
+        body = req.GetBody().GetCopy()
+    }
+    out, err := NewSipRequest("MESSAGE", ruri.GetCopy(), /*sipver*/ "",
+                    sippy_header.NewSipTo(to.GetCopy(), self.config), sippy_header.NewSipFrom(from, self.config),
+                    /*via*/ nil, /*cseq*/ 1, sippy_header.GenerateSipCallId(self.config), max_forwards,
+                    body, /*contact*/ nil, /*routes*/ nil, self.nh_address, /*cguid*/ nil,
+                    self.local_ua, /*expires*/ nil, self.config)
+    if err != nil {
+        self.config.ErrorLogger().Error("MessageRelay::RecvRequest: #4: " + err.Error())
+        return &sippy_types.Ua_context{ Response : req.GenResponse(500, "Server Internal Error", nil, server) }
+    }
+    for _, hf := range messagePassHeaders(req, self.pass_headers) {
+        out.AppendHeader(hf)
+    }
+    event := NewCCEventMessage(req.GetRtime(), "", body)
+    event.SetResponseCb(func(scode int, scode_reason string) {
+        t.SendResponse(req.GenResponse(scode, scode_reason, nil, server), false, nil)
+    })
+    if _, err = self.sip_tm.BeginNewClientTransaction(out, newMessageController(event), new(sync.Mutex), nil, nil, nil); err != nil {
+        self.config.ErrorLogger().Error("MessageRelay::RecvRequest: #5: " + err.Error())
+        return &sippy_types.Ua_context{ Response : req.GenResponse(500, "Server Internal Error", nil, server) }
+    }
+    return &sippy_types.Ua_context{}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+    "github.com/braams/sippy/types"
+)
+
+type test_message_map struct {
+    config      sippy_conf.Config
+    sip_tm      sippy_types.SipTransactionManager
+}
+
+func (self *test_message_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+    return nil, NewMessageRelay(self.sip_tm, self.config, sippy_net.NewHostPort("3.3.3.3", "5060"), nil), nil
+}
+
+func Test_MessageRelay(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := &test_message_map{ config : config }
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    tfactory.feed([]string{
+        "MESSAGE sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKmsg1",
+        "Max-Forwards: 70",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>",
+        "Call-ID: message-test@1.1.1.1",
+        "CSeq: 1 MESSAGE",
+        "Subject: greeting",
+        "Content-Type: text/plain",
+        "Content-Length: 5",
+        "",
+        "hello",
+    })
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse MESSAGE: " + err.Error())
+    }
+    assertStringEqual(req.GetMethod(), "MESSAGE", t)
+    assertStringEqual(req.GetBody().GetMtype(), "text/plain", t)
+    assertStringEqual(req.GetBody().String(), "hello", t)
+    if req.GetCallId().CallId == "message-test@1.1.1.1" {
+        t.Fatal("The relayed MESSAGE must use a new Call-ID")
+    }
+    if subject := req.GetHFs("subject"); len(subject) != 1 || subject[0].StringBody() != "greeting" {
+        t.Fatal("The Subject header has not been relayed")
+    }
+    tfactory.feed([]string{ req.GenResponse(202, "Accepted", nil, nil).LocalStr(nil, false) })
+    resp := string(tfactory.get())
+    if ! strings.HasPrefix(resp, "SIP/2.0 202 Accepted") || ! strings.Contains(resp, "message-test@1.1.1.1") {
+        t.Fatal("The delivery status has not been relayed:\n" + resp)
+    }
+}
+
+func Test_InDialogMessage(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    tfactory.feed([]string{
+        "INVITE sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKimsg1",
+        "Max-Forwards: 70",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>",
+        "Contact: <sip:100@1.1.1.1:5060>",
+        "Call-ID: imsg-test@1.1.1.1",
+        "CSeq: 1 INVITE",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+    tfactory.get() // 100 Trying
+    cmap.lock.Lock()
+    cmap.answer()
+    cmap.lock.Unlock()
+    rtime, _ := sippy_time.NewMonoTime()
+    ok200, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse 200 OK: " + err.Error())
+    }
+    to, _ := ok200.GetTo().GetBody()
+    message := func(cseq string) string {
+        tfactory.feed([]string{
+            "MESSAGE sip:200@192.168.0.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKimsg" + cseq,
+            "Max-Forwards: 70",
+            "From: <sip:100@1.1.1.1>;tag=abc",
+            "To: <sip:200@192.168.0.1>;tag=" + to.GetTag(),
+            "Call-ID: imsg-test@1.1.1.1",
+            "CSeq: " + cseq + " MESSAGE",
+            "Content-Type: text/plain",
+            "Content-Length: 5",
+            "",
+            "hello",
+        })
+        return string(tfactory.get())
+    }
+    // the call controller does not pass the message on
+    if resp := message("2"); ! strings.HasPrefix(resp, "SIP/2.0 501 ") {
+        t.Fatal("The MESSAGE that is not passed on must be rejected at once:\n" + resp)
+    }
+    cmap.lock.Lock()
+    cmap.disconnect()
+    cmap.lock.Unlock()
+    tfactory.get() // BYE
+    // nobody to pass the message to once the call is over
+    if resp := message("3"); ! strings.HasPrefix(resp, "SIP/2.0 488 ") {
+        t.Fatal("The MESSAGE outside of the Connected state must be rejected:\n" + resp)
+    }
+}
@@ -114,61 +114,21 @@ func (self *msgBody) GetParsedBody() (sippy_types.ParsedMsgBody, error) {
 }
 
 func (self *msgBody) parse() error {
-    self.parsed_body = newGenericMsgBody(self.string_content)
-    if strings.HasPrefix(self.mtype, "multipart/mixed;") {
-        arr := strings.SplitN(self.mtype, ";", 2)
-        mtheaders := arr[1]
-        var mth_boundary *string = nil
-        for _, s := range strings.Split(mtheaders, ";") {
-            arr = strings.SplitN(s, "=", 2)
-            if arr[0] == "boundary" && len(arr) == 2 {
-                mth_boundary = &arr[1]
-                break
-            }
-        }
-        if mth_boundary == nil {
-            return fmt.Errorf("Error parsing the multipart message")
-        }
-        boundary := "--" + *mth_boundary
-        for _, subsection := range strings.Split(self.string_content, boundary) {
-            subsection = strings.TrimSpace(subsection)
-            if subsection == "" { continue }
-            boff, bdel := -1, ""
-            for _, bdel = range []string{ "\r\n\r\n", "\r\r", "\n\n" } {
-                boff = strings.Index(subsection, bdel)
-                if boff != -1 {
-                    break
-                }
-            }
-            if boff == -1 {
-                continue
-            }
-            mbody := subsection[boff + len(bdel):]
-            mtype := ""
-            for _, line := range strings.FieldsFunc(subsection[:boff], func(c rune) bool { return c == '\n' || c == '\r' }) {
-                tmp := strings.ToLower(strings.TrimSpace(line))
-                if strings.HasPrefix(tmp, "content-type:") {
-                    arr = strings.SplitN(tmp, ":", 2)
-                    mtype = strings.TrimSpace(arr[1])
-                }
-            }
-            if mtype == "" {
-                continue
-            }
-            if mtype == "application/sdp" {
-                self.mtype = mtype
-                self.string_content = mbody
-                break
-            }
+    switch mtype := mimeMediaType(self.mtype); {
+    case strings.HasPrefix(mtype, "multipart/"):
+        parsed_body, err := parseMultipartBody(self.string_content, self.mtype)
+        if err != nil {
+            return err
         }
-    }
-    if self.mtype == "application/sdp" {
+        self.parsed_body = parsed_body
+    case mtype == "application/sdp":
         parsed_body, err := ParseSdpBody(self.string_content)
-        if err == nil {
-            self.parsed_body = parsed_body
-        } else {
+        if err != nil {
             return fmt.Errorf("error parsing the SDP: %s", err.Error())
         }
+        self.parsed_body = parsed_body
+    default:
+        self.parsed_body = newGenericMsgBody(self.string_content)
     }
     return nil
 }
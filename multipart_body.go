@@ -0,0 +1,397 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/sdp"
+    "github.com/braams/sippy/types"
+)
+
+// mimeMediaType returns the lower case type/subtype without parameters.
+func mimeMediaType(mtype string) string {
+    return strings.ToLower(strings.TrimSpace(strings.SplitN(mtype, ";", 2)[0]))
+}
+
+// normalizeMtype lower cases the type/subtype but keeps the parameters
+// intact since the multipart boundary is case sensitive.
+func normalizeMtype(mtype string) string {
+    arr := strings.SplitN(mtype, ";", 2)
+    rval := mimeMediaType(arr[0])
+    if len(arr) == 2 {
+        rval += ";" + strings.TrimSpace(arr[1])
+    }
+    return rval
+}
+
+func mimeParam(mtype, name string) string {
+    arr := strings.Split(mtype, ";")
+    for _, param := range arr[1:] {
+        kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+        if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), name) {
+            return strings.Trim(strings.TrimSpace(kv[1]), "\"")
+        }
+    }
+    return ""
+}
+
+type mimeHeader struct {
+    name    string
+    value   string
+}
+
+// MimePart is a single body part of the multipart body (RFC 2046). The
+// part headers are kept in the original order. The Content-Type of the
+// part is the type of its body.
+type MimePart struct {
+    headers []*mimeHeader
+    body    sippy_types.MsgBody
+}
+
+func NewMimePart(mtype, content string) *MimePart {
+    return &MimePart{
+        headers : []*mimeHeader{ &mimeHeader{ "Content-Type", mtype } },
+        body    : NewMsgBody(content, normalizeMtype(mtype)),
+    }
+}
+
+func (self *MimePart) GetBody() sippy_types.MsgBody {
+    return self.body
+}
+
+func (self *MimePart) GetMtype() string {
+    return self.body.GetMtype()
+}
+
+// GetHeader returns the value of the part header or "" if there is none.
+func (self *MimePart) GetHeader(name string) string {
+    for _, hdr := range self.headers {
+        if strings.EqualFold(hdr.name, name) {
+            return hdr.value
+        }
+    }
+    return ""
+}
+
+// SetHeader replaces the value of the part header or adds it. Setting
+// the Content-Type changes the type of the body.
+func (self *MimePart) SetHeader(name, value string) {
+    if strings.EqualFold(name, "content-type") {
+        self.body = NewMsgBody(self.body.String(), normalizeMtype(value))
+    }
+    for _, hdr := range self.headers {
+        if strings.EqualFold(hdr.name, name) {
+            hdr.value = value
+            return
+        }
+    }
+    self.headers = append(self.headers, &mimeHeader{ name, value })
+}
+
+func (self *MimePart) DelHeader(name string) {
+    headers := make([]*mimeHeader, 0, len(self.headers))
+    for _, hdr := range self.headers {
+        if ! strings.EqualFold(hdr.name, name) {
+            headers = append(headers, hdr)
+        }
+    }
+    self.headers = headers
+}
+
+// GetHeaderNames returns the names of the part headers in order.
+func (self *MimePart) GetHeaderNames() []string {
+    rval := make([]string, len(self.headers))
+    for i, hdr := range self.headers {
+        rval[i] = hdr.name
+    }
+    return rval
+}
+
+func (self *MimePart) GetCopy() *MimePart {
+    rval := &MimePart{
+        headers : make([]*mimeHeader, len(self.headers)),
+        body    : self.body.GetCopy(),
+    }
+    for i, hdr := range self.headers {
+        rval.headers[i] = &mimeHeader{ hdr.name, hdr.value }
+    }
+    return rval
+}
+
+func (self *MimePart) localStr(hostport *sippy_net.HostPort) string {
+    content := self.body.LocalStr(hostport)
+    s := ""
+    for _, hdr := range self.headers {
+        value := hdr.value
+        if strings.EqualFold(hdr.name, "content-length") {
+            value = strconv.Itoa(len(content))
+        }
+        s += hdr.name + ": " + value + "\r\n"
+    }
+    return s + "\r\n" + content
+}
+
+// MultipartBody keeps all of the parts of the multipart/* body. The SDP
+// related methods operate on the first application/sdp part so the
+// offer/answer and the media relaying work the same way as with the
+// plain SDP body.
+type MultipartBody struct {
+    boundary    string
+    parts       []*MimePart
+}
+
+// NewMultipartMsgBody creates a multipart/mixed message body out of the
+// parts.
+func NewMultipartMsgBody(parts ...*MimePart) *msgBody {
+    buf := make([]byte, 12)
+    rand.Read(buf)
+    mp := &MultipartBody{
+        boundary    : fmt.Sprintf("sippy-%x", buf),
+        parts       : parts,
+    }
+    self := NewMsgBody("", "multipart/mixed;boundary=" + mp.boundary)
+    self.parsed_body = mp
+    return self
+}
+
+func parseMultipartBody(content, mtype string) (*MultipartBody, error) {
+    boundary := mimeParam(mtype, "boundary")
+    if boundary == "" {
+        return nil, errors.New("Error parsing the multipart message: no boundary")
+    }
+    self := &MultipartBody{
+        boundary    : boundary,
+        parts       : make([]*MimePart, 0),
+    }
+    delim := "--" + boundary
+    // skip the preamble
+    idx := strings.Index(content, delim)
+    if idx == -1 || (idx > 0 && content[idx - 1] != '\n') {
+        return nil, errors.New("Error parsing the multipart message: no delimiter")
+    }
+    rest := content[idx + len(delim):]
+    for {
+        if strings.HasPrefix(rest, "--") {
+            // close-delimiter
+            return self, nil
+        }
+        eol := strings.Index(rest, "\n")
+        if eol == -1 {
+            break
+        }
+        rest = rest[eol + 1:]
+        end := strings.Index(rest, "\n" + delim)
+        if end == -1 {
+            break
+        }
+        next := rest[end + 1 + len(delim):]
+        if end > 0 && rest[end - 1] == '\r' {
+            end--
+        }
+        part, err := parseMimePart(rest[:end])
+        if err != nil {
+            return nil, err
+        }
+        self.parts = append(self.parts, part)
+        rest = next
+    }
+    return nil, errors.New("Error parsing the multipart message: no close delimiter")
+}
+
+func parseMimePart(s string) (*MimePart, error) {
+    self := &MimePart{
+        headers : make([]*mimeHeader, 0),
+    }
+    var hdrs, content string
+    if strings.HasPrefix(s, "\r\n") {
+        content = s[2:]
+    } else if strings.HasPrefix(s, "\n") {
+        content = s[1:]
+    } else {
+        boff, bdel := -1, ""
+        for _, bdel = range []string{ "\r\n\r\n", "\n\n" } {
+            if boff = strings.Index(s, bdel); boff != -1 {
+                break
+            }
+        }
+        if boff == -1 {
+            return nil, errors.New("Error parsing the multipart message: bad part")
+        }
+        hdrs, content = s[:boff], s[boff + len(bdel):]
+    }
+    for _, line := range strings.Split(strings.Replace(hdrs, "\r\n", "\n", -1), "\n") {
+        if line == "" {
+            continue
+        }
+        if (line[0] == ' ' || line[0] == '\t') && len(self.headers) > 0 {
+            // folded header
+            last := self.headers[len(self.headers) - 1]
+            last.value += " " + strings.TrimSpace(line)
+            continue
+        }
+        arr := strings.SplitN(line, ":", 2)
+        if len(arr) != 2 {
+            return nil, errors.New("Error parsing the multipart message: bad part header")
+        }
+        self.headers = append(self.headers, &mimeHeader{ strings.TrimSpace(arr[0]), strings.TrimSpace(arr[1]) })
+    }
+    mtype := self.GetHeader("content-type")
+    if mtype == "" {
+        mtype = "text/plain"
+    }
+    self.body = NewMsgBody(content, normalizeMtype(mtype))
+    return self, nil
+}
+
+func (self *MultipartBody) GetBoundary() string {
+    return self.boundary
+}
+
+func (self *MultipartBody) GetParts() []*MimePart {
+    return self.parts
+}
+
+func (self *MultipartBody) AddPart(part *MimePart) {
+    self.parts = append(self.parts, part)
+}
+
+func (self *MultipartBody) RemovePart(idx int) {
+    if idx >= 0 && idx < len(self.parts) {
+        self.parts = append(self.parts[:idx], self.parts[idx + 1:]...)
+    }
+}
+
+func (self *MultipartBody) ReplacePart(idx int, part *MimePart) {
+    if idx >= 0 && idx < len(self.parts) {
+        self.parts[idx] = part
+    }
+}
+
+// FindPart returns the index of the first part of the given type/subtype
+// or -1.
+func (self *MultipartBody) FindPart(mtype string) int {
+    mtype = mimeMediaType(mtype)
+    for i, part := range self.parts {
+        if mimeMediaType(part.GetMtype()) == mtype {
+            return i
+        }
+    }
+    return -1
+}
+
+func (self *MultipartBody) String() string {
+    return self.LocalStr(nil)
+}
+
+func (self *MultipartBody) LocalStr(hostport *sippy_net.HostPort) string {
+    s := ""
+    for _, part := range self.parts {
+        s += "--" + self.boundary + "\r\n" + part.localStr(hostport) + "\r\n"
+    }
+    return s + "--" + self.boundary + "--\r\n"
+}
+
+func (self *MultipartBody) GetCopy() sippy_types.ParsedMsgBody {
+    rval := &MultipartBody{
+        boundary    : self.boundary,
+        parts       : make([]*MimePart, len(self.parts)),
+    }
+    for i, part := range self.parts {
+        rval.parts[i] = part.GetCopy()
+    }
+    return rval
+}
+
+// sdp returns the parsed SDP part or nil.
+func (self *MultipartBody) sdp() sippy_types.ParsedMsgBody {
+    idx := self.FindPart("application/sdp")
+    if idx == -1 {
+        return nil
+    }
+    parsed_body, err := self.parts[idx].body.GetParsedBody()
+    if err != nil {
+        return nil
+    }
+    return parsed_body
+}
+
+func (self *MultipartBody) GetCHeader() *sippy_sdp.SdpConnecton {
+    if sdp := self.sdp(); sdp != nil {
+        return sdp.GetCHeader()
+    }
+    return nil
+}
+
+func (self *MultipartBody) SetCHeaderAddr(addr string) {
+    if sdp := self.sdp(); sdp != nil {
+        sdp.SetCHeaderAddr(addr)
+    }
+}
+
+func (self *MultipartBody) GetSections() []*sippy_sdp.SdpMediaDescription {
+    if sdp := self.sdp(); sdp != nil {
+        return sdp.GetSections()
+    }
+    return make([]*sippy_sdp.SdpMediaDescription, 0)
+}
+
+func (self *MultipartBody) SetSections(sections []*sippy_sdp.SdpMediaDescription) {
+    if sdp := self.sdp(); sdp != nil {
+        sdp.SetSections(sections)
+    }
+}
+
+func (self *MultipartBody) RemoveSection(idx int) {
+    if sdp := self.sdp(); sdp != nil {
+        sdp.RemoveSection(idx)
+    }
+}
+
+func (self *MultipartBody) GetOHeader() *sippy_sdp.SdpOrigin {
+    if sdp := self.sdp(); sdp != nil {
+        return sdp.GetOHeader()
+    }
+    return nil
+}
+
+func (self *MultipartBody) SetOHeader(o_header *sippy_sdp.SdpOrigin) {
+    if sdp := self.sdp(); sdp != nil {
+        sdp.SetOHeader(o_header)
+    }
+}
+
+func (self *MultipartBody) AppendAHeader(hdr string) {
+    if sdp := self.sdp(); sdp != nil {
+        sdp.AppendAHeader(hdr)
+    }
+}
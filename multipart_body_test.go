@@ -0,0 +1,110 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/time"
+)
+
+func Test_MultipartBody(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    isup := "\x01\x00\x60\x00\x0a\x03\x02\x0a\x08\x83\x90\x89\x08\x0d\x0a\x20\x00"
+    body := strings.Join([]string{
+        "--unique-Boundary",
+        "Content-Type: application/sdp",
+        "",
+        "v=0",
+        "o=- 1 1 IN IP4 1.1.1.1",
+        "s=-",
+        "c=IN IP4 1.1.1.1",
+        "t=0 0",
+        "m=audio 11111 RTP/AVP 0",
+        "",
+        "--unique-Boundary",
+        "Content-Type: application/ISUP;version=itu-t92+",
+        "Content-Disposition: signal;handling=required",
+        "",
+        isup,
+        "--unique-Boundary--",
+        "",
+    }, "\r\n")
+    lines := []string{
+        "INVITE sip:200@2.2.2.2 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK1",
+        "From: <sip:100@1.1.1.1>;tag=12345",
+        "To: <sip:200@2.2.2.2>",
+        "Call-ID: multipart-test@1.1.1.1",
+        "CSeq: 1 INVITE",
+        "Contact: <sip:100@1.1.1.1>",
+        "Content-Type: multipart/mixed;boundary=unique-Boundary",
+        "Content-Length: " + strconv.Itoa(len(body)),
+        "",
+        body,
+    }
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest([]byte(strings.Join(lines, "\r\n")), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    parsed_body, err := req.GetBody().GetParsedBody()
+    if err != nil {
+        t.Fatal("Cannot parse the body: " + err.Error())
+    }
+    mp, ok := parsed_body.(*MultipartBody)
+    if ! ok || len(mp.GetParts()) != 2 {
+        t.Fatal("Both parts must be kept")
+    }
+    assertStringEqual(mp.GetParts()[1].GetBody().String(), isup, t)
+    assertStringEqual(mp.GetParts()[1].GetHeader("content-disposition"), "signal;handling=required", t)
+
+    // The SDP part is what the media handling sees
+    parsed_body.SetCHeaderAddr("3.3.3.3")
+    mp.AddPart(NewMimePart("application/x-test", "test"))
+    mp.RemovePart(mp.FindPart("application/x-test"))
+
+    req2, err := ParseSipRequest(req.Bytes(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse the rebuilt INVITE: " + err.Error())
+    }
+    parsed_body, err = req2.GetBody().GetParsedBody()
+    if err != nil {
+        t.Fatal("Cannot parse the rebuilt body: " + err.Error())
+    }
+    mp = parsed_body.(*MultipartBody)
+    if len(mp.GetParts()) != 2 {
+        t.Fatal("The rebuilt body must have both parts")
+    }
+    assertStringEqual(mp.GetSections()[0].GetCHeader().GetAddr(), "3.3.3.3", t)
+    assertStringEqual(mp.GetParts()[1].GetBody().String(), isup, t)
+    assertStringEqual(mp.GetParts()[1].GetMtype(), "application/isup;version=itu-t92+", t)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sippy_net
+
+import (
+    "net"
+    "strings"
+)
+
+// TrustDomain is the set of hosts whose network asserted identities are
+// trusted (RFC 3325). The hosts are given as IP addresses, CIDR networks
+// or host names.
+type TrustDomain struct {
+    nets    []*net.IPNet
+    hosts   map[string]bool
+}
+
+func NewTrustDomain(specs ...string) (*TrustDomain, error) {
+    self := &TrustDomain{
+        nets    : make([]*net.IPNet, 0),
+        hosts   : make(map[string]bool),
+    }
+    for _, spec := range specs {
+        if err := self.Add(spec); err != nil {
+            return nil, err
+        }
+    }
+    return self, nil
+}
+
+func (self *TrustDomain) Add(spec string) error {
+    spec = strings.TrimSpace(spec)
+    if strings.IndexRune(spec, '/') != -1 {
+        _, ipnet, err := net.ParseCIDR(spec)
+        if err != nil {
+            return err
+        }
+        self.nets = append(self.nets, ipnet)
+        return nil
+    }
+    if ip := net.ParseIP(spec); ip != nil {
+        spec = ip.String()
+    }
+    self.hosts[strings.ToLower(spec)] = true
+    return nil
+}
+
+func (self *TrustDomain) IsTrusted(addr *HostPort) bool {
+    if self == nil || addr == nil {
+        return false
+    }
+    ip := addr.ParseIP()
+    if ip == nil {
+        return self.hosts[strings.ToLower(addr.Host.String())]
+    }
+    if self.hosts[ip.String()] {
+        return true
+    }
+    for _, ipnet := range self.nets {
+        if ipnet.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+    "github.com/braams/sippy/utils"
+)
+
+// Notifier is the UAS side of a subscription. An instance is normally
+// returned from the CallMap.OnNewDialog() as a request receiver for the
+// initial SUBSCRIBE. All public methods must be called with the session
+// lock held.
+type Notifier struct {
+    *subscriptionDialog
+    pkg             EventPackage
+    state           string
+    min_expires     int
+    max_expires     int
+    expires_at      time.Time
+    expires_timer   *Timeout
+    notify_inflight bool
+    notify_pending  bool
+    terminate_reason string
+    terminated_cb   func(*Notifier, string)
+}
+
+func NewNotifier(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, pkg EventPackage, session_lock sync.Locker) *Notifier {
+    return &Notifier{
+        subscriptionDialog  : newSubscriptionDialog(sip_tm, config, session_lock),
+        pkg                 : pkg,
+        min_expires         : 60,
+        max_expires         : 3600,
+    }
+}
+
+func (self *Notifier) SetMinExpires(min_expires int) {
+    self.min_expires = min_expires
+}
+
+func (self *Notifier) SetMaxExpires(max_expires int) {
+    self.max_expires = max_expires
+}
+
+func (self *Notifier) SetTerminatedCb(cb func(*Notifier, string)) {
+    self.terminated_cb = cb
+}
+
+func (self *Notifier) GetState() string {
+    return self.state
+}
+
+func (self *Notifier) IsYours(req sippy_types.SipRequest, br0k3n_to bool) bool {
+    return self.state != sippy_header.SUBSCRIPTION_STATE_TERMINATED && self.isYours(req)
+}
+
+func (self *Notifier) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.Ua_context {
+    if self.call_id == nil {
+        return self.recvInitialSubscribe(req, t)
+    }
+    if ! self.checkCSeq(req) {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(500, "Server Internal Error", nil, self.local_ua.AsSipServer()) }
+    }
+    if req.GetMethod() != "SUBSCRIBE" {
+        resp := req.GenResponse(405, "Method Not Allowed", nil, self.local_ua.AsSipServer())
+        resp.AppendHeader(sippy_header.NewSipAllow("SUBSCRIBE"))
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    expires, resp := self.checkExpires(req)
+    if resp != nil {
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    if expires == 0 {
+        t.SendResponse(self.genResponse(req, 200, "OK", 0), false, nil)
+        self.Terminate("timeout")
+        return nil
+    }
+    scode, reason := self.pkg.Authorize(self, req)
+    if scode >= 300 {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(scode, reason, nil, self.local_ua.AsSipServer()) }
+    }
+    if err := self.updateRouting(req, /*reverse_routes*/ false); err != nil {
+        self.logError("Notifier::RecvRequest: #1: " + err.Error())
+    }
+    t.SendResponse(self.genResponse(req, scode, reason, expires), false, nil)
+    if scode == 200 {
+        self.state = sippy_header.SUBSCRIPTION_STATE_ACTIVE
+    }
+    self.startExpiresTimer(expires)
+    self.Notify()
+    return nil
+}
+
+func (self *Notifier) recvInitialSubscribe(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.Ua_context {
+    if req.GetMethod() != "SUBSCRIBE" {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(481, "Call Leg/Transaction Does Not Exist", nil, self.local_ua.AsSipServer()) }
+    }
+    event, err := getSipEventBody(req)
+    if err != nil || event == nil || event.Package != self.pkg.Name() {
+        resp := req.GenResponse(489, "Bad Event", nil, self.local_ua.AsSipServer())
+        resp.AppendHeader(sippy_header.NewSipGenericHF("Allow-Events", self.pkg.Name()))
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    if len(req.GetContacts()) == 0 {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(400, "Bad Request (No Contact)", nil, self.local_ua.AsSipServer()) }
+    }
+    expires, resp := self.checkExpires(req)
+    if resp != nil {
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    scode, reason := self.pkg.Authorize(self, req)
+    if scode >= 300 {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(scode, reason, nil, self.local_ua.AsSipServer()) }
+    }
+    to_body, err := req.GetTo().GetBody()
+    if err != nil {
+        self.logError("Notifier::recvInitialSubscribe: #1: " + err.Error())
+        return nil
+    }
+    from_body, err := req.GetFrom().GetBody()
+    if err != nil {
+        self.logError("Notifier::recvInitialSubscribe: #2: " + err.Error())
+        return nil
+    }
+    self.event = event.GetCopy()
+    self.call_id = req.GetCallId().GetCopy()
+    self.lTag = sippy_utils.GenTag()
+    to_body = to_body.GetCopy()
+    to_body.SetTag(self.lTag)
+    self.lUri = sippy_header.NewSipFrom(to_body, self.config)
+    self.rUri = sippy_header.NewSipTo(from_body.GetCopy(), self.config)
+    self.lContact = sippy_header.NewSipContact(self.config)
+    self.lCSeq = 1
+    self.checkCSeq(req)
+    if err = self.updateRouting(req, /*reverse_routes*/ false); err != nil {
+        self.logError("Notifier::recvInitialSubscribe: #3: " + err.Error())
+        return nil
+    }
+    self.state = sippy_header.SUBSCRIPTION_STATE_PENDING
+    if scode == 200 {
+        self.state = sippy_header.SUBSCRIPTION_STATE_ACTIVE
+    }
+    t.SendResponse(self.genResponse(req, scode, reason, expires), false, nil)
+    if expires == 0 {
+        // A fetch: report the current state and forget the subscription
+        self.terminate_reason = "timeout"
+        self.state = sippy_header.SUBSCRIPTION_STATE_TERMINATED
+        self.sendNotify()
+        return nil
+    }
+    self.register(self)
+    self.startExpiresTimer(expires)
+    self.Notify()
+    return nil
+}
+
+// checkExpires returns the granted subscription duration or an error
+// response to be sent instead.
+func (self *Notifier) checkExpires(req sippy_types.SipRequest) (int, sippy_types.SipResponse) {
+    expires, ok := getSipExpires(req)
+    if ! ok {
+        expires = self.pkg.DefaultExpires()
+    }
+    if expires > 0 && expires < self.min_expires {
+        resp := req.GenResponse(423, "Interval Too Brief", nil, self.local_ua.AsSipServer())
+        resp.AppendHeader(sippy_header.NewSipGenericHF("Min-Expires", strconv.Itoa(self.min_expires)))
+        return 0, resp
+    }
+    if self.max_expires > 0 && expires > self.max_expires {
+        expires = self.max_expires
+    }
+    return expires, nil
+}
+
+func (self *Notifier) genResponse(req sippy_types.SipRequest, scode int, reason string, expires int) sippy_types.SipResponse {
+    resp := req.GenResponse(scode, reason, nil, self.local_ua.AsSipServer())
+    to_body, err := resp.GetTo().GetBody()
+    if err == nil {
+        to_body.SetTag(self.lTag)
+    }
+    resp.AppendHeader(self.lContact.GetCopy())
+    resp.AppendHeader(newSipExpiresValue(expires))
+    return resp
+}
+
+func (self *Notifier) startExpiresTimer(expires int) {
+    if self.expires_timer != nil {
+        self.expires_timer.Cancel()
+    }
+    self.expires_at = time.Now().Add(time.Duration(expires) * time.Second)
+    self.expires_timer = StartTimeout(self.expired, self.session_lock, time.Duration(expires) * time.Second, 1, self.config.ErrorLogger())
+}
+
+func (self *Notifier) expired() {
+    self.expires_timer = nil
+    self.Terminate("timeout")
+}
+
+// Activate moves a pending subscription into the active state once
+// the subscription has been authorized.
+func (self *Notifier) Activate() {
+    if self.state != sippy_header.SUBSCRIPTION_STATE_PENDING {
+        return
+    }
+    self.state = sippy_header.SUBSCRIPTION_STATE_ACTIVE
+    self.Notify()
+}
+
+// Notify sends the current resource state to the subscriber. If the
+// previous NOTIFY is still in progress the new one is sent when it
+// completes.
+func (self *Notifier) Notify() {
+    if self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED || self.call_id == nil {
+        return
+    }
+    if self.notify_inflight {
+        self.notify_pending = true
+        return
+    }
+    self.sendNotify()
+}
+
+// Terminate ends the subscription by sending the final NOTIFY with the
+// given reason (e.g. "noresource", "deactivated", "rejected").
+func (self *Notifier) Terminate(reason string) {
+    if self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED {
+        return
+    }
+    self.state = sippy_header.SUBSCRIPTION_STATE_TERMINATED
+    self.terminate_reason = reason
+    if self.expires_timer != nil {
+        self.expires_timer.Cancel()
+        self.expires_timer = nil
+    }
+    self.notify_pending = false
+    self.sendNotify()
+    self.unregister(self)
+    if self.terminated_cb != nil {
+        self.terminated_cb(self, reason)
+    }
+}
+
+func (self *Notifier) sendNotify() {
+    var ss *sippy_header.SipSubscriptionState
+
+    if self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED {
+        ss = sippy_header.NewSipSubscriptionState(self.state, -1, self.terminate_reason)
+    } else {
+        remaining := int(time.Until(self.expires_at) / time.Second)
+        if remaining < 0 {
+            remaining = 0
+        }
+        ss = sippy_header.NewSipSubscriptionState(self.state, remaining, "")
+    }
+    req, err := self.genRequest("NOTIFY", self.pkg.StateBody(self), /*expires*/ nil, ss)
+    if err != nil {
+        self.logError("Notifier::sendNotify: #1: " + err.Error())
+        return
+    }
+    self.notify_inflight = true
+    if _, err = self.sip_tm.BeginNewClientTransaction(req, self, self.session_lock, self.source_address, nil, nil); err != nil {
+        self.notify_inflight = false
+        self.logError("Notifier::sendNotify: #2: " + err.Error())
+    }
+}
+
+func (self *Notifier) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
+    code, _ := resp.GetSCode()
+    if code < 200 {
+        return
+    }
+    self.notify_inflight = false
+    if code == 481 || code == 408 {
+        // The subscriber has gone away
+        self.notify_pending = false
+        if self.state != sippy_header.SUBSCRIPTION_STATE_TERMINATED {
+            self.state = sippy_header.SUBSCRIPTION_STATE_TERMINATED
+            if self.expires_timer != nil {
+                self.expires_timer.Cancel()
+                self.expires_timer = nil
+            }
+            self.unregister(self)
+            if self.terminated_cb != nil {
+                self.terminated_cb(self, "giveup")
+            }
+        }
+        return
+    }
+    if self.notify_pending {
+        self.notify_pending = false
+        self.Notify()
+    }
+}
+
+func (self *Notifier) logError(args ...interface{}) {
+    self.config.ErrorLogger().Error(args...)
+}
@@ -0,0 +1,364 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "strings"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+)
+
+var telephone_subscriber_re = regexp.MustCompile(`^\+?[0-9*#().\-]*[0-9][0-9*#().\-]*$`)
+var e164_re = regexp.MustCompile(`^\+[1-9][0-9]{0,14}$`)
+
+// StripVisualSeparators removes the visual separators allowed in the
+// tel: URI (RFC 3966) from the telephone number. Anything that does not
+// look like a telephone number is returned as is.
+func StripVisualSeparators(number string) string {
+    if ! telephone_subscriber_re.MatchString(number) {
+        return number
+    }
+    return strings.Map(func(r rune) rune {
+        switch r {
+        case '-', '.', '(', ')':
+            return -1
+        }
+        return r
+    }, number)
+}
+
+func IsE164(number string) bool {
+    return e164_re.MatchString(number)
+}
+
+// TelURLNumber returns the telephone number of the tel: URI converted to
+// the SIP URL (see Config.SetAutoConvertTelUrl) or of the SIP URL with
+// user=phone. The local number is made global when the phone-context is
+// the global number prefix. The user part of any other URL is returned
+// as is.
+func TelURLNumber(url *sippy_header.SipURL) string {
+    if url.GetUsertype() != "phone" {
+        return url.Username
+    }
+    number := StripVisualSeparators(url.Username)
+    if strings.HasPrefix(number, "+") || ! telephone_subscriber_re.MatchString(number) {
+        return number
+    }
+    for _, param := range url.GetUserparams() {
+        arr := strings.SplitN(param, "=", 2)
+        if len(arr) == 2 && strings.ToLower(arr[0]) == "phone-context" && strings.HasPrefix(arr[1], "+") {
+            return StripVisualSeparators(arr[1]) + number
+        }
+    }
+    return number
+}
+
+// NumberingPlan describes how the numbers are dialled in the network,
+// i.e. "1", "011", "1" for NANP or "44", "00", "0" for the UK.
+type NumberingPlan struct {
+    CountryCode         string
+    InternationalPrefix string
+    NationalPrefix      string
+}
+
+// E164 converts the dialled number to the E.164 form with the leading
+// "+".
+func (self *NumberingPlan) E164(number string) (string, error) {
+    number = StripVisualSeparators(number)
+    switch {
+    case strings.HasPrefix(number, "+"):
+    case self.InternationalPrefix != "" && strings.HasPrefix(number, self.InternationalPrefix):
+        number = "+" + number[len(self.InternationalPrefix):]
+    case self.NationalPrefix != "" && strings.HasPrefix(number, self.NationalPrefix):
+        number = "+" + self.CountryCode + number[len(self.NationalPrefix):]
+    default:
+        number = "+" + self.CountryCode + number
+    }
+    if ! IsE164(number) {
+        return "", errors.New("not an E.164 number: " + number)
+    }
+    return number, nil
+}
+
+// Dial converts the E.164 number to the form dialled in the network.
+func (self *NumberingPlan) Dial(number string) (string, error) {
+    number, err := self.E164(number)
+    if err != nil {
+        return "", err
+    }
+    if strings.HasPrefix(number[1:], self.CountryCode) {
+        return self.NationalPrefix + number[1 + len(self.CountryCode):], nil
+    }
+    return self.InternationalPrefix + number[1:], nil
+}
+
+// TranslationRule is the regexp replacement applied to the "cld", "cli"
+// or "cnam" (caller name) of the call. Only the first match is replaced
+// unless the rule is Global. The Format ("e164" or "national") converts
+// the number according to the numbering plan after the replacement.
+type TranslationRule struct {
+    Field       string
+    Match       string
+    Replace     string
+    Global      bool
+    Format      string
+    match_re    *regexp.Regexp
+}
+
+func (self *TranslationRule) compile(plan *NumberingPlan) error {
+    var err error
+
+    switch self.Field {
+    case "cld", "cli", "cnam":
+    default:
+        return errors.New("unknown field '" + self.Field + "'")
+    }
+    switch self.Format {
+    case "":
+    case "e164", "national":
+        if plan == nil {
+            return errors.New("the numbering plan is required for " + self.Format)
+        }
+        if self.Field == "cnam" {
+            return errors.New("cannot format the caller name as " + self.Format)
+        }
+    default:
+        return errors.New("unknown format '" + self.Format + "'")
+    }
+    if self.Match != "" {
+        if self.match_re, err = regexp.Compile(self.Match); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (self *TranslationRule) apply(s string, plan *NumberingPlan) string {
+    if self.match_re != nil {
+        if self.Global {
+            s = self.match_re.ReplaceAllString(s, self.Replace)
+        } else if m := self.match_re.FindStringSubmatchIndex(s); m != nil {
+            s = s[:m[0]] + string(self.match_re.ExpandString(nil, self.Replace, s, m)) + s[m[1]:]
+        }
+    }
+    var err error
+    var res string
+    switch self.Format {
+    case "e164":
+        res, err = plan.E164(s)
+    case "national":
+        res, err = plan.Dial(s)
+    default:
+        return s
+    }
+    if err != nil {
+        return s
+    }
+    return res
+}
+
+// ParseTranslationRules parses the rules written as the list of sed-like
+// substitutions separated by ";", i.e.
+//
+//     cld:s/^00/+/;cli:s/^0(\d+)/+44\1/;cnam:s/\s+/ /g;cld:e164
+//
+// The field defaults to "cld". The "\/" stands for the slash in the regexp
+// and in the replacement, "\1" and "&" refer the matched groups.
+func ParseTranslationRules(spec string) ([]*TranslationRule, error) {
+    rules := []*TranslationRule{}
+    for {
+        spec = strings.TrimLeft(spec, " \t;")
+        if spec == "" {
+            break
+        }
+        rule := &TranslationRule{ Field : "cld" }
+        if idx := strings.IndexAny(spec, ":/;"); idx > 0 && spec[idx] == ':' {
+            rule.Field, spec = strings.TrimSpace(spec[:idx]), spec[idx + 1:]
+        }
+        if strings.HasPrefix(spec, "s/") {
+            var parts []string
+            var err error
+            if parts, spec, err = splitSedParts(spec[2:], 2); err != nil {
+                return nil, err
+            }
+            rule.Match, rule.Replace = parts[0], sedReplacement(parts[1])
+            idx := strings.IndexRune(spec, ';')
+            if idx == -1 {
+                idx = len(spec)
+            }
+            for _, flag := range strings.TrimSpace(spec[:idx]) {
+                if flag != 'g' {
+                    return nil, fmt.Errorf("unknown substitution flag '%c'", flag)
+                }
+                rule.Global = true
+            }
+            spec = spec[idx:]
+        } else {
+            idx := strings.IndexRune(spec, ';')
+            if idx == -1 {
+                idx = len(spec)
+            }
+            rule.Format, spec = strings.TrimSpace(spec[:idx]), spec[idx:]
+        }
+        rules = append(rules, rule)
+    }
+    return rules, nil
+}
+
+// splitSedParts splits off n parts terminated with the unescaped slash.
+func splitSedParts(s string, n int) ([]string, string, error) {
+    parts := []string{}
+    part := []byte{}
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '\\' && i + 1 < len(s) && s[i + 1] == '/':
+            part = append(part, '/')
+            i++
+        case s[i] == '/':
+            parts = append(parts, string(part))
+            part = []byte{}
+            if len(parts) == n {
+                return parts, s[i + 1:], nil
+            }
+        default:
+            part = append(part, s[i])
+        }
+    }
+    return nil, "", errors.New("unterminated substitution: s/" + s)
+}
+
+// sedReplacement converts the sed replacement to the regexp.Expand
+// template.
+func sedReplacement(s string) string {
+    res := ""
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '\\' && i + 1 < len(s):
+            i++
+            if s[i] >= '0' && s[i] <= '9' {
+                res += "${" + string(s[i]) + "}"
+            } else if s[i] == '$' {
+                res += "$$"
+            } else {
+                res += string(s[i])
+            }
+        case s[i] == '&':
+            res += "${0}"
+        case s[i] == '$':
+            res += "$$"
+        default:
+            res += string(s[i])
+        }
+    }
+    return res
+}
+
+// NumberTranslator applies the ordered list of the translation rules.
+// The nil translator leaves the numbers intact.
+type NumberTranslator struct {
+    rules   []*TranslationRule
+    plan    *NumberingPlan
+}
+
+func NewNumberTranslator(rules []*TranslationRule, plan *NumberingPlan) (*NumberTranslator, error) {
+    for i, rule := range rules {
+        if err := rule.compile(plan); err != nil {
+            return nil, fmt.Errorf("translation rule #%d: %s", i + 1, err.Error())
+        }
+    }
+    return &NumberTranslator{
+        rules   : rules,
+        plan    : plan,
+    }, nil
+}
+
+func ParseNumberTranslator(spec string, plan *NumberingPlan) (*NumberTranslator, error) {
+    rules, err := ParseTranslationRules(spec)
+    if err != nil {
+        return nil, err
+    }
+    return NewNumberTranslator(rules, plan)
+}
+
+// Translate returns the translated CLI, CLD and caller name. The visual
+// separators of the numbers that came in the tel: URIs are removed
+// before the rules are applied.
+func (self *NumberTranslator) Translate(cli, cld, caller_name string) (string, string, string) {
+    if self == nil {
+        return cli, cld, caller_name
+    }
+    cli, cld = StripVisualSeparators(cli), StripVisualSeparators(cld)
+    for _, rule := range self.rules {
+        switch rule.Field {
+        case "cld":
+            cld = rule.apply(cld, self.plan)
+        case "cli":
+            cli = rule.apply(cli, self.plan)
+        case "cnam":
+            caller_name = rule.apply(caller_name, self.plan)
+        }
+    }
+    return cli, cld, caller_name
+}
+
+// NumberTranslationTable chooses the translator by the source address
+// of the call.
+type NumberTranslationTable struct {
+    sources     []*sippy_net.TrustDomain
+    translators []*NumberTranslator
+}
+
+func NewNumberTranslationTable() *NumberTranslationTable {
+    return &NumberTranslationTable{
+        sources     : make([]*sippy_net.TrustDomain, 0),
+        translators : make([]*NumberTranslator, 0),
+    }
+}
+
+// Add appends the translator for the calls from the given sources, the
+// nil sources match any address.
+func (self *NumberTranslationTable) Add(sources *sippy_net.TrustDomain, translator *NumberTranslator) {
+    self.sources = append(self.sources, sources)
+    self.translators = append(self.translators, translator)
+}
+
+// Lookup returns the first translator matching the source or nil.
+func (self *NumberTranslationTable) Lookup(source *sippy_net.HostPort) *NumberTranslator {
+    if self == nil {
+        return nil
+    }
+    for i, sources := range self.sources {
+        if sources == nil || sources.IsTrusted(source) {
+            return self.translators[i]
+        }
+    }
+    return nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+func Test_NumberTranslation(t *testing.T) {
+    uk := &NumberingPlan{ CountryCode : "44", InternationalPrefix : "00", NationalPrefix : "0" }
+    for _, tc := range [][]string{
+        { "020 7946 0018", "" },
+        { "020-7946-0018", "+442079460018" },
+        { "00 1 (555) 123-4567", "" },
+        { "001-555-123-4567", "+15551234567" },
+        { "+44.20.7946.0018", "+442079460018" },
+        { "2079460018", "+442079460018" },
+    } {
+        res, err := uk.E164(tc[0])
+        if tc[1] == "" {
+            if err == nil {
+                t.Fatal("Spaces should not be accepted in " + tc[0])
+            }
+            continue
+        }
+        if err != nil {
+            t.Fatal("Cannot normalize " + tc[0] + ": " + err.Error())
+        }
+        assertStringEqual(res, tc[1], t)
+    }
+    res, _ := uk.Dial("+442079460018")
+    assertStringEqual(res, "02079460018", t)
+    res, _ = uk.Dial("+15551234567")
+    assertStringEqual(res, "0015551234567", t)
+    assertStringEqual(StripVisualSeparators("john.doe"), "john.doe", t)
+
+    tr, err := ParseNumberTranslator(`s/^9//;cld:e164;cli:s/^\+44(\d+)$/0\1/;cnam:s/\s+/_/g;cnam:s/\//|/`, uk)
+    if err != nil {
+        t.Fatal("Cannot parse the rules: " + err.Error())
+    }
+    cli, cld, cnam := tr.Translate("+44-20-7946-0000", "9020-7946-0018", "John  Q Public/Sales")
+    assertStringEqual(cld, "+442079460018", t)
+    assertStringEqual(cli, "02079460000", t)
+    assertStringEqual(cnam, "John_Q_Public|Sales", t)
+    var notr *NumberTranslator
+    cli, _, _ = notr.Translate("020-7946-0000", "", "")
+    assertStringEqual(cli, "020-7946-0000", t)
+
+    for _, spec := range []string{ "s/^9/", "cld:s/a/b/x", "foo:s/a/b/", "cnam:e164", "s/(/x/" } {
+        if _, err = ParseNumberTranslator(spec, uk); err == nil {
+            t.Fatal("Bad rules accepted: " + spec)
+        }
+    }
+    if _, err = ParseNumberTranslator("e164", nil); err == nil {
+        t.Fatal("E.164 format accepted without the numbering plan")
+    }
+
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    config.SetAutoConvertTelUrl(true)
+    for _, tc := range [][]string{
+        { "tel:+1-555-123-4567", "+15551234567" },
+        { "tel:7946-0018;phone-context=+44-20", "+442079460018" },
+        { "tel:1234;phone-context=example.com", "1234" },
+        { "sip:+1-555-123-4567@1.1.1.1;user=phone", "+15551234567" },
+        { "sip:555-1234@1.1.1.1", "555-1234" },
+        { "sip:1234;phone-context=+44@1.1.1.1", "1234" },
+    } {
+        url, err := sippy_header.ParseSipURL(tc[0], false, config)
+        if err != nil {
+            t.Fatal("Cannot parse " + tc[0] + ": " + err.Error())
+        }
+        assertStringEqual(TelURLNumber(url), tc[1], t)
+    }
+
+    table := NewNumberTranslationTable()
+    internal, _ := sippy_net.NewTrustDomain("10.0.0.0/8")
+    table.Add(internal, tr)
+    if table.Lookup(sippy_net.NewHostPort("10.1.1.1", "5060")) != tr {
+        t.Fatal("Translator for the internal source has not been found")
+    }
+    if table.Lookup(sippy_net.NewHostPort("1.1.1.1", "5060")) != nil {
+        t.Fatal("Translator found for the unknown source")
+    }
+}
+
+func Test_TelURLNumbers(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    config.SetAutoConvertTelUrl(true)
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+
+    tfactory.feed([]string{
+        "INVITE tel:7946-0018;phone-context=+44-20 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKtelurl",
+        "Max-Forwards: 70",
+        "From: <sip:+1-555-123-4567@1.1.1.1;user=phone>;tag=abc",
+        "To: <sip:79460018@192.168.0.1;user=phone>",
+        "Contact: <sip:100@1.1.1.1:5060>",
+        "Call-ID: telurl@1.1.1.1",
+        "CSeq: 1 INVITE",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+    rtime, _ := sippy_time.NewMonoTime()
+    resp, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if code, _ := resp.GetSCode(); code != 100 {
+        t.Fatalf("Got %d while expecting 100", code)
+    }
+    cmap.lock.Lock()
+    defer cmap.lock.Unlock()
+    event, ok := cmap.event.(*CCEventTry)
+    if ! ok {
+        t.Fatal("The call has not been passed to the controller")
+    }
+    assertStringEqual(event.GetCLI(), "+15551234567", t)
+    assertStringEqual(event.GetCLD(), "+442079460018", t)
+}
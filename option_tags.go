@@ -0,0 +1,88 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+)
+
+// The methods always handled by the UA itself. MESSAGE and REFER are
+// added when enabled in the UA.
+var ua_base_allow = []string{ "INVITE", "ACK", "CANCEL", "BYE", "OPTIONS", "INFO" }
+
+func hasOptionTag(tags []string, tag string) bool {
+    for _, t := range tags {
+        if strings.EqualFold(t, tag) {
+            return true
+        }
+    }
+    return false
+}
+
+// unsupportedOptions returns the option tags the request requires but
+// the UA does not support. Require is ignored in ACK and CANCEL (RFC 3261
+// section 8.2.2.3).
+func unsupportedOptions(ua sippy_types.UA, req sippy_types.SipRequest) []string {
+    if req.GetMethod() == "ACK" || req.GetMethod() == "CANCEL" {
+        return nil
+    }
+    var rval []string
+    supported := ua.GetSupported()
+    for _, tag := range req.GetRequire() {
+        if ! hasOptionTag(supported, tag) {
+            rval = append(rval, tag)
+        }
+    }
+    return rval
+}
+
+// methodNotAllowed builds 405 response advertising the methods the UA
+// handles (RFC 3261 section 8.2.1).
+func methodNotAllowed(ua sippy_types.UA, req sippy_types.SipRequest) sippy_types.SipResponse {
+    resp := req.GenResponse(405, "Method Not Allowed", nil, ua.GetLocalUA().AsSipServer())
+    if allow := ua.GetAllow(); len(allow) > 0 {
+        resp.AppendHeader(sippy_header.NewSipAllow(allow...))
+    }
+    return resp
+}
+
+// capabilityHeaders returns the Supported and optionally Allow headers
+// to be added to the message unless the message already has them, for
+// example copied from the other leg.
+func capabilityHeaders(ua sippy_types.UA, msg sippy_types.SipMsg, with_allow bool) []sippy_header.SipHeader {
+    rval := []sippy_header.SipHeader{}
+    if with_allow && len(ua.GetAllow()) > 0 && msg.GetFirstHF("allow") == nil {
+        rval = append(rval, sippy_header.NewSipAllow(ua.GetAllow()...))
+    }
+    if supported := ua.GetSupported(); len(supported) > 0 && msg.GetFirstHF("supported") == nil {
+        rval = append(rval, sippy_header.NewSipSupported(supported...))
+    }
+    return rval
+}
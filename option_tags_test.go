@@ -0,0 +1,124 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "testing"
+
+    "github.com/braams/sippy/time"
+)
+
+func Test_OptionTags(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    invite := func(call_id string, extra ...string) {
+        lines := []string{
+            "INVITE sip:200@192.168.0.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK" + call_id,
+            "Max-Forwards: 70",
+            "From: <sip:100@1.1.1.1>;tag=abc",
+            "To: <sip:200@192.168.0.1>",
+            "Contact: <sip:100@1.1.1.1:5060>",
+            "Call-ID: " + call_id + "@1.1.1.1",
+            "CSeq: 1 INVITE",
+        }
+        lines = append(lines, extra...)
+        tfactory.feed(append(lines, "Content-Length: 0", "", ""))
+    }
+    rtime, _ := sippy_time.NewMonoTime()
+
+    invite("require", "Require: 100rel, foo")
+    resp, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if code, _ := resp.GetSCode(); code != 420 {
+        t.Fatalf("Got %d while expecting 420", code)
+    }
+    if unsupported := resp.GetUnsupported(); len(unsupported) != 2 || unsupported[1] != "foo" {
+        t.Fatal("Unsupported must list the unknown option tags")
+    }
+    cmap.lock.Lock()
+    if _, ok := cmap.ua.GetState().(*UaStateFailed); ! ok {
+        t.Fatal("The UA rejected with 420 must be on its way to the Dead state")
+    }
+    cmap.lock.Unlock()
+
+    invite("supported", "Allow: INVITE, ACK, BYE", "k: timer, replaces")
+    tfactory.get() // 100 Trying
+    cmap.lock.Lock()
+    cmap.ua.SetSupported("replaces")
+    cmap.answer()
+    cmap.lock.Unlock()
+    resp, err = ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse 200 OK: " + err.Error())
+    }
+    if len(resp.GetAllow()) != len(ua_base_allow) + 2 {
+        t.Fatal("The 200 OK must advertise Allow")
+    }
+    if supported := resp.GetSupported(); len(supported) != 1 || supported[0] != "replaces" {
+        t.Fatal("The 200 OK must advertise Supported")
+    }
+    if ! hasOptionTag(cmap.ua.GetPeerSupported(), "timer") || len(cmap.ua.GetPeerAllow()) != 3 {
+        t.Fatal("The peer capabilities have not been recorded")
+    }
+
+    // the disabled REFER is neither advertised nor accepted
+    cmap.lock.Lock()
+    cmap.ua.SetUseRefer(false)
+    cmap.lock.Unlock()
+    to, _ := resp.GetTo().GetBody()
+    tfactory.feed([]string{
+        "REFER sip:200@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKrefer",
+        "Max-Forwards: 70",
+        "From: <sip:100@1.1.1.1>;tag=abc",
+        "To: <sip:200@192.168.0.1>;tag=" + to.GetTag(),
+        "Call-ID: supported@1.1.1.1",
+        "CSeq: 2 REFER",
+        "Refer-To: <sip:300@1.1.1.1>",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+    resp, err = ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if code, _ := resp.GetSCode(); code != 405 {
+        t.Fatalf("Got %d while expecting 405", code)
+    }
+    allow := resp.GetAllow()
+    if len(allow) != len(ua_base_allow) + 1 || hasOptionTag(allow, "REFER") {
+        t.Fatal("The disabled REFER must not be advertised")
+    }
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "testing"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+func Test_AssertedIdentity(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    trust_domain, err := sippy_net.NewTrustDomain("2.2.2.0/24")
+    if err != nil {
+        t.Fatal("Cannot create trust domain: " + err.Error())
+    }
+
+    for _, nh := range []string{ "2.2.2.2", "3.3.3.3" } {
+        ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort(nh, "5060"), cmap, &cmap.lock, nil)
+        ua.SetTrustDomain(trust_domain)
+        event := NewCCEventTry(nil, nil, "100", "200", nil, nil, "Alice", nil, "")
+        event.SetPAI([]*sippy_header.SipPAssertedIdentity{
+            sippy_header.CreateSipPAssertedIdentity("<tel:+15551234567>")[0].(*sippy_header.SipPAssertedIdentity),
+        })
+        event.SetPrivacy(sippy_header.NewSipPrivacy("id"))
+        cmap.lock.Lock()
+        ua.RecvEvent(event)
+        cmap.lock.Unlock()
+        rtime, _ := sippy_time.NewMonoTime()
+        req, err := ParseSipRequest(tfactory.get(), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse INVITE: " + err.Error())
+        }
+        from, _ := req.GetFrom().GetBody()
+        assertStringEqual(from.GetUrl().Username, "anonymous", t)
+        contact, _ := req.GetContacts()[0].GetBody()
+        assertStringEqual(contact.GetUrl().Username, "", t)
+        if req.GetPrivacy() == nil || ! req.GetPrivacy().Has("id") {
+            t.Fatal("Privacy header has not been passed")
+        }
+        pais := req.GetPAIs()
+        if nh == "3.3.3.3" {
+            if len(pais) != 0 {
+                t.Fatal("P-Asserted-Identity has leaked out of the trust domain")
+            }
+            continue
+        }
+        if len(pais) != 1 {
+            t.Fatal("P-Asserted-Identity has not been passed to the trusted host")
+        }
+        user, err := pais[0].GetUser()
+        if err != nil {
+            t.Fatal("Cannot parse P-Asserted-Identity: " + err.Error())
+        }
+        assertStringEqual(user, "+15551234567", t)
+    }
+
+    // The next hop is the outbound proxy and the CLI alone is not asserted
+    for _, with_pai := range []bool{ false, true } {
+        ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort("3.3.3.3", "5060"), cmap, &cmap.lock, nil)
+        ua.SetTrustDomain(trust_domain)
+        ua.SetOutboundProxy(sippy_net.NewHostPort("2.2.2.2", "5060"))
+        event := NewCCEventTry(nil, nil, "100", "200", nil, nil, "Alice", nil, "")
+        if with_pai {
+            event.SetPAI([]*sippy_header.SipPAssertedIdentity{
+                sippy_header.CreateSipPAssertedIdentity("<tel:+15551234567>")[0].(*sippy_header.SipPAssertedIdentity),
+            })
+        }
+        cmap.lock.Lock()
+        ua.RecvEvent(event)
+        cmap.lock.Unlock()
+        rtime, _ := sippy_time.NewMonoTime()
+        req, err := ParseSipRequest(tfactory.get(), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse INVITE: " + err.Error())
+        }
+        pais := req.GetPAIs()
+        if with_pai && len(pais) != 1 {
+            t.Fatal("P-Asserted-Identity has not been passed to the trusted outbound proxy")
+        }
+        if ! with_pai && len(pais) != 0 {
+            t.Fatal("P-Asserted-Identity has been made up of the CLI")
+        }
+    }
+}
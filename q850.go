@@ -0,0 +1,258 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "strings"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+)
+
+const (
+    Q850_NORMAL_CLEARING    = 16
+    Q850_INTERWORKING       = 127
+)
+
+var q850_cause_text = map[int]string{
+    1   : "Unallocated number",
+    2   : "No route to specified transit network",
+    3   : "No route to destination",
+    16  : "Normal call clearing",
+    17  : "User busy",
+    18  : "No user responding",
+    19  : "No answer from user",
+    20  : "Subscriber absent",
+    21  : "Call rejected",
+    25  : "Exchange routing error",
+    22  : "Number changed",
+    23  : "Redirection to new destination",
+    26  : "Non-selected user clearing",
+    27  : "Destination out of order",
+    28  : "Address incomplete",
+    29  : "Facility rejected",
+    31  : "Normal, unspecified",
+    34  : "No circuit/channel available",
+    38  : "Network out of order",
+    41  : "Temporary failure",
+    42  : "Switching equipment congestion",
+    47  : "Resource unavailable, unspecified",
+    55  : "Incoming calls barred within CUG",
+    57  : "Bearer capability not authorized",
+    58  : "Bearer capability not presently available",
+    63  : "Service or option unavailable",
+    65  : "Bearer capability not implemented",
+    70  : "Only restricted digital information bearer capability is available",
+    79  : "Service or option not implemented",
+    87  : "User not member of CUG",
+    88  : "Incompatible destination",
+    102 : "Recovery on timer expiry",
+    111 : "Protocol error, unspecified",
+    127 : "Interworking, unspecified",
+}
+
+// SIP status to Q.850 cause mapping (RFC 3398, section 8.2.6.2), except
+// for 500 that stands for the interworking failure.
+var sip_to_q850 = map[int]int{
+    400 : 41,
+    401 : 21,
+    402 : 21,
+    403 : 21,
+    404 : 1,
+    405 : 63,
+    406 : 79,
+    407 : 21,
+    408 : 102,
+    409 : 41,
+    410 : 22,
+    411 : 127,
+    413 : 127,
+    414 : 127,
+    415 : 79,
+    416 : 127,
+    420 : 127,
+    421 : 127,
+    423 : 127,
+    480 : 18,
+    481 : 41,
+    482 : 25,
+    483 : 25,
+    484 : 28,
+    485 : 1,
+    486 : 17,
+    487 : 127,
+    488 : 127,
+    500 : 127,
+    501 : 79,
+    502 : 38,
+    503 : 41,
+    504 : 102,
+    505 : 127,
+    513 : 127,
+    580 : 47,
+    600 : 17,
+    603 : 21,
+    604 : 1,
+    606 : 58,
+}
+
+// Q.850 cause to SIP status mapping (RFC 3398, section 7.2.4.1). The
+// causes produced by sip_to_q850 map back to themselves.
+var q850_to_sip = map[int]int{
+    1   : 404,
+    2   : 404,
+    3   : 404,
+    17  : 486,
+    18  : 480,
+    19  : 480,
+    20  : 480,
+    21  : 403,
+    22  : 410,
+    23  : 410,
+    25  : 483,
+    26  : 404,
+    27  : 502,
+    28  : 484,
+    29  : 501,
+    31  : 480,
+    34  : 503,
+    38  : 502,
+    41  : 503,
+    42  : 503,
+    47  : 580,
+    55  : 403,
+    57  : 403,
+    58  : 606,
+    63  : 405,
+    65  : 488,
+    70  : 488,
+    79  : 501,
+    87  : 403,
+    88  : 503,
+    102 : 504,
+    111 : 500,
+    127 : 500,
+}
+
+// SipCodeToQ850 maps the final SIP status to the Q.850 cause. The
+// successful and the cancelled calls map to the normal call clearing.
+func SipCodeToQ850(code int) int {
+    if code < 300 {
+        return Q850_NORMAL_CLEARING
+    }
+    if cause, ok := sip_to_q850[code]; ok {
+        return cause
+    }
+    return Q850_INTERWORKING
+}
+
+// Q850ToSipCode maps the Q.850 cause to the SIP status and reason phrase.
+func Q850ToSipCode(cause int) (int, string) {
+    code, ok := q850_to_sip[cause]
+    if ! ok {
+        code = 500
+    }
+    return code, Q850CauseText(cause)
+}
+
+func Q850CauseText(cause int) string {
+    if text, ok := q850_cause_text[cause]; ok {
+        return text
+    }
+    return q850_cause_text[Q850_INTERWORKING]
+}
+
+func NewQ850Reason(cause int) *sippy_header.SipReason {
+    return sippy_header.NewSipReason("Q.850", strconv.Itoa(cause), Q850CauseText(cause))
+}
+
+// reasonQ850Cause returns the cause carried by the Reason header, mapping
+// the SIP protocol causes to Q.850.
+func reasonQ850Cause(reason *sippy_header.SipReason) (int, bool) {
+    if reason == nil {
+        return 0, false
+    }
+    protocol, err := reason.GetProtocol()
+    if err != nil {
+        return 0, false
+    }
+    scause, _ := reason.GetCause()
+    cause, err := strconv.Atoi(scause)
+    if err != nil {
+        return 0, false
+    }
+    switch strings.ToUpper(protocol) {
+    case "Q.850":
+        return cause, true
+    case "SIP":
+        return SipCodeToQ850(cause), true
+    }
+    return 0, false
+}
+
+// GetQ850Cause returns the Q.850 cause of the call termination reported
+// by the event. The cause from the Reason header takes precedence over
+// the one derived from the SIP status.
+func GetQ850Cause(event sippy_types.CCEvent) int {
+    if cause, ok := reasonQ850Cause(event.GetReason()); ok {
+        return cause
+    }
+    if ev, ok := event.(*CCEventFail); ok && ev.GetScode() != 0 {
+        return SipCodeToQ850(ev.GetScode())
+    }
+    return Q850_NORMAL_CLEARING
+}
+
+// q850ReasonHeaders adds the Q.850 Reason to the extra headers of BYE,
+// CANCEL or the failure response unless it is already there or the UA
+// has been told not to send it.
+func q850ReasonHeaders(ua sippy_types.UA, event sippy_types.CCEvent, eh []sippy_header.SipHeader) []sippy_header.SipHeader {
+    if ! ua.GetQ850Reason() {
+        return eh
+    }
+    for _, hf := range eh {
+        if reason, ok := hf.(*sippy_header.SipReason); ok {
+            if protocol, _ := reason.GetProtocol(); strings.ToUpper(protocol) == "Q.850" {
+                return eh
+            }
+        }
+    }
+    return append(append([]sippy_header.SipHeader{}, eh...), NewQ850Reason(GetQ850Cause(event)))
+}
+
+// failureCode picks the status of the failure response sent on behalf of
+// the event, using the incoming Q.850 Reason when the event has no status.
+func failureCode(event sippy_types.CCEvent, code int, reason string) (int, string) {
+    if code != 0 {
+        return code, reason
+    }
+    if cause, ok := reasonQ850Cause(event.GetReason()); ok && cause != Q850_NORMAL_CLEARING {
+        return Q850ToSipCode(cause)
+    }
+    return 0, reason
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/time"
+)
+
+func Test_Q850Reason(t *testing.T) {
+    var err error
+
+    for code, cause := range map[int]int{ 200 : 16, 404 : 1, 486 : 17, 699 : 127 } {
+        if SipCodeToQ850(code) != cause {
+            t.Fatalf("Bad Q.850 cause for %d", code)
+        }
+    }
+    if code, _ := Q850ToSipCode(34); code != 503 {
+        t.Fatal("Bad SIP status for Q.850 cause 34")
+    }
+    for _, cause := range sip_to_q850 {
+        if code, _ := Q850ToSipCode(cause); SipCodeToQ850(code) != cause {
+            t.Fatalf("Q.850 cause %d does not map back to itself", cause)
+        }
+    }
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    invite := func(call_id string) {
+        tfactory.feed([]string{
+            "INVITE sip:200@192.168.0.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK" + call_id,
+            "Max-Forwards: 70",
+            "From: <sip:100@1.1.1.1>;tag=abc",
+            "To: <sip:200@192.168.0.1>",
+            "Contact: <sip:100@1.1.1.1:5060>",
+            "Call-ID: " + call_id + "@1.1.1.1",
+            "CSeq: 1 INVITE",
+            "Content-Length: 0",
+            "",
+            "",
+        })
+        tfactory.get() // 100 Trying
+    }
+    invite("q850-test")
+    // the failure from the other leg only carries the Q.850 cause
+    cmap.lock.Lock()
+    cmap.ua.RecvEvent(NewCCEventFail(0, "", nil, "", NewQ850Reason(17)))
+    cmap.lock.Unlock()
+    rtime, _ := sippy_time.NewMonoTime()
+    resp, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if resp.GetSCodeNum() != 486 {
+        t.Fatal("Expected 486 response")
+    }
+    if resp.GetReason() == nil || ! strings.HasPrefix(resp.GetReason().StringBody(), "Q.850; cause=17") {
+        t.Fatal("Q.850 Reason is missing in the response")
+    }
+
+    // the relayed status is kept as is
+    invite("q850-status")
+    cmap.lock.Lock()
+    cmap.ua.RecvEvent(NewCCEventFail(401, "Unauthorized", nil, "", NewQ850Reason(21)))
+    cmap.lock.Unlock()
+    resp, err = ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if resp.GetSCodeNum() != 401 || resp.GetSCodeReason() != "Unauthorized" {
+        t.Fatal("The relayed status has been replaced by the Q.850 Reason")
+    }
+
+    invite("q850-off")
+    cmap.lock.Lock()
+    cmap.ua.SetQ850Reason(false)
+    cmap.ua.RecvEvent(NewCCEventFail(503, "Service Unavailable", nil, ""))
+    cmap.lock.Unlock()
+    resp, err = ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if resp.GetSCodeNum() != 503 {
+        t.Fatal("Expected 503 response")
+    }
+    if resp.GetReason() != nil {
+        t.Fatal("Q.850 Reason has been sent while disabled")
+    }
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/types"
+)
+
+// RegistrarAuthFunc returns HA1 for the username in the given realm
+// and whether the username is allowed to register the address of
+// record at all.
+type RegistrarAuthFunc func(aor *sippy_header.SipURL, username, realm string) (string, bool)
+
+type Registrar struct {
+    config          sippy_conf.Config
+    realm           string
+    store           LocationStore
+    lock            sync.Mutex
+    min_expires     int
+    max_expires     int
+    default_expires int
+    auth_cb         RegistrarAuthFunc
+    authenticator   *DigestAuthenticator
+}
+
+// NewRegistrar creates a registrar keeping the bindings in the store.
+// The in-memory store is used when store is nil.
+func NewRegistrar(config sippy_conf.Config, realm string, store LocationStore) *Registrar {
+    if store == nil {
+        store = NewMemLocationStore()
+    }
+    return &Registrar{
+        config          : config,
+        realm           : realm,
+        store           : store,
+        min_expires     : 60,
+        max_expires     : 7200,
+        default_expires : 3600,
+    }
+}
+
+// SetAuthCb enables digest authentication of REGISTER requests. The
+// auth_cb returns MD5 HA1 so only MD5 is offered.
+func (self *Registrar) SetAuthCb(auth_cb RegistrarAuthFunc) {
+    self.auth_cb = auth_cb
+    self.authenticator = NewDigestAuthenticator(self.config, self.realm, self.credentials)
+    self.authenticator.SetAlgorithms("MD5")
+}
+
+// GetAuthenticator gives access to the authenticator settings such as
+// the nonce lifetime and the cap on the failed attempts.
+func (self *Registrar) GetAuthenticator() *DigestAuthenticator {
+    return self.authenticator
+}
+
+func (self *Registrar) credentials(req sippy_types.SipRequest, username, realm, algorithm string) (string, bool) {
+    to, err := req.GetTo().GetBody()
+    if err != nil {
+        return "", false
+    }
+    return self.auth_cb(to.GetUrl(), username, realm)
+}
+
+func (self *Registrar) SetExpires(min_expires, max_expires, default_expires int) {
+    self.min_expires = min_expires
+    self.max_expires = max_expires
+    self.default_expires = default_expires
+}
+
+func aorKey(url *sippy_header.SipURL) string {
+    return url.Username + "@" + strings.ToLower(url.Host.String())
+}
+
+// Lookup returns the bindings currently registered for the address of
+// record ordered by decreasing q-value. The INVITE is to be sent to
+// Binding.Contact using Binding.GetRoutes() as the route set.
+func (self *Registrar) Lookup(aor *sippy_header.SipURL) []*Binding {
+    now := time.Now()
+    bindings := make([]*Binding, 0)
+    for _, binding := range self.store.Get(aorKey(aor)) {
+        if binding.Expires.After(now) {
+            bindings = append(bindings, binding)
+        }
+    }
+    sort.SliceStable(bindings, func(i, j int) bool { return bindings[i].Q > bindings[j].Q })
+    return bindings
+}
+
+// RecvRegister processes the REGISTER request and returns the response
+// to be sent. It is intended to be called from CallMap.OnNewDialog().
+func (self *Registrar) RecvRegister(req sippy_types.SipRequest) sippy_types.SipResponse {
+    if req.GetMethod() != "REGISTER" {
+        resp := req.GenResponse(405, "Method Not Allowed", nil, nil)
+        resp.AppendHeader(sippy_header.NewSipAllow("REGISTER"))
+        return resp
+    }
+    to, err := req.GetTo().GetBody()
+    if err != nil {
+        self.config.ErrorLogger().Error("Registrar::RecvRegister: #1: " + err.Error())
+        return req.GenResponse(400, "Bad Request", nil, nil)
+    }
+    aor := to.GetUrl()
+    if self.authenticator != nil {
+        if _, resp := self.authenticator.Authenticate(req); resp != nil {
+            return resp
+        }
+    }
+    cseq, err := req.GetCSeq().GetBody()
+    if err != nil {
+        self.config.ErrorLogger().Error("Registrar::RecvRegister: #2: " + err.Error())
+        return req.GenResponse(400, "Bad Request", nil, nil)
+    }
+    call_id := req.GetCallId().CallId
+    default_expires, ok := getSipExpires(req)
+    if ! ok {
+        default_expires = self.default_expires
+    }
+    paths := make([]*sippy_header.SipAddress, 0)
+    for _, hf := range req.GetHFs("path") {
+        if path, ok := hf.(*sippy_header.SipPath); ok {
+            addr, err := path.GetBody()
+            if err != nil {
+                self.config.ErrorLogger().Error("Registrar::RecvRegister: #3: " + err.Error())
+                return req.GenResponse(400, "Bad Request", nil, nil)
+            }
+            paths = append(paths, addr)
+        }
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    now := time.Now()
+    key := aorKey(aor)
+    bindings := make([]*Binding, 0)
+    for _, binding := range self.store.Get(key) {
+        if binding.Expires.After(now) {
+            bindings = append(bindings, binding)
+        }
+    }
+    updated := false
+    for _, contact := range req.GetContacts() {
+        if contact.Asterisk {
+            if len(req.GetContacts()) != 1 || default_expires != 0 {
+                return req.GenResponse(400, "Bad Request", nil, nil)
+            }
+            for _, binding := range bindings {
+                if binding.CallId == call_id && binding.CSeq >= cseq.CSeq {
+                    return req.GenResponse(500, "Server Internal Error", nil, nil)
+                }
+            }
+            bindings = bindings[:0]
+            updated = true
+            break
+        }
+        addr, err := contact.GetBody()
+        if err != nil {
+            self.config.ErrorLogger().Error("Registrar::RecvRegister: #4: " + err.Error())
+            return req.GenResponse(400, "Bad Request", nil, nil)
+        }
+        expires := default_expires
+        if param := addr.GetParam("expires"); param != "" {
+            if expires, err = strconv.Atoi(param); err != nil || expires < 0 {
+                return req.GenResponse(400, "Bad Request", nil, nil)
+            }
+        }
+        if expires > 0 && expires < self.min_expires {
+            resp := req.GenResponse(423, "Interval Too Brief", nil, nil)
+            resp.AppendHeader(sippy_header.NewSipGenericHF("Min-Expires", strconv.Itoa(self.min_expires)))
+            return resp
+        }
+        if expires > self.max_expires {
+            expires = self.max_expires
+        }
+        uri := addr.GetUrl().String()
+        idx := -1
+        for i, binding := range bindings {
+            if binding.Contact.GetUrl().String() == uri {
+                idx = i
+                break
+            }
+        }
+        if idx >= 0 && bindings[idx].CallId == call_id && bindings[idx].CSeq >= cseq.CSeq {
+            return req.GenResponse(500, "Server Internal Error", nil, nil)
+        }
+        updated = true
+        if expires == 0 {
+            if idx >= 0 {
+                bindings = append(bindings[:idx], bindings[idx + 1:]...)
+            }
+            continue
+        }
+        binding := &Binding{
+            Contact     : addr.GetCopy(),
+            Path        : paths,
+            Q           : addr.GetQ(),
+            Expires     : now.Add(time.Duration(expires) * time.Second),
+            CallId      : call_id,
+            CSeq        : cseq.CSeq,
+            Source      : req.GetSource(),
+        }
+        if idx >= 0 {
+            bindings[idx] = binding
+        } else {
+            bindings = append(bindings, binding)
+        }
+    }
+    if updated {
+        self.store.Set(key, bindings)
+    }
+    resp := req.GenResponse(200, "OK", nil, nil)
+    for _, binding := range bindings {
+        addr := binding.Contact.GetCopy()
+        addr.SetParam("expires", strconv.Itoa(binding.ExpiresIn(now)))
+        resp.AppendHeader(sippy_header.NewSipContactFromAddress(addr, self.config))
+    }
+    for _, path := range paths {
+        resp.AppendHeader(sippy_header.NewSipPath(path, self.config))
+    }
+    return resp
+}
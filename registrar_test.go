@@ -0,0 +1,109 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+func Test_Registrar(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    registrar := NewRegistrar(config, "test", nil)
+    registrar.SetAuthCb(func(aor *sippy_header.SipURL, username, realm string) (string, bool) {
+        if aor.Username != username {
+            return "", false
+        }
+        return sippy_header.DigestCalcHA1("md5", username, realm, "secret", "", ""), true
+    })
+    register := func(cseq, contact, auth string) *sipRequest {
+        lines := []string{
+            "REGISTER sip:1.1.1.1 SIP/2.0",
+            "Via: SIP/2.0/UDP 2.2.2.2:5060;branch=z9hG4bK" + cseq,
+            "Path: <sip:3.3.3.3;lr>",
+            "From: <sip:100@1.1.1.1>;tag=12345",
+            "To: <sip:100@1.1.1.1>",
+            "Call-ID: registrar-test@2.2.2.2",
+            "CSeq: " + cseq + " REGISTER",
+            "Contact: " + contact,
+            "Expires: 600",
+        }
+        if auth != "" {
+            lines = append(lines, auth)
+        }
+        lines = append(lines, "Content-Length: 0", "", "")
+        rtime, _ := sippy_time.NewMonoTime()
+        req, err := ParseSipRequest([]byte(strings.Join(lines, "\r\n")), rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse REGISTER: " + err.Error())
+        }
+        return req
+    }
+
+    resp := registrar.RecvRegister(register("1", "<sip:100@2.2.2.2:5060>", ""))
+    if code, _ := resp.GetSCode(); code != 401 {
+        t.Fatalf("Got %d while expecting 401", code)
+    }
+    digest, err := newDigestClient(resp, nil)
+    if err != nil {
+        t.Fatal("Cannot parse the challenge: " + err.Error())
+    }
+    auth := digest.authorization("REGISTER", "sip:1.1.1.1", "100", "secret", nil)
+    resp = registrar.RecvRegister(register("2", "<sip:100@2.2.2.2:5060>;q=0.5", auth.String()))
+    if code, _ := resp.GetSCode(); code != 200 {
+        t.Fatalf("Got %d while expecting 200", code)
+    }
+    if len(resp.GetContacts()) != 1 {
+        t.Fatal("The 200 OK must list the binding")
+    }
+    bindings := registrar.Lookup(sippy_header.NewSipURL("100", sippy_net.NewMyAddress("1.1.1.1"), nil, false))
+    if len(bindings) != 1 {
+        t.Fatal("The binding has not been stored")
+    }
+    assertStringEqual(bindings[0].Contact.GetUrl().Host.String(), "2.2.2.2", t)
+    assertStringEqual(bindings[0].Path[0].GetUrl().Host.String(), "3.3.3.3", t)
+
+    auth = digest.authorization("REGISTER", "sip:1.1.1.1", "100", "wrong", nil)
+    resp = registrar.RecvRegister(register("3", "*", auth.String()))
+    if code, _ := resp.GetSCode(); code != 403 {
+        t.Fatalf("Got %d while expecting 403", code)
+    }
+    auth = digest.authorization("REGISTER", "sip:1.1.1.1", "100", "secret", nil)
+    resp = registrar.RecvRegister(register("4", "<sip:100@2.2.2.2:5060>;expires=0", auth.String()))
+    if code, _ := resp.GetSCode(); code != 200 {
+        t.Fatalf("Got %d while expecting 200", code)
+    }
+    if len(registrar.Lookup(sippy_header.NewSipURL("100", sippy_net.NewMyAddress("1.1.1.1"), nil, false))) != 0 {
+        t.Fatal("The binding has not been removed")
+    }
+}
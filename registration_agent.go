@@ -0,0 +1,374 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+    "github.com/braams/sippy/utils"
+)
+
+type RegState int
+
+const (
+    RegStateIdle = RegState(iota)
+    RegStateRegistering
+    RegStateRegistered
+    RegStateFailed
+    RegStateUnregistered
+)
+
+func (self RegState) String() string {
+    switch self {
+    case RegStateIdle:          return "Idle"
+    case RegStateRegistering:   return "Registering"
+    case RegStateRegistered:    return "Registered"
+    case RegStateFailed:        return "Failed"
+    case RegStateUnregistered:  return "Unregistered"
+    }
+    return "Unknown"
+}
+
+// RegistrationAgent keeps a single account registered with an upstream
+// registrar. Create one agent per account.
+type RegistrationAgent struct {
+    sip_tm          sippy_types.SipTransactionManager
+    config          sippy_conf.Config
+    session_lock    sync.Locker
+    registrar       *sippy_header.SipURL
+    aor             *sippy_header.SipAddress
+    contact         *sippy_header.SipContact
+    nh_address      *sippy_net.HostPort
+    outbound_proxy  *sippy_net.HostPort
+    source_address  *sippy_net.HostPort
+    username        string
+    password        string
+    expires         int
+    call_id         *sippy_header.SipCallId
+    ltag            string
+    cseq            int
+    state           RegState
+    timer           *Timeout
+    tr              sippy_types.ClientTransaction
+    tr_expires      int
+    triedauth       bool
+    digest          *digestClient
+    stopping        bool
+    failures        uint
+    retry_min       time.Duration
+    retry_max       time.Duration
+    local_ua        *sippy_header.SipUserAgent
+    status_cb       func(*RegistrationAgent, RegState, int, string)
+}
+
+// NewRegistrationAgent creates an agent registering the address of
+// record aor at the registrar. When nh_address is nil the request is
+// sent to the address of the registrar URL.
+func NewRegistrationAgent(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, registrar *sippy_header.SipURL, aor *sippy_header.SipAddress, nh_address *sippy_net.HostPort, username, password string, expires int, session_lock sync.Locker) *RegistrationAgent {
+    if session_lock == nil {
+        session_lock = new(sync.Mutex)
+    }
+    contact := sippy_header.NewSipContact(config)
+    if contact_body, err := contact.GetBody(); err == nil {
+        contact_body.GetUrl().Username = aor.GetUrl().Username
+    }
+    return &RegistrationAgent{
+        sip_tm          : sip_tm,
+        config          : config,
+        session_lock    : session_lock,
+        registrar       : registrar,
+        aor             : aor,
+        contact         : contact,
+        nh_address      : nh_address,
+        username        : username,
+        password        : password,
+        expires         : expires,
+        call_id         : sippy_header.GenerateSipCallId(config),
+        ltag            : sippy_utils.GenTag(),
+        cseq            : 1,
+        state           : RegStateIdle,
+        retry_min       : 30 * time.Second,
+        retry_max       : 30 * time.Minute,
+        local_ua        : sippy_header.NewSipUserAgent(config.GetMyUAName()),
+    }
+}
+
+// SetStatusCb installs the callback invoked on every state change
+// along with the final response code and reason that caused it.
+func (self *RegistrationAgent) SetStatusCb(cb func(*RegistrationAgent, RegState, int, string)) {
+    self.status_cb = cb
+}
+
+// SetRetryInterval sets the bounds of the exponential backoff applied
+// when the registration fails.
+func (self *RegistrationAgent) SetRetryInterval(retry_min, retry_max time.Duration) {
+    self.retry_min = retry_min
+    self.retry_max = retry_max
+}
+
+func (self *RegistrationAgent) SetContact(contact *sippy_header.SipContact) {
+    self.contact = contact
+}
+
+func (self *RegistrationAgent) SetOutboundProxy(outbound_proxy *sippy_net.HostPort) {
+    self.outbound_proxy = outbound_proxy
+}
+
+func (self *RegistrationAgent) SetSourceAddress(addr *sippy_net.HostPort) {
+    self.source_address = addr
+}
+
+func (self *RegistrationAgent) SetLocalUA(local_ua *sippy_header.SipUserAgent) {
+    self.local_ua = local_ua
+}
+
+func (self *RegistrationAgent) GetState() RegState {
+    return self.state
+}
+
+func (self *RegistrationAgent) GetAor() *sippy_header.SipAddress {
+    return self.aor
+}
+
+// Start begins registering and keeps the registration alive until Stop()
+// is called.
+func (self *RegistrationAgent) Start() {
+    self.session_lock.Lock()
+    defer self.session_lock.Unlock()
+    self.stopping = false
+    self.register()
+}
+
+// Stop removes the binding from the registrar. When a REGISTER is in
+// flight the binding is removed once its response arrives.
+func (self *RegistrationAgent) Stop() {
+    self.session_lock.Lock()
+    defer self.session_lock.Unlock()
+    self.stopping = true
+    self.cancelTimer()
+    if self.tr != nil {
+        return
+    }
+    if self.state != RegStateRegistered {
+        self.setState(RegStateUnregistered, 0, "")
+        return
+    }
+    self.sendRegister("", "", nil)
+}
+
+func (self *RegistrationAgent) register() {
+    self.timer = nil
+    if self.stopping {
+        return
+    }
+    if self.state != RegStateRegistered {
+        self.setState(RegStateRegistering, 0, "")
+    }
+    self.sendRegister("", "", nil)
+}
+
+func (self *RegistrationAgent) requestedExpires() int {
+    if self.stopping {
+        return 0
+    }
+    return self.expires
+}
+
+func (self *RegistrationAgent) sendRegister(nonce, realm string, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc) {
+    target := self.nh_address
+    if self.outbound_proxy != nil {
+        target = self.outbound_proxy
+    } else if target == nil {
+        target = self.registrar.GetAddr(self.config)
+    }
+    from := self.aor.GetCopy()
+    from.SetTag(self.ltag)
+    expires := newSipExpiresValue(self.requestedExpires())
+    req, err := NewSipRequest("REGISTER", /*ruri*/ self.registrar.GetCopy(), /*sipver*/ "",
+                    /*to*/ sippy_header.NewSipTo(self.aor.GetCopy(), self.config),
+                    /*fr0m*/ sippy_header.NewSipFrom(from, self.config), /*via*/ nil, self.cseq,
+                    self.call_id, /*maxforwards*/ nil, /*body*/ nil, self.contact.GetCopy(),
+                    /*routes*/ nil, target, /*cguid*/ nil, self.local_ua, expires, self.config)
+    if err != nil {
+        self.logError("RegistrationAgent::sendRegister: #1: " + err.Error())
+        return
+    }
+    self.cseq++
+    if nonce != "" && realm != "" && self.username != "" && self.password != "" {
+        req.AppendHeader(SipXXXAuthorization(realm, nonce, "REGISTER", self.registrar.String(), self.username, self.password))
+    }
+    self.tr, err = self.sip_tm.BeginNewClientTransaction(req, self, self.session_lock, self.source_address, nil, nil)
+    if err != nil {
+        self.logError("RegistrationAgent::sendRegister: #2: " + err.Error())
+        if self.stopping {
+            self.setState(RegStateUnregistered, 0, err.Error())
+        } else {
+            self.failed(0, err.Error(), 0)
+        }
+        return
+    }
+    self.tr_expires = self.requestedExpires()
+}
+
+func (self *RegistrationAgent) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
+    code, reason := resp.GetSCode()
+    if code < 200 || tr != self.tr {
+        return
+    }
+    self.tr = nil
+    if code == 401 && resp.GetSipWWWAuthenticate() != nil && self.username != "" && ! self.triedauth {
+        digest, err := newDigestClient(resp, self.digest)
+        if err == nil {
+            self.triedauth = true
+            self.digest = digest
+            self.sendRegister(digest.GetNonce(), digest.GetRealm(), digest.authFunc(nil))
+            return
+        }
+        self.logError("RegistrationAgent::RecvResponse: #1: " + err.Error())
+    }
+    if code == 407 && resp.GetSipProxyAuthenticate() != nil && self.username != "" && ! self.triedauth {
+        digest, err := newDigestClient(resp, self.digest)
+        if err == nil {
+            self.triedauth = true
+            self.digest = digest
+            self.sendRegister(digest.GetNonce(), digest.GetRealm(), digest.authFunc(nil))
+            return
+        }
+        self.logError("RegistrationAgent::RecvResponse: #2: " + err.Error())
+    }
+    self.triedauth = false
+    if self.stopping {
+        if self.tr_expires != 0 && code < 300 {
+            // Stop() came while registering, remove the new binding
+            self.sendRegister("", "", nil)
+            return
+        }
+        self.setState(RegStateUnregistered, code, reason)
+        return
+    }
+    if code == 423 {
+        if hf := resp.GetFirstHF("min-expires"); hf != nil {
+            if min_expires, err := strconv.Atoi(strings.TrimSpace(hf.StringBody())); err == nil && min_expires > self.expires {
+                self.expires = min_expires
+                self.sendRegister("", "", nil)
+                return
+            }
+        }
+    }
+    if code >= 300 {
+        retry_after := 0
+        if hf := resp.GetFirstHF("retry-after"); hf != nil {
+            retry_after, _ = strconv.Atoi(strings.TrimSpace(strings.SplitN(hf.StringBody(), ";", 2)[0]))
+        }
+        self.failed(code, reason, retry_after)
+        return
+    }
+    self.failures = 0
+    expires := self.grantedExpires(resp)
+    self.setState(RegStateRegistered, code, reason)
+    self.cancelTimer()
+    if expires > 0 {
+        self.timer = StartTimeout(self.register, self.session_lock, refreshInterval(expires), 1, self.config.ErrorLogger())
+    }
+}
+
+// grantedExpires finds the binding lifetime chosen by the registrar,
+// either in our Contact or in the Expires header field.
+func (self *RegistrationAgent) grantedExpires(resp sippy_types.SipResponse) int {
+    our_contact, err := self.contact.GetBody()
+    if err == nil {
+        for _, contact := range resp.GetContacts() {
+            contact_body, err := contact.GetBody()
+            if err != nil || ! isOurContact(contact_body.GetUrl(), our_contact.GetUrl()) {
+                continue
+            }
+            if expires, err := strconv.Atoi(contact_body.GetParam("expires")); err == nil {
+                return expires
+            }
+        }
+    }
+    if expires, ok := getSipExpires(resp); ok {
+        return expires
+    }
+    return self.expires
+}
+
+// isOurContact compares the user, host and port of the binding. The host
+// and port filled in from the socket when sending are not known here so
+// they match anything.
+func isOurContact(url, our_url *sippy_header.SipURL) bool {
+    if url.Username != our_url.Username {
+        return false
+    }
+    if ! our_url.Host.IsSystemDefault() && ! strings.EqualFold(url.Host.String(), our_url.Host.String()) {
+        return false
+    }
+    if our_url.Port != nil && ! our_url.Port.IsSystemDefault() {
+        return url.Port != nil && url.Port.String() == our_url.Port.String()
+    }
+    return true
+}
+
+func (self *RegistrationAgent) failed(code int, reason string, retry_after int) {
+    self.setState(RegStateFailed, code, reason)
+    self.cancelTimer()
+    delay := self.retry_min << self.failures
+    if delay > self.retry_max || delay <= 0 {
+        delay = self.retry_max
+    } else {
+        self.failures++
+    }
+    if retry_after > 0 {
+        delay = time.Duration(retry_after) * time.Second
+    }
+    self.timer = StartTimeoutWithSpread(self.register, self.session_lock, delay, 1, self.config.ErrorLogger(), 0.1)
+}
+
+func (self *RegistrationAgent) cancelTimer() {
+    if self.timer != nil {
+        self.timer.Cancel()
+        self.timer = nil
+    }
+}
+
+func (self *RegistrationAgent) setState(state RegState, code int, reason string) {
+    self.state = state
+    if self.status_cb != nil {
+        self.status_cb(self, state, code, reason)
+    }
+}
+
+func (self *RegistrationAgent) logError(args ...interface{}) {
+    self.config.ErrorLogger().Error(args...)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "testing"
+    "time"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+func Test_RegistrationAgent(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+
+    registrar := sippy_header.NewSipURL("", sippy_net.NewMyAddress("1.1.1.1"), sippy_net.NewMyPort("5060"), false)
+    aor := sippy_header.NewSipAddress("", sippy_header.NewSipURL("100", sippy_net.NewMyAddress("1.1.1.1"), nil, false))
+    agent := NewRegistrationAgent(cmap.sip_tm, config, registrar, aor, sippy_net.NewHostPort("1.1.1.1", "5060"), "100", "secret", 300, nil)
+    status_ch := make(chan RegState, 10)
+    agent.SetContact(sippy_header.CreateSipContact("<sip:100@2.2.2.2:5070>")[0].(*sippy_header.SipContact))
+    agent.SetStatusCb(func(_ *RegistrationAgent, state RegState, _ int, _ string) { status_ch <- state })
+    agent.Start()
+
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse REGISTER: " + err.Error())
+    }
+    if req.GetSipAuthorization() != nil {
+        t.Fatal("The initial REGISTER must not carry credentials")
+    }
+    resp := req.GenResponse(401, "Unauthorized", nil, nil)
+    resp.AppendHeader(sippy_header.NewSipGenericHF("WWW-Authenticate", "Digest realm=\"test\",nonce=\"abcdef\""))
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+
+    req, err = ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse REGISTER: " + err.Error())
+    }
+    if req.GetSipAuthorization() == nil {
+        t.Fatal("No Authorization in the challenged REGISTER")
+    }
+    contact := req.GetContacts()[0].StringBody()
+    resp = req.GenResponse(200, "OK", nil, nil)
+    // the binding of another device of the same user
+    resp.AppendHeader(sippy_header.NewSipGenericHF("Contact", "<sip:100@2.2.2.2:5072>;expires=10"))
+    resp.AppendHeader(sippy_header.NewSipGenericHF("Contact", contact + ";expires=120"))
+    parsed, err := ParseSipResponse([]byte(resp.LocalStr(nil, false)), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse 200 OK: " + err.Error())
+    }
+    if expires := agent.grantedExpires(parsed); expires != 120 {
+        t.Fatalf("Got %d while expecting the expires of our own binding", expires)
+    }
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+
+    for _, expect := range []RegState{ RegStateRegistering, RegStateRegistered } {
+        select {
+        case state := <-status_ch:
+            assertStringEqual(state.String(), expect.String(), t)
+        case <-time.After(time.Second):
+            t.Fatal("Timeout waiting for " + expect.String())
+        }
+    }
+    agent.Stop()
+    req, err = ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse REGISTER: " + err.Error())
+    }
+    if expires, ok := getSipExpires(req); ! ok || expires != 0 {
+        t.Fatal("The unregister request must carry Expires: 0")
+    }
+    tfactory.feed([]string{ req.GenResponse(200, "OK", nil, nil).LocalStr(nil, false) })
+    waitState := func(expect RegState) {
+        select {
+        case state := <-status_ch:
+            assertStringEqual(state.String(), expect.String(), t)
+        case <-time.After(time.Second):
+            t.Fatal("Timeout waiting for " + expect.String())
+        }
+    }
+    waitState(RegStateUnregistered)
+
+    // Stop() while the REGISTER is in flight removes the binding once
+    // it has been created
+    agent.Start()
+    waitState(RegStateRegistering)
+    req, err = ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse REGISTER: " + err.Error())
+    }
+    agent.Stop()
+    if len(tfactory.data_ch) != 0 {
+        t.Fatal("The unregister must wait for the response to the REGISTER in flight")
+    }
+    resp = req.GenResponse(200, "OK", nil, nil)
+    resp.AppendHeader(sippy_header.NewSipGenericHF("Contact", contact + ";expires=120"))
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+    req, err = ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse REGISTER: " + err.Error())
+    }
+    if expires, ok := getSipExpires(req); ! ok || expires != 0 {
+        t.Fatal("The unregister request must carry Expires: 0")
+    }
+    tfactory.feed([]string{ req.GenResponse(200, "OK", nil, nil).LocalStr(nil, false) })
+    waitState(RegStateUnregistered)
+}
@@ -58,6 +58,7 @@ type Rtp_proxy_session struct {
     inflight_lock           sync.Mutex
     inflight_cmd            *rtpp_cmd
     rtpp_wi                 chan *rtpp_cmd
+    srtp_module             string
 }
 
 type rtpproxy_update_result struct {
@@ -274,6 +275,26 @@ func (self *Rtp_proxy_session) SetInsertNortpp(v bool) {
     self.insert_nortpp = v
 }
 
+// SetCallerMediaSecurity sets the MEDIA_SECURITY_* policy of the leg
+// towards the caller.
+func (self *Rtp_proxy_session) SetCallerMediaSecurity(policy string) {
+    self.caller.setSecurity(policy)
+}
+
+// SetCalleeMediaSecurity sets the MEDIA_SECURITY_* policy of the leg
+// towards the callee. What has been learned about the SRTP of the
+// previous callee is forgotten, so that it can be set for every route
+// tried.
+func (self *Rtp_proxy_session) SetCalleeMediaSecurity(policy string) {
+    self.callee.setSecurity(policy)
+}
+
+// SetSrtpModule sets the reference of the RTPproxy module that does the
+// SRTP encryption and decryption, i.e. "M5:1".
+func (self *Rtp_proxy_session) SetSrtpModule(module string) {
+    self.srtp_module = module
+}
+
 func (self *Rtp_proxy_session) SetAfterCallerSdpChange(cb func(sippy_types.RtpProxyUpdateResult)) {
     self.caller.after_sdp_change = cb
 }
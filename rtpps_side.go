@@ -50,6 +50,11 @@ type _rtpps_side struct {
     origin_lock     sync.Mutex
     oh_remote       *sippy_sdp.SdpOrigin
     after_sdp_change func(sippy_types.RtpProxyUpdateResult)
+    security        string
+    srtp            bool
+    srtp_known      bool
+    cryptos         map[int]*sippy_sdp.SdpCrypto
+    srtp_keys       map[int]string
 }
 
 func (self *_rtpps_side) _play(prompt_name string, times int, result_callback func(string), index int) {
@@ -68,7 +73,7 @@ func (self *_rtpps_side) __play(prompt_name string, times int, result_callback f
     self.owner.send_command(command, func(r string) { self.owner.command_result(r, result_callback) })
 }
 
-func (self *_rtpps_side) update(remote_ip string, remote_port string, result_callback func(*rtpproxy_update_result), options/*= ""*/ string, index /*= 0*/int, atype /*= "IP4"*/string) {
+func (self *_rtpps_side) update(remote_ip string, remote_port string, result_callback func(*rtpproxy_update_result), options/*= ""*/ string, index /*= 0*/int, atype /*= "IP4"*/string, subcommands ...string) {
     var sbind_supported, is_local, tnot_supported bool
     var err error
 
@@ -104,6 +109,9 @@ func (self *_rtpps_side) update(remote_ip string, remote_port string, result_cal
     if self.owner.notify_socket != "" && index == 0 && tnot_supported {
         command += fmt.Sprintf(" %s %s", self.owner.notify_socket, self.owner.notify_tag)
     }
+    for _, subc := range subcommands {
+        command += " && " + subc
+    }
     self.owner.send_command(command, func(r string) { self.update_result(r, remote_ip, atype, result_callback) })
 }
 
@@ -169,6 +177,12 @@ func (self *_rtpps_side) _on_sdp_change(sdp_body sippy_types.MsgBody, result_cal
         result_callback(sdp_body)
         return nil
     }
+    subcommands := make([][]string, len(sects))
+    for i, sect := range sects {
+        if subcommands[i], err = self.secure(sect, i); err != nil {
+            return err
+        }
+    }
     formats := sects[0].GetMHeader().GetFormats()
     self.codecs = strings.Join(formats, ",")
     options := ""
@@ -182,7 +196,7 @@ func (self *_rtpps_side) _on_sdp_change(sdp_body sippy_types.MsgBody, result_cal
         }
         self.update(sect.GetCHeader().GetAddr(), sect.GetMHeader().GetPort(),
               func (res *rtpproxy_update_result) { self._sdp_change_finish(res, sdp_body, parsed_body, sect, sects, result_callback) },
-              sect_options, i, sect.GetCHeader().GetAType())
+              sect_options, i, sect.GetCHeader().GetAType(), subcommands[i]...)
     }
     return nil
 }
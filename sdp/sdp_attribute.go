@@ -0,0 +1,650 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_sdp
+
+import (
+    "strconv"
+    "strings"
+)
+
+// SdpAttribute is the parsed "a=" line. The String() returns the line
+// without the "a=" prefix.
+type SdpAttribute interface {
+    GetName() string
+    String() string
+}
+
+// ParseSdpAttribute parses the "a=" line without the prefix. The lines of
+// unknown or malformed attributes are returned as *SdpGenericAttribute,
+// which keeps them verbatim.
+func ParseSdpAttribute(line string) SdpAttribute {
+    name, value, has_value := line, "", false
+    if idx := strings.Index(line, ":"); idx >= 0 {
+        name, value, has_value = line[:idx], line[idx + 1:], true
+    }
+    var attr SdpAttribute
+    switch strings.ToLower(name) {
+    case "rtpmap":
+        if a := ParseSdpRtpmap(value); a != nil { attr = a }
+    case "fmtp":
+        if a := ParseSdpFmtp(value); a != nil { attr = a }
+    case "ptime", "maxptime":
+        if a := ParseSdpPtime(name, value); a != nil { attr = a }
+    case "sendrecv", "sendonly", "recvonly", "inactive":
+        if !has_value { attr = SdpDirection(strings.ToLower(name)) }
+    case "rtcp":
+        if a := ParseSdpRtcp(value); a != nil { attr = a }
+    case "crypto":
+        if a := ParseSdpCrypto(value); a != nil { attr = a }
+    case "fingerprint":
+        if a := ParseSdpFingerprint(value); a != nil { attr = a }
+    case "setup":
+        if value != "" { attr = &SdpSetup{ value } }
+    case "candidate":
+        if a := ParseSdpCandidate(value); a != nil { attr = a }
+    case "mid":
+        if value != "" { attr = &SdpMid{ value } }
+    case "ssrc":
+        if a := ParseSdpSsrc(value); a != nil { attr = a }
+    }
+    if attr == nil {
+        attr = &SdpGenericAttribute{ name, value, has_value }
+    }
+    return attr
+}
+
+func attributeName(line string) string {
+    if idx := strings.Index(line, ":"); idx >= 0 {
+        return line[:idx]
+    }
+    return line
+}
+
+// SdpGenericAttribute is either the property attribute like "rtcp-mux"
+// or the value attribute which value is not parsed.
+type SdpGenericAttribute struct {
+    name        string
+    value       string
+    has_value   bool
+}
+
+func NewSdpPropertyAttribute(name string) *SdpGenericAttribute {
+    return &SdpGenericAttribute{ name : name }
+}
+
+func NewSdpValueAttribute(name, value string) *SdpGenericAttribute {
+    return &SdpGenericAttribute{ name, value, true }
+}
+
+func (self *SdpGenericAttribute) GetName() string {
+    return self.name
+}
+
+func (self *SdpGenericAttribute) GetValue() string {
+    return self.value
+}
+
+func (self *SdpGenericAttribute) String() string {
+    if !self.has_value {
+        return self.name
+    }
+    return self.name + ":" + self.value
+}
+
+// SdpRtpmap is "a=rtpmap:<payload type> <encoding name>/<clock rate>[/<encoding parameters>]"
+type SdpRtpmap struct {
+    pt          string
+    encoding    string
+    clock_rate  string
+    params      string
+}
+
+func NewSdpRtpmap(pt, encoding, clock_rate, params string) *SdpRtpmap {
+    return &SdpRtpmap{ pt, encoding, clock_rate, params }
+}
+
+func ParseSdpRtpmap(value string) *SdpRtpmap {
+    arr := strings.Fields(value)
+    if len(arr) != 2 {
+        return nil
+    }
+    enc := strings.SplitN(arr[1], "/", 3)
+    if len(enc) < 2 || enc[0] == "" || enc[1] == "" {
+        return nil
+    }
+    self := &SdpRtpmap{
+        pt          : arr[0],
+        encoding    : enc[0],
+        clock_rate  : enc[1],
+    }
+    if len(enc) == 3 {
+        self.params = enc[2]
+    }
+    return self
+}
+
+func (self *SdpRtpmap) GetName() string {
+    return "rtpmap"
+}
+
+func (self *SdpRtpmap) String() string {
+    s := "rtpmap:" + self.pt + " " + self.encoding + "/" + self.clock_rate
+    if self.params != "" {
+        s += "/" + self.params
+    }
+    return s
+}
+
+func (self *SdpRtpmap) GetPT() string {
+    return self.pt
+}
+
+func (self *SdpRtpmap) SetPT(pt string) {
+    self.pt = pt
+}
+
+func (self *SdpRtpmap) GetEncoding() string {
+    return self.encoding
+}
+
+func (self *SdpRtpmap) GetClockRate() string {
+    return self.clock_rate
+}
+
+// GetParams returns the encoding parameters, i.e. the number of channels
+// of the audio codecs.
+func (self *SdpRtpmap) GetParams() string {
+    return self.params
+}
+
+// GetCodec returns the "ENCODING/rate[/params]" string with the encoding
+// name in the upper case, so that it can be compared.
+func (self *SdpRtpmap) GetCodec() string {
+    s := strings.ToUpper(self.encoding) + "/" + self.clock_rate
+    if self.params != "" {
+        s += "/" + self.params
+    }
+    return s
+}
+
+// SdpFmtp is "a=fmtp:<payload type> <format specific parameters>"
+type SdpFmtp struct {
+    pt      string
+    params  string
+}
+
+func NewSdpFmtp(pt, params string) *SdpFmtp {
+    return &SdpFmtp{ pt, params }
+}
+
+func ParseSdpFmtp(value string) *SdpFmtp {
+    arr := strings.SplitN(value, " ", 2)
+    if arr[0] == "" {
+        return nil
+    }
+    self := &SdpFmtp{ pt : arr[0] }
+    if len(arr) == 2 {
+        self.params = arr[1]
+    }
+    return self
+}
+
+func (self *SdpFmtp) GetName() string {
+    return "fmtp"
+}
+
+func (self *SdpFmtp) String() string {
+    if self.params == "" {
+        return "fmtp:" + self.pt
+    }
+    return "fmtp:" + self.pt + " " + self.params
+}
+
+func (self *SdpFmtp) GetPT() string {
+    return self.pt
+}
+
+func (self *SdpFmtp) SetPT(pt string) {
+    self.pt = pt
+}
+
+func (self *SdpFmtp) GetParams() string {
+    return self.params
+}
+
+func (self *SdpFmtp) SetParams(params string) {
+    self.params = params
+}
+
+// GetParam looks up the parameter in the "name=value;name=value" list.
+func (self *SdpFmtp) GetParam(name string) (string, bool) {
+    for _, param := range strings.Split(self.params, ";") {
+        arr := strings.SplitN(strings.TrimSpace(param), "=", 2)
+        if strings.EqualFold(arr[0], name) {
+            if len(arr) == 1 {
+                return "", true
+            }
+            return arr[1], true
+        }
+    }
+    return "", false
+}
+
+// SdpPtime is either "a=ptime:<ms>" or "a=maxptime:<ms>"
+type SdpPtime struct {
+    name    string
+    value   string
+}
+
+func NewSdpPtime(name string, ms int) *SdpPtime {
+    return &SdpPtime{ name, strconv.Itoa(ms) }
+}
+
+func ParseSdpPtime(name, value string) *SdpPtime {
+    if _, err := strconv.ParseFloat(value, 64); err != nil {
+        return nil
+    }
+    return &SdpPtime{ name, value }
+}
+
+func (self *SdpPtime) GetName() string {
+    return self.name
+}
+
+func (self *SdpPtime) String() string {
+    return self.name + ":" + self.value
+}
+
+func (self *SdpPtime) GetMs() float64 {
+    ms, _ := strconv.ParseFloat(self.value, 64)
+    return ms
+}
+
+func (self *SdpPtime) SetMs(ms int) {
+    self.value = strconv.Itoa(ms)
+}
+
+// SdpDirection is one of the "a=sendrecv", "a=sendonly", "a=recvonly"
+// and "a=inactive" attributes.
+type SdpDirection string
+
+const (
+    SDP_SENDRECV = SdpDirection("sendrecv")
+    SDP_SENDONLY = SdpDirection("sendonly")
+    SDP_RECVONLY = SdpDirection("recvonly")
+    SDP_INACTIVE = SdpDirection("inactive")
+)
+
+func (self SdpDirection) GetName() string {
+    return string(self)
+}
+
+func (self SdpDirection) String() string {
+    return string(self)
+}
+
+// Reverse returns the direction of the answer to the offer with this
+// direction (RFC 3264 section 6.1).
+func (self SdpDirection) Reverse() SdpDirection {
+    switch self {
+    case SDP_SENDONLY:
+        return SDP_RECVONLY
+    case SDP_RECVONLY:
+        return SDP_SENDONLY
+    }
+    return self
+}
+
+// SdpRtcp is "a=rtcp:<port> [<nettype> <addrtype> <connection-address>]" (RFC 3605)
+type SdpRtcp struct {
+    port    string
+    ntype   string
+    atype   string
+    addr    string
+}
+
+func ParseSdpRtcp(value string) *SdpRtcp {
+    arr := strings.Fields(value)
+    switch {
+    case len(arr) == 1:
+        return &SdpRtcp{ port : arr[0] }
+    case len(arr) == 4:
+        return &SdpRtcp{ arr[0], arr[1], arr[2], arr[3] }
+    }
+    return nil
+}
+
+func (self *SdpRtcp) GetName() string {
+    return "rtcp"
+}
+
+func (self *SdpRtcp) String() string {
+    if self.addr == "" {
+        return "rtcp:" + self.port
+    }
+    return "rtcp:" + self.port + " " + self.ntype + " " + self.atype + " " + self.addr
+}
+
+func (self *SdpRtcp) GetPort() string {
+    return self.port
+}
+
+func (self *SdpRtcp) SetPort(port string) {
+    self.port = port
+}
+
+func (self *SdpRtcp) GetAddr() string {
+    return self.addr
+}
+
+func (self *SdpRtcp) GetAType() string {
+    return self.atype
+}
+
+// SetAddr sets the connection address, the empty address removes it.
+func (self *SdpRtcp) SetAddr(atype, addr string) {
+    self.ntype, self.atype, self.addr = "IN", atype, addr
+    if addr == "" {
+        self.ntype, self.atype = "", ""
+    }
+}
+
+// SdpCrypto is the SDES key "a=crypto:<tag> <crypto-suite> <key-params> [<session-params>]" (RFC 4568)
+type SdpCrypto struct {
+    tag             string
+    suite           string
+    key_params      []string
+    session_params  []string
+}
+
+// NewSdpCrypto creates the crypto attribute with the single inline key.
+func NewSdpCrypto(tag int, suite, key string) *SdpCrypto {
+    return &SdpCrypto{
+        tag         : strconv.Itoa(tag),
+        suite       : suite,
+        key_params  : []string{ "inline:" + key },
+    }
+}
+
+func ParseSdpCrypto(value string) *SdpCrypto {
+    arr := strings.Fields(value)
+    if len(arr) < 3 {
+        return nil
+    }
+    if _, err := strconv.Atoi(arr[0]); err != nil {
+        return nil
+    }
+    return &SdpCrypto{
+        tag             : arr[0],
+        suite           : arr[1],
+        key_params      : strings.Split(arr[2], ";"),
+        session_params  : arr[3:],
+    }
+}
+
+func (self *SdpCrypto) GetName() string {
+    return "crypto"
+}
+
+func (self *SdpCrypto) String() string {
+    s := "crypto:" + self.tag + " " + self.suite + " " + strings.Join(self.key_params, ";")
+    for _, param := range self.session_params {
+        s += " " + param
+    }
+    return s
+}
+
+func (self *SdpCrypto) GetTag() int {
+    tag, _ := strconv.Atoi(self.tag)
+    return tag
+}
+
+func (self *SdpCrypto) SetTag(tag int) {
+    self.tag = strconv.Itoa(tag)
+}
+
+func (self *SdpCrypto) GetSuite() string {
+    return self.suite
+}
+
+func (self *SdpCrypto) GetKeyParams() []string {
+    return self.key_params
+}
+
+// GetKey returns the key and salt of the first inline key parameter
+// without the lifetime and MKI.
+func (self *SdpCrypto) GetKey() string {
+    for _, kp := range self.key_params {
+        if strings.HasPrefix(kp, "inline:") {
+            return strings.SplitN(kp[7:], "|", 2)[0]
+        }
+    }
+    return ""
+}
+
+func (self *SdpCrypto) GetSessionParams() []string {
+    return self.session_params
+}
+
+// SdpFingerprint is "a=fingerprint:<hash-func> <fingerprint>" (RFC 8122)
+type SdpFingerprint struct {
+    hash_func   string
+    fingerprint string
+}
+
+func ParseSdpFingerprint(value string) *SdpFingerprint {
+    arr := strings.Fields(value)
+    if len(arr) != 2 {
+        return nil
+    }
+    return &SdpFingerprint{ arr[0], arr[1] }
+}
+
+func (self *SdpFingerprint) GetName() string {
+    return "fingerprint"
+}
+
+func (self *SdpFingerprint) String() string {
+    return "fingerprint:" + self.hash_func + " " + self.fingerprint
+}
+
+func (self *SdpFingerprint) GetHashFunc() string {
+    return self.hash_func
+}
+
+func (self *SdpFingerprint) GetFingerprint() string {
+    return self.fingerprint
+}
+
+// SdpSetup is "a=setup:<role>" (RFC 4145)
+type SdpSetup struct {
+    role    string
+}
+
+func NewSdpSetup(role string) *SdpSetup {
+    return &SdpSetup{ role }
+}
+
+func (self *SdpSetup) GetName() string {
+    return "setup"
+}
+
+func (self *SdpSetup) String() string {
+    return "setup:" + self.role
+}
+
+// GetRole returns one of "active", "passive", "actpass" or "holdconn".
+func (self *SdpSetup) GetRole() string {
+    return self.role
+}
+
+// SdpCandidate is the ICE candidate (RFC 8839)
+// "a=candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> [<extensions>]"
+type SdpCandidate struct {
+    foundation  string
+    component   string
+    transport   string
+    priority    string
+    addr        string
+    port        string
+    ctype       string
+    extensions  []string
+}
+
+func ParseSdpCandidate(value string) *SdpCandidate {
+    arr := strings.Fields(value)
+    if len(arr) < 8 || arr[6] != "typ" {
+        return nil
+    }
+    return &SdpCandidate{
+        foundation  : arr[0],
+        component   : arr[1],
+        transport   : arr[2],
+        priority    : arr[3],
+        addr        : arr[4],
+        port        : arr[5],
+        ctype       : arr[7],
+        extensions  : arr[8:],
+    }
+}
+
+func (self *SdpCandidate) GetName() string {
+    return "candidate"
+}
+
+func (self *SdpCandidate) String() string {
+    s := "candidate:" + strings.Join([]string{ self.foundation, self.component, self.transport,
+        self.priority, self.addr, self.port, "typ", self.ctype }, " ")
+    for _, ext := range self.extensions {
+        s += " " + ext
+    }
+    return s
+}
+
+func (self *SdpCandidate) GetFoundation() string {
+    return self.foundation
+}
+
+func (self *SdpCandidate) GetComponent() string {
+    return self.component
+}
+
+func (self *SdpCandidate) GetTransport() string {
+    return self.transport
+}
+
+func (self *SdpCandidate) GetPriority() string {
+    return self.priority
+}
+
+func (self *SdpCandidate) GetAddr() string {
+    return self.addr
+}
+
+func (self *SdpCandidate) GetPort() string {
+    return self.port
+}
+
+// GetType returns one of "host", "srflx", "prflx" or "relay".
+func (self *SdpCandidate) GetType() string {
+    return self.ctype
+}
+
+// GetExtension returns the value of the extension like "raddr" or
+// "generation".
+func (self *SdpCandidate) GetExtension(name string) string {
+    for i := 0; i + 1 < len(self.extensions); i += 2 {
+        if self.extensions[i] == name {
+            return self.extensions[i + 1]
+        }
+    }
+    return ""
+}
+
+// SdpMid is "a=mid:<identification-tag>" (RFC 5888)
+type SdpMid struct {
+    id  string
+}
+
+func (self *SdpMid) GetName() string {
+    return "mid"
+}
+
+func (self *SdpMid) String() string {
+    return "mid:" + self.id
+}
+
+func (self *SdpMid) GetId() string {
+    return self.id
+}
+
+// SdpSsrc is "a=ssrc:<ssrc-id> <attribute>[:<value>]" (RFC 5576)
+type SdpSsrc struct {
+    ssrc        string
+    attribute   string
+    value       string
+    has_value   bool
+}
+
+func ParseSdpSsrc(value string) *SdpSsrc {
+    arr := strings.SplitN(value, " ", 2)
+    if len(arr) != 2 || arr[1] == "" {
+        return nil
+    }
+    if _, err := strconv.ParseUint(arr[0], 10, 32); err != nil {
+        return nil
+    }
+    self := &SdpSsrc{ ssrc : arr[0], attribute : arr[1] }
+    if idx := strings.Index(arr[1], ":"); idx >= 0 {
+        self.attribute, self.value, self.has_value = arr[1][:idx], arr[1][idx + 1:], true
+    }
+    return self
+}
+
+func (self *SdpSsrc) GetName() string {
+    return "ssrc"
+}
+
+func (self *SdpSsrc) String() string {
+    s := "ssrc:" + self.ssrc + " " + self.attribute
+    if self.has_value {
+        s += ":" + self.value
+    }
+    return s
+}
+
+func (self *SdpSsrc) GetSsrc() string {
+    return self.ssrc
+}
+
+func (self *SdpSsrc) GetAttribute() string {
+    return self.attribute
+}
+
+func (self *SdpSsrc) GetValue() string {
+    return self.value
+}
@@ -158,20 +158,19 @@ func (self *SdpMediaDescription) SetFormats(formats []string) {
 }
 
 func (self *SdpMediaDescription) optimize_a() {
-    new_a_headers := []string{}
-    for _, ah := range self.a_headers {
-        pt := ""
-        if strings.HasPrefix(ah, "rtpmap:") {
-            pt = strings.Split(ah[7:], " ")[0]
-        } else if strings.HasPrefix(ah, "fmtp:") {
-            pt = strings.Split(ah[5:], " ")[0]
-        }
-        if pt != "" && ! self.m_header.HasFormat(pt) {
-            continue
+    self.EditAttributes(func(attr SdpAttribute) SdpAttribute {
+        switch a := attr.(type) {
+        case *SdpRtpmap:
+            if ! self.m_header.HasFormat(a.GetPT()) {
+                return nil
+            }
+        case *SdpFmtp:
+            if ! self.m_header.HasFormat(a.GetPT()) {
+                return nil
+            }
         }
-        new_a_headers = append(new_a_headers, ah)
-    }
-    self.a_headers = new_a_headers
+        return attr
+    })
 }
 
 func (self *SdpMediaDescription) NeedsUpdate() bool {
@@ -207,10 +206,192 @@ func (self *SdpMediaDescription) IsOnHold() bool {
     if self.c_header.atype == "IP6" && self.c_header.addr == "::" {
         return true
     }
-    for _, aname := range self.a_headers {
-        if aname == "sendonly" || aname == "inactive" {
-            return true
+    dir := self.GetDirection()
+    return dir == SDP_SENDONLY || dir == SDP_INACTIVE
+}
+
+// GetAttributes parses the "a=" lines. The lines are kept as they have
+// been received until changed by EditAttributes, AddAttribute and the
+// like.
+func (self *SdpMediaDescription) GetAttributes() []SdpAttribute {
+    ret := make([]SdpAttribute, len(self.a_headers))
+    for i, ah := range self.a_headers {
+        ret[i] = ParseSdpAttribute(ah)
+    }
+    return ret
+}
+
+func (self *SdpMediaDescription) GetAttributesByName(name string) []SdpAttribute {
+    ret := []SdpAttribute{}
+    for _, ah := range self.a_headers {
+        if strings.EqualFold(attributeName(ah), name) {
+            ret = append(ret, ParseSdpAttribute(ah))
+        }
+    }
+    return ret
+}
+
+func (self *SdpMediaDescription) AddAttribute(attr SdpAttribute) {
+    self.a_headers = append(self.a_headers, attr.String())
+}
+
+// RemoveAttributes removes all attributes with the name given. Unlike
+// RemoveAHeader the name is not a prefix.
+func (self *SdpMediaDescription) RemoveAttributes(name string) {
+    self.EditAttributes(func(attr SdpAttribute) SdpAttribute {
+        if strings.EqualFold(attr.GetName(), name) {
+            return nil
+        }
+        return attr
+    })
+}
+
+// EditAttributes calls f for every attribute and replaces the line with
+// the attribute returned, nil removes the line. The lines of the
+// attributes that have not been changed are kept verbatim.
+func (self *SdpMediaDescription) EditAttributes(f func(SdpAttribute) SdpAttribute) {
+    new_a_headers := make([]string, 0, len(self.a_headers))
+    for _, ah := range self.a_headers {
+        attr := ParseSdpAttribute(ah)
+        orig := attr.String()
+        attr = f(attr)
+        if attr == nil {
+            continue
+        }
+        if s := attr.String(); s != orig {
+            ah = s
+        }
+        new_a_headers = append(new_a_headers, ah)
+    }
+    self.a_headers = new_a_headers
+}
+
+func (self *SdpMediaDescription) GetRtpmaps() []*SdpRtpmap {
+    ret := []*SdpRtpmap{}
+    for _, attr := range self.GetAttributesByName("rtpmap") {
+        if rtpmap, ok := attr.(*SdpRtpmap); ok {
+            ret = append(ret, rtpmap)
+        }
+    }
+    return ret
+}
+
+func (self *SdpMediaDescription) GetRtpmap(pt string) *SdpRtpmap {
+    for _, rtpmap := range self.GetRtpmaps() {
+        if rtpmap.GetPT() == pt {
+            return rtpmap
+        }
+    }
+    return nil
+}
+
+func (self *SdpMediaDescription) GetFmtp(pt string) *SdpFmtp {
+    for _, attr := range self.GetAttributesByName("fmtp") {
+        if fmtp, ok := attr.(*SdpFmtp); ok && fmtp.GetPT() == pt {
+            return fmtp
+        }
+    }
+    return nil
+}
+
+// GetPtime returns the "a=ptime" value or zero.
+func (self *SdpMediaDescription) GetPtime() float64 {
+    for _, attr := range self.GetAttributesByName("ptime") {
+        if ptime, ok := attr.(*SdpPtime); ok {
+            return ptime.GetMs()
+        }
+    }
+    return 0
+}
+
+// GetDirection returns the direction of the media stream, sendrecv when
+// there is no direction attribute (RFC 4566 section 6).
+func (self *SdpMediaDescription) GetDirection() SdpDirection {
+    for _, attr := range self.GetAttributes() {
+        if dir, ok := attr.(SdpDirection); ok {
+            return dir
+        }
+    }
+    return SDP_SENDRECV
+}
+
+// SetDirection replaces the direction attributes with the one given.
+func (self *SdpMediaDescription) SetDirection(dir SdpDirection) {
+    self.EditAttributes(func(attr SdpAttribute) SdpAttribute {
+        if _, ok := attr.(SdpDirection); ok {
+            return nil
+        }
+        return attr
+    })
+    self.AddAttribute(dir)
+}
+
+func (self *SdpMediaDescription) GetRtcp() *SdpRtcp {
+    for _, attr := range self.GetAttributesByName("rtcp") {
+        if rtcp, ok := attr.(*SdpRtcp); ok {
+            return rtcp
+        }
+    }
+    return nil
+}
+
+func (self *SdpMediaDescription) IsRtcpMux() bool {
+    return len(self.GetAttributesByName("rtcp-mux")) > 0
+}
+
+func (self *SdpMediaDescription) GetCryptos() []*SdpCrypto {
+    ret := []*SdpCrypto{}
+    for _, attr := range self.GetAttributesByName("crypto") {
+        if crypto, ok := attr.(*SdpCrypto); ok {
+            ret = append(ret, crypto)
+        }
+    }
+    return ret
+}
+
+func (self *SdpMediaDescription) GetCandidates() []*SdpCandidate {
+    ret := []*SdpCandidate{}
+    for _, attr := range self.GetAttributesByName("candidate") {
+        if candidate, ok := attr.(*SdpCandidate); ok {
+            ret = append(ret, candidate)
+        }
+    }
+    return ret
+}
+
+func (self *SdpMediaDescription) GetFingerprint() *SdpFingerprint {
+    for _, attr := range self.GetAttributesByName("fingerprint") {
+        if fingerprint, ok := attr.(*SdpFingerprint); ok {
+            return fingerprint
+        }
+    }
+    return nil
+}
+
+func (self *SdpMediaDescription) GetSetup() *SdpSetup {
+    for _, attr := range self.GetAttributesByName("setup") {
+        if setup, ok := attr.(*SdpSetup); ok {
+            return setup
+        }
+    }
+    return nil
+}
+
+func (self *SdpMediaDescription) GetSsrcs() []*SdpSsrc {
+    ret := []*SdpSsrc{}
+    for _, attr := range self.GetAttributesByName("ssrc") {
+        if ssrc, ok := attr.(*SdpSsrc); ok {
+            ret = append(ret, ssrc)
+        }
+    }
+    return ret
+}
+
+func (self *SdpMediaDescription) GetMid() string {
+    for _, attr := range self.GetAttributesByName("mid") {
+        if mid, ok := attr.(*SdpMid); ok {
+            return mid.GetId()
         }
     }
-    return false
+    return ""
 }
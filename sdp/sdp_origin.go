@@ -81,7 +81,7 @@ func NewSdpOrigin(address string) (*SdpOrigin, error) {
         return nil, errors.New("The address is not IP address: " + address)
     }
     address_type := "IP4"
-    if ip.To16() != nil {
+    if ip.To4() == nil {
         address_type = "IP6"
     }
     sid := atomic.AddInt64(&_sdp_session_id, 1)
@@ -125,3 +125,17 @@ func (self *SdpOrigin) GetSessionId() string {
 func (self *SdpOrigin) GetVersion() int64 {
     return self.version
 }
+
+func (self *SdpOrigin) GetAddress() string {
+    return self.address
+}
+
+func (self *SdpOrigin) SetAddress(address string) {
+    self.address = address
+    if ip := net.ParseIP(address); ip != nil {
+        self.address_type = "IP4"
+        if ip.To4() == nil {
+            self.address_type = "IP6"
+        }
+    }
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "testing"
+
+    "github.com/braams/sippy/sdp"
+)
+
+func Test_SdpAttributes(t *testing.T) {
+    lines := []string{
+        "rtpmap:0 PCMU/8000",
+        "rtpmap:96 opus/48000/2",
+        "fmtp:101 0-15",
+        "fmtp:96 minptime=10;useinbandfec=1",
+        "ptime:20",
+        "maxptime:150",
+        "sendonly",
+        "rtcp:53020",
+        "rtcp:53020 IN IP4 126.16.64.4",
+        "rtcp-mux",
+        "crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR|2^20|1:32",
+        "crypto:2 F8_128_HMAC_SHA1_80 inline:MTIzNDU2Nzg5QUJDREUwMTIzNDU2Nzg5QUJjZGVm|2^20|1:4;inline:QUJjZGVmMTIzNDU2Nzg5QUJDREUwMTIzNDU2Nzg5|2^20|2:4 FEC_ORDER=FEC_SRTP",
+        "fingerprint:sha-256 4A:AD:B9:B1:3F:82:18:3B:54:02:12:DF:3E:5D:49:6B:19:E5:7C:AB",
+        "setup:actpass",
+        "candidate:1 1 UDP 2130706431 10.0.1.1 8998 typ host",
+        "candidate:2 1 UDP 1694498815 192.0.2.3 45664 typ srflx raddr 10.0.1.1 rport 8998",
+        "mid:audio",
+        "ssrc:314159 cname:user@example.com",
+        "ssrc:314159 foo",
+        "x-unknown:whatever  it is",
+    }
+    for _, line := range lines {
+        assertStringEqual(sippy_sdp.ParseSdpAttribute(line).String(), line, t)
+    }
+
+    sect := sippy_sdp.NewSdpMediaDescription()
+    sect.AddHeader("m", "audio 10000 RTP/SAVP 96 0 101")
+    sect.AddHeader("c", "IN IP4 1.1.1.1")
+    for _, line := range lines {
+        sect.AddHeader("a", line)
+    }
+    assertStringEqual(sect.GetRtpmap("96").GetCodec(), "OPUS/48000/2", t)
+    if v, ok := sect.GetFmtp("96").GetParam("useinbandfec"); !ok || v != "1" {
+        t.Fatal("Cannot get fmtp parameter")
+    }
+    if sect.GetPtime() != 20 || sect.GetDirection() != sippy_sdp.SDP_SENDONLY || !sect.IsOnHold() || !sect.IsRtcpMux() {
+        t.Fatal("Wrong ptime, direction or rtcp-mux")
+    }
+    assertStringEqual(sect.GetRtcp().GetPort(), "53020", t)
+    cryptos := sect.GetCryptos()
+    if len(cryptos) != 2 || len(cryptos[1].GetKeyParams()) != 2 {
+        t.Fatal("Wrong crypto attributes")
+    }
+    assertStringEqual(cryptos[0].GetKey(), "PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR", t)
+    assertStringEqual(sect.GetFingerprint().GetHashFunc(), "sha-256", t)
+    assertStringEqual(sect.GetSetup().GetRole(), "actpass", t)
+    assertStringEqual(sect.GetCandidates()[1].GetExtension("raddr"), "10.0.1.1", t)
+    assertStringEqual(sect.GetMid(), "audio", t)
+    assertStringEqual(sect.GetSsrcs()[0].GetValue(), "user@example.com", t)
+
+    // Unchanged lines are kept verbatim, including the odd spacing
+    sect.SetAHeaders([]string{ "rtpmap:96  opus/48000/2", "fmtp:96 minptime=10", "sendrecv" })
+    sect.EditAttributes(func(attr sippy_sdp.SdpAttribute) sippy_sdp.SdpAttribute {
+        if fmtp, ok := attr.(*sippy_sdp.SdpFmtp); ok {
+            fmtp.SetParams("minptime=20")
+        }
+        return attr
+    })
+    sect.SetDirection(sippy_sdp.SDP_INACTIVE)
+    sect.AddAttribute(sippy_sdp.NewSdpCrypto(1, "AES_CM_128_HMAC_SHA1_80", "PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR"))
+    assertStringEqual(sect.String(), "m=audio 10000 RTP/SAVP 96 0 101\r\nc=IN IP4 1.1.1.1\r\n" +
+        "a=rtpmap:96  opus/48000/2\r\na=fmtp:96 minptime=20\r\na=inactive\r\n" +
+        "a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR\r\n", t)
+}
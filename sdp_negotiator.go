@@ -0,0 +1,531 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+
+    "github.com/braams/sippy/sdp"
+    "github.com/braams/sippy/types"
+)
+
+// ESdpNotAcceptable is returned by the SdpNegotiator hooks when no media
+// format is left in the offer or in the answer. The UA rejects such offer
+// with 488 Not Acceptable Here.
+type ESdpNotAcceptable struct {
+    msg string
+}
+
+func (self *ESdpNotAcceptable) Error() string {
+    return self.msg
+}
+
+// sdpFailure maps the error returned by a SDP change hook to the status
+// of the failure response.
+func sdpFailure(err error) (int, string) {
+    if _, ok := err.(*ESdpNotAcceptable); ok {
+        return 488, "Not Acceptable Here"
+    }
+    return 400, "Malformed SDP Body"
+}
+
+// RFC 3551 static payload types
+var static_payload_types = map[string]string{
+    "0"  : "PCMU/8000",
+    "3"  : "GSM/8000",
+    "4"  : "G723/8000",
+    "5"  : "DVI4/8000",
+    "6"  : "DVI4/16000",
+    "7"  : "LPC/8000",
+    "8"  : "PCMA/8000",
+    "9"  : "G722/8000",
+    "10" : "L16/44100/2",
+    "11" : "L16/44100",
+    "12" : "QCELP/8000",
+    "13" : "CN/8000",
+    "14" : "MPA/90000",
+    "15" : "G728/8000",
+    "16" : "DVI4/11025",
+    "17" : "DVI4/22050",
+    "18" : "G729/8000",
+    "25" : "CELB/90000",
+    "26" : "JPEG/90000",
+    "28" : "NV/90000",
+    "31" : "H261/90000",
+    "32" : "MPV/90000",
+    "33" : "MP2T/90000",
+    "34" : "H263/90000",
+}
+
+// CodecPolicy is the codec filter of a call leg. The entries are either
+// payload type numbers or encoding names as in a=rtpmap, optionally with
+// the clock rate, i.e. "0", "PCMU" or "opus/48000". Empty Allow permits
+// everything that is not denied. The codecs listed in Prefer are moved to
+// the head of the format list in that order.
+type CodecPolicy struct {
+    Allow   []string
+    Deny    []string
+    Prefer  []string
+}
+
+// ParseCodecPolicy parses the "allow=PCMU,PCMA;deny=G729;prefer=PCMA"
+// specification. The plain list of codecs is the allow list.
+func ParseCodecPolicy(spec string) (*CodecPolicy, error) {
+    self := &CodecPolicy{}
+    for _, part := range strings.Split(spec, ";") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        key, value := "allow", part
+        if idx := strings.Index(part, "="); idx >= 0 {
+            key, value = strings.ToLower(strings.TrimSpace(part[:idx])), part[idx + 1:]
+        }
+        codecs := []string{}
+        for _, codec := range strings.Split(value, ",") {
+            if codec = strings.TrimSpace(codec); codec != "" {
+                codecs = append(codecs, codec)
+            }
+        }
+        switch key {
+        case "allow":
+            self.Allow = append(self.Allow, codecs...)
+        case "deny":
+            self.Deny = append(self.Deny, codecs...)
+        case "prefer":
+            self.Prefer = append(self.Prefer, codecs...)
+        default:
+            return nil, fmt.Errorf("unknown codec policy parameter: %s", key)
+        }
+    }
+    return self, nil
+}
+
+func codecMatches(entry, pt, codec string) bool {
+    if _, err := strconv.Atoi(entry); err == nil {
+        return entry == pt
+    }
+    if codec == "" {
+        return false
+    }
+    if strings.Contains(entry, "/") {
+        return strings.EqualFold(entry, codec) || strings.HasPrefix(codec, strings.ToUpper(entry) + "/")
+    }
+    return strings.EqualFold(entry, strings.SplitN(codec, "/", 2)[0])
+}
+
+func codecIndex(list []string, pt, codec string) int {
+    for i, entry := range list {
+        if codecMatches(entry, pt, codec) {
+            return i
+        }
+    }
+    return -1
+}
+
+func (self *CodecPolicy) permits(pt, codec string) bool {
+    if self == nil {
+        return true
+    }
+    if len(self.Allow) > 0 && codecIndex(self.Allow, pt, codec) < 0 {
+        return false
+    }
+    return codecIndex(self.Deny, pt, codec) < 0
+}
+
+func (self *CodecPolicy) order(formats []string, codecs map[string]string) []string {
+    if self == nil || len(self.Prefer) == 0 {
+        return formats
+    }
+    ret := make([]string, 0, len(formats))
+    for i := range self.Prefer {
+        for _, pt := range formats {
+            if codecIndex(self.Prefer, pt, codecs[pt]) == i {
+                ret = append(ret, pt)
+            }
+        }
+    }
+    for _, pt := range formats {
+        if codecIndex(self.Prefer, pt, codecs[pt]) < 0 {
+            ret = append(ret, pt)
+        }
+    }
+    return ret
+}
+
+// sdpFormats is the list of formats of one media stream along with the
+// codecs they are mapped to.
+type sdpFormats struct {
+    formats []string
+    codecs  map[string]string
+}
+
+// find returns the payload type in the offer that matches the format of
+// the answer.
+func (self *sdpFormats) find(pt, codec string) string {
+    for _, opt := range self.formats {
+        if codec != "" && self.codecs[opt] == codec {
+            return opt
+        }
+    }
+    for _, opt := range self.formats {
+        if opt == pt && (codec == "" || self.codecs[opt] == "") {
+            return opt
+        }
+    }
+    return ""
+}
+
+func isRtpTransport(transport string) bool {
+    return strings.HasPrefix(strings.ToUpper(transport), "RTP/")
+}
+
+func isDynamicPayloadType(pt string) bool {
+    n, err := strconv.Atoi(pt)
+    return err == nil && n >= 96 && n <= 127
+}
+
+// sectionCodecs maps the payload types of the media stream to the
+// "ENCODING/rate[/channels]" strings.
+func sectionCodecs(sect *sippy_sdp.SdpMediaDescription) map[string]string {
+    codecs := map[string]string{}
+    for _, pt := range sect.GetMHeader().GetFormats() {
+        if codec, ok := static_payload_types[pt]; ok {
+            codecs[pt] = codec
+        }
+    }
+    for _, rtpmap := range sect.GetRtpmaps() {
+        codecs[rtpmap.GetPT()] = rtpmap.GetCodec()
+    }
+    return codecs
+}
+
+// renumberFormats changes the payload type numbers in the m= line and
+// in the attributes of the media stream at once, so that the numbers
+// can be swapped.
+func renumberFormats(sect *sippy_sdp.SdpMediaDescription, formats []string, remap map[string]string) []string {
+    ret := make([]string, len(formats))
+    for i, pt := range formats {
+        if npt, ok := remap[pt]; ok {
+            ret[i] = npt
+        } else {
+            ret[i] = pt
+        }
+    }
+    sect.EditAttributes(func(attr sippy_sdp.SdpAttribute) sippy_sdp.SdpAttribute {
+        switch a := attr.(type) {
+        case *sippy_sdp.SdpRtpmap:
+            if npt, ok := remap[a.GetPT()]; ok {
+                a.SetPT(npt)
+            }
+        case *sippy_sdp.SdpFmtp:
+            if npt, ok := remap[a.GetPT()]; ok {
+                a.SetPT(npt)
+            }
+        case *sippy_sdp.SdpGenericAttribute:
+            if a.GetName() != "rtcp-fb" {
+                break
+            }
+            arr := strings.SplitN(a.GetValue(), " ", 2)
+            if npt, ok := remap[arr[0]]; ok {
+                arr[0] = npt
+                return sippy_sdp.NewSdpValueAttribute("rtcp-fb", strings.Join(arr, " "))
+            }
+        }
+        return attr
+    })
+    return ret
+}
+
+// SdpNegotiator does the RFC 3264 offer/answer on one call leg. It
+// filters and reorders the formats of the offers according to the codec
+// policy, intersects the answers with the offers and keeps the mapping of
+// the dynamic payload types on the leg unchanged across the re-offers.
+// The offer or answer that has no media format left is rejected with
+// ESdpNotAcceptable.
+type SdpNegotiator struct {
+    policy          *CodecPolicy
+    local_offer     []*sdpFormats
+    remote_offer    []*sdpFormats
+    pt_maps         map[int]map[string]string
+    next_local      sippy_types.OnLocalSdpChange
+    next_remote     sippy_types.OnRemoteSdpChange
+}
+
+func NewSdpNegotiator(policy *CodecPolicy) *SdpNegotiator {
+    return &SdpNegotiator{
+        policy      : policy,
+        pt_maps     : make(map[int]map[string]string),
+    }
+}
+
+// Attach installs the negotiator as the SDP change hooks of the UA. The
+// hooks already set on the UA, i.e. the RTP proxy ones, are called with
+// the negotiated SDP afterwards.
+func (self *SdpNegotiator) Attach(ua sippy_types.UA) {
+    self.next_local = ua.GetOnLocalSdpChange()
+    self.next_remote = ua.GetOnRemoteSdpChange()
+    ua.SetOnLocalSdpChange(self.OnLocalSdpChange)
+    ua.SetOnRemoteSdpChange(self.OnRemoteSdpChange)
+}
+
+func (self *SdpNegotiator) OnLocalSdpChange(body sippy_types.MsgBody, event sippy_types.CCEvent, result_callback func(sippy_types.MsgBody)) error {
+    parsed_body, err := body.GetParsedBody()
+    if err != nil {
+        return err
+    }
+    is_offer := self.remote_offer == nil
+    switch event.(type) {
+    case *CCEventTry, *CCEventUpdate:
+        is_offer = true
+    }
+    if is_offer {
+        self.local_offer, err = self.offer(parsed_body.GetSections(), true)
+        self.remote_offer = nil
+    } else {
+        err = self.answer(parsed_body.GetSections(), self.remote_offer, true)
+        if _, ok := event.(*CCEventRing); ! ok {
+            // the offer is answered by the final response
+            self.remote_offer = nil
+        }
+    }
+    if err != nil {
+        return err
+    }
+    if self.next_local != nil {
+        return self.next_local(body, event, result_callback)
+    }
+    body.SetNeedsUpdate(false)
+    result_callback(body)
+    return nil
+}
+
+func (self *SdpNegotiator) OnRemoteSdpChange(body sippy_types.MsgBody, msg sippy_types.SipMsg, result_callback func(sippy_types.MsgBody)) error {
+    parsed_body, err := body.GetParsedBody()
+    if err != nil {
+        return err
+    }
+    is_offer := self.local_offer == nil
+    if req, ok := msg.(sippy_types.SipRequest); ok && (req.GetMethod() == "INVITE" || req.GetMethod() == "UPDATE") {
+        is_offer = true
+    }
+    if is_offer {
+        self.remote_offer, err = self.offer(parsed_body.GetSections(), false)
+        self.local_offer = nil
+    } else {
+        err = self.answer(parsed_body.GetSections(), self.local_offer, false)
+        if resp, ok := msg.(sippy_types.SipResponse); ! ok || resp.GetSCodeNum() >= 200 {
+            // the offer is answered by the final response or ACK
+            self.local_offer = nil
+        }
+    }
+    if err != nil {
+        return err
+    }
+    if self.next_remote != nil {
+        return self.next_remote(body, msg, result_callback)
+    }
+    body.SetNeedsUpdate(false)
+    result_callback(body)
+    return nil
+}
+
+func (self *SdpNegotiator) offer(sections []*sippy_sdp.SdpMediaDescription, local bool) ([]*sdpFormats, error) {
+    ret := make([]*sdpFormats, len(sections))
+    rtp, active := 0, 0
+    for i, sect := range sections {
+        mhdr := sect.GetMHeader()
+        if mhdr == nil || mhdr.GetPort() == "0" {
+            continue
+        }
+        if !isRtpTransport(mhdr.GetTransport()) {
+            active++
+            continue
+        }
+        rtp++
+        codecs := sectionCodecs(sect)
+        formats := []string{}
+        for _, pt := range mhdr.GetFormats() {
+            if self.policy.permits(pt, codecs[pt]) {
+                formats = append(formats, pt)
+            }
+        }
+        if len(formats) == 0 {
+            // RFC 3264 section 8.2: the stream is disabled by the zero port
+            mhdr.SetPort("0")
+            continue
+        }
+        formats = self.policy.order(formats, codecs)
+        if local {
+            formats, codecs = self.keepMapping(i, sect, formats, codecs)
+        }
+        sect.SetFormats(formats)
+        ret[i] = &sdpFormats{ formats, codecs }
+        active++
+    }
+    if rtp > 0 && active == 0 {
+        return nil, &ESdpNotAcceptable{ "No acceptable media formats in the offer" }
+    }
+    self.recordMapping(ret)
+    return ret, nil
+}
+
+func (self *SdpNegotiator) answer(sections []*sippy_sdp.SdpMediaDescription, offer []*sdpFormats, local bool) error {
+    ret := make([]*sdpFormats, len(sections))
+    rtp, active := 0, 0
+    for i, sect := range sections {
+        mhdr := sect.GetMHeader()
+        if mhdr == nil || mhdr.GetPort() == "0" {
+            continue
+        }
+        if !isRtpTransport(mhdr.GetTransport()) {
+            active++
+            continue
+        }
+        rtp++
+        if i >= len(offer) || offer[i] == nil {
+            mhdr.SetPort("0")
+            continue
+        }
+        codecs := sectionCodecs(sect)
+        formats := []string{}
+        remap := map[string]string{}
+        for _, pt := range mhdr.GetFormats() {
+            opt := offer[i].find(pt, codecs[pt])
+            if opt == "" {
+                continue
+            }
+            if local && opt != pt {
+                // RFC 3264 section 6.1: the answer uses the payload types of the offer
+                remap[pt] = opt
+            }
+            formats = append(formats, pt)
+        }
+        if len(formats) == 0 {
+            mhdr.SetPort("0")
+            continue
+        }
+        formats = self.policy.order(formats, codecs)
+        if len(remap) > 0 {
+            formats = renumberFormats(sect, formats, remap)
+            codecs = sectionCodecs(sect)
+        }
+        sect.SetFormats(formats)
+        ret[i] = &sdpFormats{ formats, codecs }
+        active++
+    }
+    if rtp > 0 && active == 0 {
+        return &ESdpNotAcceptable{ "No acceptable media formats in the answer" }
+    }
+    self.recordMapping(ret)
+    return nil
+}
+
+// keepMapping renumbers the dynamic payload types of the local offer so
+// that the codecs already negotiated on the leg keep their numbers and
+// the numbers in use are not reassigned to other codecs (RFC 3264
+// section 8.3.2).
+func (self *SdpNegotiator) keepMapping(idx int, sect *sippy_sdp.SdpMediaDescription, formats []string, codecs map[string]string) ([]string, map[string]string) {
+    pt_map := self.pt_maps[idx]
+    if len(pt_map) == 0 {
+        return formats, codecs
+    }
+    reserved := map[string]string{}
+    for codec, pt := range pt_map {
+        reserved[pt] = codec
+    }
+    remap := map[string]string{}
+    taken := map[string]bool{}
+    for _, pt := range formats {
+        if !isDynamicPayloadType(pt) {
+            taken[pt] = true
+        } else if npt, ok := pt_map[codecs[pt]]; ok && !taken[npt] {
+            remap[pt] = npt
+            taken[npt] = true
+        }
+    }
+    next := 96
+    for _, pt := range formats {
+        if !isDynamicPayloadType(pt) {
+            continue
+        }
+        if _, ok := remap[pt]; ok {
+            continue
+        }
+        if _, ok := reserved[pt]; !ok && !taken[pt] {
+            remap[pt] = pt
+            taken[pt] = true
+            continue
+        }
+        for ; next <= 127; next++ {
+            npt := strconv.Itoa(next)
+            if _, ok := reserved[npt]; !ok && !taken[npt] {
+                break
+            }
+        }
+        if next > 127 {
+            // no room, leave it as is
+            continue
+        }
+        remap[pt] = strconv.Itoa(next)
+        taken[remap[pt]] = true
+    }
+    for pt, npt := range remap {
+        if pt == npt {
+            delete(remap, pt)
+        }
+    }
+    if len(remap) == 0 {
+        return formats, codecs
+    }
+    formats = renumberFormats(sect, formats, remap)
+    return formats, sectionCodecs(sect)
+}
+
+func (self *SdpNegotiator) recordMapping(streams []*sdpFormats) {
+    for i, stream := range streams {
+        if stream == nil {
+            continue
+        }
+        pt_map, ok := self.pt_maps[i]
+        if !ok {
+            pt_map = make(map[string]string)
+            self.pt_maps[i] = pt_map
+        }
+        for _, pt := range stream.formats {
+            codec := stream.codecs[pt]
+            if codec == "" || !isDynamicPayloadType(pt) {
+                continue
+            }
+            if _, ok := pt_map[codec]; !ok {
+                pt_map[codec] = pt
+            }
+        }
+    }
+}
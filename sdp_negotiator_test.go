@@ -0,0 +1,204 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+    "github.com/braams/sippy/types"
+)
+
+type negotiating_call_map struct {
+    *test_call_map
+    policy  *CodecPolicy
+}
+
+func (self *negotiating_call_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+    ua, rr, resp := self.test_call_map.OnNewDialog(req, tr)
+    NewSdpNegotiator(self.policy).Attach(ua)
+    return ua, rr, resp
+}
+
+func mLine(body string) string {
+    for _, line := range strings.Split(body, "\r\n") {
+        if strings.HasPrefix(line, "m=audio ") {
+            return line
+        }
+    }
+    return ""
+}
+
+func Test_SdpNegotiator(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    policy, err := ParseCodecPolicy("PCMU,PCMA,telephone-event,opus;deny=G729;prefer=PCMA")
+    if err != nil {
+        t.Fatal("Cannot parse codec policy: " + err.Error())
+    }
+    cmap := &negotiating_call_map{ NewTestCallMap(config), policy }
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    rtime, _ := sippy_time.NewMonoTime()
+
+    // The offer is filtered and reordered
+    ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort("2.2.2.2", "5060"), cmap, &cmap.lock, nil)
+    NewSdpNegotiator(policy).Attach(ua)
+    sdp := "v=0\r\no=- 12345 1 IN IP4 1.1.1.1\r\ns=-\r\nc=IN IP4 1.1.1.1\r\nt=0 0\r\n" +
+        "m=audio 10000 RTP/AVP 18 0 8 101\r\na=fmtp:18 annexb=no\r\n" +
+        "a=rtpmap:101 telephone-event/8000\r\na=fmtp:101 0-15\r\n"
+    cmap.lock.Lock()
+    ua.RecvEvent(NewCCEventTry(sippy_header.NewSipCallIdFromString("negotiator@1.1.1.1"), nil, "100", "200",
+        NewMsgBody(sdp, "application/sdp"), nil, "Alice", nil, ""))
+    cmap.lock.Unlock()
+    invite, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    body := invite.GetBody().String()
+    assertStringEqual(mLine(body), "m=audio 10000 RTP/AVP 8 0 101", t)
+    if strings.Contains(body, "annexb") {
+        t.Fatal("Attributes of the removed format have been left: " + body)
+    }
+
+    // The answer is intersected with the offer
+    resp := invite.GenResponse(200, "OK", NewMsgBody("v=0\r\no=- 5 1 IN IP4 2.2.2.2\r\ns=-\r\nc=IN IP4 2.2.2.2\r\nt=0 0\r\n" +
+        "m=audio 20000 RTP/AVP 0 9 101\r\na=rtpmap:101 telephone-event/8000\r\n", "application/sdp"), nil)
+    to, _ := resp.GetTo().GetBody()
+    to.SetTag("callee")
+    resp.AppendHeader(sippy_header.CreateSipContact("<sip:200@2.2.2.2:5060>")[0])
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+    tfactory.get() // ACK
+    cmap.lock.Lock()
+    assertStringEqual(mLine(ua.GetRSDP().String()), "m=audio 20000 RTP/AVP 0 101", t)
+
+    // The re-offer keeps telephone-event at 101 and moves opus away from it
+    sdp = "v=0\r\no=- 12345 2 IN IP4 1.1.1.1\r\ns=-\r\nc=IN IP4 1.1.1.1\r\nt=0 0\r\n" +
+        "m=audio 10000 RTP/AVP 0 8 96 101\r\na=rtpmap:96 telephone-event/8000\r\n" +
+        "a=fmtp:96 0-15\r\na=rtpmap:101 opus/48000/2\r\n"
+    ua.RecvEvent(NewCCEventUpdate(rtime, "", nil, nil, NewMsgBody(sdp, "application/sdp")))
+    cmap.lock.Unlock()
+    reinvite, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse re-INVITE: " + err.Error())
+    }
+    body = reinvite.GetBody().String()
+    assertStringEqual(mLine(body), "m=audio 10000 RTP/AVP 8 0 101 96", t)
+    if ! strings.Contains(body, "a=rtpmap:101 telephone-event/8000\r\na=fmtp:101 0-15\r\na=rtpmap:96 opus/48000/2\r\n") {
+        t.Fatal("Payload types have not been renumbered: " + body)
+    }
+
+    // The offer without acceptable formats is rejected
+    tfactory.feed([]string{
+        "INVITE sip:300@" + config.GetMyAddress().String() + " SIP/2.0",
+        "Via: SIP/2.0/UDP 3.3.3.3:5060;branch=z9hG4bKnegotiator1",
+        "Max-Forwards: 70",
+        "From: <sip:400@3.3.3.3>;tag=caller",
+        "To: <sip:300@" + config.GetMyAddress().String() + ">",
+        "Call-ID: negotiator@3.3.3.3",
+        "CSeq: 1 INVITE",
+        "Contact: <sip:400@3.3.3.3:5060>",
+        "Content-Type: application/sdp",
+        "",
+        "v=0",
+        "o=- 1 1 IN IP4 3.3.3.3",
+        "s=-",
+        "c=IN IP4 3.3.3.3",
+        "t=0 0",
+        "m=audio 30000 RTP/AVP 18",
+        "",
+    })
+    trying, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse 100 Trying: " + err.Error())
+    }
+    assertStringEqual(trying.GetSL(), "SIP/2.0 100 Trying", t)
+    reject, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse the final response: " + err.Error())
+    }
+    assertStringEqual(reject.GetSL(), "SIP/2.0 488 Not Acceptable Here", t)
+}
+
+func Test_SdpNegotiatorLateOffer(t *testing.T) {
+    config, tfactory := newTestConfig()
+    policy, err := ParseCodecPolicy("PCMU,PCMA")
+    if err != nil {
+        t.Fatal("Cannot parse codec policy: " + err.Error())
+    }
+    cmap := &negotiating_call_map{ NewTestCallMap(config), policy }
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    rtime, _ := sippy_time.NewMonoTime()
+    sdp := func(version, mline string) sippy_types.MsgBody {
+        return NewMsgBody("v=0\r\no=- 5 " + version + " IN IP4 2.2.2.2\r\ns=-\r\nc=IN IP4 2.2.2.2\r\nt=0 0\r\n" + mline + "\r\n", "application/sdp")
+    }
+
+    ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort("2.2.2.2", "5060"), cmap, &cmap.lock, nil)
+    NewSdpNegotiator(policy).Attach(ua)
+    cmap.lock.Lock()
+    ua.RecvEvent(NewCCEventTry(sippy_header.NewSipCallIdFromString("late-offer@1.1.1.1"), nil, "100", "200",
+        sdp("1", "m=audio 10000 RTP/AVP 0"), nil, "Alice", nil, ""))
+    cmap.lock.Unlock()
+    invite, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    resp := invite.GenResponse(200, "OK", sdp("1", "m=audio 20000 RTP/AVP 0"), nil)
+    to, _ := resp.GetTo().GetBody()
+    to.SetTag("callee")
+    resp.AppendHeader(sippy_header.CreateSipContact("<sip:200@2.2.2.2:5060>")[0])
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+    tfactory.get() // ACK
+
+    // The SDP in 200 OK to the late offer re-INVITE is the new offer, not
+    // the answer to the offer of the INVITE
+    cmap.lock.Lock()
+    ua.RecvEvent(NewCCEventUpdate(rtime, "", nil, nil, nil))
+    cmap.lock.Unlock()
+    reinvite, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse re-INVITE: " + err.Error())
+    }
+    if reinvite.GetBody() != nil {
+        t.Fatal("The late offer re-INVITE has a body")
+    }
+    resp = reinvite.GenResponse(200, "OK", sdp("2", "m=audio 20000 RTP/AVP 8"), nil)
+    resp.AppendHeader(sippy_header.CreateSipContact("<sip:200@2.2.2.2:5060>")[0])
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+    tfactory.get() // ACK
+    cmap.lock.Lock()
+    defer cmap.lock.Unlock()
+    if _, ok := cmap.event.(*CCEventFail); ok {
+        t.Fatal("The late offer has been rejected")
+    }
+    assertStringEqual(mLine(ua.GetRSDP().String()), "m=audio 20000 RTP/AVP 8", t)
+}
@@ -269,6 +269,9 @@ func (self *serverTransaction) SendResponseWithLossEmul(resp sippy_types.SipResp
         }
     }
     self.sip_tm.beforeResponseSent(resp)
+    if self.before_response_sent != nil {
+        self.before_response_sent(resp)
+    }
     self.data = []byte(resp.LocalStr(self.userv.GetLAddress(), /*compact*/ false))
     via0, err = resp.GetVias()[0].GetBody()
     if err != nil {
@@ -317,9 +320,6 @@ func (self *serverTransaction) SendResponseWithLossEmul(resp sippy_types.SipResp
             need_cleanup = true
         }
     }
-    if self.before_response_sent != nil {
-        self.before_response_sent(resp)
-    }
     self.sip_tm.transmitData(self.userv, self.data, self.address, self.checksum, self.tid.CallId, lossemul)
     if need_cleanup {
         self.cleanup()
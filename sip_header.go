@@ -27,14 +27,19 @@
 package sippy
 
 import (
+    "errors"
     "fmt"
     "strings"
+    "sync"
 
     "github.com/braams/sippy/conf"
     "github.com/braams/sippy/headers"
 )
 
-var sip_header_name_map = map[string]func(body string) ([]sippy_header.SipHeader) {
+// SipHeaderFactory creates typed header(s) out of the header body.
+type SipHeaderFactory func(body string) []sippy_header.SipHeader
+
+var sip_header_name_map = map[string]SipHeaderFactory {
     "cseq"              : sippy_header.CreateSipCSeq,
     "call-id"           : sippy_header.CreateSipCallId,
     "i"                 : sippy_header.CreateSipCallId,
@@ -71,6 +76,130 @@ var sip_header_name_map = map[string]func(body string) ([]sippy_header.SipHeader
     "reason"            : sippy_header.CreateSipReason,
     "warning"           : sippy_header.CreateSipWarning,
     "diversion"         : sippy_header.CreateSipDiversion,
+    "event"             : sippy_header.CreateSipEvent,
+    "o"                 : sippy_header.CreateSipEvent,
+    "subscription-state": sippy_header.CreateSipSubscriptionState,
+    "path"              : sippy_header.CreateSipPath,
+    "p-asserted-identity": sippy_header.CreateSipPAssertedIdentity,
+    "p-preferred-identity": sippy_header.CreateSipPPreferredIdentity,
+    "privacy"           : sippy_header.CreateSipPrivacy,
+    "history-info"      : sippy_header.CreateSipHistoryInfo,
+    "allow"             : sippy_header.CreateSipAllow,
+    "supported"         : sippy_header.CreateSipSupported,
+    "k"                 : sippy_header.CreateSipSupported,
+    "require"           : sippy_header.CreateSipRequire,
+    "unsupported"       : sippy_header.CreateSipUnsupported,
+}
+
+// The full names of the headers known by the compact form.
+var sip_compact_header_names = map[string]string {
+    "i" : "call-id",
+    "f" : "from",
+    "t" : "to",
+    "v" : "via",
+    "l" : "content-length",
+    "c" : "content-type",
+    "m" : "contact",
+    "r" : "refer-to",
+    "o" : "event",
+    "k" : "supported",
+}
+
+var sip_header_compact_names = func() map[string]string {
+    rval := map[string]string{}
+    for compact, full := range sip_compact_header_names {
+        rval[full] = compact
+    }
+    return rval
+}()
+
+var sip_custom_header_lock sync.RWMutex
+var sip_custom_header_map = map[string]SipHeaderFactory{}
+var sip_custom_compact_names = map[string]string{}
+
+// RegisterSipHeader makes the parser to create typed headers using the
+// factory for the custom or vendor specific header. The compact_name is
+// optional. The headers built into the library cannot be overridden.
+// The header type is expected to embed sippy_header.HFName so that
+// GetFirstHF()/GetHFs() find it by either name.
+func RegisterSipHeader(name, compact_name string, factory SipHeaderFactory) error {
+    if strings.TrimSpace(name) == "" {
+        return errors.New("Header name cannot be empty")
+    }
+    if factory == nil {
+        return errors.New("Header '" + name + "' cannot be registered without a factory")
+    }
+    names := []string{ strings.ToLower(name) }
+    if compact_name != "" {
+        names = append(names, strings.ToLower(compact_name))
+    }
+    for _, n := range names {
+        if _, ok := sip_header_name_map[n]; ok {
+            return errors.New("Header '" + n + "' is built in and cannot be registered")
+        }
+    }
+    sip_custom_header_lock.Lock()
+    defer sip_custom_header_lock.Unlock()
+    for _, n := range names {
+        sip_custom_header_map[n] = factory
+    }
+    if compact_name != "" {
+        sip_custom_compact_names[names[1]] = names[0]
+    }
+    return nil
+}
+
+// UnregisterSipHeader reverts the header to the generic one.
+func UnregisterSipHeader(name, compact_name string) {
+    sip_custom_header_lock.Lock()
+    defer sip_custom_header_lock.Unlock()
+    delete(sip_custom_header_map, strings.ToLower(name))
+    if compact_name != "" {
+        delete(sip_custom_header_map, strings.ToLower(compact_name))
+        delete(sip_custom_compact_names, strings.ToLower(compact_name))
+    }
+}
+
+// canonicalHFName maps the lower case header name to the lower case full
+// name of the header.
+func canonicalHFName(name string) string {
+    if full, ok := sip_compact_header_names[name]; ok {
+        return full
+    }
+    sip_custom_header_lock.RLock()
+    full, ok := sip_custom_compact_names[name]
+    sip_custom_header_lock.RUnlock()
+    if ok {
+        return full
+    }
+    return name
+}
+
+// compactHFName maps the lower case full name of the header to the
+// compact one or returns an empty string if the header has none.
+func compactHFName(key string) string {
+    if compact, ok := sip_header_compact_names[key]; ok {
+        return compact
+    }
+    sip_custom_header_lock.RLock()
+    defer sip_custom_header_lock.RUnlock()
+    for compact, full := range sip_custom_compact_names {
+        if full == key {
+            return compact
+        }
+    }
+    return ""
+}
+
+func lookupSipHeaderFactory(name string) (SipHeaderFactory, bool) {
+    factory, ok := sip_header_name_map[name]
+    if ok {
+        return factory, true
+    }
+    sip_custom_header_lock.RLock()
+    factory, ok = sip_custom_header_map[name]
+    sip_custom_header_lock.RUnlock()
+    return factory, ok
 }
 
 func ParseSipHeader(s string, config sippy_conf.Config) ([]sippy_header.SipHeader, error) {
@@ -80,7 +209,7 @@ func ParseSipHeader(s string, config sippy_conf.Config) ([]sippy_header.SipHeade
     }
     name := strings.TrimSpace(res[0])
     body := strings.TrimSpace(res[1])
-    factory, ok := sip_header_name_map[strings.ToLower(name)]
+    factory, ok := lookupSipHeaderFactory(strings.ToLower(name))
     if ok {
         return factory(body), nil
     }
@@ -0,0 +1,115 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+type test_acme_hf struct {
+    sippy_header.HFName
+    tag     string
+}
+
+func (self *test_acme_hf) StringBody() string {
+    return "tag=" + self.tag
+}
+
+func (self *test_acme_hf) String() string {
+    return self.Name() + ": " + self.StringBody()
+}
+
+func (self *test_acme_hf) LocalStr(hostport *sippy_net.HostPort, compact bool) string {
+    if compact {
+        return self.CompactName() + ": " + self.StringBody()
+    }
+    return self.String()
+}
+
+func (self *test_acme_hf) GetCopyAsIface() sippy_header.SipHeader {
+    rval := *self
+    return &rval
+}
+
+func Test_RegisterSipHeader(t *testing.T) {
+    factory := func(body string) []sippy_header.SipHeader {
+        return []sippy_header.SipHeader{ &test_acme_hf{
+            HFName  : sippy_header.NewHFName("X-Acme", "xa"),
+            tag     : strings.TrimPrefix(body, "tag="),
+        } }
+    }
+    if RegisterSipHeader("Via", "", factory) == nil {
+        t.Fatal("Built in headers must not be overridden")
+    }
+    if RegisterSipHeader("", "xa", factory) == nil {
+        t.Fatal("Empty header name must be rejected")
+    }
+    if RegisterSipHeader("X-Acme", "xa", nil) == nil {
+        t.Fatal("Nil factory must be rejected")
+    }
+    err := RegisterSipHeader("X-Acme", "xa", factory)
+    if err != nil {
+        t.Fatal("Cannot register header: " + err.Error())
+    }
+    defer UnregisterSipHeader("X-Acme", "xa")
+
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest([]byte("OPTIONS sip:1.1.1.1 SIP/2.0\r\n" +
+        "Via: SIP/2.0/UDP 2.2.2.2:5060;branch=z9hG4bK1\r\n" +
+        "From: <sip:100@1.1.1.1>;tag=12345\r\n" +
+        "To: <sip:1.1.1.1>\r\n" +
+        "Call-ID: custom-header-test@2.2.2.2\r\n" +
+        "CSeq: 1 OPTIONS\r\n" +
+        "X-Acme: tag=one\r\n" +
+        "xa: tag=two\r\n" +
+        "Content-Length: 0\r\n\r\n"), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse request: " + err.Error())
+    }
+    hfs := req.GetHFs("x-acme")
+    if len(hfs) != 2 {
+        t.Fatalf("Expected 2 X-Acme headers, got %d", len(hfs))
+    }
+    for i, tag := range []string{ "one", "two" } {
+        hf, ok := hfs[i].(*test_acme_hf)
+        if ! ok {
+            t.Fatal("The header has not been parsed into the registered type")
+        }
+        assertStringEqual(hf.tag, tag, t)
+    }
+    if _, ok := req.GetFirstHF("xa").(*test_acme_hf); ! ok {
+        t.Fatal("The header is not found by the compact name")
+    }
+}
@@ -70,6 +70,10 @@ type sipMsg struct {
     sip_user_agent      *sippy_header.SipUserAgent
     sip_cisco_guid      *sippy_header.SipCiscoGUID
     sip_h323_conf_id    *sippy_header.SipH323ConfId
+    nlazy               int
+    parse_err           *ESipParseException
+    content_length_offset int
+    strict_seen         uint
     config              sippy_conf.Config
 }
 
@@ -88,7 +92,21 @@ func NewSipMsg(rtime *sippy_time.MonoTime, config sippy_conf.Config) *sipMsg {
     return self
 }
 
-func ParseSipMsg(_buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipMsg, error) {
+func ParseSipMsg(buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipMsg, error) {
+    self, err := parseSipMsg(buf, rtime, config)
+    if err == nil && self.parse_err != nil {
+        err = self.parse_err
+    }
+    if err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+// parseSipMsg returns the message even if there is a problem with one of
+// the headers (stored in parse_err), so that the request can be answered.
+// The message is only nil if some of the mandatory headers is missing.
+func parseSipMsg(_buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipMsg, error) {
     self := NewSipMsg(rtime, config)
     buf := string(_buf)
     // Locate a body
@@ -104,53 +122,196 @@ func ParseSipMsg(_buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Conf
             break
         }
     }
-    // Split message into lines and put aside start line
-    lines := strings.FieldsFunc(buf, func(c rune) bool { return c == '\n' || c == '\r' })
-    self.startline = lines[0]
-    header_lines := make([]string, 0)
-    prev_l := ""
-    for _, l := range lines[1:] {
-        if l == "" || l[0] == ' ' || l[0] == '\t' {
-            prev_l += strings.TrimSpace(l)
+    // Split message into lines and put aside start line. The header
+    // lines are referred to by the offsets in the buffer, the folded ones
+    // are joined.
+    var body string
+    folded, start, colon, end := false, -1, -1, -1
+    strict := config != nil && config.StrictParser()
+    for pos := 0; pos < len(buf); {
+        var line string
+        lstart := pos
+        eol := strings.IndexAny(buf[pos:], "\r\n")
+        if eol == -1 {
+            line, pos = buf[pos:], len(buf)
         } else {
-            if len(prev_l) > 0 {
-                header_lines = append(header_lines, prev_l)
+            line, pos = buf[pos:pos + eol], pos + eol + 1
+            if buf[pos - 1] == '\r' && pos < len(buf) && buf[pos] == '\n' {
+                pos++
             }
-            prev_l = l
+        }
+        if line == "" {
+            continue
+        }
+        if self.startline == "" {
+            self.startline = line
+            continue
+        }
+        if line[0] == ' ' || line[0] == '\t' {
+            if start != -1 {
+                if body == "" {
+                    body = strings.TrimSpace(line)
+                } else {
+                    body += " " + strings.TrimSpace(line)
+                }
+                folded = true
+            }
+            continue
+        }
+        if start != -1 {
+            if err := self.appendRawHeader(buf, start, colon, end, body, folded, strict); err != nil {
+                return nil, err
+            }
+        }
+        start, end, folded = lstart, lstart + len(line), false
+        if colon = strings.IndexByte(line, ':'); colon != -1 {
+            colon += lstart
+            body = strings.TrimSpace(buf[colon + 1:end])
+        } else {
+            body = ""
         }
     }
-    if prev_l != "" {
-        header_lines = append(header_lines, prev_l)
+    if start != -1 {
+        if err := self.appendRawHeader(buf, start, colon, end, body, folded, strict); err != nil {
+            return nil, err
+        }
+    }
+    for _, hf := range []struct{ name string; present bool }{
+            { "Via", len(self.vias) > 0 },
+            { "To", self.to != nil },
+            { "From", self.from != nil },
+            { "CSeq", self.cseq != nil },
+            { "Call-ID", self.call_id != nil },
+        } {
+        if !hf.present {
+            return nil, newESipHFParseException(SipParseErrorMissing, hf.name, "", -1, "")
+        }
     }
+    return self, nil
+}
 
-    // Parse headers
-    for _, line := range header_lines {
-        headers, err := ParseSipHeader(line, config)
-        if err != nil {
-            return nil, err
+// The headers required to route the message and to match it against the
+// transactions. They are parsed at once, all the others only when asked for.
+var sip_eager_headers = []struct{ name, compact_name string }{
+    { "via", "v" },
+    { "cseq", "" },
+    { "call-id", "i" },
+    { "from", "f" },
+    { "to", "t" },
+    { "content-length", "l" },
+    { "content-type", "c" },
+    { "route", "" },
+}
+
+func (self *sipMsg) appendRawHeader(buf string, start, colon, end int, body string, folded, strict bool) error {
+    var name string
+    if colon != -1 {
+        name = strings.TrimSpace(buf[start:colon])
+    }
+    if name == "" {
+        err := newESipHFParseException(SipParseErrorMalformed, "", buf[start:end], start, "Bad header line")
+        if strict {
+            self.parseFail(err)
+            return nil
         }
-        for _, header := range headers {
-            if contact, ok := header.(*sippy_header.SipContact); ok {
-                if contact.Asterisk {
-                    continue
+        return err
+    }
+    hf_ok := true
+    if strict {
+        hf_ok = self.strictCheckHF(name, body, start)
+    }
+    for _, hf := range sip_eager_headers {
+        if strings.EqualFold(name, hf.name) || (hf.compact_name != "" && strings.EqualFold(name, hf.compact_name)) {
+            factory, _ := lookupSipHeaderFactory(hf.name)
+            for _, header := range factory(body) {
+                // no point in parsing the header already known to be broken,
+                // the others are only checked by the strict parser
+                if hf_ok && (strict || self.isTransactionHF(header)) {
+                    if err := checkMandatoryHF(header); err != nil {
+                        self.parseFail(newESipHFParseException(SipParseErrorMalformed, name, body, start, err.Error()))
+                    }
                 }
+                self.AppendHeader(header)
             }
-            self.AppendHeader(header)
+            if hf.name == "content-length" {
+                self.content_length_offset = start
+            }
+            return nil
         }
     }
-    if len(self.vias) == 0 {
-        return nil, errors.New("Via HF is missed")
+    if ! folded {
+        body = ""
     }
-    if self.to == nil {
-        return nil, errors.New("To HF is missed")
+    self.headers = append(self.headers, newLazyHF(buf, start, colon, end, body))
+    self.nlazy++
+    return nil
+}
+
+// isTransactionHF tells whether the header is used to match the message
+// against the transactions, that is the top Via, To, From or CSeq.
+func (self *sipMsg) isTransactionHF(header sippy_header.SipHeader) bool {
+    switch header.(type) {
+    case *sippy_header.SipVia:
+        return len(self.vias) == 0
+    case *sippy_header.SipTo, *sippy_header.SipFrom, *sippy_header.SipCSeq:
+        return true
     }
-    if self.from == nil {
-        return nil, errors.New("From HF is missed")
+    return false
+}
+
+// checkMandatoryHF parses the header required to handle the message.
+func checkMandatoryHF(header sippy_header.SipHeader) (err error) {
+    switch t := header.(type) {
+    case *sippy_header.SipVia:
+        _, err = t.GetBody()
+    case *sippy_header.SipTo:
+        _, err = t.GetBody()
+    case *sippy_header.SipFrom:
+        _, err = t.GetBody()
+    case *sippy_header.SipCSeq:
+        _, err = t.GetBody()
     }
-    if self.cseq == nil {
-        return nil, errors.New("CSeq HF is missed")
+    return err
+}
+
+// parseFail records the problem with the message unless there is one
+// already.
+func (self *sipMsg) parseFail(err *ESipParseException) {
+    if self.parse_err == nil {
+        self.parse_err = err
+    }
+}
+
+// materialize replaces the placeholders of the named header with the
+// typed header objects in place keeping the order of the headers.
+func (self *sipMsg) materialize(name string) {
+    if self.nlazy == 0 {
+        return
+    }
+    key := canonicalHFName(strings.ToLower(name))
+    compact := compactHFName(key)
+    for i := 0; i < len(self.headers); i++ {
+        lhf, ok := self.headers[i].(*lazyHF)
+        if ! ok || ! lhf.is(key, compact) {
+            continue
+        }
+        self.nlazy--
+        parsed := make([]sippy_header.SipHeader, 0, 1)
+        for _, header := range lhf.parse(key) {
+            if contact, ok := header.(*sippy_header.SipContact); ok && contact.Asterisk {
+                continue
+            }
+            if self.setTypedHeader(header) {
+                parsed = append(parsed, header)
+            }
+        }
+        if len(parsed) == 1 {
+            self.headers[i] = parsed[0]
+            continue
+        }
+        self.headers = append(self.headers[:i], append(parsed, self.headers[i + 1:]...)...)
+        i += len(parsed) - 1
     }
-    return self, nil
 }
 
 func (self *sipMsg) appendHeaders(hdrs []sippy_header.SipHeader) {
@@ -161,6 +322,65 @@ func (self *sipMsg) appendHeaders(hdrs []sippy_header.SipHeader) {
 }
 
 func (self *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
+    if lhf, ok := hdr.(*lazyHF); ok {
+        self.headers = append(self.headers, lhf)
+        self.nlazy++
+        return
+    }
+    if hdr != nil {
+        // Keep the order of the headers with the same name
+        self.materialize(hdr.Name())
+    }
+    if self.setTypedHeader(hdr) {
+        self.headers = append(self.headers, hdr)
+    }
+}
+
+// ReplaceHeader puts the hdrs in place of the old header. The Via, Route
+// and Content-* headers are not kept in the generic list and cannot be
+// replaced this way.
+func (self *sipMsg) ReplaceHeader(old sippy_header.SipHeader, hdrs ...sippy_header.SipHeader) {
+    headers := make([]sippy_header.SipHeader, 0, len(self.headers))
+    found := false
+    for _, hf := range self.headers {
+        if !found && hf == old {
+            found = true
+            headers = append(headers, hdrs...)
+            continue
+        }
+        headers = append(headers, hf)
+    }
+    if found {
+        self.reindex(headers)
+    }
+}
+
+func (self *sipMsg) RemoveHeader(hdr sippy_header.SipHeader) {
+    self.ReplaceHeader(hdr)
+}
+
+// reindex rebuilds the typed fields from the generic header list.
+func (self *sipMsg) reindex(headers []sippy_header.SipHeader) {
+    self.headers = make([]sippy_header.SipHeader, 0, len(headers))
+    self.contacts = make([]*sippy_header.SipContact, 0)
+    self.record_routes = make([]*sippy_header.SipRecordRoute, 0)
+    self.also = make([]*sippy_header.SipAlso, 0)
+    self.to, self.from, self.cseq, self.call_id = nil, nil, nil, nil
+    self.maxforwards, self.refer_to, self.reason_hf, self.sip_warning = nil, nil, nil, nil
+    self.sip_www_authenticate, self.sip_authorization = nil, nil
+    self.sip_proxy_authenticate, self.sip_proxy_authorization = nil, nil
+    self.sip_server, self.sip_user_agent = nil, nil
+    self.sip_cisco_guid, self.sip_h323_conf_id = nil, nil
+    for _, hf := range headers {
+        if _, ok := hf.(*lazyHF); ok || self.setTypedHeader(hf) {
+            self.headers = append(self.headers, hf)
+        }
+    }
+}
+
+// setTypedHeader stores the header in the typed field and tells whether
+// it belongs to the generic header list.
+func (self *sipMsg) setTypedHeader(hdr sippy_header.SipHeader) bool {
     switch t := hdr.(type) {
     case *sippy_header.SipCSeq:
         self.cseq = t
@@ -174,19 +394,19 @@ func (self *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
         self.maxforwards = t
     case *sippy_header.SipVia:
         self.vias = append(self.vias, t)
-        return
+        return false
     case *sippy_header.SipContentLength:
         self.content_length = t
-        return
+        return false
     case *sippy_header.SipContentType:
         self.content_type = t
-        return
+        return false
     case *sippy_header.SipExpires:
     case *sippy_header.SipRecordRoute:
         self.record_routes = append(self.record_routes, t)
     case *sippy_header.SipRoute:
         self.routes = append(self.routes, t)
-        return
+        return false
     case *sippy_header.SipContact:
         self.contacts = append(self.contacts, t)
     case *sippy_header.SipWWWAuthenticate:
@@ -217,9 +437,14 @@ func (self *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
     case *sippy_header.SipWarning:
         self.sip_warning = t
     case nil:
-        return
+        return false
     }
-    self.headers = append(self.headers, hdr)
+    return true
+}
+
+func (self *sipMsg) contentLengthError(msg string) *ESipParseException {
+    return newESipHFParseException(SipParseErrorMalformed, self.content_length.Name(), self.content_length.StringBody(),
+        self.content_length_offset, msg)
 }
 
 func (self *sipMsg) init_body() error {
@@ -233,15 +458,19 @@ func (self *sipMsg) init_body() error {
         if self.__mbody != nil {
             mblen = len([]byte(*self.__mbody)) // length in bytes, not runes
         }
-        if blen == 0 {
+        if blen < 0 {
+            return self.contentLengthError(fmt.Sprintf("negative value %d", blen))
+        } else if blen == 0 {
             self.__mbody = nil
             mblen = 0
         } else if self.__mbody == nil {
             // XXX: Should generate 400 Bad Request if such condition
             // happens with request
-            return &ESipParseException{ msg : fmt.Sprintf("Missed SIP body, %d bytes expected", blen) }
+            return self.contentLengthError(fmt.Sprintf("Missed SIP body, %d bytes expected", blen))
         } else if blen > mblen {
-            if blen - mblen < 7 && mblen > 7 && (*self.__mbody)[len(*self.__mbody)-4:] == "\r\n\r\n" {
+            if self.config != nil && self.config.StrictParser() {
+                return self.contentLengthError(fmt.Sprintf("Truncated SIP body, %d bytes expected, %d received", blen, mblen))
+            } else if blen - mblen < 7 && mblen > 7 && (*self.__mbody)[len(*self.__mbody)-4:] == "\r\n\r\n" {
                 // XXX: we should not really be doing this, but it appears to be
                 // a common off-by-one/two/.../six problem with SDPs generates by
                 // the consumer-grade devices.
@@ -264,7 +493,7 @@ func (self *sipMsg) init_body() error {
             } else {
                 // XXX: Should generate 400 Bad Request if such condition
                 // happens with request
-                return &ESipParseException{ msg : fmt.Sprintf("Truncated SIP body, %d bytes expected, %d received", blen, mblen) }
+                return self.contentLengthError(fmt.Sprintf("Truncated SIP body, %d bytes expected, %d received", blen, mblen))
             }
         } else if blen < mblen {
             *self.__mbody = (*self.__mbody)[:blen]
@@ -273,7 +502,7 @@ func (self *sipMsg) init_body() error {
     }
     if self.__mbody != nil {
         if self.content_type != nil {
-            self.body = NewMsgBody(*self.__mbody, strings.ToLower(self.content_type.StringBody()))
+            self.body = NewMsgBody(*self.__mbody, normalizeMtype(self.content_type.StringBody()))
         } else {
             self.body = NewMsgBody(*self.__mbody, "application/sdp")
         }
@@ -473,14 +702,17 @@ func (self *sipMsg) getCopy() *sipMsg {
 }
 
 func (self *sipMsg) GetSipProxyAuthorization() *sippy_header.SipProxyAuthorization {
+    self.materialize("proxy-authorization")
     return self.sip_proxy_authorization
 }
 
 func (self *sipMsg) GetSipServer() *sippy_header.SipServer {
+    self.materialize("server")
     return self.sip_server
 }
 
 func (self *sipMsg) GetSipUserAgent() *sippy_header.SipUserAgent {
+    self.materialize("user-agent")
     return self.sip_user_agent
 }
 
@@ -489,18 +721,43 @@ func (self *sipMsg) GetCSeq() *sippy_header.SipCSeq {
 }
 
 func (self *sipMsg) GetSipProxyAuthenticate() *sippy_header.SipProxyAuthenticate {
+    self.materialize("proxy-authenticate")
     return self.sip_proxy_authenticate
 }
 
 func (self *sipMsg) GetSipWWWAuthenticate() *sippy_header.SipWWWAuthenticate {
+    self.materialize("www-authenticate")
     return self.sip_www_authenticate
 }
 
+func (self *sipMsg) GetSipWWWAuthenticates() []*sippy_header.SipWWWAuthenticate {
+    self.materialize("www-authenticate")
+    rval := make([]*sippy_header.SipWWWAuthenticate, 0)
+    for _, hf := range self.headers {
+        if www_auth, ok := hf.(*sippy_header.SipWWWAuthenticate); ok {
+            rval = append(rval, www_auth)
+        }
+    }
+    return rval
+}
+
+func (self *sipMsg) GetSipProxyAuthenticates() []*sippy_header.SipProxyAuthenticate {
+    self.materialize("proxy-authenticate")
+    rval := make([]*sippy_header.SipProxyAuthenticate, 0)
+    for _, hf := range self.headers {
+        if proxy_auth, ok := hf.(*sippy_header.SipProxyAuthenticate); ok {
+            rval = append(rval, proxy_auth)
+        }
+    }
+    return rval
+}
+
 func (self *sipMsg) GetTo() *sippy_header.SipTo {
     return self.to
 }
 
 func (self *sipMsg) GetReason() *sippy_header.SipReason {
+    self.materialize("reason")
     return self.reason_hf
 }
 
@@ -533,6 +790,7 @@ func (self *sipMsg) GetFrom() *sippy_header.SipFrom {
 }
 
 func (self *sipMsg) GetReferTo() *sippy_header.SipReferTo {
+    self.materialize("refer-to")
     return self.refer_to
 }
 
@@ -541,26 +799,32 @@ func (self *sipMsg) GetRtime() *sippy_time.MonoTime {
 }
 
 func (self *sipMsg) GetAlso() []*sippy_header.SipAlso {
+    self.materialize("also")
     return self.also
 }
 
 func (self *sipMsg) GetContacts() []*sippy_header.SipContact {
+    self.materialize("contact")
     return self.contacts
 }
 
 func (self *sipMsg) GetRecordRoutes() []*sippy_header.SipRecordRoute {
+    self.materialize("record-route")
     return self.record_routes
 }
 
 func (self *sipMsg) GetCGUID() *sippy_header.SipCiscoGUID {
+    self.materialize("cisco-guid")
     return self.sip_cisco_guid
 }
 
 func (self *sipMsg) GetH323ConfId() *sippy_header.SipH323ConfId {
+    self.materialize("h323-conf-id")
     return self.sip_h323_conf_id
 }
 
 func (self *sipMsg) GetSipAuthorization() *sippy_header.SipAuthorization {
+    self.materialize("authorization")
     return self.sip_authorization
 }
 
@@ -570,6 +834,7 @@ func match_name (name string, hf sippy_header.SipHeader) bool {
 }
 
 func (self *sipMsg) GetFirstHF(name string) sippy_header.SipHeader {
+    self.materialize(name)
     for _, hf := range self.headers {
         if match_name(name, hf) {
             return hf
@@ -591,6 +856,7 @@ func (self *sipMsg) GetFirstHF(name string) sippy_header.SipHeader {
 }
 
 func (self *sipMsg) GetHFs(name string) []sippy_header.SipHeader {
+    self.materialize(name)
     rval := make([]sippy_header.SipHeader, 0)
     for _, hf := range self.headers {
         if match_name(name, hf) {
@@ -616,10 +882,90 @@ func (self *sipMsg) GetHFs(name string) []sippy_header.SipHeader {
     return rval
 }
 
+func (self *sipMsg) GetPAIs() []*sippy_header.SipPAssertedIdentity {
+    self.materialize("p-asserted-identity")
+    rval := make([]*sippy_header.SipPAssertedIdentity, 0)
+    for _, hf := range self.headers {
+        if pai, ok := hf.(*sippy_header.SipPAssertedIdentity); ok {
+            rval = append(rval, pai)
+        }
+    }
+    return rval
+}
+
+func (self *sipMsg) GetPPIs() []*sippy_header.SipPPreferredIdentity {
+    self.materialize("p-preferred-identity")
+    rval := make([]*sippy_header.SipPPreferredIdentity, 0)
+    for _, hf := range self.headers {
+        if ppi, ok := hf.(*sippy_header.SipPPreferredIdentity); ok {
+            rval = append(rval, ppi)
+        }
+    }
+    return rval
+}
+
+func (self *sipMsg) GetPrivacy() *sippy_header.SipPrivacy {
+    self.materialize("privacy")
+    for _, hf := range self.headers {
+        if privacy, ok := hf.(*sippy_header.SipPrivacy); ok {
+            return privacy
+        }
+    }
+    return nil
+}
+
+// GetAllow returns the methods listed in all of the Allow headers or nil
+// if there is no Allow header at all.
+func (self *sipMsg) GetAllow() []string {
+    self.materialize("allow")
+    var rval []string
+    for _, hf := range self.headers {
+        if allow, ok := hf.(*sippy_header.SipAllow); ok {
+            rval = append(rval, allow.Values...)
+        }
+    }
+    return rval
+}
+
+func (self *sipMsg) GetSupported() []string {
+    self.materialize("supported")
+    var rval []string
+    for _, hf := range self.headers {
+        if supported, ok := hf.(*sippy_header.SipSupported); ok {
+            rval = append(rval, supported.Values...)
+        }
+    }
+    return rval
+}
+
+func (self *sipMsg) GetRequire() []string {
+    self.materialize("require")
+    var rval []string
+    for _, hf := range self.headers {
+        if require, ok := hf.(*sippy_header.SipRequire); ok {
+            rval = append(rval, require.Values...)
+        }
+    }
+    return rval
+}
+
+func (self *sipMsg) GetUnsupported() []string {
+    self.materialize("unsupported")
+    var rval []string
+    for _, hf := range self.headers {
+        if unsupported, ok := hf.(*sippy_header.SipUnsupported); ok {
+            rval = append(rval, unsupported.Values...)
+        }
+    }
+    return rval
+}
+
 func (self *sipMsg) GetMaxForwards() *sippy_header.SipMaxForwards {
+    self.materialize("max-forwards")
     return self.maxforwards
 }
 
 func (self *sipMsg) SetMaxForwards(maxforwards *sippy_header.SipMaxForwards) {
+    self.materialize("max-forwards")
     self.maxforwards = maxforwards
 }
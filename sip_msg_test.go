@@ -0,0 +1,228 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/time"
+)
+
+var test_parser_invite = []byte(strings.Join([]string{
+    "INVITE sip:200@192.168.0.1 SIP/2.0",
+    "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds",
+    "Via: SIP/2.0/UDP 2.2.2.2:5060;branch=z9hG4bK5b2c1a",
+    "Max-Forwards: 70",
+    "Record-Route: <sip:2.2.2.2;lr>",
+    "From: \"Alice\" <sip:100@1.1.1.1>;tag=1928301774",
+    "To: <sip:200@192.168.0.1>",
+    "Call-ID: a84b4c76e66710@1.1.1.1",
+    "CSeq: 314159 INVITE",
+    "m: <sip:100@1.1.1.1:5060>",
+    "Allow: INVITE, ACK, CANCEL, BYE, OPTIONS",
+    "Supported: timer, replaces",
+    "P-Asserted-Identity: \"Alice\" <sip:100@1.1.1.1>",
+    "User-Agent: Test UA/1.0",
+    "x-custom-header:  some   value",
+    "Subject: a folded",
+    "  subject",
+    "Content-Type: application/sdp",
+    "Content-Length: 128",
+    "",
+    "v=0",
+    "o=alice 2890844526 2890844526 IN IP4 1.1.1.1",
+    "s=-",
+    "c=IN IP4 1.1.1.1",
+    "t=0 0",
+    "m=audio 49170 RTP/AVP 0",
+    "a=rtpmap:0 PCMU/8000",
+    "",
+}, "\r\n"))
+
+// parseSipMsgEager is the former parser building all of the headers at
+// once, kept as the baseline for the benchmarks.
+func parseSipMsgEager(_buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipMsg, error) {
+    self := NewSipMsg(rtime, config)
+    buf := string(_buf)
+    for _, bdel := range []string{ "\r\n\r\n", "\r\r", "\n\n" } {
+        boff := strings.Index(buf, bdel)
+        if boff != -1 {
+            tmp := buf[boff + len(bdel):]
+            self.__mbody = &tmp
+            buf = buf[:boff]
+            break
+        }
+    }
+    lines := strings.FieldsFunc(buf, func(c rune) bool { return c == '\n' || c == '\r' })
+    self.startline = lines[0]
+    header_lines := make([]string, 0)
+    prev_l := ""
+    for _, l := range lines[1:] {
+        if l[0] == ' ' || l[0] == '\t' {
+            prev_l += strings.TrimSpace(l)
+        } else {
+            if len(prev_l) > 0 {
+                header_lines = append(header_lines, prev_l)
+            }
+            prev_l = l
+        }
+    }
+    if prev_l != "" {
+        header_lines = append(header_lines, prev_l)
+    }
+    for _, line := range header_lines {
+        headers, err := ParseSipHeader(line, config)
+        if err != nil {
+            return nil, err
+        }
+        for _, header := range headers {
+            if contact, ok := header.(*sippy_header.SipContact); ok && contact.Asterisk {
+                continue
+            }
+            self.AppendHeader(header)
+        }
+    }
+    return self, self.init_body()
+}
+
+func Test_LazyParser(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest(test_parser_invite, rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse request: " + err.Error())
+    }
+    if req.nlazy == 0 {
+        t.Fatal("The non-core headers must not be parsed up front")
+    }
+    // Unmodified headers are sent out as received
+    out := req.LocalStr(nil, false)
+    for _, line := range []string{ "m: <sip:100@1.1.1.1:5060>", "x-custom-header:  some   value", "Subject: a folded subject" } {
+        if !strings.Contains(out, line + "\r\n") {
+            t.Fatalf("'%s' has not been kept verbatim:\n%s", line, out)
+        }
+    }
+    // Typed access parses the header
+    contacts := req.GetContacts()
+    if len(contacts) != 1 {
+        t.Fatal("Contact has not been parsed")
+    }
+    addr, err := contacts[0].GetBody()
+    if err != nil {
+        t.Fatal("Cannot parse Contact: " + err.Error())
+    }
+    assertStringEqual(addr.GetUrl().Host.String(), "1.1.1.1", t)
+    if mf := req.GetMaxForwards(); mf == nil {
+        t.Fatal("Max-Forwards has not been parsed")
+    }
+    if len(req.GetRecordRoutes()) != 1 || len(req.GetPAIs()) != 1 {
+        t.Fatal("Record-Route and P-Asserted-Identity must be parsed on access")
+    }
+    if supported := req.GetSupported(); len(supported) != 2 || supported[1] != "replaces" {
+        t.Fatal("Supported has not been parsed")
+    }
+    hf := req.GetFirstHF("X-Custom-Header")
+    if hf == nil {
+        t.Fatal("Cannot find the custom header")
+    }
+    assertStringEqual(hf.StringBody(), "some   value", t)
+    // The order of the headers is kept after the parsing
+    out = req.LocalStr(nil, false)
+    if strings.Index(out, "Record-Route:") > strings.Index(out, "From:") ||
+            strings.Index(out, "Contact:") > strings.Index(out, "Allow:") {
+        t.Fatalf("The order of the headers has changed:\n%s", out)
+    }
+    // The order of the repeated headers is kept when one more is appended
+    req2, _ := ParseSipRequest(test_parser_invite, rtime, config)
+    req2.AppendHeader(sippy_header.CreateSipRecordRoute("<sip:3.3.3.3;lr>")[0])
+    rrs := req2.GetRecordRoutes()
+    if len(rrs) != 2 {
+        t.Fatalf("Got %d Record-Route headers while expecting 2", len(rrs))
+    }
+    assertStringEqual(rrs[0].StringBody(), "<sip:2.2.2.2;lr>", t)
+    // The copy keeps the placeholders
+    assertStringEqual(req.getCopy().localStr(nil, false), req.localStr(nil, false), t)
+}
+
+func benchmarkParser(b *testing.B, parse func([]byte, *sippy_time.MonoTime, sippy_conf.Config) (*sipMsg, error), access bool) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    rtime, _ := sippy_time.NewMonoTime()
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        msg, err := parse(test_parser_invite, rtime, config)
+        if err != nil {
+            b.Fatal(err)
+        }
+        if _, err = msg.GetTId(true, true, false); err != nil {
+            b.Fatal(err)
+        }
+        if access {
+            // What the UA looks at in the incoming INVITE
+            msg.GetContacts()
+            msg.GetRecordRoutes()
+            msg.GetMaxForwards()
+            msg.GetSipAuthorization()
+            msg.GetSipProxyAuthorization()
+            msg.GetReason()
+            msg.GetPAIs()
+            msg.GetPrivacy()
+            msg.GetAllow()
+            msg.GetSupported()
+            msg.GetRequire()
+            msg.GetCGUID()
+        }
+    }
+}
+
+func parseSipMsgLazy(buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipMsg, error) {
+    msg, err := ParseSipMsg(buf, rtime, config)
+    if err != nil {
+        return nil, err
+    }
+    return msg, msg.init_body()
+}
+
+func BenchmarkParseSipMsg(b *testing.B) {
+    benchmarkParser(b, parseSipMsgLazy, false)
+}
+
+func BenchmarkParseSipMsgEager(b *testing.B) {
+    benchmarkParser(b, parseSipMsgEager, false)
+}
+
+func BenchmarkParseSipMsgAccess(b *testing.B) {
+    benchmarkParser(b, parseSipMsgLazy, true)
+}
+
+func BenchmarkParseSipMsgEagerAccess(b *testing.B) {
+    benchmarkParser(b, parseSipMsgEager, true)
+}
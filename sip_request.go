@@ -49,11 +49,18 @@ type sipRequest struct {
 
 func ParseSipRequest(buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Config) (*sipRequest, error) {
     self := &sipRequest{ nated : false }
-    super, err := ParseSipMsg(buf, rtime, config)
+    super, err := parseSipMsg(buf, rtime, config)
     if err != nil {
         return nil, err
     }
     self.sipMsg = super
+    strict := config != nil && config.StrictParser()
+    if strict {
+        self.strictCheckRequest()
+    }
+    if self.parse_err != nil {
+        return nil, self.rejectMalformed(self.parse_err)
+    }
     arr := strings.Fields(self.startline)
     if len(arr) != 3 {
         return nil, errors.New("SIP bad start line in SIP request: " + self.startline)
@@ -61,17 +68,38 @@ func ParseSipRequest(buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.C
     self.method, self.sipver = arr[0], arr[2]
     self.ruri, err = sippy_header.ParseSipURL(arr[1], false /* relaxedparser */, config)
     if err != nil {
+        if strict {
+            return nil, self.rejectMalformed(newESipHFParseException(SipParseErrorMalformed, "", self.startline, 0,
+                "Bad SIP URL in SIP request: " + arr[1]))
+        }
         return nil, errors.New("Bad SIP URL in SIP request: " + arr[1])
     }
     err = self.init_body()
     if err != nil {
         if e, ok := err.(*ESipParseException); ok {
-            e.sip_response = self.GenResponse(400, "Bad Request - " + e.Error(), nil, nil)
+            self.rejectMalformed(e)
         }
     }
     return self, err
 }
 
+var sip_parse_error_reasons = map[int]string{
+    400 : "Bad Request",
+    416 : "Unsupported URI Scheme",
+    505 : "Version Not Supported",
+}
+
+// rejectMalformed attaches to the error the response with the Warning
+// header naming the problem.
+func (self *sipRequest) rejectMalformed(err *ESipParseException) *ESipParseException {
+    if self.sipver == "" || err.code == 505 {
+        self.sipver = "SIP/2.0"
+    }
+    err.sip_response = self.GenResponse(err.code, sip_parse_error_reasons[err.code], nil, nil)
+    err.sip_response.AppendHeader(sippy_header.NewSipWarning(err.description()))
+    return err
+}
+
 func NewSipRequest(method string, ruri *sippy_header.SipURL, sipver string, to *sippy_header.SipTo,
         from *sippy_header.SipFrom, via *sippy_header.SipVia, cseq int, callid *sippy_header.SipCallId,
         maxforwards *sippy_header.SipMaxForwards, body sippy_types.MsgBody, contact *sippy_header.SipContact,
@@ -182,7 +210,7 @@ func (self *sipRequest) GenResponse(scode int, reason string, body sippy_types.M
     for _, via := range self.vias {
         vias = append(vias, via.GetCopy())
     }
-    for _, rr := range self.record_routes {
+    for _, rr := range self.GetRecordRoutes() {
         rrs = append(rrs, rr.GetCopy())
     }
     return NewSipResponse(scode, reason, self.sipver, self.from.GetCopy(),
@@ -196,8 +224,8 @@ func (self *sipRequest) GenACK(to *sippy_header.SipTo) (sippy_types.SipRequest,
     }
     var maxforwards *sippy_header.SipMaxForwards = nil
 
-    if self.maxforwards != nil {
-        maxforwards = self.maxforwards.GetCopy()
+    if self.GetMaxForwards() != nil {
+        maxforwards = self.GetMaxForwards().GetCopy()
     }
     cseq, err := self.cseq.GetBody()
     if err != nil {
@@ -214,8 +242,8 @@ func (self *sipRequest) GenACK(to *sippy_header.SipTo) (sippy_types.SipRequest,
 func (self *sipRequest) GenCANCEL() (sippy_types.SipRequest, error) {
     var maxforwards *sippy_header.SipMaxForwards = nil
 
-    if self.maxforwards != nil {
-        maxforwards = self.maxforwards.GetCopy()
+    if self.GetMaxForwards() != nil {
+        maxforwards = self.GetMaxForwards().GetCopy()
     }
     routes := make([]*sippy_header.SipRoute, len(self.routes))
     for i, r := range self.routes {
@@ -58,11 +58,12 @@ type sipTransactionManager struct {
     tserver         map[sippy_header.TID]sippy_types.ServerTransaction
     tserver_lock    sync.Mutex
     nat_traversal   bool
-    req_consumers   map[string][]sippy_types.UA
+    req_consumers   map[string][]sippy_types.RequestConsumer
     consumers_lock  sync.Mutex
     pass_t_to_cb    bool
     provisional_retr time.Duration
     before_response_sent func(sippy_types.SipResponse)
+    header_rules    sippy_types.HeaderRules
 }
 
 type sipTMRetransmitO struct {
@@ -85,7 +86,7 @@ func NewSipTransactionManager(config sippy_conf.Config, call_map sippy_types.Cal
         tclient         : make(map[sippy_header.TID]sippy_types.ClientTransaction),
         tserver         : make(map[sippy_header.TID]sippy_types.ServerTransaction),
         nat_traversal   : false,
-        req_consumers   : make(map[string][]sippy_types.UA),
+        req_consumers   : make(map[string][]sippy_types.RequestConsumer),
         pass_t_to_cb    : false,
         provisional_retr : 0,
     }
@@ -239,12 +240,12 @@ func (self *sipTransactionManager) process_response(rtime *sippy_time.MonoTime,
             }
             taddr := via0.GetTAddr(self.config)
             if taddr.Port.String() != self.config.SipPort().String() {
-                if len(resp.contacts) == 0 {
+                if len(resp.GetContacts()) == 0 {
                     self.logBadMessage("OnUdpPacket: no Contact: in SIP response", data)
                     return
                 }
-                if ! resp.contacts[0].Asterisk {
-                    contact, err = resp.contacts[0].GetBody()
+                if ! resp.GetContacts()[0].Asterisk {
+                    contact, err = resp.GetContacts()[0].GetBody()
                     if err != nil {
                         self.logBadMessage(err.Error(), data)
                         return
@@ -269,8 +270,8 @@ func (self *sipTransactionManager) process_response(rtime *sippy_time.MonoTime,
     }
     t.Lock()
     defer t.Unlock()
-    if self.nat_traversal && len(resp.contacts) > 0 && !resp.contacts[0].Asterisk && ! check1918(t.GetHost()) {
-        contact, err = resp.contacts[0].GetBody()
+    if self.nat_traversal && len(resp.GetContacts()) > 0 && !resp.GetContacts()[0].Asterisk && ! check1918(t.GetHost()) {
+        contact, err = resp.GetContacts()[0].GetBody()
         if err != nil {
             self.logBadMessage(err.Error(), data)
             return
@@ -330,10 +331,10 @@ func (self *sipTransactionManager) process_request(rtime *sippy_time.MonoTime, d
     if via0.HasRport() || req.nated {
         via0.SetRport(&rport)
     }
-    if self.nat_traversal && len(req.contacts) > 0 && !req.contacts[0].Asterisk && len(req.vias) == 1 {
+    if self.nat_traversal && len(req.GetContacts()) > 0 && !req.GetContacts()[0].Asterisk && len(req.vias) == 1 {
         var contact *sippy_header.SipAddress
 
-        contact, err = req.contacts[0].GetBody()
+        contact, err = req.GetContacts()[0].GetBody()
         curl := contact.GetUrl()
         if check1918(curl.Host.String()) {
             tmp_host, tmp_port := address.Host.String(), address.Port.String()
@@ -495,20 +496,21 @@ func (self *sipTransactionManager) new_server_transaction(server sippy_net.Trans
     t.StartTimers()
     self.consumers_lock.Lock()
     consumers, ok := self.req_consumers[tid.CallId]
-    var ua sippy_types.UA
+    var consumer sippy_types.RequestConsumer
     if ok {
         for _, c := range consumers {
             if c.IsYours(req, /*br0k3n_to =*/ false) {
-                ua = c
+                consumer = c
                 break
             }
         }
     }
     self.consumers_lock.Unlock()
-    if ua != nil {
-        t.UpgradeToSessionLock(ua.GetSessionLock())
-        sippy_utils.SafeCall(func() { rval = ua.RecvRequest(req, t) }, nil, self.config.ErrorLogger())
+    if consumer != nil {
+        t.UpgradeToSessionLock(consumer.GetSessionLock())
+        sippy_utils.SafeCall(func() { rval = consumer.RecvRequest(req, t) }, nil, self.config.ErrorLogger())
     } else {
+        var ua sippy_types.UA
         var req_receiver sippy_types.RequestReceiver
         var resp sippy_types.SipResponse
         sippy_utils.SafeCall(func () { ua, req_receiver, resp = self.call_map.OnNewDialog(req, t) }, nil, self.config.ErrorLogger())
@@ -518,6 +520,8 @@ func (self *sipTransactionManager) new_server_transaction(server sippy_net.Trans
         } else {
             if ua != nil {
                 t.UpgradeToSessionLock(ua.GetSessionLock())
+            } else if rc, ok := req_receiver.(sippy_types.RequestConsumer); ok {
+                t.UpgradeToSessionLock(rc.GetSessionLock())
             }
             if req_receiver != nil {
                 rval = req_receiver.RecvRequest(req, t)
@@ -543,18 +547,18 @@ func (self *sipTransactionManager) new_server_transaction(server sippy_net.Trans
     }
 }
 
-func (self *sipTransactionManager) RegConsumer(consumer sippy_types.UA, call_id string) {
+func (self *sipTransactionManager) RegConsumer(consumer sippy_types.RequestConsumer, call_id string) {
     self.consumers_lock.Lock()
     defer self.consumers_lock.Unlock()
     consumers, ok := self.req_consumers[call_id]
     if ! ok {
-        consumers = make([]sippy_types.UA, 0)
+        consumers = make([]sippy_types.RequestConsumer, 0)
     }
     consumers = append(consumers, consumer)
     self.req_consumers[call_id] = consumers
 }
 
-func (self *sipTransactionManager) UnregConsumer(consumer sippy_types.UA, call_id string) {
+func (self *sipTransactionManager) UnregConsumer(consumer sippy_types.RequestConsumer, call_id string) {
     // Usually there will be only one consumer per call_id, so that
     // optimize management for this case
     consumer.OnUnregister()
@@ -671,7 +675,16 @@ func (self *sipTransactionManager) Shutdown() {
     self.shutdown_chan <- 1
 }
 
+func (self *sipTransactionManager) beforeRequestSent(req sippy_types.SipRequest) {
+    if self.header_rules != nil {
+        self.header_rules.ApplyToRequest(req, "")
+    }
+}
+
 func (self *sipTransactionManager) beforeResponseSent(resp sippy_types.SipResponse) {
+    if self.header_rules != nil {
+        self.header_rules.ApplyToResponse(resp, "")
+    }
     if self.before_response_sent != nil {
         self.before_response_sent(resp)
     }
@@ -680,3 +693,9 @@ func (self *sipTransactionManager) beforeResponseSent(resp sippy_types.SipRespon
 func (self *sipTransactionManager) SetBeforeResponseSent(cb func(sippy_types.SipResponse)) {
     self.before_response_sent = cb
 }
+
+// SetHeaderRules installs the rules applied to all the messages sent by
+// the transactions.
+func (self *sipTransactionManager) SetHeaderRules(rules sippy_types.HeaderRules) {
+    self.header_rules = rules
+}
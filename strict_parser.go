@@ -0,0 +1,362 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// The headers that may appear only once in a message.
+var sip_singleton_headers = []string{ "to", "from", "call-id", "cseq", "max-forwards", "content-length", "content-type" }
+
+var sip_via_re = regexp.MustCompile(`^(?i:SIP)\s*/\s*2\.0\s*/\s*[-.!%*_+` + "`" + `'~A-Za-z0-9]+\s+[^\s;]+(\s*;\s*[-.!%*_+` + "`" + `'~A-Za-z0-9]+(\s*=\s*[^\s;]+)?)*\s*$`)
+var sip_version_re = regexp.MustCompile(`^(?i:SIP)/[0-9]+\.[0-9]+$`)
+var sip_scheme_re = regexp.MustCompile(`^[A-Za-z][-+.A-Za-z0-9]*$`)
+
+func isTokenChar(c byte) bool {
+    return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+        strings.IndexByte("-.!%*_+`'~", c) != -1
+}
+
+func isToken(s string) bool {
+    if s == "" {
+        return false
+    }
+    for i := 0; i < len(s); i++ {
+        if !isTokenChar(s[i]) {
+            return false
+        }
+    }
+    return true
+}
+
+func isDigits(s string) bool {
+    if s == "" {
+        return false
+    }
+    for i := 0; i < len(s); i++ {
+        if s[i] < '0' || s[i] > '9' {
+            return false
+        }
+    }
+    return true
+}
+
+func isHex(c byte) bool {
+    return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// strictFail records the violation of the grammar unless there is a
+// problem with the message recorded already.
+func (self *sipMsg) strictFail(code int, kind SipParseErrorKind, hf_name, raw_value string, offset int, msg string) {
+    err := newESipHFParseException(kind, hf_name, raw_value, offset, msg)
+    err.code = code
+    self.parseFail(err)
+}
+
+// strictCheckURI checks the URI against the RFC 3261 grammar. The in_hf
+// tells that the URI comes from a header field, where the headers part is
+// permitted.
+func strictCheckURI(uri string, in_hf bool) (int, string) {
+    colon := strings.IndexByte(uri, ':')
+    if colon == -1 || !sip_scheme_re.MatchString(uri[:colon]) {
+        return 400, "malformed URI " + uri
+    }
+    scheme := strings.ToLower(uri[:colon])
+    rest := uri[colon + 1:]
+    for i := 0; i < len(rest); i++ {
+        c := rest[i]
+        switch {
+        case c == '%':
+            if i + 2 >= len(rest) || !isHex(rest[i + 1]) || !isHex(rest[i + 2]) {
+                return 400, "bad escape in URI " + uri
+            }
+        case isTokenChar(c), strings.IndexByte(";/?:@&=$,()[]", c) != -1:
+        default:
+            return 400, "invalid character in URI " + uri
+        }
+    }
+    if scheme != "sip" && scheme != "sips" {
+        return 0, ""
+    }
+    hostport := rest
+    if at := strings.LastIndexByte(hostport, '@'); at != -1 {
+        hostport = hostport[at + 1:]
+    }
+    if i := strings.IndexAny(hostport, ";?"); i != -1 {
+        if !in_hf && strings.IndexByte(hostport[i:], '?') != -1 {
+            return 400, "headers in Request-URI " + uri
+        }
+        hostport = hostport[:i]
+    }
+    if hostport == "" {
+        return 400, "missing host in URI " + uri
+    }
+    if hostport[0] == '[' {
+        rb := strings.IndexByte(hostport, ']')
+        if rb == -1 {
+            return 400, "malformed IPv6 reference in URI " + uri
+        }
+        hostport = hostport[rb + 1:]
+        if hostport != "" && (hostport[0] != ':' || !isDigits(hostport[1:])) {
+            return 400, "malformed port in URI " + uri
+        }
+        return 0, ""
+    }
+    host := hostport
+    if i := strings.IndexByte(hostport, ':'); i != -1 {
+        host = hostport[:i]
+        if port, err := strconv.Atoi(hostport[i + 1:]); err != nil || port > 65535 || !isDigits(hostport[i + 1:]) {
+            return 400, "malformed port in URI " + uri
+        }
+    }
+    for i := 0; i < len(host); i++ {
+        c := host[i]
+        if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '.') {
+            return 400, "malformed host in URI " + uri
+        }
+    }
+    if host == "" {
+        return 400, "missing host in URI " + uri
+    }
+    return 0, ""
+}
+
+// splitHFValues splits the comma separated header field values ignoring
+// the commas within the quoted strings and the angle brackets.
+func splitHFValues(value string) []string {
+    var rval []string
+    quoted, angled, start := false, false, 0
+    for i := 0; i < len(value); i++ {
+        switch c := value[i]; {
+        case quoted && c == '\\':
+            i++
+        case c == '"':
+            quoted = !quoted
+        case quoted:
+        case c == '<':
+            angled = true
+        case c == '>':
+            angled = false
+        case c == ',' && !angled:
+            rval = append(rval, value[start:i])
+            start = i + 1
+        }
+    }
+    return append(rval, value[start:])
+}
+
+// strictCheckNameAddr checks the name-addr / addr-spec header value. The
+// known_scheme requests the URI scheme to be one understood by us.
+func strictCheckNameAddr(value string, known_scheme bool) (int, string) {
+    value = strings.TrimSpace(value)
+    if value == "" {
+        return 400, "empty value"
+    }
+    langle, quoted := -1, false
+    for i := 0; i < len(value) && langle == -1; i++ {
+        switch c := value[i]; {
+        case quoted && c == '\\':
+            i++
+        case c == '"':
+            quoted = !quoted
+        case !quoted && c == '<':
+            langle = i
+        }
+    }
+    if quoted {
+        return 400, "unterminated quoted string"
+    }
+    var uri string
+    if langle == -1 {
+        uri = value
+        if i := strings.IndexByte(uri, ';'); i != -1 {
+            uri = strings.TrimSpace(uri[:i])
+        }
+        if strings.ContainsAny(uri, " \t?,") {
+            return 400, "address must be enclosed in <>"
+        }
+    } else {
+        display := strings.TrimSpace(value[:langle])
+        if display != "" && display[0] != '"' {
+            for i := 0; i < len(display); i++ {
+                if !isTokenChar(display[i]) && display[i] != ' ' && display[i] != '\t' {
+                    return 400, "non-token characters in display name"
+                }
+            }
+        }
+        rangle := strings.IndexByte(value[langle:], '>')
+        if rangle == -1 {
+            return 400, "unterminated <>"
+        }
+        uri = value[langle + 1:langle + rangle]
+        if strings.ContainsAny(uri, " \t") {
+            return 400, "spaces within addr-spec"
+        }
+    }
+    if code, problem := strictCheckURI(uri, true); code != 0 {
+        return code, problem
+    }
+    if known_scheme {
+        scheme := strings.ToLower(uri[:strings.IndexByte(uri, ':')])
+        if scheme != "sip" && scheme != "sips" && scheme != "tel" {
+            return 416, "unsupported URI scheme " + scheme
+        }
+    }
+    return 0, ""
+}
+
+func strictCheckNumber(value string, max uint64) (int, string) {
+    if !isDigits(value) {
+        return 400, "not a number"
+    }
+    if v, err := strconv.ParseUint(value, 10, 64); err != nil || v > max {
+        return 400, "value is out of range"
+    }
+    return 0, ""
+}
+
+// strictCheckHF checks the header field at the time it is received from
+// the network, so that the problem is known even for the headers parsed
+// lazily. Returns false if the header has been found malformed.
+func (self *sipMsg) strictCheckHF(name, body string, offset int) bool {
+    if !isToken(name) {
+        self.strictFail(400, SipParseErrorMalformed, "", name + ":" + body, offset, "Malformed header name")
+        return false
+    }
+    key := canonicalHFName(strings.ToLower(name))
+    for i, sname := range sip_singleton_headers {
+        if sname != key {
+            continue
+        }
+        if self.strict_seen & (1 << uint(i)) != 0 {
+            self.strictFail(400, SipParseErrorDuplicate, name, body, offset, "")
+            return false
+        }
+        self.strict_seen |= 1 << uint(i)
+    }
+    code, problem := 0, ""
+    switch key {
+    case "via":
+        for _, via := range splitHFValues(body) {
+            if !sip_via_re.MatchString(strings.TrimSpace(via)) {
+                code = 400
+                break
+            }
+        }
+    case "to", "from":
+        code, problem = strictCheckNameAddr(body, true)
+    case "contact", "route", "record-route":
+        if key == "contact" && body == "*" {
+            break
+        }
+        for _, v := range splitHFValues(body) {
+            if code, problem = strictCheckNameAddr(v, false); code != 0 {
+                break
+            }
+        }
+    case "call-id":
+        if body == "" || strings.ContainsAny(body, " \t") {
+            code = 400
+        }
+    case "cseq":
+        arr := strings.Fields(body)
+        if len(arr) != 2 || !isToken(arr[1]) {
+            code = 400
+        } else {
+            code, problem = strictCheckNumber(arr[0], 1 << 31 - 1)
+        }
+    case "max-forwards":
+        code, problem = strictCheckNumber(body, 255)
+    case "content-length":
+        code, problem = strictCheckNumber(body, 1 << 31 - 1)
+    case "expires":
+        code, problem = strictCheckNumber(body, 1 << 32 - 1)
+    case "date":
+        if t, err := time.Parse(time.RFC1123, body); err != nil || !strings.HasSuffix(body, " GMT") || t.IsZero() {
+            code = 400
+        }
+    }
+    if code != 0 {
+        self.strictFail(code, SipParseErrorMalformed, name, body, offset, problem)
+        return false
+    }
+    return true
+}
+
+// strictCheckRequest checks the request line and the mandatory headers.
+// The problems with the request line take precedence over the ones found
+// in the headers.
+func (self *sipRequest) strictCheckRequest() {
+    hf_err := self.parse_err
+    self.parse_err = nil
+    self.strictCheckRequestLine()
+    if self.parse_err == nil {
+        self.parse_err = hf_err
+    }
+    if self.GetMaxForwards() == nil {
+        self.strictFail(400, SipParseErrorMissing, "Max-Forwards", "", -1, "")
+    }
+    if cseq, err := self.cseq.GetBody(); err == nil && cseq.Method != strings.SplitN(self.startline, " ", 2)[0] {
+        self.strictFail(400, SipParseErrorMalformed, self.cseq.Name(), self.cseq.StringBody(), -1,
+            "method does not match the Request-Line")
+    }
+}
+
+func (self *sipRequest) strictCheckRequestLine() {
+    fail := func(code int, msg string) {
+        self.strictFail(code, SipParseErrorMalformed, "", self.startline, 0, msg)
+    }
+    arr := strings.Split(self.startline, " ")
+    if len(arr) != 3 || arr[0] == "" || arr[1] == "" || arr[2] == "" {
+        fail(400, "Malformed Request-Line")
+        return
+    }
+    if !isToken(arr[0]) {
+        fail(400, "Malformed method in Request-Line")
+        return
+    }
+    if !strings.EqualFold(arr[2], "SIP/2.0") {
+        if sip_version_re.MatchString(arr[2]) {
+            fail(505, "Unsupported SIP version " + arr[2])
+        } else {
+            fail(400, "Malformed SIP version in Request-Line")
+        }
+        return
+    }
+    if code, problem := strictCheckURI(arr[1], false); code != 0 {
+        fail(code, "Malformed Request-URI: " + problem)
+        return
+    }
+    scheme := strings.ToLower(arr[1][:strings.IndexByte(arr[1], ':')])
+    if scheme != "sip" && scheme != "sips" && !(scheme == "tel" && self.config.AutoConvertTelUrl()) {
+        fail(416, "Unsupported URI scheme " + scheme + " in Request-URI")
+    }
+}
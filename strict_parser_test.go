@@ -0,0 +1,759 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/time"
+)
+
+const torture_sdp = "v=0\r\no=mhandley 29739 7272939 IN IP4 192.0.2.3\r\ns=-\r\nc=IN IP4 192.0.2.4\r\n" +
+        "t=0 0\r\nm=audio 49217 RTP/AVP 0 12\r\nm=video 3227 RTP/AVP 31\r\na=rtpmap:31 LPC\r\n"
+
+// The messages from RFC 4475 with the outcome expected from the strict
+// parser: 0 - accepted, -1 - dropped, otherwise the response code. The
+// parser accepts bext01, invut, sdp01 and regaut01, their 420, 415, 406
+// and 401 responses are up to the UA and the registrar. The inv2543 is
+// rejected for the missing Max-Forwards, the strict parser does not
+// provide RFC 2543 compatibility.
+var torture_msgs = []struct {
+    name    string
+    lines   []string
+    body    string
+    code    int
+}{
+    { "wsinv", []string{
+        "INVITE sip:vivekg@chair-dnrc.example.com;unknownparam SIP/2.0",
+        "TO :",
+        " sip:vivekg@chair-dnrc.example.com ;   tag    = 1918181833n",
+        "from   : \"J Rosenberg \\\\\\\"\"       <sip:jdrosen@example.com>",
+        "  ;",
+        "  tag = 98asjd8",
+        "MaX-fOrWaRdS: 0068",
+        "Call-ID: wsinv.ndaksdj@192.0.2.1",
+        "Content-Length   : %CL%",
+        "cseq: 0009",
+        "  INVITE",
+        "Via  : SIP  /   2.0",
+        " /UDP",
+        "    192.0.2.2;branch=390skdjuw",
+        "s :",
+        "NewFangledHeader:   newfangled value",
+        " continued newfangled value",
+        "UnknownHeaderWithUnusualValue: ;;,,;;,;",
+        "Content-Type: application/sdp",
+        "Route:",
+        " <sip:services.example.com;lr;unknownwith=value;unknown-no-value>",
+        "v:  SIP  / 2.0  / TCP     spindle.example.com   ;",
+        "  branch  =   z9hG4bK9ikj8  ,",
+        " SIP  /    2.0   / UDP  192.168.255.111   ; branch=",
+        " z9hG4bK30239",
+        "m:\"Quoted string \\\"\\\"\" <sip:jdrosen@example.com> ; newparam =",
+        "      newvalue ;",
+        "  secondparam ; q = 0.33",
+        }, torture_sdp, 0 },
+    { "intmeth", []string{
+        "!interesting-Method0123456789_*+`.%indeed'~ sip:1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*:&it+has=1,weird!*pas$wo~d_too.(doesn't-it)@example.com SIP/2.0",
+        "Via: SIP/2.0/TCP host1.example.com;branch=z9hG4bK-.!%66*_+`'~",
+        "To: \"BEL:\\\x07 NUL:\\\x00 DEL:\\\x7f\" <sip:1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*@example.com>",
+        "From: token1~` token2'+_ token3*%!.- <sip:mundane@example.com>;fromParam''~+*_!.-%=\"\u0440\u0430\u0431\u043e\u0442\u0430\u044e\u0449\u0438\u0439\";tag=_token~1'+`*%!-.",
+        "Call-ID: intmeth.word%ZK-!.*_+'@word`~)(><:\\/\"][?}{",
+        "CSeq: 139122385 !interesting-Method0123456789_*+`.%indeed'~",
+        "Max-Forwards: 255",
+        "extensionHeader-!.%*+_`'~:\ufeff\u5927\u505c\u96fb",
+        "Content-Length: 0",
+        }, "", 0 },
+    { "esc01", []string{
+        "INVITE sip:sips%3Auser%40example.com@example.net SIP/2.0",
+        "To: sip:%75se%72@example.com",
+        "From: <sip:I%20have%20spaces@example.net>;tag=938",
+        "Max-Forwards: 87",
+        "i: esc01.239409asdfakjkn23onasd0-3234",
+        "CSeq: 234234 INVITE",
+        "Via: SIP/2.0/UDP host5.example.net;branch=z9hG4bKkdjuw",
+        "C: application/sdp",
+        "Contact:",
+        "  <sip:cal%6Cer@host5.example.net;%6C%72;n%61me=v%61lue%25%34%31>",
+        "Content-Length: %CL%",
+        }, torture_sdp, 0 },
+    { "escnull", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "To: sip:null-%00-null@example.com",
+        "From: sip:null-%00-null@example.com;tag=839923423",
+        "Max-Forwards: 70",
+        "Call-ID: escnull.39203ndfvkjdasfkq3w4otrq0adsfdfnavd",
+        "CSeq: 14398234 REGISTER",
+        "Via: SIP/2.0/UDP host5.example.com;branch=z9hG4bKkdjuw",
+        "Contact: <sip:%00@host5.example.com>",
+        "Contact: <sip:%00%00@host5.example.com>",
+        "L:0",
+        }, "", 0 },
+    { "esc02", []string{
+        "RE%47IST%45R sip:registrar.example.com SIP/2.0",
+        "To: \"%Z%45\" <sip:resource@example.com>",
+        "From: \"%Z%45\" <sip:resource@example.com>;tag=f232jadfj23",
+        "Call-ID: esc02.asdfnqwo34rq23i34jrjasdcnl23nrlknsdf",
+        "Via: SIP/2.0/TCP host.example.com;rport;branch=z9hG4bK209760",
+        "Max-Forwards: 70",
+        "Contact: <sip:alias1@host1.example.com>",
+        "Contact: <sip:alias2@host2.example.com>",
+        "Contact: <sip:alias3@host3.example.com>",
+        "CSeq: 29344 RE%47IST%45R",
+        "l: 0",
+        }, "", 0 },
+    { "lwsdisp", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "To: sip:user@example.com",
+        "From: caller<sip:caller@example.com>;tag=323",
+        "Max-Forwards: 70",
+        "Call-ID: lwsdisp.1234abcd@funky.example.com",
+        "CSeq: 60 OPTIONS",
+        "Via: SIP/2.0/UDP funky.example.com;branch=z9hG4bKkdjuw",
+        "l: 0",
+        }, "", 0 },
+    { "semiuri", []string{
+        "OPTIONS sip:user;par=u%40example.net@example.com SIP/2.0",
+        "To: sip:j_user@example.com",
+        "From: sip:caller@example.org;tag=33242",
+        "Max-Forwards: 3",
+        "Call-ID: semiuri.0ha0isndaksdj",
+        "CSeq: 8 OPTIONS",
+        "Accept: application/sdp, application/pkcs7-mime,",
+        "        multipart/mixed, multipart/signed,",
+        "        message/sip, message/sipfrag",
+        "Via: SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKkdjuw",
+        "l: 0",
+        }, "", 0 },
+    { "transports", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "To: sip:user@example.com",
+        "From: <sip:caller@example.com>;tag=323",
+        "Max-Forwards: 70",
+        "Call-ID:  transports.kijh4akdnaqjkwendsasfdj",
+        "Accept: application/sdp",
+        "CSeq: 60 OPTIONS",
+        "Via: SIP/2.0/UDP t1.example.com;branch=z9hG4bKkdjuw",
+        "Via: SIP/2.0/SCTP t2.example.com;branch=z9hG4bKklasjdhf",
+        "Via: SIP/2.0/TLS t3.example.com;branch=z9hG4bK2980unddj",
+        "Via: SIP/2.0/UNKNOWN t4.example.com;branch=z9hG4bKasd0f3en",
+        "Via: SIP/2.0/TCP t5.example.com;branch=z9hG4bK0a9idfnee",
+        "l: 0",
+        }, "", 0 },
+    { "dblreq", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "To: sip:j.user@example.com",
+        "From: sip:j.user@example.com;tag=43251j3j324",
+        "Max-Forwards: 8",
+        "I: dblreq.0ha0isndaksdj99sdfafnl3lk233412",
+        "Contact: sip:j.user@host.example.com",
+        "CSeq: 8 REGISTER",
+        "Via: SIP/2.0/UDP 192.0.2.125;branch=z9hG4bKkdjuw23492",
+        "Content-Length: 0",
+        }, "\r\nINVITE sip:joe@example.com SIP/2.0\r\nt: sip:joe@example.com\r\n", 0 },
+    { "zeromf", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=3ghsd41",
+        "Call-ID: zeromf.jfasdlfnm2o2l43r5u0asdfas",
+        "CSeq: 39234321 OPTIONS",
+        "Via: SIP/2.0/UDP host1.example.com;branch=z9hG4bKkdjuw2349i",
+        "Max-Forwards: 0",
+        "Content-Length: 0",
+        }, "", 0 },
+    { "cparam01", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "Via: SIP/2.0/UDP saturn.example.com:5060;branch=z9hG4bKkdjuw",
+        "Max-Forwards: 70",
+        "From: sip:watson@example.com;tag=DkfVgjkrtMwaerKKpe",
+        "To: sip:watson@example.com",
+        "Call-ID: cparam01.70710@saturn.example.com",
+        "CSeq: 2 REGISTER",
+        "Contact: sip:+19725552222@gw1.example.net;unknownparam",
+        "l: 0",
+        }, "", 0 },
+    { "badinv01", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "To: sip:j.user@example.com",
+        "From: sip:caller@example.net;tag=134161461246",
+        "Max-Forwards: 7",
+        "Call-ID: badinv01.0ha0isndaksdjasdf3234nas",
+        "CSeq: 8 INVITE",
+        "Via: SIP/2.0/UDP 192.0.2.15;;,;,,",
+        "Contact: \"Joe\" <sip:joe@example.org>;;;;",
+        "Content-Length: %CL%",
+        "Content-Type: application/sdp",
+        }, torture_sdp, 400 },
+    { "clerr", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "Max-Forwards: 80",
+        "To: sip:j.user@example.com",
+        "From: sip:caller@example.net;tag=93942939o2",
+        "Contact: <sip:caller@hungry.example.net>",
+        "Call-ID: clerr.0ha0isndaksdjweiafasdk3",
+        "CSeq: 8 INVITE",
+        "Via: SIP/2.0/UDP host5.example.com;branch=z9hG4bK-39234-23523",
+        "Content-Type: application/sdp",
+        "Content-Length: 9999",
+        }, torture_sdp, 400 },
+    { "ncl", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "Max-Forwards: 254",
+        "To: sip:j.user@example.com",
+        "From: sip:caller@example.net;tag=32394234",
+        "Call-ID: ncl.0ha0isndaksdj2193423r542w35",
+        "CSeq: 0 INVITE",
+        "Via: SIP/2.0/UDP 192.0.2.53;branch=z9hG4bKkdjuw",
+        "Contact: <sip:caller@example53.example.net>",
+        "Content-Type: application/sdp",
+        "Content-Length: -999",
+        }, torture_sdp, 400 },
+    { "scalar02", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "Via: SIP/2.0/TCP host129.example.com;branch=z9hG4bK342sdfoi3",
+        "To: <sip:user@example.com>",
+        "From: <sip:user@example.com>;tag=239232jh3",
+        "CSeq: 36893488147419103232 REGISTER",
+        "Call-ID: scalar02.23o0pd9vanlq3wnrlnewofjas9ui32",
+        "Max-Forwards: 300",
+        "Expires: 1000000000000000000000000000",
+        "Contact: <sip:user@host129.example.com>;expires=280297596632815",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "quotbal", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "To: \"Mr. J. User <sip:j.user@example.com>",
+        "From: sip:caller@example.net;tag=93334",
+        "Max-Forwards: 10",
+        "Call-ID: quotbal.aksdj",
+        "Contact: <sip:caller@host59.example.net>",
+        "CSeq: 8 INVITE",
+        "Via: SIP/2.0/UDP 192.0.2.59:5050;branch=z9hG4bKkdjuw39234",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "ltgtruri", []string{
+        "INVITE <sip:user@example.com> SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=39291",
+        "Max-Forwards: 23",
+        "Call-ID: ltgtruri.1@192.0.2.5",
+        "CSeq: 1 INVITE",
+        "Via: SIP/2.0/UDP 192.0.2.5;branch=z9hG4bKkdjuw",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "lwsruri", []string{
+        "INVITE sip:user@example.com; lr SIP/2.0",
+        "To: sip:user@example.com;tag=3xfe-9921883-z9f",
+        "From: sip:caller@example.net;tag=231413434",
+        "Max-Forwards: 5",
+        "Call-ID: lwsruri.asdfasdoeoi2323-asdfwrn23-asd834rk423",
+        "CSeq: 2130706432 INVITE",
+        "Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bKkdjuw2395",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "lwsstart", []string{
+        "INVITE  sip:user@example.com  SIP/2.0",
+        "Max-Forwards: 8",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=8814",
+        "Call-ID: lwsstart.dfknq234oi243099adsdfnawe3@example.com",
+        "CSeq: 1893884 INVITE",
+        "Via: SIP/2.0/UDP host1.example.com;branch=z9hG4bKkdjuw3923",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "trws", []string{
+        "OPTIONS sip:remote-target@example.com SIP/2.0  ",
+        "Via: SIP/2.0/TCP host1.example.com;branch=z9hG4bK299342093",
+        "To: <sip:remote-target@example.com>",
+        "From: <sip:local-resource@example.com>;tag=329429089",
+        "Call-ID: trws.oicu34958239neffasdhr2345r",
+        "Accept: application/sdp",
+        "CSeq: 238923 OPTIONS",
+        "Max-Forwards: 70",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "escruri", []string{
+        "INVITE sip:user@example.com?Route=%3Csip:example.com%3E SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=341518",
+        "Max-Forwards: 7",
+        "Contact: <sip:caller@host39923.example.net>",
+        "Call-ID: escruri.23940-asdfhj-aje3br-234q098w-fawerh2q-h4n5",
+        "CSeq: 39234 INVITE",
+        "Via: SIP/2.0/UDP host-of-the-hour.example.com;branch=z9hG4bKkdjuw",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "baddate", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=2234923",
+        "Max-Forwards: 70",
+        "Call-ID: baddate.239423mnsadf3j23lj42--sedfnm234",
+        "CSeq: 1392934 INVITE",
+        "Via: SIP/2.0/UDP host.example.com;branch=z9hG4bKkdjuw",
+        "Date: Fri, 01 Jan 2010 16:00:00 EST",
+        "Contact: <sip:caller@host5.example.net>",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "regbadct", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:user@example.com;tag=998332",
+        "Max-Forwards: 70",
+        "Call-ID: regbadct.k345asrl3fdbv@10.0.0.1",
+        "CSeq: 1 REGISTER",
+        "Via: SIP/2.0/UDP 135.180.130.133:5060;branch=z9hG4bKkdjuw",
+        "Contact: sip:user@example.com?Route=%3Csip:sip.example.com%3E",
+        "l: 0",
+        }, "", 400 },
+    { "badaspec", []string{
+        "OPTIONS sip:user@example.org SIP/2.0",
+        "Via: SIP/2.0/UDP host4.example.com:5060;branch=z9hG4bKkdju43234",
+        "Max-Forwards: 70",
+        "From: \"Bell, Alexander\" <sip:a.g.bell@example.com>;tag=433423",
+        "To: \"Watson, Thomas\" < sip:t.watson@example.org >",
+        "Call-ID: badaspec.sdf0234n2nds0a099u23h3hnnw009cdkne3",
+        "Accept: application/sdp",
+        "CSeq: 3923239 OPTIONS",
+        "l: 0",
+        }, "", 400 },
+    { "baddn", []string{
+        "OPTIONS sip:t.watson@example.org SIP/2.0",
+        "Via: SIP/2.0/UDP c.example.com:5060;branch=z9hG4bKkdjuw",
+        "Max-Forwards: 70",
+        "From: Bell, Alexander <sip:a.g.bell@example.com>;tag=43",
+        "To: Watson, Thomas <sip:t.watson@example.org>",
+        "Call-ID: baddn.31415@c.example.com",
+        "Accept: application/sdp",
+        "CSeq: 3923239 OPTIONS",
+        "l: 0",
+        }, "", 400 },
+    { "badvers", []string{
+        "OPTIONS sip:t.watson@example.org SIP/7.0",
+        "Via:     SIP/7.0/UDP c.example.com;branch=z9hG4bKkdjuw",
+        "Max-Forwards:     70",
+        "From:    A. Bell <sip:a.g.bell@example.com>;tag=qweoiqpe",
+        "To:      T. Watson <sip:t.watson@example.org>",
+        "Call-ID: badvers.31417@c.example.com",
+        "CSeq:    1 OPTIONS",
+        "l: 0",
+        }, "", 505 },
+    { "mismatch01", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "To: sip:j.user@example.com",
+        "From: sip:caller@example.net;tag=34525",
+        "Max-Forwards: 6",
+        "Call-ID: mismatch01.dj0234sxdfl3",
+        "CSeq: 8 INVITE",
+        "Via: SIP/2.0/UDP host.example.com;branch=z9hG4bKkdjuw",
+        "l: 0",
+        }, "", 400 },
+    { "mismatch02", []string{
+        "NEWMETHOD sip:user@example.com SIP/2.0",
+        "To: sip:j.user@example.com",
+        "From: sip:caller@example.net;tag=34525",
+        "Max-Forwards: 6",
+        "Call-ID: mismatch02.dj0234sxdfl3",
+        "CSeq: 8 INVITE",
+        "Contact: <sip:caller@host.example.net>",
+        "Via: SIP/2.0/UDP host.example.net;branch=z9hG4bKkdjuw",
+        "l: 0",
+        }, "", 400 },
+    { "insuf", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "CSeq: 193942 INVITE",
+        "Via: SIP/2.0/UDP 192.0.2.95;branch=z9hG4bKkdj.insuf",
+        "Content-Length: 0",
+        }, "", -1 },
+    { "unkscm", []string{
+        "OPTIONS nobodyknowsthisscheme:totallyopaque-content SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=384",
+        "Max-Forwards: 3",
+        "Call-ID: unkscm.nasdfasser0q239nwsdfasdkl34",
+        "CSeq: 3923423 OPTIONS",
+        "Via: SIP/2.0/TCP host9.example.com;branch=z9hG4bKkdjuw39234",
+        "Content-Length: 0",
+        }, "", 416 },
+    { "novelsc", []string{
+        "OPTIONS soap.beep://192.0.2.103:3002 SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:caller@example.net;tag=384",
+        "Max-Forwards: 3",
+        "Call-ID: novelsc.asdfasser0q239nwsdfasdkl34",
+        "CSeq: 3923423 OPTIONS",
+        "Via: SIP/2.0/TCP host9.example.com;branch=z9hG4bKkdjuw39234",
+        "Content-Length: 0",
+        }, "", 416 },
+    { "unksm2", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "To: isbn:2983792873",
+        "From: <http://www.example.com>;tag=3234233",
+        "Call-ID: unksm2.daksdj@hyphenated-host.example.com",
+        "CSeq: 234902 REGISTER",
+        "Max-Forwards: 70",
+        "Via: SIP/2.0/UDP 192.0.2.21:5060;branch=z9hG4bKkdjuw",
+        "Contact: <name@127.0.0.1>",
+        "l: 0",
+        }, "", 416 },
+    { "multi01", []string{
+        "INVITE sip:user@company.com SIP/2.0",
+        "Contact: <sip:caller@host25.example.net>",
+        "Via: SIP/2.0/UDP 192.0.2.25;branch=z9hG4bKkdjuw",
+        "Max-Forwards: 70",
+        "CSeq: 5 INVITE",
+        "Call-ID: multi01.98asdh@192.0.2.1",
+        "CSeq: 59 INVITE",
+        "Call-ID: multi01.98asdh@192.0.2.2",
+        "From: sip:caller@example.com;tag=3413415",
+        "To: sip:user@example.com",
+        "To: sip:other@example.net",
+        "From: sip:caller@example.net;tag=2923420123",
+        "Content-Type: application/sdp",
+        "l: %CL%",
+        }, torture_sdp, 400 },
+    { "emptyfrom", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "Via: SIP/2.0/UDP host5.example.net;branch=z9hG4bK293424",
+        "To: sip:user@example.com",
+        "From:",
+        "Call-ID: emptyfrom.fhn2323orihawfdoa3o4r52o3irsdf",
+        "CSeq: 15932 OPTIONS",
+        "Max-Forwards: 60",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "emptyto", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "Via: SIP/2.0/UDP host5.example.net;branch=z9hG4bK293425",
+        "To: ",
+        "From: sip:other@example.net;tag=3923942",
+        "Call-ID: emptyto.fhn2323orihawfdoa3o4r52o3irsdf",
+        "CSeq: 15932 OPTIONS",
+        "Max-Forwards: 60",
+        "Content-Length: 0",
+        }, "", 400 },
+    { "mcl01", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "Via: SIP/2.0/UDP host5.example.net;branch=z9hG4bK293423",
+        "To: sip:user@example.com",
+        "From: sip:other@example.net;tag=3923942",
+        "Call-ID: mcl01.fhn2323orihawfdoa3o4r52o3irsdf",
+        "CSeq: 15932 OPTIONS",
+        "Content-Length: 13",
+        "Max-Forwards: 60",
+        "Content-Length: 5",
+        "Content-Type: text/plain",
+        }, "There's no way to know how many octets are supposed to be here.", 400 },
+    { "longreq", tortureLongReq(), torture_sdp, 0 },
+    { "mpart01", []string{
+        "MESSAGE sip:kumiko@example.org SIP/2.0",
+        "Via: SIP/2.0/UDP 127.0.0.1:5070;branch=z9hG4bK-d87543-4dade06d0bdb11ee-1--d87543-;rport",
+        "Max-Forwards: 70",
+        "Route: <sip:127.0.0.1:5080>",
+        "Identity: r5mwreLuyDRYBi/0TiPwEsY3rEVsk/G2WxhgTV1PF7hHuLIK0YWVKZhKv9Mj8UeXqkMVbnVq37CD+813gvYjcBUaZngQmXc9WNZSDNGCzA+fWl9MEUHWIZo1CeJebdY/XlgKeTa0Olvq0rt70Q5jiSfbqMJmQFteeivUhkMWYUA=",
+        "Contact: <sip:fluffy@127.0.0.1:5070>",
+        "To: <sip:kumiko@example.org>",
+        "From: <sip:fluffy@example.com>;tag=2fb0dcc9",
+        "Call-ID: 3d9485ad0c49859b@Zmx1ZmZ5LW1hYy0xNi5sb2NhbA..",
+        "CSeq: 1 MESSAGE",
+        "Accept: multipart/mixed, text/plain, message/cpim, message/sipfrag",
+        "Allow: INVITE, ACK, CANCEL, OPTIONS, BYE, MESSAGE, SUBSCRIBE, NOTIFY, REFER",
+        "Content-Type: multipart/mixed;boundary=7a9cbec02ceef655",
+        "Date: Sat, 15 Oct 2005 04:44:56 GMT",
+        "User-Agent: SIPimp.org/0.2.5 (curses)",
+        "Content-Length: %CL%",
+        }, "--7a9cbec02ceef655\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: binary\r\n\r\nHello\r\n" +
+        "--7a9cbec02ceef655\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: binary\r\n\r\n" +
+        "0\x82\x01R\x06\t*\x86H\x86\xf7\r\x01\x07\x02\xa0\x82\x01C0\x82\x01?\x02\x01\x011\t0\x07\x06\x05+\x0e\x03\x02\x1a\r\n" +
+        "--7a9cbec02ceef655--\r\n", 0 },
+    { "bext01", []string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "To: sip:j_user@example.com",
+        "From: sip:caller@example.net;tag=242etr",
+        "Max-Forwards: 6",
+        "Call-ID: bext01.0ha0isndaksdj",
+        "Require: nothingSupportedHere",
+        "Proxy-Require: noProxiesSupportThis, nothingSupportedHere",
+        "CSeq: 8 OPTIONS",
+        "Via: SIP/2.0/TLS fold-and-staple.example.com;branch=z9hG4bKkdjuw",
+        "Content-Length: 0",
+        }, "", 0 },
+    { "invut", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "Contact: <sip:caller@host5.example.net>",
+        "To: sip:j.user@example.com",
+        "From: sip:caller@example.net;tag=8392034",
+        "Max-Forwards: 70",
+        "Call-ID: invut.0ha0isndaksdjadsfij34n23d",
+        "CSeq: 235448 INVITE",
+        "Via: SIP/2.0/UDP somehost.example.com;branch=z9hG4bKkdjuw",
+        "Content-Type: application/unknownformat",
+        "Content-Length: %CL%",
+        }, "<audio>\r\n <pcmu port=\"443\"/>\r\n</audio>\r\n", 0 },
+    { "inv2543", []string{
+        "INVITE sip:UserB@example.com SIP/2.0",
+        "Via: SIP/2.0/UDP iftgw.example.com",
+        "From: <sip:+13035551111@ift.client.example.net;user=phone>",
+        "Record-Route: <sip:UserB@example.com;maddr=ss1.example.com>",
+        "To: sip:+16505552222@ss1.example.net;user=phone",
+        "Call-ID: inv2543.1717@ift.client.example.com",
+        "CSeq: 56 INVITE",
+        "Content-Type: application/sdp",
+        }, "v=0\r\no=mhandley 29739 7272939 IN IP4 192.0.2.5\r\ns=-\r\nc=IN IP4 192.0.2.5\r\nt=0 0\r\nm=audio 49217 RTP/AVP 0\r\n", 400 },
+    { "cparam02", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "Via: SIP/2.0/UDP saturn.example.com:5060;branch=z9hG4bKkdjuw",
+        "Max-Forwards: 70",
+        "From: sip:watson@example.com;tag=838293",
+        "To: sip:watson@example.com",
+        "Call-ID: cparam02.70710@saturn.example.com",
+        "CSeq: 3 REGISTER",
+        "Contact: <sip:+19725552222@gw1.example.net;unknownparam>",
+        "l: 0",
+        }, "", 0 },
+    { "regescrt", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "To: sip:user@example.com",
+        "From: sip:user@example.com;tag=8",
+        "Max-Forwards: 70",
+        "Call-ID: regescrt.k345asrl3fdbv@192.0.2.1",
+        "CSeq: 14398234 REGISTER",
+        "Via: SIP/2.0/UDP host5.example.com;branch=z9hG4bKkdjuw",
+        "M: <sip:user@example.com?Route=%3Csip:sip.example.com%3E>",
+        "L:0",
+        }, "", 0 },
+    { "sdp01", []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "To: sip:j_user@example.com",
+        "Contact: <sip:caller@host15.example.net>",
+        "From: sip:caller@example.net;tag=234",
+        "Max-Forwards: 5",
+        "Call-ID: sdp01.ndaksdj9342dasdd",
+        "Accept: text/nobodyKnowsThis",
+        "CSeq: 8 INVITE",
+        "Via: SIP/2.0/UDP 60.si.example.net;branch=z9hG4bKkdjuw",
+        "Content-Length: %CL%",
+        "Content-Type: application/sdp",
+        }, torture_sdp, 0 },
+    { "regaut01", []string{
+        "REGISTER sip:example.com SIP/2.0",
+        "To: sip:j.user@example.com",
+        "From: sip:j.user@example.com;tag=87321hj23128",
+        "Max-Forwards: 8",
+        "Call-ID: regaut01.0ha0isndaksdj",
+        "CSeq: 9338 REGISTER",
+        "Via: SIP/2.0/TCP 192.0.2.253;branch=z9hG4bKkdjuw",
+        "Authorization: NoOneKnowsThisScheme opaque-data=here",
+        "Content-Length:0",
+        }, "", 0 },
+}
+
+// The responses from RFC 4475: 0 - accepted, -1 - dropped. Not sending
+// to the broadcast address in bcast is up to the transport.
+var torture_resps = []struct {
+    name    string
+    lines   []string
+    body    string
+    code    int
+}{
+    { "unreason", []string{
+        "SIP/2.0 200 = 2**3 * 5**2 \u043d\u043e \u0441\u0442\u043e \u0434\u0435\u0432\u044f\u043d\u043e\u0441\u0442\u043e " +
+            "\u0434\u0435\u0432\u044f\u0442\u044c - \u043f\u0440\u043e\u0441\u0442\u043e\u0435",
+        "Via: SIP/2.0/UDP 192.0.2.198;branch=z9hG4bK1324923",
+        "Call-ID: unreason.1234ksdfak3j2erwedfsASdf",
+        "CSeq: 35 INVITE",
+        "From: sip:user@example.com;tag=11141343",
+        "To: sip:user@example.edu;tag=2229",
+        "Content-Length: %CL%",
+        "Content-Type: application/sdp",
+        "Contact: <sip:user@host198.example.com>",
+        }, torture_sdp, 0 },
+    { "noreason", []string{
+        "SIP/2.0 100 ",
+        "Via: SIP/2.0/UDP 192.0.2.105;branch=z9hG4bK2398ndaoe",
+        "Call-ID: noreason.asndj203insdf99223ndf",
+        "CSeq: 35 INVITE",
+        "From: <sip:user@example.com>;tag=39ansfi3",
+        "To: <sip:user@example.edu>;tag=902jndnke3",
+        "Content-Length: 0",
+        "Contact: <sip:user@host105.example.com>",
+        }, "", 0 },
+    { "scalarlg", []string{
+        "SIP/2.0 503 Service Unavailable",
+        "Via: SIP/2.0/TCP host129.example.com;branch=z9hG4bKzzxdiwo34sw;received=192.0.2.129",
+        "To: <sip:user@example.com>",
+        "From: <sip:other@example.net>;tag=2easdjfejw",
+        "CSeq: 9292394834772304023312 OPTIONS",
+        "Call-ID: scalarlg.noase0of0234hn2qofoaf0232aewf2394r",
+        "Retry-After: 949302838503028349304023988",
+        "Warning: 1812 overture \"In Progress\"",
+        "Content-Length: 0",
+        }, "", -1 },
+    { "bcast", []string{
+        "SIP/2.0 200 OK",
+        "Via: SIP/2.0/UDP 192.0.2.198;branch=z9hG4bK1324923",
+        "Via: SIP/2.0/UDP 255.255.255.255;branch=z9hG4bK1saber23",
+        "Call-ID: bcast.0384840201234ksdfak3j2erwedfsASdf",
+        "CSeq: 35 INVITE",
+        "From: sip:user@example.com;tag=11141343",
+        "To: sip:user@example.edu;tag=2229",
+        "Content-Length: %CL%",
+        "Content-Type: application/sdp",
+        "Contact: <sip:user@host28.example.com>",
+        }, torture_sdp, 0 },
+}
+
+// tortureLongReq builds the longreq message, which has the header values
+// and the number of the Via headers far beyond the usual.
+func tortureLongReq() []string {
+    long := func(s string) string { return strings.Repeat(s, 10) }
+    name := long("amazinglylongcallername")
+    lines := []string{
+        "INVITE sip:user@example.com SIP/2.0",
+        "To: \"I have a user name of " + long("extreme") + " proportion\"<sip:user@example.com:6000;unknownparam1=very" +
+            long("long") + "value;longparam" + long("name") + "=shortvalue;very" + long("long") + "ParameterNameWithNoValue>",
+        "F: sip:" + name + "@example.net;tag=12" + long("98") + "424;unknownheaderparam" + long("name") + "=unknowheaderparam" +
+            long("value") + ";noValueParam" + long("name"),
+        "Call-ID: longreq.one" + long("really") + "longcallid",
+        "CSeq: 3882340 INVITE",
+        "Unknown-" + long("Long") + "-Name: unknown-" + long("long") + "-value; unknown-" + long("long") +
+            "-parameter-name = unknown-" + long("long") + "-parameter-value",
+    }
+    for i := 33; i > 0; i-- {
+        hf := "Via: "
+        if i % 2 == 0 {
+            hf = "v: "
+        }
+        lines = append(lines, hf + "SIP/2.0/TCP sip" + strconv.Itoa(i) + ".example.com")
+    }
+    return append(lines,
+        "Via: SIP/2.0/TCP 192.0.2.1;branch=z9hG4bK" + long("long") + "branch",
+        "Max-Forwards: 70",
+        "Contact: <sip:" + name + "@host5.example.net>",
+        "Content-Type: application/sdp",
+        "l: %CL%",
+    )
+}
+
+func tortureMsg(lines []string, body string) []byte {
+    msg := strings.Join(lines, "\r\n")
+    msg = strings.Replace(msg, "%CL%", strconv.Itoa(len(body)), -1)
+    return []byte(msg + "\r\n\r\n" + body)
+}
+
+func Test_StrictParser(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    config.SetStrictParser(true)
+    rtime, _ := sippy_time.NewMonoTime()
+    for _, tc := range torture_msgs {
+        req, err := ParseSipRequest(tortureMsg(tc.lines, tc.body), rtime, config)
+        switch {
+        case tc.code == 0:
+            if err != nil {
+                t.Fatalf("%s: the valid message has been rejected: %s", tc.name, err.Error())
+            }
+            if _, err = req.GetTId(true, true, false); err != nil {
+                t.Fatalf("%s: cannot get the transaction id: %s", tc.name, err.Error())
+            }
+        case tc.code == -1:
+            if err == nil {
+                t.Fatalf("%s: the invalid message has been accepted", tc.name)
+            }
+        default:
+            perr, ok := err.(*ESipParseException)
+            if !ok || perr.sip_response == nil {
+                t.Fatalf("%s: the invalid message has not been rejected with a response (%v)", tc.name, err)
+            }
+            if code, _ := perr.sip_response.GetSCode(); code != tc.code {
+                t.Fatalf("%s: got %d while expecting %d", tc.name, code, tc.code)
+            }
+            if perr.sip_response.GetFirstHF("Warning") == nil {
+                t.Fatalf("%s: the response has no Warning header", tc.name)
+            }
+        }
+    }
+    for _, tc := range torture_resps {
+        _, err := ParseSipResponse(tortureMsg(tc.lines, tc.body), rtime, config)
+        if tc.code == 0 && err != nil {
+            t.Fatalf("%s: the valid response has been rejected: %s", tc.name, err.Error())
+        } else if tc.code == -1 && err == nil {
+            t.Fatalf("%s: the invalid response has been accepted", tc.name)
+        }
+    }
+    // The lenient parser must survive all of them as well
+    lconfig := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    for _, tc := range torture_msgs {
+        req, err := ParseSipRequest(tortureMsg(tc.lines, tc.body), rtime, lconfig)
+        if err == nil {
+            req.GetTId(true, true, false)
+            req.GetContacts()
+        } else if tc.name == "inv2543" {
+            t.Fatal("inv2543: the lenient parser must accept RFC 2543 request: " + err.Error())
+        }
+    }
+    // The transaction identity is found with the folded headers
+    req, _ := ParseSipRequest(tortureMsg(torture_msgs[0].lines, torture_msgs[0].body), rtime, config)
+    tid, _ := req.GetTId(true, true, false)
+    assertStringEqual(tid.Branch, "390skdjuw", t)
+    assertStringEqual(tid.CSeqMethod, "INVITE", t)
+}
+
+func Test_StrictParserResponse(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    config.SetStrictParser(true)
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    tfactory.feed([]string{
+        "OPTIONS sip:user@example.com SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bKstrict1",
+        "To: sip:user@example.com",
+        "From: sip:caller@1.1.1.1;tag=34525",
+        "Call-ID: strict1@1.1.1.1",
+        "CSeq: 8 OPTIONS",
+        "Content-Length: 0",
+        "", "",
+    })
+    rtime, _ := sippy_time.NewMonoTime()
+    resp, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if code, _ := resp.GetSCode(); code != 400 {
+        t.Fatalf("Got %d while expecting 400", code)
+    }
+    warning := resp.GetFirstHF("Warning")
+    if warning == nil || !strings.Contains(warning.StringBody(), "Missing Max-Forwards header") {
+        t.Fatal("The Warning header must name the problem")
+    }
+}
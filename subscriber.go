@@ -0,0 +1,298 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+    "github.com/braams/sippy/utils"
+)
+
+// Subscriber is the UAC side of a subscription. It sends the initial
+// SUBSCRIBE, keeps the subscription refreshed and delivers incoming
+// NOTIFY requests to the application. All public methods must be called
+// with the session lock held.
+type Subscriber struct {
+    *subscriptionDialog
+    nh_address      *sippy_net.HostPort
+    expires         int
+    state           string
+    username        string
+    password        string
+    triedauth       bool
+    digest          *digestClient
+    unsubscribing   bool
+    refresh_timer   *Timeout
+    notify_cb       func(*Subscriber, sippy_types.SipRequest, *sippy_header.SipSubscriptionStateBody)
+    terminated_cb   func(*Subscriber, string, int)
+}
+
+func NewSubscriber(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, nh_address *sippy_net.HostPort, event_package, event_id string, expires int, session_lock sync.Locker) *Subscriber {
+    self := &Subscriber{
+        subscriptionDialog  : newSubscriptionDialog(sip_tm, config, session_lock),
+        nh_address          : nh_address,
+        expires             : expires,
+    }
+    self.event = &sippy_header.SipEventBody{ Package : event_package, Id : event_id }
+    return self
+}
+
+func (self *Subscriber) SetCredentials(username, password string) {
+    self.username = username
+    self.password = password
+}
+
+// SetNotifyCb installs the callback invoked for every NOTIFY received
+// within the subscription.
+func (self *Subscriber) SetNotifyCb(cb func(*Subscriber, sippy_types.SipRequest, *sippy_header.SipSubscriptionStateBody)) {
+    self.notify_cb = cb
+}
+
+// SetTerminatedCb installs the callback invoked once the subscription
+// is over. The reason is taken from the Subscription-State header or is
+// "rejected"/"timeout" when the subscription failed locally, scode is
+// the final response code when one is available.
+func (self *Subscriber) SetTerminatedCb(cb func(*Subscriber, string, int)) {
+    self.terminated_cb = cb
+}
+
+func (self *Subscriber) GetState() string {
+    return self.state
+}
+
+func (self *Subscriber) IsYours(req sippy_types.SipRequest, br0k3n_to bool) bool {
+    return self.state != sippy_header.SUBSCRIPTION_STATE_TERMINATED && self.isYours(req)
+}
+
+// Subscribe starts a new subscription to the resource identified by ruri.
+func (self *Subscriber) Subscribe(ruri *sippy_header.SipURL, from *sippy_header.SipAddress) error {
+    self.call_id = sippy_header.GenerateSipCallId(self.config)
+    self.lTag = sippy_utils.GenTag()
+    if from == nil {
+        from = sippy_header.NewSipAddress("", sippy_header.NewSipURL("", self.config.GetMyAddress(), self.config.GetMyPort(), false))
+    } else {
+        from = from.GetCopy()
+    }
+    from.SetTag(self.lTag)
+    self.lUri = sippy_header.NewSipFrom(from, self.config)
+    self.rUri = sippy_header.NewSipTo(sippy_header.NewSipAddress("", ruri.GetCopy()), self.config)
+    self.rTarget = ruri.GetCopy()
+    if self.nh_address != nil {
+        self.rAddr = self.nh_address
+    } else {
+        self.rAddr = ruri.GetAddr(self.config)
+    }
+    self.lContact = sippy_header.NewSipContact(self.config)
+    self.lCSeq = 1
+    self.state = sippy_header.SUBSCRIPTION_STATE_PENDING
+    self.register(self)
+    return self.sendSubscribe(self.expires, "", "", nil)
+}
+
+// Unsubscribe asks the notifier to terminate the subscription. The
+// terminated callback is invoked once the final NOTIFY arrives.
+func (self *Subscriber) Unsubscribe() error {
+    if self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED {
+        return nil
+    }
+    self.unsubscribing = true
+    self.cancelRefresh()
+    // Do not wait forever if the final NOTIFY never comes
+    self.refresh_timer = StartTimeout(func() { self.terminate("timeout", 0) }, self.session_lock, 32 * time.Second, 1, self.config.ErrorLogger())
+    return self.sendSubscribe(0, "", "", nil)
+}
+
+func (self *Subscriber) sendSubscribe(expires int, nonce, realm string, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc) error {
+    extra_headers := []sippy_header.SipHeader{}
+    if nonce != "" && realm != "" && self.username != "" && self.password != "" {
+        extra_headers = append(extra_headers, SipXXXAuthorization(realm, nonce, "SUBSCRIBE", self.rTarget.String(),
+          self.username, self.password))
+    }
+    req, err := self.genRequest("SUBSCRIBE", nil, newSipExpiresValue(expires), extra_headers...)
+    if err != nil {
+        return err
+    }
+    _, err = self.sip_tm.BeginNewClientTransaction(req, self, self.session_lock, self.source_address, nil, nil)
+    return err
+}
+
+func (self *Subscriber) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
+    code, _ := resp.GetSCode()
+    if code < 200 || self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED {
+        return
+    }
+    if code == 401 && resp.GetSipWWWAuthenticate() != nil && self.username != "" && ! self.triedauth {
+        digest, err := newDigestClient(resp, self.digest)
+        if err != nil {
+            self.logError("Subscriber::RecvResponse: #1: " + err.Error())
+        } else {
+            self.triedauth = true
+            self.digest = digest
+            if err = self.sendSubscribe(self.requestedExpires(), digest.GetNonce(), digest.GetRealm(), digest.authFunc(nil)); err == nil {
+                return
+            }
+            self.logError("Subscriber::RecvResponse: #2: " + err.Error())
+        }
+    }
+    if code == 407 && resp.GetSipProxyAuthenticate() != nil && self.username != "" && ! self.triedauth {
+        digest, err := newDigestClient(resp, self.digest)
+        if err != nil {
+            self.logError("Subscriber::RecvResponse: #3: " + err.Error())
+        } else {
+            self.triedauth = true
+            self.digest = digest
+            if err = self.sendSubscribe(self.requestedExpires(), digest.GetNonce(), digest.GetRealm(), digest.authFunc(nil)); err == nil {
+                return
+            }
+            self.logError("Subscriber::RecvResponse: #4: " + err.Error())
+        }
+    }
+    self.triedauth = false
+    if code >= 300 {
+        if self.unsubscribing {
+            self.terminate("timeout", code)
+        } else {
+            self.terminate("rejected", code)
+        }
+        return
+    }
+    if self.rTag() == "" {
+        // The dialog is established by the first 2xx
+        to_body, err := resp.GetTo().GetBody()
+        if err != nil {
+            self.logError("Subscriber::RecvResponse: #5: " + err.Error())
+            return
+        }
+        self.rUri = sippy_header.NewSipTo(to_body.GetCopy(), self.config)
+        if err = self.updateRouting(resp, /*reverse_routes*/ true); err != nil {
+            self.logError("Subscriber::RecvResponse: #6: " + err.Error())
+        }
+    }
+    if self.unsubscribing {
+        return
+    }
+    if expires, ok := getSipExpires(resp); ok {
+        self.scheduleRefresh(expires)
+    } else {
+        self.scheduleRefresh(self.expires)
+    }
+}
+
+func (self *Subscriber) requestedExpires() int {
+    if self.unsubscribing {
+        return 0
+    }
+    return self.expires
+}
+
+func (self *Subscriber) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.Ua_context {
+    if ! self.checkCSeq(req) {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(500, "Server Internal Error", nil, self.local_ua.AsSipServer()) }
+    }
+    if req.GetMethod() != "NOTIFY" {
+        resp := req.GenResponse(405, "Method Not Allowed", nil, self.local_ua.AsSipServer())
+        resp.AppendHeader(sippy_header.NewSipAllow("NOTIFY"))
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    if event, err := getSipEventBody(req); err != nil || event == nil {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(489, "Bad Event", nil, self.local_ua.AsSipServer()) }
+    }
+    ss, err := getSipSubscriptionStateBody(req)
+    if err != nil {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(400, "Bad Request (" + err.Error() + ")", nil, self.local_ua.AsSipServer()) }
+    }
+    if self.rTag() == "" {
+        // NOTIFY has overtaken the 2xx to the SUBSCRIBE
+        from_body, err := req.GetFrom().GetBody()
+        if err != nil {
+            self.logError("Subscriber::RecvRequest: #1: " + err.Error())
+            return nil
+        }
+        self.rUri = sippy_header.NewSipTo(from_body.GetCopy(), self.config)
+    }
+    if err = self.updateRouting(req, /*reverse_routes*/ false); err != nil {
+        self.logError("Subscriber::RecvRequest: #2: " + err.Error())
+    }
+    t.SendResponse(req.GenResponse(200, "OK", nil, self.local_ua.AsSipServer()), false, nil)
+    if self.notify_cb != nil {
+        self.notify_cb(self, req, ss)
+    }
+    switch ss.State {
+    case sippy_header.SUBSCRIPTION_STATE_TERMINATED:
+        self.terminate(ss.Reason, 0)
+    case sippy_header.SUBSCRIPTION_STATE_ACTIVE, sippy_header.SUBSCRIPTION_STATE_PENDING:
+        self.state = ss.State
+        if ss.Expires >= 0 && ! self.unsubscribing {
+            self.scheduleRefresh(ss.Expires)
+        }
+    }
+    return nil
+}
+
+func (self *Subscriber) scheduleRefresh(expires int) {
+    self.cancelRefresh()
+    self.refresh_timer = StartTimeout(self.refresh, self.session_lock, refreshInterval(expires), 1, self.config.ErrorLogger())
+}
+
+func (self *Subscriber) cancelRefresh() {
+    if self.refresh_timer != nil {
+        self.refresh_timer.Cancel()
+        self.refresh_timer = nil
+    }
+}
+
+func (self *Subscriber) refresh() {
+    self.refresh_timer = nil
+    if self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED || self.unsubscribing {
+        return
+    }
+    if err := self.sendSubscribe(self.expires, "", "", nil); err != nil {
+        self.logError("Subscriber::refresh: " + err.Error())
+        self.terminate("timeout", 0)
+    }
+}
+
+func (self *Subscriber) terminate(reason string, scode int) {
+    if self.state == sippy_header.SUBSCRIPTION_STATE_TERMINATED {
+        return
+    }
+    self.state = sippy_header.SUBSCRIPTION_STATE_TERMINATED
+    self.cancelRefresh()
+    self.unregister(self)
+    if self.terminated_cb != nil {
+        self.terminated_cb(self, reason, scode)
+    }
+}
+
+func (self *Subscriber) logError(args ...interface{}) {
+    self.config.ErrorLogger().Error(args...)
+}
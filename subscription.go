@@ -0,0 +1,294 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "errors"
+    "sync"
+    "time"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+)
+
+// EventPackage is the hook through which a notifier consults the
+// application about a particular event package (RFC 6665, section 7),
+// such as "dialog" for BLF, "message-summary" for MWI or "refer" for
+// the transfer progress reports.
+type EventPackage interface {
+    // The event package name as it appears in the Event header field.
+    Name() string
+    // Subscription duration in seconds used when SUBSCRIBE has no Expires.
+    DefaultExpires() int
+    // Called for every initial and refreshing SUBSCRIBE. Returning 200
+    // makes the subscription active, 202 makes it pending, any other
+    // code rejects the request.
+    Authorize(*Notifier, sippy_types.SipRequest) (int, string)
+    // Returns the current state of the resource to be sent with a NOTIFY.
+    // nil means NOTIFY without a body.
+    StateBody(*Notifier) sippy_types.MsgBody
+}
+
+// subscriptionDialog holds the dialog state shared by the subscriber
+// and the notifier sides of a subscription.
+type subscriptionDialog struct {
+    sip_tm          sippy_types.SipTransactionManager
+    config          sippy_conf.Config
+    session_lock    sync.Locker
+    call_id         *sippy_header.SipCallId
+    event           *sippy_header.SipEventBody
+    lUri            *sippy_header.SipFrom
+    rUri            *sippy_header.SipTo
+    lTag            string
+    rTarget         *sippy_header.SipURL
+    rAddr           *sippy_net.HostPort
+    routes          []*sippy_header.SipRoute
+    lContact        *sippy_header.SipContact
+    lCSeq           int
+    rCSeq           int
+    outbound_proxy  *sippy_net.HostPort
+    source_address  *sippy_net.HostPort
+    local_ua        *sippy_header.SipUserAgent
+    extra_headers   []sippy_header.SipHeader
+    registered      bool
+}
+
+func newSubscriptionDialog(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, session_lock sync.Locker) *subscriptionDialog {
+    if session_lock == nil {
+        session_lock = new(sync.Mutex)
+    }
+    return &subscriptionDialog{
+        sip_tm          : sip_tm,
+        config          : config,
+        session_lock    : session_lock,
+        routes          : make([]*sippy_header.SipRoute, 0),
+        rCSeq           : -1,
+        local_ua        : sippy_header.NewSipUserAgent(config.GetMyUAName()),
+    }
+}
+
+func (self *subscriptionDialog) GetSessionLock() sync.Locker {
+    return self.session_lock
+}
+
+func (self *subscriptionDialog) OnUnregister() {
+}
+
+func (self *subscriptionDialog) GetCallId() *sippy_header.SipCallId {
+    return self.call_id
+}
+
+func (self *subscriptionDialog) GetEvent() *sippy_header.SipEventBody {
+    return self.event
+}
+
+func (self *subscriptionDialog) GetLUri() *sippy_header.SipFrom {
+    return self.lUri
+}
+
+func (self *subscriptionDialog) GetRUri() *sippy_header.SipTo {
+    return self.rUri
+}
+
+func (self *subscriptionDialog) GetRTarget() *sippy_header.SipURL {
+    return self.rTarget
+}
+
+func (self *subscriptionDialog) SetOutboundProxy(outbound_proxy *sippy_net.HostPort) {
+    self.outbound_proxy = outbound_proxy
+}
+
+func (self *subscriptionDialog) SetSourceAddress(addr *sippy_net.HostPort) {
+    self.source_address = addr
+}
+
+func (self *subscriptionDialog) SetLocalUA(local_ua *sippy_header.SipUserAgent) {
+    self.local_ua = local_ua
+}
+
+func (self *subscriptionDialog) SetExtraHeaders(extra_headers []sippy_header.SipHeader) {
+    self.extra_headers = extra_headers
+}
+
+func (self *subscriptionDialog) register(consumer sippy_types.RequestConsumer) {
+    if self.registered {
+        return
+    }
+    self.registered = true
+    self.sip_tm.RegConsumer(consumer, self.call_id.CallId)
+}
+
+func (self *subscriptionDialog) unregister(consumer sippy_types.RequestConsumer) {
+    if ! self.registered {
+        return
+    }
+    self.registered = false
+    self.sip_tm.UnregConsumer(consumer, self.call_id.CallId)
+}
+
+func (self *subscriptionDialog) rTag() string {
+    if self.rUri == nil {
+        return ""
+    }
+    rUri, err := self.rUri.GetBody()
+    if err != nil {
+        return ""
+    }
+    return rUri.GetTag()
+}
+
+// isYours matches an incoming request against the dialog identifiers
+// and the Event header.
+func (self *subscriptionDialog) isYours(req sippy_types.SipRequest) bool {
+    if self.call_id == nil || req.GetCallId().CallId != self.call_id.CallId {
+        return false
+    }
+    to_body, err := req.GetTo().GetBody()
+    if err != nil || to_body.GetTag() != self.lTag {
+        return false
+    }
+    from_body, err := req.GetFrom().GetBody()
+    if err != nil {
+        return false
+    }
+    if rtag := self.rTag(); rtag != "" && rtag != from_body.GetTag() {
+        return false
+    }
+    if event, err := getSipEventBody(req); err == nil && event != nil && self.event != nil {
+        return self.event.Matches(event)
+    }
+    return true
+}
+
+// checkCSeq enforces the remote CSeq ordering within the dialog.
+func (self *subscriptionDialog) checkCSeq(req sippy_types.SipRequest) bool {
+    cseq_body, err := req.GetCSeq().GetBody()
+    if err != nil || (self.rCSeq != -1 && self.rCSeq >= cseq_body.CSeq) {
+        return false
+    }
+    self.rCSeq = cseq_body.CSeq
+    return true
+}
+
+func (self *subscriptionDialog) updateRouting(msg sippy_types.SipMsg, reverse_routes bool) error {
+    if len(msg.GetContacts()) > 0 {
+        contact, err := msg.GetContacts()[0].GetBody()
+        if err != nil {
+            return err
+        }
+        self.rTarget = contact.GetUrl().GetCopy()
+    }
+    rrs := msg.GetRecordRoutes()
+    self.routes = make([]*sippy_header.SipRoute, len(rrs))
+    for i, r := range rrs {
+        if reverse_routes {
+            self.routes[len(rrs) - i - 1] = r.AsSipRoute()
+        } else {
+            self.routes[i] = r.AsSipRoute()
+        }
+    }
+    if len(self.routes) > 0 {
+        r0, err := self.routes[0].GetBody()
+        if err != nil {
+            return err
+        }
+        if ! r0.GetUrl().Lr {
+            self.routes = append(self.routes, sippy_header.NewSipRoute(sippy_header.NewSipAddress("", self.rTarget), self.config))
+            self.rTarget = r0.GetUrl()
+            self.routes = self.routes[1:]
+            self.rAddr = self.rTarget.GetAddr(self.config)
+        } else {
+            self.rAddr = r0.GetUrl().GetAddr(self.config)
+        }
+    } else {
+        self.rAddr = self.rTarget.GetAddr(self.config)
+    }
+    return nil
+}
+
+func (self *subscriptionDialog) genRequest(method string, body sippy_types.MsgBody, expires *sippy_header.SipExpires, extra_headers ...sippy_header.SipHeader) (sippy_types.SipRequest, error) {
+    target := self.rAddr
+    if self.outbound_proxy != nil {
+        target = self.outbound_proxy
+    }
+    req, err := NewSipRequest(method, /*ruri*/ self.rTarget.GetCopy(), /*sipver*/ "", /*to*/ self.rUri.GetCopy(),
+                    /*fr0m*/ self.lUri.GetCopy(), /*via*/ nil, self.lCSeq, self.call_id, /*maxforwars*/ nil, body,
+                    self.lContact.GetCopy(), self.routes, target, /*cguid*/ nil, self.local_ua, expires, self.config)
+    if err != nil {
+        return nil, err
+    }
+    self.lCSeq++
+    req.AppendHeader(sippy_header.NewSipEvent(self.event.Package, self.event.Id))
+    req.appendHeaders(self.extra_headers)
+    req.appendHeaders(extra_headers)
+    return req, nil
+}
+
+func getSipEventBody(msg sippy_types.SipMsg) (*sippy_header.SipEventBody, error) {
+    event, ok := msg.GetFirstHF("event").(*sippy_header.SipEvent)
+    if ! ok {
+        return nil, nil
+    }
+    return event.GetBody()
+}
+
+func getSipSubscriptionStateBody(msg sippy_types.SipMsg) (*sippy_header.SipSubscriptionStateBody, error) {
+    ss, ok := msg.GetFirstHF("subscription-state").(*sippy_header.SipSubscriptionState)
+    if ! ok {
+        return nil, errors.New("Subscription-State header is missing")
+    }
+    return ss.GetBody()
+}
+
+func getSipExpires(msg sippy_types.SipMsg) (int, bool) {
+    expires, ok := msg.GetFirstHF("expires").(*sippy_header.SipExpires)
+    if ! ok {
+        return 0, false
+    }
+    body, err := expires.GetBody()
+    if err != nil {
+        return 0, false
+    }
+    return body.Number, true
+}
+
+func newSipExpiresValue(expires int) *sippy_header.SipExpires {
+    hf := sippy_header.NewSipExpires()
+    hf.Number = expires
+    return hf
+}
+
+// refreshInterval returns how long to wait before refreshing a
+// subscription or a registration of the given duration.
+func refreshInterval(expires int) time.Duration {
+    if expires > 64 {
+        return time.Duration(expires - 32) * time.Second
+    }
+    return time.Duration(expires) * time.Second / 2
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/time"
+    "github.com/braams/sippy/types"
+)
+
+type test_event_package struct {
+}
+
+func (*test_event_package) Name() string { return "message-summary" }
+func (*test_event_package) DefaultExpires() int { return 3600 }
+func (*test_event_package) Authorize(*Notifier, sippy_types.SipRequest) (int, string) { return 200, "OK" }
+func (*test_event_package) StateBody(*Notifier) sippy_types.MsgBody {
+    return NewMsgBody("Messages-Waiting: yes\r\n", "application/simple-message-summary")
+}
+
+type test_subscribe_map struct {
+    config      sippy_conf.Config
+    sip_tm      sippy_types.SipTransactionManager
+    lock        sync.Mutex
+}
+
+func (self *test_subscribe_map) OnNewDialog(req sippy_types.SipRequest, tr sippy_types.ServerTransaction) (sippy_types.UA, sippy_types.RequestReceiver, sippy_types.SipResponse) {
+    if req.GetMethod() != "SUBSCRIBE" {
+        return nil, nil, req.GenResponse(501, "Not Implemented", nil, nil)
+    }
+    return nil, NewNotifier(self.sip_tm, self.config, &test_event_package{}, &self.lock), nil
+}
+
+func Test_Subscription(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := &test_subscribe_map{ config : config }
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    subscribe := []string{
+        "SUBSCRIBE sip:100@192.168.0.1 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds1",
+        "Max-Forwards: 70",
+        "From: <sip:200@1.1.1.1>;tag=1928301774",
+        "To: <sip:100@192.168.0.1>",
+        "Call-ID: a84b4c76e66710@1.1.1.1",
+        "CSeq: 1 SUBSCRIBE",
+        "Contact: <sip:200@1.1.1.1:5060>",
+        "Event: message-summary",
+        "Expires: 600",
+        "Content-Length: 0",
+        "",
+        "",
+    }
+    tfactory.feed(subscribe)
+    rtime, _ := sippy_time.NewMonoTime()
+    resp, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response: " + err.Error())
+    }
+    if code, _ := resp.GetSCode(); code != 200 {
+        t.Fatalf("Got %d response to SUBSCRIBE while expecting 200", code)
+    }
+    to_body, _ := resp.GetTo().GetBody()
+    if to_body.GetTag() == "" {
+        t.Fatal("No To tag in the response to SUBSCRIBE")
+    }
+    notify, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse NOTIFY: " + err.Error())
+    }
+    assertStringEqual(notify.GetMethod(), "NOTIFY", t)
+    ss, err := getSipSubscriptionStateBody(notify)
+    if err != nil {
+        t.Fatal("Cannot parse Subscription-State: " + err.Error())
+    }
+    assertStringEqual(ss.State, sippy_header.SUBSCRIPTION_STATE_ACTIVE, t)
+    event, err := getSipEventBody(notify)
+    if err != nil || event == nil {
+        t.Fatal("No Event in NOTIFY")
+    }
+    assertStringEqual(event.Package, "message-summary", t)
+    tfactory.feed([]string{ notify.GenResponse(200, "OK", nil, nil).LocalStr(nil, false) })
+
+    // Unsubscribe within the dialog
+    subscribe[1] = "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK776asdhds2"
+    subscribe[4] = "To: <sip:100@192.168.0.1>;tag=" + to_body.GetTag()
+    subscribe[6] = "CSeq: 2 SUBSCRIBE"
+    subscribe[9] = "Expires: 0"
+    tfactory.feed(subscribe)
+    for i := 0; i < 2; i++ {
+        data := tfactory.get()
+        if strings.HasPrefix(string(data), "SIP/2.0") {
+            continue
+        }
+        notify, err = ParseSipRequest(data, rtime, config)
+        if err != nil {
+            t.Fatal("Cannot parse NOTIFY: " + err.Error())
+        }
+    }
+    ss, err = getSipSubscriptionStateBody(notify)
+    if err != nil {
+        t.Fatal("Cannot parse Subscription-State: " + err.Error())
+    }
+    assertStringEqual(ss.State, sippy_header.SUBSCRIPTION_STATE_TERMINATED, t)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "os"
+    "regexp"
+    "strings"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/types"
+    "github.com/braams/sippy/utils"
+)
+
+// The documentation addresses (RFC 5737, RFC 3849) put in place of the
+// internal ones in SDP, same as the Rtp_proxy_session does with the
+// origin.
+const (
+    HIDDEN_ADDRESS_IP4 = "192.0.2.1"
+    HIDDEN_ADDRESS_IP6 = "2001:db8::1"
+)
+
+var topology_hiding_addr_re = regexp.MustCompile(`\[[0-9A-Fa-f:.]+\](:\d+)?|\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+
+// TopologyHider removes the addresses of the internal network from the
+// messages sent on the outside leg of the B2BUA. The Ua with the hider
+// also uses its own Call-ID instead of the one of the incoming leg and
+// does not pass the Cisco-GUID.
+type TopologyHider struct {
+    internal    *sippy_net.TrustDomain
+    hostname    string
+    config      sippy_conf.Config
+}
+
+// NewTopologyHider creates the hider for the given set of the internal
+// hosts and networks. The local host name is always considered internal.
+func NewTopologyHider(internal *sippy_net.TrustDomain, config sippy_conf.Config) *TopologyHider {
+    hostname, _ := os.Hostname()
+    return &TopologyHider{
+        internal    : internal,
+        hostname    : strings.ToLower(hostname),
+        config      : config,
+    }
+}
+
+func (self *TopologyHider) IsInternal(host string) bool {
+    if host == "" {
+        return false
+    }
+    if self.hostname != "" && strings.ToLower(host) == self.hostname {
+        return true
+    }
+    return self.internal.IsTrusted(sippy_net.NewHostPort(host, ""))
+}
+
+func (self *TopologyHider) HideRequest(req sippy_types.SipRequest) {
+    // Only the topmost Via belongs to us
+    vias := req.GetVias()
+    if len(vias) > 1 {
+        keep := []*sippy_header.SipVia{}
+        for _, via := range vias[1:] {
+            if via_body, err := via.GetBody(); err == nil {
+                host, _ := via_body.GetAddr(self.config)
+                if self.IsInternal(host) {
+                    continue
+                }
+            }
+            keep = append(keep, via)
+        }
+        if len(keep) < len(vias) - 1 {
+            for len(req.GetVias()) > 1 {
+                req.RemoveFirstVia()
+            }
+            top := req.GetVias()[0]
+            req.RemoveFirstVia()
+            for i := len(keep) - 1; i >= 0; i-- {
+                req.InsertFirstVia(keep[i])
+            }
+            req.InsertFirstVia(top)
+        }
+    }
+    self.hideMsg(req)
+}
+
+func (self *TopologyHider) HideResponse(resp sippy_types.SipResponse) {
+    self.hideMsg(resp)
+}
+
+func (self *TopologyHider) hideMsg(msg sippy_types.SipMsg) {
+    for _, rr := range msg.GetRecordRoutes() {
+        addr, err := rr.GetBody()
+        if err != nil || self.IsInternal(addr.GetUrl().Host.String()) {
+            msg.RemoveHeader(rr)
+        }
+    }
+    for _, contact := range msg.GetContacts() {
+        addr, err := contact.GetBody()
+        if err != nil || ! self.IsInternal(addr.GetUrl().Host.String()) {
+            continue
+        }
+        hidden := contact.GetCopy()
+        addr, _ = hidden.GetBody()
+        addr.GetUrl().Host = self.config.GetMyAddress()
+        addr.GetUrl().Port = self.config.GetMyPort()
+        msg.ReplaceHeader(contact, hidden)
+    }
+    for _, hf := range msg.GetHFs("warning") {
+        arr := sippy_utils.FieldsN(hf.StringBody(), 3)
+        if len(arr) != 3 {
+            msg.RemoveHeader(hf)
+            continue
+        }
+        agent := arr[1]
+        if self.IsInternal(hostOf(agent)) {
+            agent = self.config.GetMyAddress().String()
+        }
+        body := arr[0] + " " + agent + " \"" + self.stripAddresses(strings.Trim(arr[2], "\"")) + "\""
+        if body != hf.StringBody() {
+            msg.ReplaceHeader(hf, sippy_header.CreateSipWarning(body)...)
+        }
+    }
+    for _, name := range []string{ "user-agent", "server" } {
+        for _, hf := range msg.GetHFs(name) {
+            body := self.stripAddresses(hf.StringBody())
+            if body == "" {
+                msg.RemoveHeader(hf)
+            } else if body != hf.StringBody() {
+                hfs, _ := ParseSipHeader(hf.Name() + ": " + body, self.config)
+                msg.ReplaceHeader(hf, hfs...)
+            }
+        }
+    }
+    if body := msg.GetBody(); body != nil {
+        body = body.GetCopy()
+        if self.hideSdp(body) {
+            msg.SetBody(body)
+        }
+    }
+}
+
+// stripAddresses removes the internal IP addresses from the free text.
+func (self *TopologyHider) stripAddresses(text string) string {
+    text = topology_hiding_addr_re.ReplaceAllStringFunc(text, func(addr string) string {
+        if self.IsInternal(hostOf(addr)) {
+            return ""
+        }
+        return addr
+    })
+    return strings.Join(strings.Fields(text), " ")
+}
+
+// hostOf strips the port from the "host:port" or "[host]:port".
+func hostOf(hostport string) string {
+    if strings.HasPrefix(hostport, "[") {
+        if idx := strings.IndexRune(hostport, ']'); idx != -1 {
+            return hostport[1:idx]
+        }
+    }
+    return strings.SplitN(hostport, ":", 2)[0]
+}
+
+func (self *TopologyHider) hiddenAddress(addr string) string {
+    if strings.IndexRune(addr, ':') != -1 {
+        return HIDDEN_ADDRESS_IP6
+    }
+    return HIDDEN_ADDRESS_IP4
+}
+
+// hideSdp replaces the internal addresses in the o= and c= lines. The
+// addresses allocated on the rtpproxy are not internal and stay intact.
+func (self *TopologyHider) hideSdp(body sippy_types.MsgBody) bool {
+    parsed_body, err := body.GetParsedBody()
+    if err != nil {
+        return false
+    }
+    changed := false
+    if origin := parsed_body.GetOHeader(); origin != nil && self.IsInternal(origin.GetAddress()) {
+        origin.SetAddress(self.hiddenAddress(origin.GetAddress()))
+        changed = true
+    }
+    if c_header := parsed_body.GetCHeader(); c_header != nil && self.IsInternal(c_header.GetAddr()) {
+        c_header.SetAddr(self.hiddenAddress(c_header.GetAddr()))
+        changed = true
+    }
+    for _, sect := range parsed_body.GetSections() {
+        if c_header := sect.GetCHeader(); c_header != nil && self.IsInternal(c_header.GetAddr()) {
+            c_header.SetAddr(self.hiddenAddress(c_header.GetAddr()))
+            changed = true
+        }
+    }
+    return changed
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
+    "github.com/braams/sippy/log"
+    "github.com/braams/sippy/net"
+    "github.com/braams/sippy/time"
+)
+
+func Test_TopologyHiding(t *testing.T) {
+    var err error
+
+    config, tfactory := newTestConfig()
+    cmap := NewTestCallMap(config)
+    cmap.sip_tm = startTestSipTM(t, config, cmap)
+    defer cmap.sip_tm.Shutdown()
+    internal, err := sippy_net.NewTrustDomain("10.0.0.0/8")
+    if err != nil {
+        t.Fatal("Cannot create internal network: " + err.Error())
+    }
+
+    ua := NewUA(cmap.sip_tm, config, sippy_net.NewHostPort("2.2.2.2", "5060"), cmap, &cmap.lock, nil)
+    ua.SetTopologyHider(NewTopologyHider(internal, config))
+    ua.SetLocalUA(sippy_header.NewSipUserAgent("PBX 10.0.0.7"))
+    ua.SetExtraHeaders([]sippy_header.SipHeader{
+        sippy_header.CreateSipWarning("399 10.1.1.1 \"failover from 10.1.1.2:5060\"")[0],
+        sippy_header.CreateSipRecordRoute("<sip:10.0.0.9;lr>")[0],
+        sippy_header.CreateSipRecordRoute("<sip:3.3.3.3;lr>")[0],
+    })
+    sdp := "v=0\r\no=- 12345 1 IN IP4 10.0.0.5\r\ns=-\r\nc=IN IP4 10.0.0.6\r\nt=0 0\r\n" +
+        "m=audio 10000 RTP/AVP 0\r\nm=message 2855 TCP/MSRP *\r\nc=IN IP4 3.3.3.3\r\n"
+    cmap.lock.Lock()
+    ua.RecvEvent(NewCCEventTry(sippy_header.NewSipCallIdFromString("internal@10.0.0.5"), nil, "100", "200",
+        NewMsgBody(sdp, "application/sdp"), nil, "Alice", nil, ""))
+    cmap.lock.Unlock()
+    rtime, _ := sippy_time.NewMonoTime()
+    invite, err := ParseSipRequest(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    call_id := invite.GetCallId().CallId
+    if call_id == "internal@10.0.0.5" {
+        t.Fatal("Call-ID of the incoming leg has been reused")
+    }
+    assertStringEqual(invite.GetFirstHF("warning").StringBody(), "399 " + config.GetMyAddress().String() + " \"failover from\"", t)
+    assertStringEqual(invite.GetSipUserAgent().UserAgent, "PBX", t)
+    rrs := invite.GetRecordRoutes()
+    if len(rrs) != 1 {
+        t.Fatal("Internal Record-Route has not been removed")
+    }
+    assertStringEqual(rrs[0].StringBody(), "<sip:3.3.3.3;lr>", t)
+    body := invite.GetBody().String()
+    if strings.Contains(body, "10.0.0.") {
+        t.Fatal("Internal address leaked in SDP: " + body)
+    }
+    if ! strings.Contains(body, "IN IP4 " + HIDDEN_ADDRESS_IP4) || ! strings.Contains(body, "c=IN IP4 3.3.3.3") {
+        t.Fatal("Unexpected SDP: " + body)
+    }
+
+    resp := invite.GenResponse(200, "OK", nil, nil)
+    to, _ := resp.GetTo().GetBody()
+    to.SetTag("callee")
+    resp.AppendHeader(sippy_header.CreateSipContact("<sip:200@2.2.2.2:5060>")[0])
+    tfactory.feed([]string{ resp.LocalStr(nil, false) })
+    tfactory.get() // ACK
+
+    from, _ := invite.GetFrom().GetBody()
+    tfactory.feed([]string{
+        "BYE sip:100@" + config.GetMyAddress().String() + " SIP/2.0",
+        "Via: SIP/2.0/UDP 2.2.2.2:5060;branch=z9hG4bKhiding1",
+        "Max-Forwards: 70",
+        "From: <sip:200@2.2.2.2>;tag=callee",
+        "To: <sip:100@" + config.GetMyAddress().String() + ">;tag=" + from.GetTag(),
+        "Call-ID: " + call_id,
+        "CSeq: 2 BYE",
+        "Content-Length: 0",
+        "",
+        "",
+    })
+    ok, err := ParseSipResponse(tfactory.get(), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse response to BYE: " + err.Error())
+    }
+    if ok.GetSCodeNum() != 200 {
+        t.Fatal("In-dialog BYE has not been matched to the outgoing leg")
+    }
+    assertStringEqual(ok.GetCallId().CallId, call_id, t)
+    assertStringEqual(ok.GetSipServer().Server, "PBX", t)
+}
+
+func Test_TopologyHidingMultipart(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    internal, err := sippy_net.NewTrustDomain("10.0.0.0/8")
+    if err != nil {
+        t.Fatal("Cannot create internal network: " + err.Error())
+    }
+    body := strings.Join([]string{
+        "--unique-Boundary",
+        "Content-Type: application/sdp",
+        "",
+        "v=0",
+        "o=- 12345 1 IN IP4 10.0.0.5",
+        "s=-",
+        "c=IN IP4 10.0.0.6",
+        "t=0 0",
+        "m=audio 10000 RTP/AVP 0",
+        "",
+        "--unique-Boundary",
+        "Content-Type: application/isup;version=itu-t92+",
+        "",
+        "isup",
+        "--unique-Boundary--",
+        "",
+    }, "\r\n")
+    lines := []string{
+        "INVITE sip:200@2.2.2.2 SIP/2.0",
+        "Via: SIP/2.0/UDP 1.1.1.1:5060;branch=z9hG4bK1",
+        "From: <sip:100@1.1.1.1>;tag=12345",
+        "To: <sip:200@2.2.2.2>",
+        "Call-ID: multipart-hiding@1.1.1.1",
+        "CSeq: 1 INVITE",
+        "Contact: <sip:100@1.1.1.1>",
+        "Content-Type: multipart/mixed;boundary=unique-Boundary",
+        "Content-Length: " + strconv.Itoa(len(body)),
+        "",
+        body,
+    }
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := ParseSipRequest([]byte(strings.Join(lines, "\r\n")), rtime, config)
+    if err != nil {
+        t.Fatal("Cannot parse INVITE: " + err.Error())
+    }
+    NewTopologyHider(internal, config).HideRequest(req)
+    hidden := req.GetBody().String()
+    if strings.Contains(hidden, "10.0.0.") {
+        t.Fatal("Internal address leaked in the multipart SDP: " + hidden)
+    }
+    if ! strings.Contains(hidden, "c=IN IP4 " + HIDDEN_ADDRESS_IP4) || ! strings.Contains(hidden, "isup") {
+        t.Fatal("Unexpected multipart body: " + hidden)
+    }
+}
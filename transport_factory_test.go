@@ -2,9 +2,13 @@ package sippy
 
 import (
     "strings"
+    "testing"
 
+    "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/log"
     "github.com/braams/sippy/net"
     "github.com/braams/sippy/time"
+    "github.com/braams/sippy/types"
 )
 
 type test_sip_transport_factory struct {
@@ -52,3 +56,24 @@ func (self *test_sip_transport_factory) feed(inp []string) {
 func (self *test_sip_transport_factory) get() []byte {
     return <-self.data_ch
 }
+
+// newTestConfig returns the config sending over the test transport.
+func newTestConfig() (sippy_conf.Config, *test_sip_transport_factory) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), NewTestSipLogger())
+    config.SetSipAddress(config.GetMyAddress())
+    config.SetSipPort(config.GetMyPort())
+    tfactory := NewTestSipTransportFactory()
+    config.SetSipTransportFactory(tfactory)
+    return config, tfactory
+}
+
+// startTestSipTM creates and runs the transaction manager. The caller
+// shuts it down.
+func startTestSipTM(t *testing.T, config sippy_conf.Config, cmap sippy_types.CallMap) *sipTransactionManager {
+    sip_tm, err := NewSipTransactionManager(config, cmap)
+    if err != nil {
+        t.Fatal("Cannot create SIP transaction manager: " + err.Error())
+    }
+    go sip_tm.Run()
+    return sip_tm
+}
@@ -42,6 +42,16 @@ type RequestReceiver interface {
     RecvRequest(SipRequest, ServerTransaction) *Ua_context
 }
 
+// RequestConsumer is anything that owns a dialog usage (an INVITE
+// session, a subscription) and wants to receive in-dialog requests
+// from the transaction manager.
+type RequestConsumer interface {
+    RequestReceiver
+    IsYours(SipRequest, bool) bool
+    GetSessionLock() sync.Locker
+    OnUnregister()
+}
+
 type ResponseReceiver interface {
     RecvResponse(SipResponse, ClientTransaction)
 }
@@ -59,6 +69,8 @@ type SipMsg interface {
     GetTo() *sippy_header.SipTo
     GetReason() *sippy_header.SipReason
     AppendHeader(hdr sippy_header.SipHeader)
+    ReplaceHeader(old sippy_header.SipHeader, hdrs ...sippy_header.SipHeader)
+    RemoveHeader(hdr sippy_header.SipHeader)
     GetVias() []*sippy_header.SipVia
     GetCallId() *sippy_header.SipCallId
     SetRtime(*sippy_time.MonoTime)
@@ -83,6 +95,13 @@ type SipMsg interface {
     GetSL() string
     GetMaxForwards() *sippy_header.SipMaxForwards
     SetMaxForwards(*sippy_header.SipMaxForwards)
+    GetPAIs() []*sippy_header.SipPAssertedIdentity
+    GetPPIs() []*sippy_header.SipPPreferredIdentity
+    GetPrivacy() *sippy_header.SipPrivacy
+    GetAllow() []string
+    GetSupported() []string
+    GetRequire() []string
+    GetUnsupported() []string
 }
 
 type SipRequest interface {
@@ -107,6 +126,8 @@ type SipResponse interface {
     GetSCodeReason() string
     GetSipWWWAuthenticate() *sippy_header.SipWWWAuthenticate
     GetSipProxyAuthenticate() *sippy_header.SipProxyAuthenticate
+    GetSipWWWAuthenticates() []*sippy_header.SipWWWAuthenticate
+    GetSipProxyAuthenticates() []*sippy_header.SipProxyAuthenticate
     SetSCodeReason(string)
     GetCopy() SipResponse
 }
@@ -199,6 +220,7 @@ type UA interface {
     SetClientTransaction(ClientTransaction)
     GetOutboundProxy() *sippy_net.HostPort
     SetOutboundProxy(*sippy_net.HostPort)
+    GetNextHop() *sippy_net.HostPort
     GetNoReplyTime() time.Duration
     SetNoReplyTime(time.Duration)
     GetExpireTime() time.Duration
@@ -232,6 +254,9 @@ type UA interface {
     SetCreditTime(time.Duration)
     ResetCreditTime(*sippy_time.MonoTime, map[int64]*sippy_time.MonoTime)
     ShouldUseRefer() bool
+    SetUseRefer(bool)
+    ShouldUseMessage() bool
+    SetUseMessage(bool)
     GetState() UaState
     Disconnect(*sippy_time.MonoTime)
     SetKaInterval(time.Duration)
@@ -239,6 +264,23 @@ type UA interface {
     OnDead()
     GetGoDeadTimeout() time.Duration
     ChangeState(UaState)
+    DeferUpdate(CCEvent)
+    ScheduleUpdateRetry(CCEvent)
+    UpdatePending() bool
+    SetTrustDomain(*sippy_net.TrustDomain)
+    GetTrustDomain() *sippy_net.TrustDomain
+    SetPAIAsCLI(bool)
+    GetPAIAsCLI() bool
+    SetQ850Reason(bool)
+    GetQ850Reason() bool
+    SetDiversionDialect(string)
+    GetDiversionDialect() string
+    SetAllow(...string)
+    GetAllow() []string
+    SetSupported(...string)
+    GetSupported() []string
+    GetPeerAllow() []string
+    GetPeerSupported() []string
     GetLastScode() int
     SetLastScode(int)
     HasNoReplyTimer() bool
@@ -274,6 +316,9 @@ type UA interface {
     SetOnRemoteSdpChange(OnRemoteSdpChange)
     GetRemoteUA() string
     SetExtraHeaders([]sippy_header.SipHeader)
+    SetHeaderRules(HeaderRules, string)
+    GetTopologyHider() TopologyHider
+    SetTopologyHider(TopologyHider)
     GetAcct(*sippy_time.MonoTime) (time.Duration, time.Duration, bool, bool)
     GetCLI() string
     GetCLD() string
@@ -320,8 +365,8 @@ type ServerTransaction interface {
 }
 
 type SipTransactionManager interface {
-    RegConsumer(UA, string)
-    UnregConsumer(UA, string)
+    RegConsumer(RequestConsumer, string)
+    UnregConsumer(RequestConsumer, string)
     BeginNewClientTransaction(SipRequest, ResponseReceiver, sync.Locker, *sippy_net.HostPort, sippy_net.Transport, func(SipRequest)) (ClientTransaction, error)
     CreateClientTransaction(SipRequest, ResponseReceiver, sync.Locker, *sippy_net.HostPort, sippy_net.Transport, func(SipRequest)) (ClientTransaction, error)
     BeginClientTransaction(SipRequest, ClientTransaction)
@@ -385,3 +430,17 @@ type RtpProxyClient interface {
 type RtpProxyUpdateResult interface {
     Address() string
 }
+
+// HeaderRules changes the outgoing messages. The leg is "A" for the
+// incoming call leg, "O" for the outgoing one and empty when unknown.
+type HeaderRules interface {
+    ApplyToRequest(req SipRequest, leg string)
+    ApplyToResponse(resp SipResponse, leg string)
+}
+
+// TopologyHider removes the details of the internal network from the
+// messages sent to the outside.
+type TopologyHider interface {
+    HideRequest(SipRequest)
+    HideResponse(SipResponse)
+}
@@ -27,6 +27,7 @@
 package sippy
 
 import (
+    "math/rand"
     "sync"
     "time"
 
@@ -74,6 +75,9 @@ type Ua struct {
     username        string
     password        string
     extra_headers   []sippy_header.SipHeader
+    header_rules    sippy_types.HeaderRules
+    header_rules_leg string
+    topology_hider  sippy_types.TopologyHider
     reqs            map[int]*sipRequest
     tr              sippy_types.ClientTransaction
     source_address  *sippy_net.HostPort
@@ -95,6 +99,7 @@ type Ua struct {
     credit_timer    *Timeout
     uasResp         sippy_types.SipResponse
     useRefer        bool
+    useMessage      bool
     kaInterval      time.Duration
     godead_timeout  time.Duration
     last_scode      int
@@ -107,10 +112,23 @@ type Ua struct {
     credit_times    map[int64]*sippy_time.MonoTime
     auth            sippy_header.SipHeader
     pass_auth       bool
+    digest          *digestClient
     pending_tr      sippy_types.ClientTransaction
     late_media      bool
     heir            sippy_types.UA
     uas_lossemul    int
+    deferred_updates []sippy_types.CCEvent
+    update_timer    *Timeout
+    dialog_store    DialogStore
+    dialog_saved    *DialogState
+    trust_domain    *sippy_net.TrustDomain
+    pai_as_cli      bool
+    q850_reason     bool
+    diversion_dialect string
+    allow           []string
+    supported       []string
+    peer_allow      []string
+    peer_supported  []string
 }
 
 func (self *Ua) me() sippy_types.UA {
@@ -138,6 +156,8 @@ func NewUA(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, n
         reqs            : make(map[int]*sipRequest),
         rCSeq           : -1,
         useRefer        : true,
+        useMessage      : true,
+        q850_reason     : true,
         kaInterval      : 0,
         godead_timeout  : time.Duration(32 * time.Second),
         last_scode      : 100,
@@ -175,7 +195,26 @@ func (self *Ua) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTran
             NoAckCB  : nil,
         }
     }
+    if unsupported := unsupportedOptions(self.me(), req); len(unsupported) > 0 {
+        resp := req.GenResponse(420, "Bad Extension", /*body*/ nil, /*server*/ self.local_ua.AsSipServer())
+        resp.AppendHeader(sippy_header.NewSipUnsupported(unsupported...))
+        if self.state == nil {
+            // The dialog is never established, let the UA expire and unregister
+            self.me().ChangeState(NewUaStateFailed(self.me(), nil, "", 0, self.config))
+        }
+        return &sippy_types.Ua_context{
+            Response : resp,
+            CancelCB : nil,
+            NoAckCB  : nil,
+        }
+    }
     self.rCSeq = cseq_body.CSeq
+    if req.GetMethod() == "INVITE" {
+        self.updatePeerCapabilities(req)
+    }
+    if req.GetMethod() == "MESSAGE" && self.state != nil {
+        return self.recvMessage(req, t)
+    }
     if self.state == nil {
         if req.GetMethod() == "INVITE" {
             self.ChangeState(NewUasStateIdle(self.me(), self.config))
@@ -186,6 +225,8 @@ func (self *Ua) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTran
     newstate := self.state.RecvRequest(req, t)
     if newstate != nil {
         self.me().ChangeState(newstate)
+    } else {
+        self.saveDialogState()
     }
     self.emitPendingEvents()
     if newstate != nil && req.GetMethod() == "INVITE" {
@@ -199,9 +240,35 @@ func (self *Ua) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTran
     }
 }
 
+// recvMessage passes an in-dialog MESSAGE to the call controller. The
+// transaction is answered once the other leg reports the delivery status
+// or right away if the message has not been passed on.
+func (self *Ua) recvMessage(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.Ua_context {
+    if ! self.useMessage {
+        return &sippy_types.Ua_context{
+            Response : methodNotAllowed(self, req),
+        }
+    }
+    if ! self.isConnected() {
+        return &sippy_types.Ua_context{
+            Response : req.GenResponse(488, "Not Acceptable Here", nil, self.local_ua.AsSipServer()),
+        }
+    }
+    event := NewCCEventMessage(req.GetRtime(), self.GetOrigin(), req.GetBody(), messagePassHeaders(req, nil)...)
+    event.SetReason(req.GetReason())
+    event.SetResponseCb(func(scode int, scode_reason string) {
+        t.SendResponse(req.GenResponse(scode, scode_reason, nil, self.local_ua.AsSipServer()), false, nil)
+    })
+    self.Enqueue(event)
+    self.emitPendingEvents()
+    if ! event.isForwarded() {
+        event.Respond(501, "Not Implemented")
+    }
+    return &sippy_types.Ua_context{}
+}
+
 func (self *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.ClientTransaction) {
     var err error
-    var challenge *sippy_header.SipWWWAuthenticateBody
     var req sippy_types.SipRequest
     var cseq_body *sippy_header.SipCSeqBody
 
@@ -218,13 +285,13 @@ func (self *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.Client
     //cseq, method := resp.GetCSeq().CSeq, resp.GetCSeq().Method
     orig_req, cseq_found := self.reqs[cseq_body.CSeq]
     if cseq_body.Method == "INVITE" && !self.pass_auth && cseq_found && code == 401 && resp.GetSipWWWAuthenticate() != nil &&
-      self.username != "" && self.password != "" && orig_req.sip_authorization == nil {
-        challenge, err = resp.GetSipWWWAuthenticate().GetBody()
+      self.username != "" && self.password != "" && orig_req.GetSipAuthorization() == nil {
+        self.digest, err = newDigestClient(resp, self.digest)
         if err != nil {
             self.logError("UA::RecvResponse: cannot parse WWW-Authenticate: " + err.Error())
             return
         }
-        req, err = self.GenRequest("INVITE", self.lSDP, challenge.GetNonce(), challenge.GetRealm(), /*SipXXXAuthorization*/ nil)
+        req, err = self.GenRequest("INVITE", self.lSDP, self.digest.GetNonce(), self.digest.GetRealm(), self.digest.authFunc(self.lSDP))
         if err != nil {
             self.logError("UA::RecvResponse: cannot create INVITE(1): " + err.Error())
             return
@@ -239,12 +306,12 @@ func (self *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.Client
     }
     if cseq_body.Method == "INVITE" && !self.pass_auth && cseq_found && code == 407 && resp.GetSipProxyAuthenticate() != nil &&
       self.username != "" && self.password != "" && orig_req.GetSipProxyAuthorization() == nil {
-        challenge, err = resp.GetSipProxyAuthenticate().GetBody()
+        self.digest, err = newDigestClient(resp, self.digest)
         if err != nil {
             self.logError("UA::RecvResponse: cannot parse Proxy-Authenticate: " + err.Error())
             return
         }
-        req, err = self.me().GenRequest("INVITE", self.lSDP, challenge.GetNonce(), challenge.GetRealm(), sippy_header.NewSipProxyAuthorization)
+        req, err = self.me().GenRequest("INVITE", self.lSDP, self.digest.GetNonce(), self.digest.GetRealm(), self.digest.authFunc(self.lSDP))
         if err != nil {
             self.logError("UA::RecvResponse: cannot create INVITE(2): " + err.Error())
             return
@@ -260,9 +327,14 @@ func (self *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.Client
     if code >= 200 && cseq_found {
         delete(self.reqs, cseq_body.CSeq)
     }
+    if cseq_body.Method == "INVITE" && code > 100 && code < 300 {
+        self.updatePeerCapabilities(resp)
+    }
     newstate := self.state.RecvResponse(resp, tr)
     if newstate != nil {
         self.me().ChangeState(newstate)
+    } else {
+        self.saveDialogState()
     }
     self.emitPendingEvents()
 }
@@ -304,6 +376,8 @@ func (self *Ua) RecvEvent(event sippy_types.CCEvent) {
     }
     if newstate != nil {
         self.me().ChangeState(newstate)
+    } else {
+        self.saveDialogState()
     }
     self.emitPendingEvents()
 }
@@ -345,6 +419,52 @@ func (self *Ua) ChangeState(newstate sippy_types.UaState) {
     }
     self.state = newstate //.Newstate(self, self.config)
     newstate.OnActivation()
+    if _, ok := newstate.(*UaStateConnected); ok {
+        self.saveDialogState()
+        if len(self.deferred_updates) > 0 && self.update_timer == nil {
+            self.update_timer = StartTimeout(self.sendDeferredUpdate, self.session_lock, 0, 1, self.config.ErrorLogger())
+        }
+    }
+}
+
+// DeferUpdate queues an update that cannot be sent in the current state.
+// The queued updates are sent in order once the dialog returns to the
+// Connected state.
+func (self *Ua) DeferUpdate(event sippy_types.CCEvent) {
+    self.deferred_updates = append(self.deferred_updates, event)
+}
+
+// ScheduleUpdateRetry resends the update rejected with 491 after the
+// randomized interval defined in RFC 3261 section 14.1.
+func (self *Ua) ScheduleUpdateRetry(event sippy_types.CCEvent) {
+    self.deferred_updates = append([]sippy_types.CCEvent{ event }, self.deferred_updates...)
+    if self.update_timer != nil {
+        self.update_timer.Cancel()
+    }
+    var delay time.Duration
+    if self.origin == "callee" {
+        // We have generated the Call-ID
+        delay = time.Duration(210 + rand.Intn(191)) * 10 * time.Millisecond
+    } else {
+        delay = time.Duration(rand.Intn(201)) * 10 * time.Millisecond
+    }
+    self.update_timer = StartTimeout(self.sendDeferredUpdate, self.session_lock, delay, 1, self.config.ErrorLogger())
+}
+
+// UpdatePending reports whether new updates have to be queued behind
+// the already deferred ones.
+func (self *Ua) UpdatePending() bool {
+    return self.update_timer != nil
+}
+
+func (self *Ua) sendDeferredUpdate() {
+    self.update_timer = nil
+    if _, ok := self.state.(*UaStateConnected); ! ok || len(self.deferred_updates) == 0 {
+        return
+    }
+    event := self.deferred_updates[0]
+    self.deferred_updates = self.deferred_updates[1:]
+    self.me().RecvEvent(event)
 }
 
 func (self *Ua) EmitEvent(event sippy_types.CCEvent) {
@@ -373,11 +493,7 @@ func (self *Ua) emitPendingEvents() {
 func (self *Ua) GenRequest(method string, body sippy_types.MsgBody, nonce string, realm string, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc, extra_headers ...sippy_header.SipHeader) (sippy_types.SipRequest, error) {
     var target *sippy_net.HostPort
 
-    if self.outbound_proxy != nil {
-        target = self.outbound_proxy
-    } else {
-        target = self.rAddr
-    }
+    target = self.GetNextHop()
     req, err := NewSipRequest(method, /*ruri*/ self.rTarget, /*sipver*/ "", /*to*/ self.rUri, /*fr0m*/ self.lUri,
                     /*via*/ nil, self.lCSeq, self.cId, /*maxforwars*/ nil, body, self.lContact, self.routes,
                     target, self.cGUID, /*user_agent*/ self.local_ua, /*expires*/ nil, self.config)
@@ -395,6 +511,7 @@ func (self *Ua) GenRequest(method string, body sippy_types.MsgBody, nonce string
     if extra_headers != nil {
         req.appendHeaders(extra_headers)
     }
+    req.appendHeaders(capabilityHeaders(self.me(), req, method == "INVITE"))
     self.reqs[self.lCSeq] = req
     return req, nil
 }
@@ -419,6 +536,11 @@ func (self *Ua) SendUasResponse(t sippy_types.ServerTransaction, scode int, reas
     for _, eh := range extra_headers {
         uasResp.AppendHeader(eh)
     }
+    if scode >= 200 && scode < 300 {
+        for _, hf := range capabilityHeaders(self.me(), uasResp, true) {
+            uasResp.AppendHeader(hf)
+        }
+    }
     var ack_cb func(sippy_types.SipRequest)
     if ack_wait {
         ack_cb = self.recvACK
@@ -501,6 +623,7 @@ func (self *Ua) IsYours(req sippy_types.SipRequest, br0k3n_to bool /*= False*/)
 
 func (self *Ua) DelayedRemoteSdpUpdate(event sippy_types.CCEvent, remote_sdp_body sippy_types.MsgBody) {
     self.rSDP = remote_sdp_body.GetCopy()
+    self.saveDialogState()
     self.me().Enqueue(event)
     self.emitPendingEvents()
 }
@@ -756,6 +879,113 @@ func (self *Ua) SetOutboundProxy(outbound_proxy *sippy_net.HostPort) {
     self.outbound_proxy = outbound_proxy
 }
 
+// SetTrustDomain enables the RFC 3325 handling of the asserted identity.
+// The P-Asserted-Identity is only accepted from and only sent to the
+// hosts of the trust domain.
+func (self *Ua) SetTrustDomain(trust_domain *sippy_net.TrustDomain) {
+    self.trust_domain = trust_domain
+}
+
+func (self *Ua) GetTrustDomain() *sippy_net.TrustDomain {
+    return self.trust_domain
+}
+
+// SetPAIAsCLI makes the trusted P-Asserted-Identity the source of the
+// calling number reported in CCEventTry.
+func (self *Ua) SetPAIAsCLI(pai_as_cli bool) {
+    self.pai_as_cli = pai_as_cli
+}
+
+func (self *Ua) GetPAIAsCLI() bool {
+    return self.pai_as_cli
+}
+
+// SetQ850Reason controls whether the Reason: Q.850 header is added to the
+// BYE, CANCEL and failure responses. It is on by default.
+func (self *Ua) SetQ850Reason(q850_reason bool) {
+    self.q850_reason = q850_reason
+}
+
+func (self *Ua) GetQ850Reason() bool {
+    return self.q850_reason
+}
+
+// SetDiversionDialect selects how the redirection history from CCEventTry
+// is sent in the outgoing INVITE: DIVERSION_DIALECT_DIVERSION,
+// DIVERSION_DIALECT_HISTORY_INFO or DIVERSION_DIALECT_NONE to leave it
+// to the extra headers.
+func (self *Ua) SetDiversionDialect(dialect string) {
+    self.diversion_dialect = dialect
+}
+
+func (self *Ua) GetDiversionDialect() string {
+    return self.diversion_dialect
+}
+
+// SetAllow overrides the methods advertised in the Allow header. By
+// default the header lists the methods the UA handles.
+func (self *Ua) SetAllow(methods ...string) {
+    self.allow = methods
+}
+
+func (self *Ua) GetAllow() []string {
+    if self.allow != nil {
+        return self.allow
+    }
+    rval := append([]string{}, ua_base_allow...)
+    if self.useMessage {
+        rval = append(rval, "MESSAGE")
+    }
+    if self.useRefer {
+        rval = append(rval, "REFER")
+    }
+    return rval
+}
+
+// SetSupported sets the option tags of the extensions the application
+// implements. The tags of the extensions enabled in the UA itself are
+// added automatically.
+func (self *Ua) SetSupported(tags ...string) {
+    self.supported = tags
+}
+
+func (self *Ua) GetSupported() []string {
+    rval := append([]string{}, self.supported...)
+    if self.diversion_dialect == DIVERSION_DIALECT_HISTORY_INFO && ! hasOptionTag(rval, "histinfo") {
+        rval = append(rval, "histinfo")
+    }
+    return rval
+}
+
+// GetPeerAllow returns the methods the peer has advertised or nil if
+// the peer has not sent Allow.
+func (self *Ua) GetPeerAllow() []string {
+    return self.peer_allow
+}
+
+// GetPeerSupported returns the option tags the peer has advertised or
+// nil if the peer has not sent Supported.
+func (self *Ua) GetPeerSupported() []string {
+    return self.peer_supported
+}
+
+func (self *Ua) updatePeerCapabilities(msg sippy_types.SipMsg) {
+    if allow := msg.GetAllow(); allow != nil {
+        self.peer_allow = allow
+    }
+    if supported := msg.GetSupported(); supported != nil {
+        self.peer_supported = supported
+    }
+}
+
+// GetNextHop returns the address the out-of-dialog requests are sent to.
+func (self *Ua) GetNextHop() *sippy_net.HostPort {
+    if self.outbound_proxy != nil {
+        return self.outbound_proxy
+    }
+    return self.rAddr
+}
+
 func (self *Ua) GetNoReplyTime() time.Duration {
     return self.no_reply_time
 }
@@ -872,6 +1102,17 @@ func (self *Ua) OnDead() {
     self.expire_timer = nil
     self.no_progress_timer = nil
     self.credit_timer = nil
+    if self.update_timer != nil {
+        self.update_timer.Cancel()
+        self.update_timer = nil
+    }
+    self.deferred_updates = nil
+    if self.dialog_store != nil && self.cId != nil {
+        if err := self.dialog_store.Delete(dialogKey(self.cId.CallId, self.ltag, self.getRTag())); err != nil {
+            self.logError("UA::OnDead: #1: " + err.Error())
+        }
+        self.dialog_store = nil
+    }
     // Keep this at the very end of processing
     if self.dead_cb != nil {
         self.dead_cb()
@@ -903,6 +1144,22 @@ func (self *Ua) ShouldUseRefer() bool {
     return self.useRefer
 }
 
+// SetUseRefer enables or disables call transfer with REFER in both
+// directions. Disabled REFER is rejected with 405.
+func (self *Ua) SetUseRefer(use_refer bool) {
+    self.useRefer = use_refer
+}
+
+// SetUseMessage enables or disables passing in-dialog MESSAGE requests to
+// the call controller. Disabled MESSAGE is rejected with 405.
+func (self *Ua) SetUseMessage(use_message bool) {
+    self.useMessage = use_message
+}
+
+func (self *Ua) ShouldUseMessage() bool {
+    return self.useMessage
+}
+
 func (self *Ua) GetState() sippy_types.UaState {
     return self.state
 }
@@ -1193,8 +1450,33 @@ func (self *Ua) Config() sippy_conf.Config {
     return self.config
 }
 
-func (self *Ua) BeforeResponseSent(sippy_types.SipResponse) {
+func (self *Ua) BeforeResponseSent(resp sippy_types.SipResponse) {
+    if self.header_rules != nil {
+        self.header_rules.ApplyToResponse(resp, self.header_rules_leg)
+    }
+    if self.topology_hider != nil {
+        self.topology_hider.HideResponse(resp)
+    }
+}
+
+func (self *Ua) BeforeRequestSent(req sippy_types.SipRequest) {
+    if self.header_rules != nil {
+        self.header_rules.ApplyToRequest(req, self.header_rules_leg)
+    }
+    if self.topology_hider != nil {
+        self.topology_hider.HideRequest(req)
+    }
+}
+
+func (self *Ua) SetHeaderRules(rules sippy_types.HeaderRules, leg string) {
+    self.header_rules = rules
+    self.header_rules_leg = leg
+}
+
+func (self *Ua) GetTopologyHider() sippy_types.TopologyHider {
+    return self.topology_hider
 }
 
-func (self *Ua) BeforeRequestSent(sippy_types.SipRequest) {
+func (self *Ua) SetTopologyHider(hider sippy_types.TopologyHider) {
+    self.topology_hider = hider
 }
@@ -65,6 +65,10 @@ func (self *UaStateConnected) String() string {
 
 func (self *UaStateConnected) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) sippy_types.UaState {
     if req.GetMethod() == "REFER" {
+        if ! self.ua.ShouldUseRefer() {
+            t.SendResponse(methodNotAllowed(self.ua, req), false, nil)
+            return nil
+        }
         if req.GetReferTo() == nil {
             t.SendResponse(req.GenResponse(400, "Bad Request", nil, self.ua.GetLocalUA().AsSipServer()), false, nil)
             return nil
@@ -95,13 +99,21 @@ func (self *UaStateConnected) RecvRequest(req sippy_types.SipRequest, t sippy_ty
             }
             parsed_body.SetCHeaderAddr("0.0.0.0")
         } else if self.ua.GetRSDP().String() == body.String() {
-            t.SendResponse(req.GenResponse(200, "OK", self.ua.GetLSDP(), self.ua.GetLocalUA().AsSipServer()), false, nil)
+            resp := req.GenResponse(200, "OK", self.ua.GetLSDP(), self.ua.GetLocalUA().AsSipServer())
+            for _, hf := range capabilityHeaders(self.ua, resp, true) {
+                resp.AppendHeader(hf)
+            }
+            t.SendResponse(resp, false, nil)
             return nil
         }
         event := NewCCEventUpdate(req.GetRtime(), self.ua.GetOrigin(), req.GetReason(), req.GetMaxForwards(), body)
         if body != nil {
             if self.ua.HasOnRemoteSdpChange() {
-                self.ua.OnRemoteSdpChange(body, req, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
+                if err := self.ua.OnRemoteSdpChange(body, req, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                    code, reason := sdpFailure(err)
+                    self.ua.SendUasResponse(t, code, reason, nil, nil, false, sippy_header.NewSipWarning(err.Error()))
+                    return nil
+                }
                 return NewUasStateUpdating(self.ua, self.config)
             } else {
                 self.ua.SetRSDP(body.GetCopy())
@@ -139,7 +151,13 @@ func (self *UaStateConnected) RecvRequest(req sippy_types.SipRequest, t sippy_ty
         return nil
     }
     if req.GetMethod() == "OPTIONS" || req.GetMethod() == "UPDATE" {
-        t.SendResponse(req.GenResponse(200, "OK", nil, self.ua.GetLocalUA().AsSipServer()), false, nil)
+        resp := req.GenResponse(200, "OK", nil, self.ua.GetLocalUA().AsSipServer())
+        if req.GetMethod() == "OPTIONS" {
+            for _, hf := range capabilityHeaders(self.ua, resp, true) {
+                resp.AppendHeader(hf)
+            }
+        }
+        t.SendResponse(resp, false, nil)
         return nil
     }
     //print "wrong request %s in the state Connected" % req.GetMethod()
@@ -184,7 +202,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
             req.AppendHeader(rby)
             self.ua.SipTM().BeginNewClientTransaction(req, newRedirectController(self.ua), self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
         } else {
-            req, err = self.ua.GenRequest("BYE", nil, "", "", nil, eh...)
+            req, err = self.ua.GenRequest("BYE", nil, "", "", nil, q850ReasonHeaders(self.ua, event, eh)...)
             if err != nil {
                 return nil, err
             }
@@ -202,6 +220,10 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
     if _event, ok := event.(*CCEventUpdate); ok {
         var tr sippy_types.ClientTransaction
 
+        if self.ua.UpdatePending() {
+            self.ua.DeferUpdate(event)
+            return nil, nil
+        }
         body := _event.GetBody()
         if self.ua.GetLSDP() != nil && body != nil && self.ua.GetLSDP().String() == body.String() {
             if self.ua.GetRSDP() != nil {
@@ -214,7 +236,8 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
         if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
             err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
             if err != nil {
-                ev := NewCCEventFail(400, "Malformed SDP Body", event.GetRtime(), "")
+                code, reason := sdpFailure(err)
+                ev := NewCCEventFail(code, reason, event.GetRtime(), "")
                 ev.SetWarning(err.Error())
                 self.ua.Enqueue(ev)
             }
@@ -239,6 +262,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
             return nil, err
         }
         self.ua.IncLCSeq()
+        newstate := NewUacStateUpdating(self.ua, _event, self.config)
         self.ua.SetLSDP(body)
         tr, err = self.ua.PrepTr(req)
         if err != nil {
@@ -246,7 +270,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
         }
         self.ua.SetClientTransaction(tr)
         self.ua.SipTM().BeginClientTransaction(req, tr)
-        return NewUacStateUpdating(self.ua, self.config), nil
+        return newstate, nil
     }
     if _event, ok := event.(*CCEventInfo); ok {
         body := _event.GetBody()
@@ -259,17 +283,38 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
         self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
         return nil, nil
     }
+    if _event, ok := event.(*CCEventMessage); ok {
+        req, err = self.ua.GenRequest("MESSAGE", nil, "", "", nil, eh...)
+        if err != nil {
+            return nil, err
+        }
+        req.SetBody(_event.GetBody())
+        self.ua.IncLCSeq()
+        _, err = self.ua.SipTM().BeginNewClientTransaction(req, newMessageController(_event), self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
+        if err != nil {
+            _event.Respond(500, "Server Internal Error")
+            return nil, err
+        }
+        _event.markForwarded()
+        return nil, nil
+    }
     if _event, ok := event.(*CCEventConnect); ok && self.ua.GetPendingTr() != nil {
         self.ua.CancelExpireTimer()
         body := _event.GetBody()
         if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-            self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                return rejectSessionSdp(self.ua, event.GetRtime(), err, self.config), nil
+            }
             return nil, nil
         }
         self.ua.StartCreditTimer(event.GetRtime())
         self.ua.SetConnectTs(event.GetRtime())
         self.ua.SetLSDP(body)
-        self.ua.GetPendingTr().GetACK().SetBody(body)
+        ack := self.ua.GetPendingTr().GetACK()
+        ack.SetBody(body)
+        if hider := self.ua.GetTopologyHider(); hider != nil {
+            hider.HideRequest(ack)
+        }
         self.ua.GetPendingTr().SendACK()
         self.ua.SetPendingTr(nil)
         self.ua.ConnCb(event.GetRtime(), self.ua.GetOrigin())
@@ -299,7 +344,11 @@ func (self *UaStateConnected) RecvACK(req sippy_types.SipRequest) {
     self.ua.ConnCb(req.GetRtime(), self.ua.GetOrigin())
     if body != nil {
         if self.ua.HasOnRemoteSdpChange() {
-            self.ua.OnRemoteSdpChange(body, req, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
+            if err := self.ua.OnRemoteSdpChange(body, req, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                if newstate := rejectSessionSdp(self.ua, req.GetRtime(), err, self.config); newstate != nil {
+                    self.ua.ChangeState(newstate)
+                }
+            }
             return
         } else {
             self.ua.SetRSDP(body.GetCopy())
@@ -55,6 +55,65 @@ func (self *UacStateIdle) String() string {
     return "Idle(UAC)"
 }
 
+// identityHeaders adds the asserted identity when the next hop is in the
+// trust domain and strips it otherwise (RFC 3325). The identity is only
+// taken from a trusted request or set by the controller, never made up of
+// the unverified CLI.
+func (self *UacStateIdle) identityHeaders(event *CCEventTry) []sippy_header.SipHeader {
+    trust_domain := self.ua.GetTrustDomain()
+    if trust_domain == nil {
+        eh := event.GetExtraHeaders()
+        if event.GetPrivacy() != nil {
+            eh = append(eh, event.GetPrivacy().GetCopy())
+        }
+        return eh
+    }
+    trusted := trust_domain.IsTrusted(self.ua.GetNextHop())
+    eh := []sippy_header.SipHeader{}
+    has_pai := false
+    for _, hf := range event.GetExtraHeaders() {
+        switch hf.(type) {
+        case *sippy_header.SipPAssertedIdentity, *sippy_header.SipPPreferredIdentity:
+            if ! trusted {
+                continue
+            }
+            has_pai = true
+        }
+        eh = append(eh, hf)
+    }
+    if trusted && ! has_pai {
+        for _, pai := range event.GetPAI() {
+            eh = append(eh, pai.GetCopy())
+        }
+    }
+    if event.GetPrivacy() != nil {
+        eh = append(eh, event.GetPrivacy().GetCopy())
+    }
+    return eh
+}
+
+// diversionHeaders renders the redirection history in the dialect of
+// the outgoing leg replacing the one found in the extra headers.
+func (self *UacStateIdle) diversionHeaders(event *CCEventTry, eh []sippy_header.SipHeader) []sippy_header.SipHeader {
+    var rval []sippy_header.SipHeader
+    switch self.ua.GetDiversionDialect() {
+    case DIVERSION_DIALECT_DIVERSION:
+        rval = DiversionHeaders(event.GetDiversion(), self.config)
+    case DIVERSION_DIALECT_HISTORY_INFO:
+        rval = HistoryInfoHeaders(event.GetDiversion(), self.ua.GetRTarget(), self.config)
+    default:
+        return eh
+    }
+    for _, hf := range eh {
+        switch hf.(type) {
+        case *sippy_header.SipDiversion, *sippy_header.SipHistoryInfo:
+            continue
+        }
+        rval = append(rval, hf)
+    }
+    return rval
+}
+
 func (self *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaState, error) {
     var err error
     var rUri *sippy_header.SipAddress
@@ -71,13 +130,20 @@ func (self *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaS
         self.ua.SetOrigin("callee")
         if event.GetBody() != nil {
             if event.GetBody().NeedsUpdate() && self.ua.HasOnLocalSdpChange() {
-                self.ua.OnLocalSdpChange(event.GetBody(), event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+                if err = self.ua.OnLocalSdpChange(event.GetBody(), event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                    code, reason := sdpFailure(err)
+                    ev := NewCCEventFail(code, reason, event.rtime, self.ua.GetOrigin())
+                    ev.SetWarning(err.Error())
+                    self.ua.Enqueue(ev)
+                    self.ua.SetDisconnectTs(event.rtime)
+                    return NewUaStateFailed(self.ua, event.rtime, self.ua.GetOrigin(), code, self.config), nil
+                }
                 return nil, nil
             }
         } else {
             self.ua.SetLateMedia(true)
         }
-        if event.GetSipCallId() == nil {
+        if event.GetSipCallId() == nil || self.ua.GetTopologyHider() != nil {
             self.ua.SetCallId(sippy_header.GenerateSipCallId(self.config))
         } else {
             self.ua.SetCallId(event.GetSipCallId().GetCopy())
@@ -95,14 +161,20 @@ func (self *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaS
         if self.ua.GetToUsername() != "" {
             rUri.GetUrl().Username = self.ua.GetToUsername()
         }
-        self.ua.SetLUri(sippy_header.NewSipFrom(sippy_header.NewSipAddress(event.GetCallerName(), sippy_header.NewSipURL(event.GetCLI(), self.config.GetMyAddress(), self.config.GetMyPort(), false)), self.config))
+        privacy := event.GetPrivacy()
+        anonymous := privacy != nil && privacy.Has("id")
+        if anonymous {
+            self.ua.SetLUri(sippy_header.NewSipFrom(sippy_header.NewSipAddress("Anonymous", sippy_header.NewSipURL("anonymous", sippy_net.NewMyAddress("anonymous.invalid"), nil, false)), self.config))
+        } else {
+            self.ua.SetLUri(sippy_header.NewSipFrom(sippy_header.NewSipAddress(event.GetCallerName(), sippy_header.NewSipURL(event.GetCLI(), self.config.GetMyAddress(), self.config.GetMyPort(), false)), self.config))
+        }
         self.ua.SipTM().RegConsumer(self.ua, self.ua.GetCallId().CallId)
         lUri, err = self.ua.GetLUri().GetBody()
         if err != nil {
             return nil, err
         }
         lUri.GetUrl().Port = nil
-        if self.ua.GetFromDomain() != "" {
+        if self.ua.GetFromDomain() != "" && ! anonymous {
             lUri.GetUrl().Host = sippy_net.NewMyAddress(self.ua.GetFromDomain())
         }
         lUri.SetTag(self.ua.GetLTag())
@@ -114,11 +186,18 @@ func (self *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaS
         if err != nil {
             return nil, err
         }
-        contact.GetUrl().Username = event.GetCLI()
+        if anonymous {
+            contact.GetUrl().Username = ""
+        } else {
+            contact.GetUrl().Username = event.GetCLI()
+        }
         self.ua.SetRoutes(make([]*sippy_header.SipRoute, 0))
-        self.ua.SetCGUID(event.GetSipCiscoGUID())
+        if self.ua.GetTopologyHider() == nil {
+            self.ua.SetCGUID(event.GetSipCiscoGUID())
+        }
         self.ua.SetLSDP(event.GetBody())
-        eh := event.GetExtraHeaders()
+        eh := self.identityHeaders(event)
+        eh = self.diversionHeaders(event, eh)
         if event.GetMaxForwards() != nil {
             eh = append(eh, event.GetMaxForwards())
         }
@@ -79,7 +79,9 @@ func (self *UacStateRinging) RecvResponse(resp sippy_types.SipResponse, tr sippy
         self.ua.RingCb(resp.GetRtime(), self.ua.GetOrigin(), code)
         if body != nil {
             if self.ua.HasOnRemoteSdpChange() {
-                self.ua.OnRemoteSdpChange(body, resp, func(x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
+                if err = self.ua.OnRemoteSdpChange(body, resp, func(x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                    return rejectEarlySdp(self.ua, resp, err, self.config)
+                }
                 return nil
             } else {
                 self.ua.SetRSDP(body.GetCopy())
@@ -145,7 +147,9 @@ func (self *UacStateRinging) RecvResponse(resp sippy_types.SipResponse, tr sippy
         self.ua.StartCreditTimer(resp.GetRtime())
         if body != nil {
             if self.ua.HasOnRemoteSdpChange() {
-                self.ua.OnRemoteSdpChange(body, resp, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
+                if err = self.ua.OnRemoteSdpChange(body, resp, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                    return rejectSessionSdp(self.ua, resp.GetRtime(), err, self.config)
+                }
                 return rval
             } else {
                 self.ua.SetRSDP(body.GetCopy())
@@ -203,7 +207,7 @@ func (self *UacStateRinging) RecvEvent(event sippy_types.CCEvent) (sippy_types.U
         //return nil, fmt.Errorf("wrong event %s in the Ringing state", event.String())
         return nil, nil
     }
-    self.ua.GetClientTransaction().Cancel()
+    self.ua.GetClientTransaction().Cancel(q850ReasonHeaders(self.ua, event, event.GetExtraHeaders())...)
     self.ua.CancelExpireTimer()
     if self.ua.GetSetupTs() != nil && ! self.ua.GetSetupTs().After(event.GetRtime()) {
         self.ua.SetDisconnectTs(event.GetRtime())
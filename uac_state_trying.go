@@ -81,7 +81,9 @@ func (self *UacStateTrying) RecvResponse(resp sippy_types.SipResponse, tr sippy_
         event := NewCCEventRing(code, reason, body, resp.GetRtime(), self.ua.GetOrigin())
         if body != nil {
             if self.ua.HasOnRemoteSdpChange() {
-                self.ua.OnRemoteSdpChange(body, resp, func(x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
+                if err = self.ua.OnRemoteSdpChange(body, resp, func(x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                    return rejectEarlySdp(self.ua, resp, err, self.config)
+                }
                 self.ua.SetP1xxTs(resp.GetRtime())
                 return NewUacStateRinging(self.ua, resp.GetRtime(), self.ua.GetOrigin(), code, self.config)
             } else {
@@ -148,7 +150,9 @@ func (self *UacStateTrying) RecvResponse(resp sippy_types.SipResponse, tr sippy_
         }
         if body != nil {
             if self.ua.HasOnRemoteSdpChange() {
-                self.ua.OnRemoteSdpChange(body, resp, func(x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
+                if err = self.ua.OnRemoteSdpChange(body, resp, func(x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                    return rejectSessionSdp(self.ua, resp.GetRtime(), err, self.config)
+                }
                 self.ua.SetConnectTs(resp.GetRtime())
                 return rval
             } else {
@@ -217,7 +221,7 @@ func (self *UacStateTrying) RecvEvent(event sippy_types.CCEvent) (sippy_types.Ua
     case *CCEventDisconnect: cancel_transaction = true
     }
     if cancel_transaction {
-        self.ua.GetClientTransaction().Cancel(event.GetExtraHeaders()...)
+        self.ua.GetClientTransaction().Cancel(q850ReasonHeaders(self.ua, event, event.GetExtraHeaders())...)
         self.ua.CancelExpireTimer()
         self.ua.CancelNoProgressTimer()
         self.ua.CancelNoReplyTimer()
@@ -232,3 +236,41 @@ func (self *UacStateTrying) RecvEvent(event sippy_types.CCEvent) (sippy_types.Ua
     //return nil, fmt.Errorf("uac-trying: wrong event %s in the Trying state", event.String())
     return nil, nil
 }
+
+// rejectEarlySdp cancels the INVITE which provisional response carries
+// the SDP rejected by the SDP change hook.
+func rejectEarlySdp(ua sippy_types.UA, resp sippy_types.SipResponse, err error, config sippy_conf.Config) sippy_types.UaState {
+    code, reason := sdpFailure(err)
+    ev := NewCCEventFail(code, reason, resp.GetRtime(), ua.GetOrigin())
+    ev.SetWarning(err.Error())
+    ua.Enqueue(ev)
+    ua.GetClientTransaction().Cancel()
+    ua.CancelExpireTimer()
+    ua.CancelNoProgressTimer()
+    ua.CancelNoReplyTimer()
+    ua.SetDisconnectTs(resp.GetRtime())
+    return NewUacStateCancelling(ua, resp.GetRtime(), ua.GetOrigin(), code, config)
+}
+
+// rejectSessionSdp tears down the session established by the 2xx response
+// or ACK which SDP has been rejected by the SDP change hook.
+func rejectSessionSdp(ua sippy_types.UA, rtime *sippy_time.MonoTime, err error, config sippy_conf.Config) sippy_types.UaState {
+    code, reason := sdpFailure(err)
+    ev := NewCCEventFail(code, reason, rtime, ua.GetOrigin())
+    ev.SetWarning(err.Error())
+    ua.Enqueue(ev)
+    if ua.GetPendingTr() != nil {
+        ua.GetPendingTr().SendACK()
+        ua.SetPendingTr(nil)
+    }
+    req, err := ua.GenRequest("BYE", nil, "", "", nil)
+    if err != nil {
+        config.ErrorLogger().Error("rejectSessionSdp: #1: " + err.Error())
+        return nil
+    }
+    ua.IncLCSeq()
+    ua.SipTM().BeginNewClientTransaction(req, nil, ua.GetSessionLock(), ua.GetSourceAddress(), nil, ua.BeforeRequestSent)
+    ua.CancelCreditTimer()
+    ua.SetDisconnectTs(rtime)
+    return NewUaStateFailed(ua, rtime, ua.GetOrigin(), code, config)
+}
@@ -37,12 +37,16 @@ import (
 type UacStateUpdating struct {
     *uaStateGeneric
     triedauth   bool
+    event       *CCEventUpdate
+    prev_lsdp   sippy_types.MsgBody
 }
 
-func NewUacStateUpdating(ua sippy_types.UA, config sippy_conf.Config) *UacStateUpdating {
+func NewUacStateUpdating(ua sippy_types.UA, event *CCEventUpdate, config sippy_conf.Config) *UacStateUpdating {
     self := &UacStateUpdating{
         uaStateGeneric  : newUaStateGeneric(ua, config),
         triedauth       : false,
+        event           : event,
+        prev_lsdp       : ua.GetLSDP(),
     }
     self.connected = true
     return self
@@ -89,8 +93,14 @@ func (self *UacStateUpdating) RecvResponse(resp sippy_types.SipResponse, tr sipp
         if body != nil {
             if self.ua.HasOnRemoteSdpChange() {
                 if err := self.ua.OnRemoteSdpChange(body, resp, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
-                    ev := NewCCEventFail(502, "Bad Gateway", event.GetRtime(), "")
-                    ev.SetWarning(fmt.Sprintf("Malformed SDP Body received from downstream: \"%s\"", err.Error()))
+                    code, reason := sdpFailure(err)
+                    warning := err.Error()
+                    if code == 400 {
+                        code, reason = 502, "Bad Gateway"
+                        warning = fmt.Sprintf("Malformed SDP Body received from downstream: \"%s\"", err.Error())
+                    }
+                    ev := NewCCEventFail(code, reason, event.GetRtime(), "")
+                    ev.SetWarning(warning)
                     return self.updateFailed(ev)
                 }
                 return NewUaStateConnected(self.ua, nil, "", self.config)
@@ -103,6 +113,12 @@ func (self *UacStateUpdating) RecvResponse(resp sippy_types.SipResponse, tr sipp
         self.ua.Enqueue(event)
         return NewUaStateConnected(self.ua, nil, "", self.config)
     }
+    if code == 491 && self.event != nil {
+        // Glare, retry the same update later (RFC 3261 section 14.1)
+        self.ua.SetLSDP(self.prev_lsdp)
+        self.ua.ScheduleUpdateRetry(self.event)
+        return NewUaStateConnected(self.ua, nil, "", self.config)
+    }
     reason_rfc3326 := resp.GetReason()
     if (code == 301 || code == 302) && len(resp.GetContacts()) > 0 {
         var contact *sippy_header.SipAddress
@@ -149,7 +165,7 @@ func (self *UacStateUpdating) updateFailed(event sippy_types.CCEvent) sippy_type
     if event.GetReason() != nil {
         eh = append(eh, event.GetReason())
     }
-    req, err := self.ua.GenRequest("BYE", nil, "", "", nil, eh...)
+    req, err := self.ua.GenRequest("BYE", nil, "", "", nil, q850ReasonHeaders(self.ua, event, eh)...)
     if err != nil {
         self.config.ErrorLogger().Error("UacStateUpdating::updateFailed: #1: " + err.Error())
         return nil
@@ -173,7 +189,7 @@ func (self *UacStateUpdating) RecvEvent(event sippy_types.CCEvent) (sippy_types.
     }
     if send_bye {
         self.ua.GetClientTransaction().Cancel()
-        req, err := self.ua.GenRequest("BYE", nil, "", "", nil, event.GetExtraHeaders()...)
+        req, err := self.ua.GenRequest("BYE", nil, "", "", nil, q850ReasonHeaders(self.ua, event, event.GetExtraHeaders())...)
         if err != nil {
             return nil, err
         }
@@ -183,6 +199,10 @@ func (self *UacStateUpdating) RecvEvent(event sippy_types.CCEvent) (sippy_types.
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateDisconnected(self.ua, event.GetRtime(), event.GetOrigin(), 0, nil, self.config), nil
     }
+    if _, ok := event.(*CCEventUpdate); ok {
+        self.ua.DeferUpdate(event)
+        return nil, nil
+    }
     //return nil, fmt.Errorf("wrong event %s in the Updating state", event.String())
     return nil, nil
 }
@@ -115,8 +115,32 @@ func (self *UasStateIdle) RecvRequest(req sippy_types.SipRequest, t sippy_types.
         return nil
     }
     self.ua.SetBranch(via0.GetBranch())
-    event := NewCCEventTry(self.ua.GetCallId(), self.ua.GetCGUID(), from_body.GetUrl().Username,
-        req.GetRURI().Username, body, auth, from_body.GetName(), req.GetRtime(), self.ua.GetOrigin())
+    cli, caller_name := TelURLNumber(from_body.GetUrl()), from_body.GetName()
+    var pais []*sippy_header.SipPAssertedIdentity
+    if self.ua.GetTrustDomain().IsTrusted(req.GetSource()) {
+        pais = req.GetPAIs()
+    }
+    if len(pais) > 0 && self.ua.GetPAIAsCLI() {
+        if pai, err := pais[0].GetBody(); err == nil {
+            if number := TelURLNumber(pai.GetUrl()); number != "" {
+                cli = number
+            }
+            if pai.GetName() != "" {
+                caller_name = pai.GetName()
+            }
+        } else if user, err := pais[0].GetUser(); err == nil && user != "" {
+            cli = StripVisualSeparators(user)
+        }
+    }
+    event := NewCCEventTry(self.ua.GetCallId(), self.ua.GetCGUID(), cli,
+        TelURLNumber(req.GetRURI()), body, auth, caller_name, req.GetRtime(), self.ua.GetOrigin())
+    event.SetPAI(pais)
+    event.SetPrivacy(req.GetPrivacy())
+    if diversion, err := ParseDiversion(req); err != nil {
+        self.config.ErrorLogger().Debug("UasStateIdle::RecvRequest: #6: " + err.Error())
+    } else {
+        event.SetDiversion(diversion)
+    }
     event.SetReason(req.GetReason())
     event.SetMaxForwards(req.GetMaxForwards())
     if self.ua.GetExpireTime() > 0 {
@@ -132,8 +156,15 @@ func (self *UasStateIdle) RecvRequest(req sippy_types.SipRequest, t sippy_types.
     }
     if body != nil {
         if self.ua.HasOnRemoteSdpChange() {
-            self.ua.OnRemoteSdpChange(body, req, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) })
             self.ua.SetSetupTs(req.GetRtime())
+            if err := self.ua.OnRemoteSdpChange(body, req, func (x sippy_types.MsgBody) { self.ua.DelayedRemoteSdpUpdate(event, x) }); err != nil {
+                code, reason := sdpFailure(err)
+                self.ua.SendUasResponse(t, code, reason, nil, nil, false, sippy_header.NewSipWarning(err.Error()))
+                self.ua.CancelExpireTimer()
+                self.ua.CancelNoProgressTimer()
+                self.ua.SetDisconnectTs(req.GetRtime())
+                return NewUaStateFailed(self.ua, req.GetRtime(), self.ua.GetOrigin(), code, self.config)
+            }
             return NewUasStateTrying(self.ua, self.config)
         } else {
             self.ua.SetRSDP(body.GetCopy())
@@ -71,7 +71,9 @@ func (self *UasStateRinging) RecvEvent(_event sippy_types.CCEvent) (sippy_types.
                 return nil, nil
             }
             if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-                self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+                if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                    return rejectLocalSdp(self.ua, event, err, self.config), nil
+                }
                 return nil, nil
             }
         }
@@ -85,7 +87,9 @@ func (self *UasStateRinging) RecvEvent(_event sippy_types.CCEvent) (sippy_types.
     case *CCEventConnect:
         body := event.body
         if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-            self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                return rejectLocalSdp(self.ua, event, err, self.config), nil
+            }
             return nil, nil
         }
         self.ua.SetLSDP(body)
@@ -97,7 +101,9 @@ func (self *UasStateRinging) RecvEvent(_event sippy_types.CCEvent) (sippy_types.
     case *CCEventPreConnect:
         body := event.body
         if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-            self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                return rejectLocalSdp(self.ua, event, err, self.config), nil
+            }
             return nil, nil
         }
         self.ua.SetLSDP(body)
@@ -109,16 +115,20 @@ func (self *UasStateRinging) RecvEvent(_event sippy_types.CCEvent) (sippy_types.
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateFailed(self.ua, event.GetRtime(), event.GetOrigin(), event.scode, self.config), nil
     case *CCEventFail:
-        code, reason := event.scode, event.scode_reason
+        code, reason := failureCode(event, event.scode, event.scode_reason)
         if code == 0 {
             code, reason = 500, "Failed"
         }
-        self.ua.SendUasResponse(nil, code, reason, nil, nil, false, eh...)
+        self.ua.SendUasResponse(nil, code, reason, nil, nil, false, q850ReasonHeaders(self.ua, event, eh)...)
         self.ua.CancelExpireTimer()
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateFailed(self.ua, event.GetRtime(), event.GetOrigin(), code, self.config), nil
     case *CCEventDisconnect:
-        self.ua.SendUasResponse(nil, 500, "Disconnected", nil, nil, false, eh...)
+        code, reason := failureCode(event, 0, "Disconnected")
+        if code == 0 {
+            code = 500
+        }
+        self.ua.SendUasResponse(nil, code, reason, nil, nil, false, q850ReasonHeaders(self.ua, event, eh)...)
         self.ua.CancelExpireTimer()
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateDisconnected(self.ua, event.GetRtime(), event.GetOrigin(), self.ua.GetLastScode(), nil, self.config), nil
@@ -28,6 +28,7 @@ package sippy
 
 import (
     "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
     "github.com/braams/sippy/time"
     "github.com/braams/sippy/types"
 )
@@ -42,6 +43,20 @@ func NewUasStateTrying(ua sippy_types.UA, config sippy_conf.Config) *UasStateTry
     }
 }
 
+// rejectLocalSdp fails the INVITE when the SDP of the response has been
+// rejected by the SDP change hook.
+func rejectLocalSdp(ua sippy_types.UA, event sippy_types.CCEvent, err error, config sippy_conf.Config) sippy_types.UaState {
+    code, reason := sdpFailure(err)
+    ua.SendUasResponse(nil, code, reason, nil, nil, false, sippy_header.NewSipWarning(err.Error()))
+    ev := NewCCEventFail(code, reason, event.GetRtime(), ua.GetOrigin())
+    ev.SetWarning(err.Error())
+    ua.Enqueue(ev)
+    ua.CancelExpireTimer()
+    ua.CancelNoProgressTimer()
+    ua.SetDisconnectTs(event.GetRtime())
+    return NewUaStateFailed(ua, event.GetRtime(), ua.GetOrigin(), code, config)
+}
+
 func (self *UasStateTrying) OnActivation() {
 }
 
@@ -61,7 +76,9 @@ func (self *UasStateTrying) RecvEvent(_event sippy_types.CCEvent) (sippy_types.U
                 return nil, nil
             }
             if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-                self.ua.OnLocalSdpChange(body, event, func (sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+                if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                    return rejectLocalSdp(self.ua, event, err, self.config), nil
+                }
                 return nil, nil
             }
         }
@@ -80,7 +97,9 @@ func (self *UasStateTrying) RecvEvent(_event sippy_types.CCEvent) (sippy_types.U
     case *CCEventPreConnect:
         code, reason, body := event.scode, event.scode_reason, event.body
         if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-            self.ua.OnLocalSdpChange(body, event, func (sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                return rejectLocalSdp(self.ua, event, err, self.config), nil
+            }
             return nil, nil
         }
         self.ua.SetLSDP(body)
@@ -90,7 +109,9 @@ func (self *UasStateTrying) RecvEvent(_event sippy_types.CCEvent) (sippy_types.U
     case *CCEventConnect:
         code, reason, body := event.scode, event.scode_reason, event.body
         if body != nil && self.ua.HasOnLocalSdpChange() && body.NeedsUpdate() {
-            self.ua.OnLocalSdpChange(body, event, func (sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                return rejectLocalSdp(self.ua, event, err, self.config), nil
+            }
             return nil, nil
         }
         self.ua.SetLSDP(body)
@@ -107,17 +128,21 @@ func (self *UasStateTrying) RecvEvent(_event sippy_types.CCEvent) (sippy_types.U
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateFailed(self.ua, event.GetRtime(), event.GetOrigin(), event.scode, self.config), nil
     case *CCEventFail:
-        code, reason := event.scode, event.scode_reason
+        code, reason := failureCode(event, event.scode, event.scode_reason)
         if code == 0 {
             code, reason = 500, "Failed"
         }
-        self.ua.SendUasResponse(nil, code, reason, nil, nil, false, eh...)
+        self.ua.SendUasResponse(nil, code, reason, nil, nil, false, q850ReasonHeaders(self.ua, event, eh)...)
         self.ua.CancelExpireTimer()
         self.ua.CancelNoProgressTimer()
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateFailed(self.ua, event.GetRtime(), event.GetOrigin(), code, self.config), nil
     case *CCEventDisconnect:
-        self.ua.SendUasResponse(nil, 500, "Disconnected", nil, nil, false, eh...)
+        code, reason := failureCode(event, 0, "Disconnected")
+        if code == 0 {
+            code = 500
+        }
+        self.ua.SendUasResponse(nil, code, reason, nil, nil, false, q850ReasonHeaders(self.ua, event, eh)...)
         self.ua.CancelExpireTimer()
         self.ua.CancelNoProgressTimer()
         self.ua.SetDisconnectTs(event.GetRtime())
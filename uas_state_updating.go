@@ -28,6 +28,7 @@ package sippy
 
 import (
     "github.com/braams/sippy/conf"
+    "github.com/braams/sippy/headers"
     "github.com/braams/sippy/time"
     "github.com/braams/sippy/types"
 )
@@ -66,6 +67,10 @@ func (self *UasStateUpdating) RecvRequest(req sippy_types.SipRequest, t sippy_ty
         self.ua.SetDisconnectTs(req.GetRtime())
         return NewUaStateDisconnected(self.ua, req.GetRtime(), self.ua.GetOrigin(), 0, req, self.config)
     } else if req.GetMethod() == "REFER" {
+        if ! self.ua.ShouldUseRefer() {
+            t.SendResponseWithLossEmul(methodNotAllowed(self.ua, req), false, nil, self.ua.UasLossEmul())
+            return nil
+        }
         if req.GetReferTo() == nil {
             t.SendResponseWithLossEmul(req.GenResponse(400, "Bad Request", nil, self.ua.GetLocalUA().AsSipServer()), false, nil, self.ua.UasLossEmul())
             return nil
@@ -95,7 +100,11 @@ func (self *UasStateUpdating) RecvEvent(_event sippy_types.CCEvent) (sippy_types
             code, reason, body = 180, "Ringing", nil
         }
         if body != nil && body.NeedsUpdate() && self.ua.HasOnLocalSdpChange() {
-            self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                code, reason := sdpFailure(err)
+                self.ua.SendUasResponse(nil, code, reason, nil, nil, false, sippy_header.NewSipWarning(err.Error()))
+                return NewUaStateConnected(self.ua, nil, "", self.config), nil
+            }
             return nil, nil
         }
         self.ua.SetLSDP(body)
@@ -104,7 +113,11 @@ func (self *UasStateUpdating) RecvEvent(_event sippy_types.CCEvent) (sippy_types
     case *CCEventConnect:
         code, reason, body := event.scode, event.scode_reason, event.body
         if body != nil && body.NeedsUpdate() && self.ua.HasOnLocalSdpChange() {
-            self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) })
+            if err := self.ua.OnLocalSdpChange(body, event, func(sippy_types.MsgBody) { self.ua.RecvEvent(event) }); err != nil {
+                code, reason := sdpFailure(err)
+                self.ua.SendUasResponse(nil, code, reason, nil, nil, false, sippy_header.NewSipWarning(err.Error()))
+                return NewUaStateConnected(self.ua, nil, "", self.config), nil
+            }
             return nil, nil
         }
         self.ua.SetLSDP(body)
@@ -125,7 +138,7 @@ func (self *UasStateUpdating) RecvEvent(_event sippy_types.CCEvent) (sippy_types
         return NewUaStateConnected(self.ua, nil, "", self.config), nil
     case *CCEventDisconnect:
         self.ua.SendUasResponse(nil, 487, "Request Terminated", nil, nil, false, eh...)
-        req, err := self.ua.GenRequest("BYE", nil, "", "", nil, eh...)
+        req, err := self.ua.GenRequest("BYE", nil, "", "", nil, q850ReasonHeaders(self.ua, event, eh)...)
         if err != nil {
             return nil, err
         }
@@ -134,6 +147,9 @@ func (self *UasStateUpdating) RecvEvent(_event sippy_types.CCEvent) (sippy_types
         self.ua.CancelCreditTimer()
         self.ua.SetDisconnectTs(event.GetRtime())
         return NewUaStateDisconnected(self.ua, event.GetRtime(), event.GetOrigin(), 0, nil, self.config), nil
+    case *CCEventUpdate:
+        self.ua.DeferUpdate(event)
+        return nil, nil
     }
     //return nil, fmt.Errorf("wrong event %s in the Updating state", _event.String())
     return nil, nil